@@ -0,0 +1,247 @@
+package driplang
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AfterTime is satisfied if A is satisfied by events strictly after T, e.g.
+// for users that signed up after a given date. Unlike After, it doesn't
+// depend on Then.A, and can be used anywhere.
+//
+// Only the instant of T and its offset from UTC are kept when it's marshalled
+// or written as text, not its Location: a T in e.g. "Europe/Copenhagen" or
+// time.Local comes back in a fixed zone with the same offset, or UTC if it's
+// zero. This doesn't change the result, but T must be compared using
+// time.Time.Equal, or normalised using Canonical, which converts it to UTC.
+type AfterTime struct {
+	A Expr      `json:"a"`
+	T time.Time `json:"t"`
+}
+
+func (a AfterTime) Expression() string {
+	return fmt.Sprintf("(%s AFTER %s)", a.A.Expression(), strconv.Quote(a.T.Format(time.RFC3339Nano)))
+}
+
+// BeforeTime is satisfied if A is satisfied by events strictly before T. Like
+// for AfterTime, only the instant of T and its offset are kept.
+type BeforeTime struct {
+	A Expr      `json:"a"`
+	T time.Time `json:"t"`
+}
+
+func (b BeforeTime) Expression() string {
+	return fmt.Sprintf("(%s BEFORE %s)", b.A.Expression(), strconv.Quote(b.T.Format(time.RFC3339Nano)))
+}
+
+// During is satisfied by an occurrence of A (see Count) whose event happened
+// between the times of day From (inclusive) and To (exclusive) in the time
+// zone Zone, an IANA time zone name such as "Europe/Copenhagen". From and To
+// are durations since midnight, in whole seconds. If To is before From, the
+// window wraps around midnight, e.g. from 22:00 to 06:00.
+type During struct {
+	A    Expr     `json:"a"`
+	From Duration `json:"from"`
+	To   Duration `json:"to"`
+	Zone string   `json:"zone"`
+}
+
+func (d During) Expression() string {
+	return fmt.Sprintf("(%s DURING %s TO %s IN %s)", d.A.Expression(), strconv.Quote(formatTimeOfDay(d.From)), strconv.Quote(formatTimeOfDay(d.To)), strconv.Quote(d.Zone))
+}
+
+// check returns an error if d's times of day or time zone are invalid.
+func (d During) check() error {
+	for _, t := range []Duration{d.From, d.To} {
+		if t < 0 || t > Duration(24*time.Hour) || t%Duration(time.Second) != 0 {
+			return fmt.Errorf("invalid time of day %s", time.Duration(t))
+		}
+	}
+
+	if d.From == d.To {
+		return fmt.Errorf("time of day window from %s to %s is empty", formatTimeOfDay(d.From), formatTimeOfDay(d.To))
+	}
+
+	return checkZone(d.Zone)
+}
+
+// matches reports whether t is within d's window.
+func (d During) matches(t time.Time) bool {
+	loc, err := loadLocation(d.Zone)
+	if err != nil {
+		return false
+	}
+
+	hour, minute, second := t.In(loc).Clock()
+	tod := Duration(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(second)*time.Second)
+	if d.From <= d.To {
+		return d.From <= tod && tod < d.To
+	}
+	return d.From <= tod || tod < d.To
+}
+
+// On is satisfied by an occurrence of A (see Count) whose event happened on
+// one of Days in the time zone Zone, an IANA time zone name such as
+// "Europe/Copenhagen".
+type On struct {
+	A    Expr           `json:"a"`
+	Days []time.Weekday `json:"days"`
+	Zone string         `json:"zone"`
+}
+
+func (o On) Expression() string {
+	days := make([]string, len(o.Days))
+	for i, day := range o.Days {
+		days[i] = formatWeekday(day)
+	}
+	return fmt.Sprintf("(%s ON [%s] IN %s)", o.A.Expression(), strings.Join(days, ", "), strconv.Quote(o.Zone))
+}
+
+// check returns an error if o's days or time zone are invalid.
+func (o On) check() error {
+	if len(o.Days) == 0 {
+		return fmt.Errorf("no days given")
+	}
+
+	for _, day := range o.Days {
+		if day < time.Sunday || day > time.Saturday {
+			return fmt.Errorf("invalid day of week %d", day)
+		}
+	}
+
+	return checkZone(o.Zone)
+}
+
+// matches reports whether t is on one of o's days.
+func (o On) matches(t time.Time) bool {
+	loc, err := loadLocation(o.Zone)
+	if err != nil {
+		return false
+	}
+
+	weekday := t.In(loc).Weekday()
+	for _, day := range o.Days {
+		if day == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTimestamp parses an RFC 3339 timestamp. Unlike time.Parse, the result
+// doesn't depend on the local time zone: it is in UTC if its offset is zero,
+// and in a fixed zone with its offset otherwise.
+func parseTimestamp(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+
+	_, offset := t.Zone()
+	if offset == 0 {
+		return t.UTC(), nil
+	}
+	return t.In(time.FixedZone("", offset)), nil
+}
+
+var weekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+func formatWeekday(day time.Weekday) string {
+	if day < time.Sunday || day > time.Saturday {
+		return strconv.Itoa(int(day))
+	}
+	return weekdays[day]
+}
+
+// parseWeekday parses the abbreviated, case insensitive name of a day of the
+// week, e.g. "MON".
+func parseWeekday(s string) (time.Weekday, bool) {
+	for i, name := range weekdays {
+		if strings.EqualFold(s, name) {
+			return time.Weekday(i), true
+		}
+	}
+	return 0, false
+}
+
+// formatTimeOfDay formats a duration since midnight as "15:04", or
+// "15:04:05" if it has seconds.
+func formatTimeOfDay(d Duration) string {
+	t := time.Duration(d)
+	hours, minutes, seconds := t/time.Hour, t%time.Hour/time.Minute, t%time.Minute/time.Second
+	if seconds != 0 {
+		return fmt.Sprintf("%02d:%02d:%02d", hours, minutes, seconds)
+	}
+	return fmt.Sprintf("%02d:%02d", hours, minutes)
+}
+
+// parseTimeOfDay parses a time of day formatted by formatTimeOfDay into a
+// duration since midnight. "24:00" is accepted as the end of the day.
+func parseTimeOfDay(s string) (Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+
+	limits := []int{24, 59, 59}
+	units := []time.Duration{time.Hour, time.Minute, time.Second}
+	var d time.Duration
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		// Hours may be given using a single digit, e.g. "9:00".
+		digits := len(part) == 2 || i == 0 && len(part) == 1
+		if err != nil || !digits || n < 0 || n > limits[i] {
+			return 0, fmt.Errorf("invalid time of day %q", s)
+		}
+		d += time.Duration(n) * units[i]
+	}
+
+	if d > 24*time.Hour {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return Duration(d), nil
+}
+
+// locations caches loaded time zones by name, since loading them reads the
+// time zone database.
+var locations sync.Map
+
+// loadLocation returns the time zone with the given name. "Local" is rejected,
+// since it would make results depend on the time zone of the system.
+func loadLocation(name string) (*time.Location, error) {
+	if name == "Local" {
+		return nil, fmt.Errorf("time zone %q depends on the system", name)
+	}
+
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// checkZone returns an error if zone isn't a known time zone. Time zones must
+// be given explicitly; the empty name, which time.LoadLocation takes to mean
+// UTC, and "Local", the time zone of the system, are rejected.
+func checkZone(zone string) error {
+	switch zone {
+	case "":
+		return fmt.Errorf("missing time zone")
+	case "Local":
+		return fmt.Errorf("time zone %q depends on the system; give it explicitly, e.g. \"Europe/Copenhagen\"", zone)
+	}
+
+	if _, err := loadLocation(zone); err != nil {
+		return fmt.Errorf("unknown time zone %q", zone)
+	}
+	return nil
+}
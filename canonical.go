@@ -0,0 +1,166 @@
+package driplang
+
+import (
+	"crypto/sha256"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Canonical returns the canonical form of e, which is evaluated like e, and
+// is the same for expressions that differ only in ways that can't change
+// their results: the order of the operands of AND, OR, ALL_OF, ANY_OF and
+// AT_LEAST, and of other lists that are sets, such as the predicates of a
+// Where; how chains of ANDs and ORs are nested; the time zones of timestamps;
+// and the Go types of numbers.
+//
+// In the canonical form, chains of Ands and AllOfs are AllOfs, chains of Ors
+// and AnyOfs are AnyOfs, like Flatten returns them, and operands are sorted by
+// their textual form. Ors that Flatten keeps are kept, too.
+func Canonical(e Expr) Expr {
+	return Rewrite(e, func(e Expr) Expr {
+		switch v := e.(type) {
+		case And, AllOf:
+			return AllOf{Exprs: sortExprs(flattenOperands(e, nil, allOperands))}
+
+		case Or, AnyOf:
+			if _, ok := anyOperands(e); !ok {
+				// The Or is commutative, but can't be chained; see Flatten.
+				or := e.(Or)
+				operands := sortExprs([]Expr{or.A, or.B})
+				return Or{A: operands[0], B: operands[1]}
+			}
+			return AnyOf{Exprs: sortExprs(flattenOperands(e, nil, anyOperands))}
+
+		case AtLeast:
+			v.Exprs = sortExprs(v.Exprs)
+			return v
+
+		case Where:
+			v.Predicates = canonicalPredicates(v.Predicates)
+			return v
+
+		case Seq:
+			if v.Relaxed {
+				// Ignore has no effect on relaxed sequences.
+				v.Ignore = nil
+				return v
+			}
+
+			v.Ignore = uniqueSorted(v.Ignore, func(name EventName) string {
+				return string(name)
+			})
+			return v
+
+		case On:
+			v.Days = uniqueSorted(v.Days, func(day time.Weekday) string {
+				return strconv.Itoa(int(day))
+			})
+			return v
+
+		case AfterTime:
+			v.T = v.T.UTC()
+			return v
+
+		case BeforeTime:
+			v.T = v.T.UTC()
+			return v
+
+		default:
+			return e
+		}
+	})
+}
+
+// Fingerprint returns a hash of the canonical form of e, which identifies e
+// and the expressions that are Equivalent to it, e.g. to deduplicate rules or
+// cache their results. It only depends on the textual form of the canonical
+// form, which makes it stable across processes and versions of this package
+// that parse the same expressions.
+func Fingerprint(e Expr) [32]byte {
+	return sha256.Sum256([]byte("driplang/v1\n" + Canonical(e).Expression()))
+}
+
+// Equivalent reports whether a and b have the same canonical form, meaning
+// that they're evaluated the same; see Canonical. Expressions that are
+// evaluated the same for other reasons, such as `NOT NOT "a"` and `"a"` where
+// that's the case, aren't reported as equivalent; Simplify can remove some of
+// those differences first.
+func Equivalent(a, b Expr) bool {
+	return Fingerprint(a) == Fingerprint(b)
+}
+
+// sortExprs returns a copy of exprs sorted by their textual form.
+func sortExprs(exprs []Expr) []Expr {
+	keys := make([]string, len(exprs))
+	sorted := make([]int, len(exprs))
+	for i, e := range exprs {
+		keys[i] = e.Expression()
+		sorted[i] = i
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return keys[sorted[i]] < keys[sorted[j]]
+	})
+
+	result := make([]Expr, len(exprs))
+	for i, j := range sorted {
+		result[i] = exprs[j]
+	}
+	return result
+}
+
+// canonicalPredicates returns predicates sorted and deduplicated by their
+// textual form, since all of them must be satisfied, with numbers converted to
+// float64 and the values of lists sorted and deduplicated.
+func canonicalPredicates(predicates []Predicate) []Predicate {
+	canonical := make([]Predicate, len(predicates))
+	for i, p := range predicates {
+		p.Value = canonicalValue(p.Value)
+		if values, ok := p.Value.([]interface{}); ok {
+			p.Value = uniqueSorted(values, formatValue)
+		}
+		canonical[i] = p
+	}
+
+	return uniqueSorted(canonical, func(p Predicate) string {
+		return p.Expression()
+	})
+}
+
+// canonicalValue returns v with numbers converted to float64.
+func canonicalValue(v interface{}) interface{} {
+	if values, ok := v.([]interface{}); ok {
+		canonical := make([]interface{}, len(values))
+		for i, value := range values {
+			canonical[i] = canonicalValue(value)
+		}
+		return canonical
+	}
+
+	if n, ok := toNumber(v); ok {
+		return n
+	}
+	return v
+}
+
+// uniqueSorted returns a copy of values sorted by key, keeping only the first
+// of values with the same key. It returns nil if values is empty.
+func uniqueSorted[T any](values []T, key func(T) string) []T {
+	if len(values) == 0 {
+		return nil
+	}
+
+	sorted := append([]T{}, values...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return key(sorted[i]) < key(sorted[j])
+	})
+
+	unique := sorted[:1]
+	for _, v := range sorted[1:] {
+		if key(v) != key(unique[len(unique)-1]) {
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
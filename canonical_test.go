@@ -0,0 +1,211 @@
+package driplang_test
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/micvbang/driplang"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCanonical verifies that Canonical flattens chains, sorts the operands of
+// commutative operators and normalizes values.
+func TestCanonical(t *testing.T) {
+	a, b, c := driplang.EventName("a"), driplang.EventName("b"), driplang.EventName("c")
+	cet := time.FixedZone("CET", 3600)
+
+	tests := map[string]struct {
+		expr     driplang.Expr
+		expected driplang.Expr
+	}{
+		"event name": {
+			expr:     a,
+			expected: a,
+		},
+		"and": {
+			expr:     driplang.And{A: b, B: a},
+			expected: driplang.AllOf{Exprs: []driplang.Expr{a, b}},
+		},
+		"or chain": {
+			expr:     driplang.Or{A: c, B: driplang.AnyOf{Exprs: []driplang.Expr{b, driplang.Or{A: a, B: c}}}},
+			expected: driplang.AnyOf{Exprs: []driplang.Expr{a, b, c, c}},
+		},
+		"then": {
+			expr:     driplang.Then{A: driplang.Or{A: b, B: a}, B: a},
+			expected: driplang.Then{A: driplang.AnyOf{Exprs: []driplang.Expr{a, b}}, B: a},
+		},
+		"at least": {
+			expr:     driplang.AtLeast{K: 2, Exprs: []driplang.Expr{c, driplang.Not{A: a}, b}},
+			expected: driplang.AtLeast{K: 2, Exprs: []driplang.Expr{b, c, driplang.Not{A: a}}},
+		},
+		"where": {
+			expr: driplang.Where{Name: a, Predicates: []driplang.Predicate{
+				{Property: "plan", Op: driplang.OpIn, Value: []interface{}{"pro", 2, "basic", 2.0}},
+				{Property: "n", Op: driplang.OpGreater, Value: 3},
+				{Property: "n", Op: driplang.OpGreater, Value: 3.0},
+			}},
+			expected: driplang.Where{Name: a, Predicates: []driplang.Predicate{
+				{Property: "n", Op: driplang.OpGreater, Value: 3.0},
+				{Property: "plan", Op: driplang.OpIn, Value: []interface{}{"basic", "pro", 2.0}},
+			}},
+		},
+		"seq": {
+			expr:     driplang.Seq{Steps: []driplang.Expr{b, a}, Ignore: []driplang.EventName{c, a, c}},
+			expected: driplang.Seq{Steps: []driplang.Expr{b, a}, Ignore: []driplang.EventName{a, c}},
+		},
+		"relaxed seq": {
+			expr:     driplang.Seq{Steps: []driplang.Expr{b, a}, Relaxed: true, Ignore: []driplang.EventName{c}},
+			expected: driplang.Seq{Steps: []driplang.Expr{b, a}, Relaxed: true},
+		},
+		"on": {
+			expr:     driplang.On{A: a, Days: []time.Weekday{time.Friday, time.Monday, time.Friday}, Zone: "UTC"},
+			expected: driplang.On{A: a, Days: []time.Weekday{time.Monday, time.Friday}, Zone: "UTC"},
+		},
+		"after time": {
+			expr:     driplang.AfterTime{A: a, T: time.Date(2024, 3, 1, 13, 0, 0, 0, cet)},
+			expected: driplang.AfterTime{A: a, T: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, test.expected, driplang.Canonical(test.expr))
+		})
+	}
+}
+
+// TestEquivalent verifies that Equivalent recognizes expressions that differ
+// only in the order of commutative operands and the nesting of chains.
+func TestEquivalent(t *testing.T) {
+	tests := map[string]struct {
+		a, b       string
+		equivalent bool
+	}{
+		"same": {
+			a:          `"a" THEN "b"`,
+			b:          `"a" THEN "b"`,
+			equivalent: true,
+		},
+		"commuted and": {
+			a:          `"a" AND "b"`,
+			b:          `"b" AND "a"`,
+			equivalent: true,
+		},
+		"reassociated or": {
+			a:          `("a" OR "b") OR "c"`,
+			b:          `"c" OR ("b" OR "a")`,
+			equivalent: true,
+		},
+		"chain of and and all of": {
+			a:          `ALL_OF("a", "b") AND NOT "c"`,
+			b:          `NOT "c" AND ("b" AND "a")`,
+			equivalent: true,
+		},
+		"commuted within then": {
+			a:          `("a" OR "b") THEN COUNT("c" AND "a") >= 2`,
+			b:          `("b" OR "a") THEN COUNT("a" AND "c") >= 2`,
+			equivalent: true,
+		},
+		"commuted then": {
+			a:          `"a" THEN "b"`,
+			b:          `"b" THEN "a"`,
+			equivalent: false,
+		},
+		"and and or": {
+			a:          `"a" AND "b"`,
+			b:          `"a" OR "b"`,
+			equivalent: false,
+		},
+		"different count": {
+			a:          `AT_LEAST(1, "a", "b")`,
+			b:          `AT_LEAST(2, "b", "a")`,
+			equivalent: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			a, err := driplang.Parse(test.a)
+			require.NoError(t, err)
+			b, err := driplang.Parse(test.b)
+			require.NoError(t, err)
+
+			require.Equal(t, test.equivalent, driplang.Equivalent(a, b))
+			require.Equal(t, test.equivalent, driplang.Fingerprint(a) == driplang.Fingerprint(b))
+		})
+	}
+}
+
+// TestFingerprintStable verifies that fingerprints don't change, since they
+// may be stored.
+func TestFingerprintStable(t *testing.T) {
+	expr := driplang.Then{
+		A: driplang.Or{A: driplang.EventName("signup"), B: driplang.EventName("invite")},
+		B: driplang.Not{A: driplang.After{A: driplang.EventName("purchase"), D: driplang.Duration(24 * time.Hour)}},
+	}
+
+	fingerprint := driplang.Fingerprint(expr)
+	require.Equal(t, "7f3eb16a67c338cac77f26cde1966beae93b3334eedda1d752f98e4566a2e0c5", hex.EncodeToString(fingerprint[:]))
+}
+
+// TestCanonicalEqualsEvaluate verifies that canonical forms are evaluated like
+// the expressions they're the canonical forms of, and that expressions with
+// shuffled commutative operands are equivalent, for random expressions and
+// event histories.
+func TestCanonicalEqualsEvaluate(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	names := []string{"a", "b", "c"}
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for run := 0; run < 2000; run++ {
+		expr := randomExpr(rng, names, 4)
+		canonical := driplang.Canonical(expr)
+		require.True(t, driplang.Equivalent(expr, shuffleOperands(rng, expr)), expr.Expression())
+		require.Equal(t, canonical, driplang.Canonical(canonical))
+
+		events := randomEvents(rng, names, start, rng.Intn(12))
+		now := start.Add(time.Duration(rng.Intn(48)) * time.Hour)
+
+		expectedIndex, expected := driplang.EvaluateWithIndexAt(expr, events, now)
+		gotIndex, got := driplang.EvaluateWithIndexAt(canonical, events, now)
+		require.Equal(t, expected, got, "%s %v", expr.Expression(), events)
+		require.Equal(t, expectedIndex, gotIndex, "%s %v", expr.Expression(), events)
+
+		expectedNext, expectedChanges := driplang.NextChange(expr, events, now)
+		gotNext, gotChanges := driplang.NextChange(canonical, events, now)
+		require.Equal(t, expectedChanges, gotChanges)
+		require.Equal(t, expectedNext, gotNext)
+	}
+}
+
+// shuffleOperands returns e with the operands of its commutative operators
+// in random order.
+func shuffleOperands(rng *rand.Rand, e driplang.Expr) driplang.Expr {
+	return driplang.Rewrite(e, func(e driplang.Expr) driplang.Expr {
+		switch v := e.(type) {
+		case driplang.And:
+			return driplang.And{A: v.B, B: v.A}
+		case driplang.Or:
+			return driplang.Or{A: v.B, B: v.A}
+		case driplang.AnyOf:
+			return driplang.AnyOf{Exprs: shuffled(rng, v.Exprs)}
+		case driplang.AllOf:
+			return driplang.AllOf{Exprs: shuffled(rng, v.Exprs)}
+		case driplang.AtLeast:
+			return driplang.AtLeast{K: v.K, Exprs: shuffled(rng, v.Exprs)}
+		default:
+			return e
+		}
+	})
+}
+
+// shuffled returns a copy of exprs in random order.
+func shuffled(rng *rand.Rand, exprs []driplang.Expr) []driplang.Expr {
+	shuffled := append([]driplang.Expr{}, exprs...)
+	rng.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled
+}
@@ -5,4 +5,8 @@ import "time"
 type Event struct {
 	Name string
 	Time time.Time
+
+	// Properties are attributes of the event that can be matched using
+	// Where. Values are strings, numbers or booleans.
+	Properties map[string]interface{} `json:",omitempty"`
 }
@@ -0,0 +1,93 @@
+package driplang
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidExpression is returned when attempting to unmarshal something that
+// isn't a driplang.Expr. Every *Error matches it using errors.Is.
+var ErrInvalidExpression = errors.New("invalid expression")
+
+// ErrorCode identifies the kind of problem an Error describes.
+type ErrorCode string
+
+const (
+	// ErrorCodeSyntax is used for input that can't be tokenized or parsed,
+	// such as malformed JSON or a missing closing parenthesis.
+	ErrorCodeSyntax ErrorCode = "syntax"
+
+	// ErrorCodeUnknownOperator is used for operators that don't exist.
+	ErrorCodeUnknownOperator ErrorCode = "unknown_operator"
+
+	// ErrorCodeMissingField is used when an operator is missing a required
+	// operand.
+	ErrorCodeMissingField ErrorCode = "missing_field"
+
+	// ErrorCodeInvalidValue is used for operands of the wrong type or with an
+	// invalid value, such as a malformed duration.
+	ErrorCodeInvalidValue ErrorCode = "invalid_value"
+
+	// ErrorCodeLimitExceeded is used for expressions that are nested too
+	// deeply or have too many nodes; see WithMaxDepth and WithMaxNodes.
+	ErrorCodeLimitExceeded ErrorCode = "limit_exceeded"
+
+	// ErrorCodeMisplacedAfter is used by Validate for After, Within and
+	// Between outside the right hand side of Then, where they can never be
+	// satisfied.
+	ErrorCodeMisplacedAfter ErrorCode = "misplaced_after"
+
+	// ErrorCodeContradiction is used by Validate for And expressions
+	// requiring both an expression and its negation.
+	ErrorCodeContradiction ErrorCode = "contradiction"
+)
+
+// Error describes a single problem found in an expression. Problems found by
+// Unmarshal are located by a JSON path into the document, e.g. "$.b.a.a",
+// while problems found by Parse are located by 1-based line and column.
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Path    string    `json:"path,omitempty"`
+	Line    int       `json:"line,omitempty"`
+	Column  int       `json:"column,omitempty"`
+	Message string    `json:"message"`
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.Path != "":
+		return fmt.Sprintf("%s: %s", e.Path, e.Message)
+	case e.Line > 0:
+		return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+	default:
+		return e.Message
+	}
+}
+
+// Is reports whether target is ErrInvalidExpression.
+func (e *Error) Is(target error) bool {
+	return target == ErrInvalidExpression
+}
+
+// Errors is the error returned by Parse and Unmarshal. It holds every
+// problem found in the input, in the order they were found.
+type Errors []*Error
+
+func (es Errors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the individual errors, making errors.Is and errors.As see
+// each of them.
+func (es Errors) Unwrap() []error {
+	errs := make([]error, len(es))
+	for i, e := range es {
+		errs[i] = e
+	}
+	return errs
+}
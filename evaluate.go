@@ -1,38 +1,238 @@
 package driplang
 
 import (
+	"errors"
+	"fmt"
+	"sort"
 	"time"
 )
 
+// ErrInvalidEvents is returned by Evaluator.EvaluateE and ValidateEvents for
+// events that aren't sorted by time, or that have an empty name or zero time.
+var ErrInvalidEvents = errors.New("invalid events")
+
 var minTime = time.Time{}
 
-// Evaluate checks if Expr is satisfied by the given slice of Events
+// Clock tells the time. It's used by evaluations for every decision that
+// depends on the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts an ordinary function to the Clock interface.
+type ClockFunc func() time.Time
+
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// SystemClock is a Clock returning the current system time.
+var SystemClock Clock = ClockFunc(time.Now)
+
+// Evaluator evaluates expressions using a configurable Clock. The zero value
+// uses SystemClock.
+type Evaluator struct {
+	Clock Clock
+
+	// SortEvents makes EvaluateE and EvaluateWithIndexE stable sort the
+	// events by time before evaluating them, instead of returning an error
+	// when they aren't sorted. The given slice isn't modified.
+	SortEvents bool
+}
+
+func (ev Evaluator) now() time.Time {
+	if ev.Clock == nil {
+		return SystemClock.Now()
+	}
+	return ev.Clock.Now()
+}
+
+// Evaluate checks if Expr is satisfied by the given slice of Events at the
+// time given by ev.Clock.
 // Assumes that events are sorted by Event.Time.
+func (ev Evaluator) Evaluate(e Expr, events []Event) bool {
+	return EvaluateAt(e, events, ev.now())
+}
+
+// EvaluateWithIndex is like Evaluate, but additionally returns the index of
+// the event that satisfied the expression.
+func (ev Evaluator) EvaluateWithIndex(e Expr, events []Event) (int, bool) {
+	return EvaluateWithIndexAt(e, events, ev.now())
+}
+
+// EvaluateE is like Evaluate, but returns an error instead of an unreliable
+// result when events aren't valid, see ValidateEvents, and when e contains
+// operators unknown to this package, see Compile.
+func (ev Evaluator) EvaluateE(e Expr, events []Event) (bool, error) {
+	_, satisfied, err := ev.EvaluateWithIndexE(e, events)
+	return satisfied, err
+}
+
+// EvaluateWithIndexE is like EvaluateE, but additionally returns the index of
+// the event that satisfied the expression. The index refers to the given
+// events, also when they're sorted because of ev.SortEvents.
+func (ev Evaluator) EvaluateWithIndexE(e Expr, events []Event) (int, bool, error) {
+	program, err := Compile(e)
+	if err != nil {
+		return -1, false, err
+	}
+
+	if !ev.SortEvents {
+		err := ValidateEvents(events)
+		if err != nil {
+			return -1, false, err
+		}
+
+		i, satisfied := program.EvaluateWithIndexAt(events, ev.now())
+		return i, satisfied, nil
+	}
+
+	err = validateEvents(events, false)
+	if err != nil {
+		return -1, false, err
+	}
+
+	order := make([]int, len(events))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return events[order[i]].Time.Before(events[order[j]].Time)
+	})
+
+	sorted := make([]Event, len(events))
+	for i, j := range order {
+		sorted[i] = events[j]
+	}
+
+	i, satisfied := program.EvaluateWithIndexAt(sorted, ev.now())
+	if i >= 0 {
+		i = order[i]
+	}
+	return i, satisfied, nil
+}
+
+// ValidateEvents returns an error wrapping ErrInvalidEvents, describing the
+// first problem found, if events aren't sorted by time, or if any of them has
+// an empty name or a zero time.
+func ValidateEvents(events []Event) error {
+	return validateEvents(events, true)
+}
+
+func validateEvents(events []Event, sorted bool) error {
+	for i, event := range events {
+		if event.Name == "" {
+			return fmt.Errorf("%w: event %d has an empty name", ErrInvalidEvents, i)
+		}
+
+		if event.Time.IsZero() {
+			return fmt.Errorf("%w: event %d (%q) has a zero time", ErrInvalidEvents, i, event.Name)
+		}
+
+		if sorted && i > 0 && event.Time.Before(events[i-1].Time) {
+			return fmt.Errorf("%w: event %d (%q) at %s is before the previous event at %s", ErrInvalidEvents, i, event.Name, event.Time, events[i-1].Time)
+		}
+	}
+	return nil
+}
+
+// EvaluateE is like Evaluate, but returns an error for invalid input; see
+// Evaluator.EvaluateE.
+func EvaluateE(e Expr, events []Event) (bool, error) {
+	return Evaluator{}.EvaluateE(e, events)
+}
+
+// EvaluateWithIndexE is like EvaluateWithIndex, but returns an error for
+// invalid input; see Evaluator.EvaluateE.
+func EvaluateWithIndexE(e Expr, events []Event) (int, bool, error) {
+	return Evaluator{}.EvaluateWithIndexE(e, events)
+}
+
+// Evaluate checks if Expr is satisfied by the given slice of Events
+// Assumes that events are sorted by Event.Time; use EvaluateE to have them
+// validated.
 func Evaluate(e Expr, events []Event) bool {
-	_, satisfied, _ := evaluate(e, events, minTime)
-	return satisfied
+	return Evaluator{}.Evaluate(e, events)
 }
 
 func EvaluateWithIndex(e Expr, events []Event) (int, bool) {
-	i, satisfied, _ := evaluate(e, events, minTime)
+	return Evaluator{}.EvaluateWithIndex(e, events)
+}
+
+// EvaluateAt checks if Expr is satisfied by the given slice of Events as of
+// the time now, e.g. to replay a rule against history.
+// Assumes that events are sorted by Event.Time.
+func EvaluateAt(e Expr, events []Event, now time.Time) bool {
+	_, satisfied := EvaluateWithIndexAt(e, events, now)
+	return satisfied
+}
+
+// EvaluateWithIndexAt is like EvaluateAt, but additionally returns the index
+// of the event that satisfied the expression.
+func EvaluateWithIndexAt(e Expr, events []Event, now time.Time) (int, bool) {
+	ev := evaluator{events: events, now: now}
+	i, satisfied, _ := ev.evaluate(e, 0, len(events), minTime)
 	return i, satisfied
 }
 
-func evaluate(e Expr, evs []Event, mustBeAfter time.Time) (evsIndex int, satisfied, timeAfter bool) {
+// evaluator holds the state of a single evaluation.
+type evaluator struct {
+	events []Event
+	now    time.Time
+
+	// index holds, for each event name ID of a compiled Program, the indices
+	// of the events with that name in ascending order. It's nil unless
+	// evaluating a Program.
+	index [][]int
+
+	// cursors holds a cursor for each name ID of index.
+	cursors []cursor
+
+	// trace is the node of the Explanation currently being built; nil unless
+	// explaining.
+	trace *Explanation
+
+	// deadline is the earliest time not before now that was compared to now,
+	// i.e. the earliest time at which the result of nowAfter might change.
+	deadline    time.Time
+	hasDeadline bool
+}
+
+// nowAfter reports whether the time of the evaluation is after t. Every
+// decision that depends on the current time must be made using it.
+func (ev *evaluator) nowAfter(t time.Time) bool {
+	after := ev.now.After(t)
+	if !after && (!ev.hasDeadline || t.Before(ev.deadline)) {
+		ev.deadline, ev.hasDeadline = t, true
+	}
+	return after
+}
+
+// evaluate evaluates e against the events in ev.events[lo:hi]. Returned
+// indices are indices into ev.events.
+func (ev *evaluator) evaluate(e Expr, lo, hi int, mustBeAfter time.Time) (evsIndex int, satisfied, timeAfter bool) {
+	if ev.trace != nil {
+		return ev.explain(e, lo, hi, mustBeAfter)
+	}
+	return ev.evaluateExpr(e, lo, hi, mustBeAfter)
+}
+
+func (ev *evaluator) evaluateExpr(e Expr, lo, hi int, mustBeAfter time.Time) (evsIndex int, satisfied, timeAfter bool) {
 	switch v := e.(type) {
 	case EventName:
 		name := string(v)
+		evs := ev.events
 
 		// Check for satisfied + timeAfter
-		for i, ev := range evs {
-			if name == ev.Name && ev.Time.Sub(mustBeAfter) >= 0 {
+		for i := lo; i < hi; i++ {
+			if name == evs[i].Name && evs[i].Time.Sub(mustBeAfter) >= 0 {
 				return i, true, true
 			}
 		}
 
 		// Check for satisfied
-		for i, ev := range evs {
-			if name == ev.Name {
+		for i := lo; i < hi; i++ {
+			if name == evs[i].Name {
 				return i, true, false
 			}
 		}
@@ -41,57 +241,74 @@ func evaluate(e Expr, evs []Event, mustBeAfter time.Time) (evsIndex int, satisfi
 		// after. This is important for NOT expressions where an event is
 		// expected to not be present (and we therefore can't compare its'
 		// arrival time)
-		return -1, false, time.Now().After(mustBeAfter)
+		return -1, false, ev.nowAfter(mustBeAfter)
 
-	case Or:
-		ai, a, aAfter := evaluate(v.A, evs, mustBeAfter)
-		bi, b, bAfter := evaluate(v.B, evs, mustBeAfter)
-		if a && b {
-			// Neither index will be < 0, use the minimum one
-			return min(ai, bi), true, aAfter || bAfter
+	case Where:
+		evs := ev.events
+
+		for i := lo; i < hi; i++ {
+			if evs[i].Time.Sub(mustBeAfter) >= 0 && v.matches(evs[i]) {
+				return i, true, true
+			}
+		}
+
+		for i := lo; i < hi; i++ {
+			if v.matches(evs[i]) {
+				return i, true, false
+			}
 		}
 
-		// One index is < 0, use the maximum one
-		return max(ai, bi), a || b, aAfter || bAfter
+		return -1, false, ev.nowAfter(mustBeAfter)
+
+	case Or:
+		ai, a, aAfter := ev.evaluate(v.A, lo, hi, mustBeAfter)
+		bi, b, bAfter := ev.evaluate(v.B, lo, hi, mustBeAfter)
+		return combineOr(ai, a, aAfter, bi, b, bAfter)
 
 	case And:
-		ai, a, aAfter := evaluate(v.A, evs, mustBeAfter)
-		bi, b, bAfter := evaluate(v.B, evs, mustBeAfter)
-		if a && b {
-			// Both indices >= 0, use maximum one
-			return max(ai, bi), true, aAfter && bAfter
-		}
-		// One index is false, use neither one
-		return -1, false, false
+		ai, a, aAfter := ev.evaluate(v.A, lo, hi, mustBeAfter)
+		bi, b, bAfter := ev.evaluate(v.B, lo, hi, mustBeAfter)
+		return combineAnd(ai, a, aAfter, bi, b, bAfter)
+
+	case AnyOf:
+		return evaluateAnyOf(len(v.Exprs), func(i int) (int, bool, bool) {
+			return ev.evaluate(v.Exprs[i], lo, hi, mustBeAfter)
+		})
+
+	case AllOf:
+		return evaluateAllOf(len(v.Exprs), func(i int) (int, bool, bool) {
+			return ev.evaluate(v.Exprs[i], lo, hi, mustBeAfter)
+		})
+
+	case AtLeast:
+		return evaluateAtLeast(v.K, len(v.Exprs), func(i int) (int, bool, bool) {
+			return ev.evaluate(v.Exprs[i], lo, hi, mustBeAfter)
+		})
 
 	case Not:
-		ai, a, aAfter := evaluate(v.A, evs, mustBeAfter)
-		if a {
-			// Invert a
-			return ai, false, aAfter
-		}
-		return -1, true, aAfter
+		ai, a, aAfter := ev.evaluate(v.A, lo, hi, mustBeAfter)
+		return combineNot(isWindow(v.A), ai, a, aAfter)
+
+	case eventRef:
+		return ev.evaluateEventRef(v, lo, hi, mustBeAfter)
+
+	case whereRef:
+		return ev.evaluateWhereRef(v, lo, hi, mustBeAfter)
+
+	case afterRef:
+		return ev.evaluateAfterRef(v, lo, hi)
 
 	case Then:
-		for i := len(evs); i > 0; i-- {
-			ai, a, aAfter := evaluate(v.A, evs[:i], mustBeAfter)
-			if !a {
-				continue
-			}
+		return ev.evaluateThen(v, nil, lo, hi, mustBeAfter)
 
-			bMustBeAfter := mustBeAfter
-			if ai >= 0 && ai < len(evs) {
-				bMustBeAfter = evs[ai].Time
-			}
+	case thenRef:
+		return ev.evaluateThen(v.Then, v.ids, lo, hi, mustBeAfter)
 
-			bi, b, bAfter := evaluate(v.B, evs[ai+1:], bMustBeAfter)
-			if a && b {
-				return ai + bi + 1, true, aAfter && bAfter
-			}
+	case After:
+		if v.Anchor.Kind != AnchorThen {
+			return ev.evaluateAnchoredAfter(v, ev.anchor(v.Anchor, lo, hi), lo, hi)
 		}
-		return -1, false, false
 
-	case After:
 		if mustBeAfter == minTime {
 			// if t is minTime then `After` has not been in a `Then.B` clause,
 			// which is a requirement; otherwise we don't have a point in time
@@ -99,14 +316,493 @@ func evaluate(e Expr, evs []Event, mustBeAfter time.Time) (evsIndex int, satisfi
 			return -1, false, false
 		}
 
-		ai, a, aAfter := evaluate(v.A, evs, mustBeAfter.Add(time.Duration(v.D)))
+		ai, a, aAfter := ev.evaluate(v.A, lo, hi, mustBeAfter.Add(time.Duration(v.D)))
 		if a {
 			return ai, true && aAfter, aAfter
 		}
 
 		return -1, false, false
 
+	case Within:
+		return ev.evaluateWindow(v.A, lo, hi, mustBeAfter, 0, v.D)
+
+	case Count:
+		return ev.evaluateCount(v, lo, hi, mustBeAfter)
+
+	case Window:
+		return ev.evaluateWindowCount(v, lo, hi, mustBeAfter)
+
+	case Since:
+		return ev.evaluateSince(v, lo, hi, mustBeAfter)
+
+	case Between:
+		return ev.evaluateWindow(v.A, lo, hi, mustBeAfter, v.Min, v.Max)
+
+	case AfterTime:
+		// Events are sorted by time, so the ones not after T can be left out
+		// by finding the first event after it.
+		lo += sort.Search(hi-lo, func(i int) bool {
+			return ev.events[lo+i].Time.After(v.T)
+		})
+		return ev.evaluate(v.A, lo, hi, mustBeAfter)
+
+	case BeforeTime:
+		hi = lo + sort.Search(hi-lo, func(i int) bool {
+			return !ev.events[lo+i].Time.Before(v.T)
+		})
+		return ev.evaluate(v.A, lo, hi, mustBeAfter)
+
+	case During:
+		return ev.evaluateFilter(v.A, lo, hi, mustBeAfter, v.matches)
+
+	case Seq:
+		return ev.evaluateSeq(v, lo, hi, mustBeAfter)
+
+	case On:
+		return ev.evaluateFilter(v.A, lo, hi, mustBeAfter, v.matches)
+
+	default:
+		return -1, false, false
+	}
+}
+
+// combineOr returns the result of an Or whose operands gave the results a and
+// b.
+func combineOr(ai int, a, aAfter bool, bi int, b, bAfter bool) (evsIndex int, satisfied, timeAfter bool) {
+	if a && b {
+		// Neither index will be < 0, use the minimum one
+		return min(ai, bi), true, aAfter || bAfter
+	}
+
+	// One index is < 0, use the maximum one
+	return max(ai, bi), a || b, aAfter || bAfter
+}
+
+// combineAnd returns the result of an And whose operands gave the results a
+// and b.
+func combineAnd(ai int, a, aAfter bool, bi int, b, bAfter bool) (evsIndex int, satisfied, timeAfter bool) {
+	if a && b {
+		// Both indices >= 0, use maximum one
+		return max(ai, bi), true, aAfter && bAfter
+	}
+	// One index is false, use neither one
+	return -1, false, false
+}
+
+// combineNot returns the result of a Not whose operand gave the result a. window
+// reports whether the operand is a window; see isWindow.
+func combineNot(window bool, ai int, a, aAfter bool) (evsIndex int, satisfied, timeAfter bool) {
+	if a {
+		// Invert a
+		return ai, false, aAfter
+	}
+
+	// The absence of events in a window is only known once it has closed.
+	if window && !aAfter {
+		return -1, false, false
+	}
+	return -1, true, aAfter
+}
+
+// evaluateAnyOf evaluates n expressions, evaluated by operand, like a chain of
+// Ors, but only uses the indices of those that are satisfied.
+func evaluateAnyOf(n int, operand func(i int) (int, bool, bool)) (evsIndex int, satisfied, timeAfter bool) {
+	evsIndex = -1
+	for i := 0; i < n; i++ {
+		// Every expression is evaluated, in order for their comparisons with
+		// the current time to be recorded.
+		ai, a, aAfter := operand(i)
+		if a && (!satisfied || ai < evsIndex) {
+			evsIndex = ai
+		}
+		satisfied = satisfied || a
+		timeAfter = timeAfter || aAfter
+	}
+	return evsIndex, satisfied, timeAfter
+}
+
+// evaluateAllOf evaluates n expressions, evaluated by operand, like a chain of
+// Ands.
+func evaluateAllOf(n int, operand func(i int) (int, bool, bool)) (evsIndex int, satisfied, timeAfter bool) {
+	evsIndex, satisfied, timeAfter = -1, true, true
+	for i := 0; i < n; i++ {
+		ai, a, aAfter := operand(i)
+		evsIndex = max(evsIndex, ai)
+		satisfied = satisfied && a
+		timeAfter = timeAfter && aAfter
+	}
+
+	if !satisfied {
+		return -1, false, false
+	}
+	return evsIndex, true, timeAfter
+}
+
+// evaluateAtLeast evaluates an AtLeast of n expressions, evaluated by operand,
+// by counting those that are satisfied. The returned index is the k'th lowest
+// one of theirs.
+func evaluateAtLeast(k, n int, operand func(i int) (int, bool, bool)) (evsIndex int, satisfied, timeAfter bool) {
+	var indices []int
+	after, anyAfter := 0, false
+	for i := 0; i < n; i++ {
+		ai, ok, aAfter := operand(i)
+		if ok {
+			indices = append(indices, ai)
+			if aAfter {
+				after++
+			}
+		}
+		anyAfter = anyAfter || aAfter
+	}
+
+	if k < 1 || len(indices) < k {
+		return -1, false, anyAfter
+	}
+
+	sort.Ints(indices)
+	return indices[k-1], true, after >= k
+}
+
+// evaluateAnchoredAfter evaluates v, whose anchor is the event at index
+// anchor, or -1 if there is none.
+func (ev *evaluator) evaluateAnchoredAfter(v After, anchor int, lo, hi int) (evsIndex int, satisfied, timeAfter bool) {
+	if anchor < 0 {
+		// Like After outside Then.B, there is no point in time to compare
+		// v.A to.
+		return -1, false, false
+	}
+
+	ai, a, aAfter := ev.evaluate(v.A, lo, hi, ev.events[anchor].Time.Add(time.Duration(v.D)))
+	if a {
+		return ai, aAfter, aAfter
+	}
+
+	return -1, false, false
+}
+
+// anchor returns the index of the event in ev.events[lo:hi] that a refers
+// to, or -1 if there is none.
+func (ev *evaluator) anchor(a Anchor, lo, hi int) int {
+	switch {
+	case lo >= hi:
+		return -1
+	case a.Name == "" && a.Kind == AnchorFirst:
+		return lo
+	case a.Name == "" && a.Kind == AnchorLast:
+		return hi - 1
+	case a.Kind == AnchorFirst:
+		for i := lo; i < hi; i++ {
+			if ev.events[i].Name == string(a.Name) {
+				return i
+			}
+		}
+	case a.Kind == AnchorLast:
+		for i := hi - 1; i >= lo; i-- {
+			if ev.events[i].Name == string(a.Name) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// evaluateWindow evaluates e against the events from `from` until `to` after
+// mustBeAfter, both inclusive. If e isn't satisfied, timeAfter reports whether
+// the window has closed.
+func (ev *evaluator) evaluateWindow(e Expr, lo, hi int, mustBeAfter time.Time, from, to Duration) (evsIndex int, satisfied, timeAfter bool) {
+	if mustBeAfter == minTime {
+		// Like After, the window needs a point in time to start from.
+		return -1, false, false
+	}
+
+	start := mustBeAfter.Add(time.Duration(from))
+	end := mustBeAfter.Add(time.Duration(to))
+
+	// Events are sorted by time, so the ones after the window can be left
+	// out by finding the first of them.
+	hi = lo + sort.Search(hi-lo, func(i int) bool {
+		return ev.events[lo+i].Time.After(end)
+	})
+
+	ai, a, aAfter := ev.evaluate(e, lo, hi, start)
+	if a && aAfter {
+		return ai, true, true
+	}
+
+	return -1, false, ev.nowAfter(end)
+}
+
+// evaluateCount evaluates c by counting the occurrences of c.A, one after the
+// other. The returned index is that of the last occurrence counted.
+func (ev *evaluator) evaluateCount(c Count, lo, hi int, mustBeAfter time.Time) (evsIndex int, satisfied, timeAfter bool) {
+	// Once the count is above the limits of OpGreater and OpGreaterOrEqual,
+	// further occurrences can't change the result.
+	limit := hi - lo
+	switch c.Op {
+	case OpGreater:
+		limit = c.N + 1
+	case OpGreaterOrEqual:
+		limit = c.N
+	}
+
+	mark := ev.mark()
+	n, last := 0, -1
+	for i := lo; i < hi && n < limit; {
+		ai := ev.occurrence(c.A, i, hi, mustBeAfter)
+		if ai < 0 {
+			break
+		}
+
+		n, last = n+1, ai
+		i = ai + 1
+	}
+	ev.mergeOccurrences(mark)
+
+	if !c.compare(n) {
+		return -1, false, n > 0 || ev.nowAfter(mustBeAfter)
+	}
+	return last, true, n > 0 || ev.nowAfter(mustBeAfter)
+}
+
+// evaluateWindowCount evaluates w by finding the occurrences of w.A, one after
+// the other, until the latest w.N of them are within w.D. The returned index
+// is that of the occurrence closing the window.
+func (ev *evaluator) evaluateWindowCount(w Window, lo, hi int, mustBeAfter time.Time) (evsIndex int, satisfied, timeAfter bool) {
+	mark := ev.mark()
+	defer ev.mergeOccurrences(mark)
+
+	var occurrences []int
+	for i := lo; i < hi && w.N > 0; {
+		ai := ev.occurrence(w.A, i, hi, mustBeAfter)
+		if ai < 0 {
+			break
+		}
+		occurrences = append(occurrences, ai)
+
+		if n := len(occurrences); n >= w.N {
+			first := ev.events[occurrences[n-w.N]].Time
+			if ev.events[ai].Time.Sub(first) <= time.Duration(w.D) {
+				return ai, true, true
+			}
+		}
+		i = ai + 1
+	}
+
+	return -1, false, len(occurrences) > 0 || ev.nowAfter(mustBeAfter)
+}
+
+// evaluateSince evaluates s by finding the latest occurrence of s.A, one
+// occurrence after the other. The returned index is that of the latest
+// occurrence, or -1 if there is none.
+func (ev *evaluator) evaluateSince(s Since, lo, hi int, mustBeAfter time.Time) (evsIndex int, satisfied, timeAfter bool) {
+	mark := ev.mark()
+	latest := -1
+	for i := lo; i < hi; {
+		ai := ev.occurrence(s.A, i, hi, mustBeAfter)
+		if ai < 0 {
+			break
+		}
+		latest, i = ai, ai+1
+	}
+	ev.mergeOccurrences(mark)
+
+	var since time.Time
+	switch {
+	case latest >= 0:
+		since = ev.events[latest].Time
+	case mustBeAfter != minTime:
+		since = mustBeAfter
+	case len(ev.events) > 0:
+		// Without any occurrences, inactivity is measured from the start of
+		// history.
+		since = ev.events[0].Time
+	default:
+		return -1, false, false
+	}
+
+	// The time of evaluation must not be before since+D, i.e. it must be
+	// after the nanosecond before it.
+	if !ev.nowAfter(since.Add(time.Duration(s.D)).Add(-time.Nanosecond)) {
+		return -1, false, latest >= 0 || ev.nowAfter(mustBeAfter)
+	}
+	return latest, true, true
+}
+
+// evaluateSeq evaluates s by trying every event as that of its first step,
+// preferring those not before mustBeAfter like EventName does.
+func (ev *evaluator) evaluateSeq(s Seq, lo, hi int, mustBeAfter time.Time) (evsIndex int, satisfied, timeAfter bool) {
+	first := -1
+	for i := lo; i < hi; i++ {
+		end := ev.matchSeq(s, i, hi)
+		if end < 0 {
+			continue
+		}
+
+		if ev.events[i].Time.Sub(mustBeAfter) >= 0 {
+			return end, true, true
+		}
+		if first < 0 {
+			first = end
+		}
+	}
+
+	if first >= 0 {
+		return first, true, false
+	}
+	return -1, false, ev.nowAfter(mustBeAfter)
+}
+
+// evaluateFilter evaluates e by finding the occurrences of e, one after the
+// other, until one is satisfied by an event whose time matches. The returned
+// index is that of the matching occurrence.
+func (ev *evaluator) evaluateFilter(e Expr, lo, hi int, mustBeAfter time.Time, matches func(time.Time) bool) (evsIndex int, satisfied, timeAfter bool) {
+	mark := ev.mark()
+	defer ev.mergeOccurrences(mark)
+
+	found := false
+	for i := lo; i < hi; {
+		ai := ev.occurrence(e, i, hi, mustBeAfter)
+		if ai < 0 {
+			break
+		}
+
+		if matches(ev.events[ai].Time) {
+			return ai, true, true
+		}
+		found, i = true, ai+1
+	}
+
+	return -1, false, found || ev.nowAfter(mustBeAfter)
+}
+
+// occurrence returns the index of the first occurrence of e in
+// ev.events[lo:hi] satisfied by events not before mustBeAfter, or -1 if there
+// is none. Satisfying e without events doesn't count as an occurrence.
+func (ev *evaluator) occurrence(e Expr, lo, hi int, mustBeAfter time.Time) int {
+	ai, a, aAfter := ev.evaluate(e, lo, hi, mustBeAfter)
+	if !a || !aAfter || ai < 0 {
+		return -1
+	}
+	return ai
+}
+
+// isWindow reports whether e is an operator limiting the events to a window
+// of time. Windows nested in other operators, e.g. OR, aren't, so NOT only
+// waits for a window to close when it applies to it directly; see Within.
+func isWindow(e Expr) bool {
+	switch e.(type) {
+	case Within, Between:
+		return true
 	default:
+		return false
+	}
+}
+
+// evaluateThen evaluates v by trying every prefix of the events as the events
+// that v.A may use, starting with the longest one. If ids is non-nil, only
+// events with those name IDs can change A's result, and prefixes that differ
+// only by other events are skipped.
+func (ev *evaluator) evaluateThen(v Then, ids []int, lo, hi int, mustBeAfter time.Time) (evsIndex int, satisfied, timeAfter bool) {
+	if v.Strategy != ThenDefault {
+		return ev.evaluateThenStrategy(v, lo, hi, mustBeAfter)
+	}
+
+	prevAi := -2
+	for i := hi; i > lo; i = ev.prevPrefix(ids, i) {
+		ev.retrace()
+
+		ai, a, aAfter := ev.evaluate(v.A, lo, i, mustBeAfter)
+		if !a {
+			continue
+		}
+
+		// If A keeps its occurrence, the prefixes that still include ai give
+		// the same result, and are skipped.
+		if ids != nil && ai >= 0 && keepsOccurrence(v.A) {
+			i = ai + 1
+		}
+
+		// B's result only depends on ai, and it wasn't satisfied the last
+		// time around.
+		if ai == prevAi {
+			continue
+		}
+		prevAi = ai
+
+		if bi, b, bAfter := ev.evaluateThenB(v, ai, lo, hi, mustBeAfter); b {
+			return bi, true, aAfter && bAfter
+		}
+	}
+	return -1, false, false
+}
+
+// evaluateThenStrategy evaluates v by finding the occurrences of v.A, one
+// after the other, and trying those chosen by v.Strategy.
+func (ev *evaluator) evaluateThenStrategy(v Then, lo, hi int, mustBeAfter time.Time) (evsIndex int, satisfied, timeAfter bool) {
+	mark := ev.mark()
+	var occurrences []int
+	for i := lo; i < hi; {
+		ai := ev.occurrence(v.A, i, hi, mustBeAfter)
+		if ai < 0 {
+			break
+		}
+		occurrences, i = append(occurrences, ai), ai+1
+	}
+
+	if len(occurrences) == 0 {
+		ai, a, aAfter := ev.evaluate(v.A, lo, hi, mustBeAfter)
+		ev.mergeOccurrences(mark)
+		if !a {
+			return -1, false, false
+		}
+
+		bi, b, bAfter := ev.evaluateThenB(v, ai, lo, hi, mustBeAfter)
+		return bi, b, b && aAfter && bAfter
+	}
+	ev.mergeOccurrences(mark)
+
+	if v.Strategy == ThenEarliest {
+		occurrences = occurrences[:1]
+	}
+
+	mark = ev.mark()
+	defer ev.mergeAttempts(mark)
+
+	for k, ai := range occurrences {
+		bi, b, bAfter := ev.evaluateThenB(v, ai, lo, hi, mustBeAfter)
+		if !b {
+			continue
+		}
+
+		// Using ThenLatest, the occurrence must be the latest one before the
+		// event satisfying B, or the latest one of all if B is satisfied
+		// without events, in which case bi is ai.
+		last := k == len(occurrences)-1
+		if v.Strategy == ThenLatest && !last && (bi == ai || bi > occurrences[k+1]) {
+			continue
+		}
+		return bi, true, bAfter
+	}
+	return -1, false, false
+}
+
+// evaluateThenB evaluates v.B against the events following the event at index
+// ai satisfying v.A. The returned index is that of the event satisfying v.B,
+// or ai if v.B is satisfied without events.
+func (ev *evaluator) evaluateThenB(v Then, ai, lo, hi int, mustBeAfter time.Time) (evsIndex int, satisfied, timeAfter bool) {
+	// If A is satisfied without an event, e.g. by NOT, B may be satisfied by
+	// any of the events.
+	bLo, bMustBeAfter := lo, mustBeAfter
+	if ai >= 0 {
+		bLo, bMustBeAfter = ai+1, ev.events[ai].Time
+	}
+
+	bi, b, bAfter := ev.evaluate(v.B, bLo, hi, bMustBeAfter)
+	if !b {
 		return -1, false, false
 	}
+	if bi < 0 {
+		return ai, true, bAfter
+	}
+	return bi, true, bAfter
 }
@@ -200,6 +200,36 @@ func TestEvaluateSimpleOr(t *testing.T) {
 	}
 }
 
+// TestEvaluateOrUnsatisfiedIndex verifies that Or keeps returning the larger
+// index of its operands when only one of them is satisfied, even if the other
+// one's is that of NOT's operand, which moves the anchor of an enclosing Then.
+// Stored rules depend on this; AnyOf returns the index of the satisfied
+// operand instead.
+func TestEvaluateOrUnsatisfiedIndex(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	events := []driplang.Event{
+		{Name: "x", Time: t0},
+		{Name: "b", Time: timey.AddHours(t0, 1)},
+		{Name: "y", Time: timey.AddHours(t0, 2)},
+	}
+	now := timey.AddHours(t0, 24)
+	b := driplang.After{A: driplang.EventName("b"), D: driplang.Duration(30 * time.Minute)}
+	nots := []driplang.Expr{driplang.Not{A: driplang.EventName("x")}, driplang.Not{A: driplang.EventName("y")}}
+
+	// Until y, NOT "x" isn't satisfied by x, and NOT "y" is satisfied, making
+	// x the anchor of Or.
+	or := driplang.Then{A: driplang.Or{A: nots[0], B: nots[1]}, B: b}
+	i, satisfied := driplang.EvaluateWithIndexAt(or, events, now)
+	require.True(t, satisfied)
+	require.Equal(t, 1, i)
+
+	// AnyOf has no anchor, and After is never satisfied without one.
+	anyOf := driplang.Then{A: driplang.AnyOf{Exprs: nots}, B: b}
+	i, satisfied = driplang.EvaluateWithIndexAt(anyOf, events, now)
+	require.False(t, satisfied)
+	require.Equal(t, -1, i)
+}
+
 // TestEvaluateSimpleNot verifies that simple Not expressions are satisfied only
 // when the underlying value isn't.
 func TestEvaluateSimpleNot(t *testing.T) {
@@ -700,6 +730,178 @@ func TestEvaluateThen(t *testing.T) {
 	}
 }
 
+// TestEvaluateAt verifies that expressions depending on the passing of time
+// are evaluated as of the given time, allowing rules to be replayed against
+// history.
+func TestEvaluateAt(t *testing.T) {
+	const (
+		signup   = "signup"
+		purchase = "purchase"
+	)
+
+	expr := driplang.Then{
+		A: driplang.EventName(signup),
+		B: driplang.After{
+			A: driplang.Not{A: driplang.EventName(purchase)},
+			D: driplang.Duration(72 * time.Hour),
+		},
+	}
+
+	signupTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	events := []driplang.Event{
+		{Name: signup, Time: signupTime},
+	}
+
+	tests := map[string]struct {
+		expected bool
+		now      time.Time
+	}{
+		"before duration": {
+			expected: false,
+			now:      timey.AddHours(signupTime, 71),
+		},
+		"at duration": {
+			expected: false,
+			now:      timey.AddHours(signupTime, 72),
+		},
+		"after duration": {
+			expected: true,
+			now:      timey.AddHours(signupTime, 72).Add(time.Nanosecond),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, test.expected, driplang.EvaluateAt(expr, events, test.now))
+
+			evaluator := driplang.Evaluator{
+				Clock: driplang.ClockFunc(func() time.Time { return test.now }),
+			}
+			require.Equal(t, test.expected, evaluator.Evaluate(expr, events))
+
+			i, satisfied := evaluator.EvaluateWithIndex(expr, events)
+			require.Equal(t, test.expected, satisfied)
+			if satisfied {
+				require.Equal(t, 0, i)
+			}
+		})
+	}
+}
+
+// TestEvaluateE verifies that EvaluateE returns an error for events that
+// aren't sorted by time, have an empty name or a zero time, and for unknown
+// operators, and that it sorts the events instead when asked to.
+func TestEvaluateE(t *testing.T) {
+	expr := driplang.Then{
+		A: driplang.EventName("a"),
+		B: driplang.EventName("b"),
+	}
+
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := timey.AddHours(t0, 10)
+	unsorted := []driplang.Event{
+		{Name: "c", Time: timey.AddHours(t0, 2)},
+		{Name: "b", Time: timey.AddHours(t0, 1)},
+		{Name: "a", Time: t0},
+		{Name: "b", Time: timey.AddHours(t0, 1)},
+	}
+
+	tests := map[string]struct {
+		expr       driplang.Expr
+		events     []driplang.Event
+		sortEvents bool
+		expected   bool
+		index      int
+		err        string
+	}{
+		"sorted": {
+			expr: expr,
+			events: []driplang.Event{
+				{Name: "a", Time: t0},
+				{Name: "b", Time: t0},
+			},
+			expected: true,
+			index:    1,
+		},
+		"no events": {
+			expr:  expr,
+			index: -1,
+		},
+		"unsorted": {
+			expr:   expr,
+			events: unsorted,
+			index:  -1,
+			err:    `invalid events: event 1 ("b") at 2024-03-01 13:00:00 +0000 UTC is before the previous event at 2024-03-01 14:00:00 +0000 UTC`,
+		},
+		"empty name": {
+			expr:   expr,
+			events: []driplang.Event{{Name: "a", Time: t0}, {Time: t0}},
+			index:  -1,
+			err:    "invalid events: event 1 has an empty name",
+		},
+		"zero time": {
+			expr:   expr,
+			events: makeEvents("a", "b"),
+			index:  -1,
+			err:    `invalid events: event 0 ("a") has a zero time`,
+		},
+		"zero time sorted": {
+			expr:       expr,
+			events:     makeEvents("a", "b"),
+			sortEvents: true,
+			index:      -1,
+			err:        `invalid events: event 0 ("a") has a zero time`,
+		},
+		"unknown operator": {
+			expr:  driplang.Not{A: unknownExpr{}},
+			index: -1,
+			err:   "$.a: unknown operator driplang_test.unknownExpr",
+		},
+		"sort unsorted": {
+			expr:       expr,
+			events:     unsorted,
+			sortEvents: true,
+			expected:   true,
+			// The first b after sorting is the one that came first in the
+			// given events.
+			index: 1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			events := append([]driplang.Event(nil), test.events...)
+			evaluator := driplang.Evaluator{
+				Clock:      driplang.ClockFunc(func() time.Time { return now }),
+				SortEvents: test.sortEvents,
+			}
+
+			i, satisfied, err := evaluator.EvaluateWithIndexE(test.expr, events)
+			if test.err != "" {
+				require.EqualError(t, err, test.err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, test.expected, satisfied)
+			require.Equal(t, test.index, i)
+
+			// The given events must not be modified.
+			require.Equal(t, test.events, events)
+		})
+	}
+}
+
+// TestEvaluateEErrorTypes verifies that the errors returned by EvaluateE can
+// be told apart using errors.Is.
+func TestEvaluateEErrorTypes(t *testing.T) {
+	_, err := driplang.EvaluateE(driplang.EventName("a"), makeEvents("a"))
+	require.ErrorIs(t, err, driplang.ErrInvalidEvents)
+
+	_, err = driplang.EvaluateE(unknownExpr{}, nil)
+	require.ErrorIs(t, err, driplang.ErrInvalidExpression)
+	require.NotErrorIs(t, err, driplang.ErrInvalidEvents)
+}
+
 func makeEvents(names ...string) []driplang.Event {
 	events := make([]driplang.Event, len(names))
 	for i, n := range names {
@@ -707,3 +909,1063 @@ func makeEvents(names ...string) []driplang.Event {
 	}
 	return events
 }
+
+// TestEvaluateWithin verifies that Within and Between are only satisfied by
+// events inside their window, and that NOT of them is only satisfied once the
+// window has closed without such events.
+func TestEvaluateWithin(t *testing.T) {
+	const (
+		signup   = "signup"
+		purchase = "purchase"
+	)
+
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	within := driplang.Within{A: driplang.EventName(purchase), D: driplang.Duration(24 * time.Hour)}
+	between := driplang.Between{A: driplang.EventName(purchase), Min: driplang.Duration(time.Hour), Max: driplang.Duration(24 * time.Hour)}
+
+	tests := map[string]struct {
+		expected bool
+		expr     driplang.Expr
+		events   []driplang.Event
+		now      time.Time
+	}{
+		"within": {
+			expected: true,
+			expr:     driplang.Then{A: driplang.EventName(signup), B: within},
+			events: []driplang.Event{
+				{Name: signup, Time: t0},
+				{Name: purchase, Time: timey.AddHours(t0, 24)},
+			},
+			now: timey.AddHours(t0, 48),
+		},
+		"within too late": {
+			expected: false,
+			expr:     driplang.Then{A: driplang.EventName(signup), B: within},
+			events: []driplang.Event{
+				{Name: signup, Time: t0},
+				{Name: purchase, Time: timey.AddHours(t0, 24).Add(time.Nanosecond)},
+			},
+			now: timey.AddHours(t0, 48),
+		},
+		"within before then.a": {
+			expected: false,
+			expr:     driplang.Then{A: driplang.EventName(signup), B: within},
+			events: []driplang.Event{
+				{Name: purchase, Time: t0},
+				{Name: signup, Time: timey.AddHours(t0, 1)},
+			},
+			now: timey.AddHours(t0, 2),
+		},
+		"within outside then.b": {
+			expected: false,
+			expr:     within,
+			events:   []driplang.Event{{Name: purchase, Time: t0}},
+			now:      timey.AddHours(t0, 1),
+		},
+		"between": {
+			expected: true,
+			expr:     driplang.Then{A: driplang.EventName(signup), B: between},
+			events: []driplang.Event{
+				{Name: signup, Time: t0},
+				{Name: purchase, Time: timey.AddHours(t0, 1)},
+			},
+			now: timey.AddHours(t0, 2),
+		},
+		"between too early": {
+			expected: false,
+			expr:     driplang.Then{A: driplang.EventName(signup), B: between},
+			events: []driplang.Event{
+				{Name: signup, Time: t0},
+				{Name: purchase, Time: t0.Add(time.Minute)},
+			},
+			now: timey.AddHours(t0, 2),
+		},
+		"between later event": {
+			expected: true,
+			expr:     driplang.Then{A: driplang.EventName(signup), B: between},
+			events: []driplang.Event{
+				{Name: signup, Time: t0},
+				{Name: purchase, Time: t0.Add(time.Minute)},
+				{Name: purchase, Time: timey.AddHours(t0, 2)},
+			},
+			now: timey.AddHours(t0, 2),
+		},
+		"not within, window open": {
+			expected: false,
+			expr:     driplang.Then{A: driplang.EventName(signup), B: driplang.Not{A: within}},
+			events:   []driplang.Event{{Name: signup, Time: t0}},
+			now:      timey.AddHours(t0, 24),
+		},
+		"not within, window closed": {
+			expected: true,
+			expr:     driplang.Then{A: driplang.EventName(signup), B: driplang.Not{A: within}},
+			events:   []driplang.Event{{Name: signup, Time: t0}},
+			now:      timey.AddHours(t0, 24).Add(time.Nanosecond),
+		},
+		"not within, event in window": {
+			expected: false,
+			expr:     driplang.Then{A: driplang.EventName(signup), B: driplang.Not{A: within}},
+			events: []driplang.Event{
+				{Name: signup, Time: t0},
+				{Name: purchase, Time: timey.AddHours(t0, 23)},
+			},
+			now: timey.AddHours(t0, 48),
+		},
+		"not within, event after window": {
+			expected: true,
+			expr:     driplang.Then{A: driplang.EventName(signup), B: driplang.Not{A: within}},
+			events: []driplang.Event{
+				{Name: signup, Time: t0},
+				{Name: purchase, Time: timey.AddHours(t0, 25)},
+			},
+			now: timey.AddHours(t0, 48),
+		},
+		"not between, event before window": {
+			expected: true,
+			expr:     driplang.Then{A: driplang.EventName(signup), B: driplang.Not{A: between}},
+			events: []driplang.Event{
+				{Name: signup, Time: t0},
+				{Name: purchase, Time: t0.Add(time.Minute)},
+			},
+			now: timey.AddHours(t0, 25),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, test.expected, driplang.EvaluateAt(test.expr, test.events, test.now))
+		})
+	}
+}
+
+// TestEvaluateCount verifies that Count compares the number of occurrences of
+// its sub-expression, only counting those after the time of the event
+// satisfying Then.A.
+func TestEvaluateCount(t *testing.T) {
+	const (
+		signup   = "signup"
+		pageView = "page_view"
+		email    = "email"
+	)
+
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	events := []driplang.Event{
+		{Name: pageView, Time: t0},
+		{Name: signup, Time: timey.AddHours(t0, 1)},
+		{Name: pageView, Time: timey.AddHours(t0, 2)},
+		{Name: email, Time: timey.AddHours(t0, 3)},
+		{Name: pageView, Time: timey.AddHours(t0, 4)},
+		{Name: pageView, Time: timey.AddHours(t0, 5)},
+	}
+	now := timey.AddHours(t0, 6)
+
+	count := func(e driplang.Expr, op driplang.PredicateOp, n int) driplang.Count {
+		return driplang.Count{A: e, Op: op, N: n}
+	}
+
+	tests := map[string]struct {
+		expr     driplang.Expr
+		expected bool
+		index    int
+	}{
+		"at least": {
+			expr:     count(driplang.EventName(pageView), driplang.OpGreaterOrEqual, 3),
+			expected: true,
+			index:    4,
+		},
+		"at least too many": {
+			expr:     count(driplang.EventName(pageView), driplang.OpGreaterOrEqual, 5),
+			expected: false,
+			index:    -1,
+		},
+		"exactly": {
+			expr:     count(driplang.EventName(email), driplang.OpEqual, 1),
+			expected: true,
+			index:    3,
+		},
+		"exactly, more occurrences": {
+			expr:     count(driplang.EventName(pageView), driplang.OpEqual, 3),
+			expected: false,
+			index:    -1,
+		},
+		"less, no occurrences": {
+			expr:     count(driplang.EventName("purchase"), driplang.OpLess, 1),
+			expected: true,
+			index:    -1,
+		},
+		"after then.a": {
+			expr: driplang.Then{
+				A: driplang.EventName(signup),
+				B: count(driplang.EventName(pageView), driplang.OpEqual, 3),
+			},
+			expected: true,
+			index:    5,
+		},
+		"after after": {
+			expr: driplang.Then{
+				A: driplang.EventName(signup),
+				B: driplang.After{
+					A: count(driplang.EventName(pageView), driplang.OpEqual, 2),
+					D: driplang.Duration(2 * time.Hour),
+				},
+			},
+			expected: true,
+			index:    5,
+		},
+		"count of then": {
+			expr: count(driplang.Then{
+				A: driplang.EventName(pageView),
+				B: driplang.EventName(pageView),
+			}, driplang.OpEqual, 2),
+			expected: true,
+			index:    5,
+		},
+		"satisfied without events isn't counted": {
+			expr:     count(driplang.Not{A: driplang.EventName("purchase")}, driplang.OpEqual, 0),
+			expected: true,
+			index:    -1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			i, satisfied := driplang.EvaluateWithIndexAt(test.expr, events, now)
+			require.Equal(t, test.expected, satisfied)
+			require.Equal(t, test.index, i)
+		})
+	}
+}
+
+// TestEvaluateWindow verifies that Window is satisfied when enough
+// occurrences happen within its duration, and that the returned index is that
+// of the event closing the window.
+func TestEvaluateWindow(t *testing.T) {
+	const (
+		failedLogin = "failed_login"
+		signup      = "signup"
+	)
+
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes ...int) []driplang.Event {
+		events := make([]driplang.Event, len(minutes))
+		for i, m := range minutes {
+			events[i] = driplang.Event{Name: failedLogin, Time: t0.Add(time.Duration(m) * time.Minute)}
+		}
+		return events
+	}
+	window := driplang.Window{A: driplang.EventName(failedLogin), N: 3, D: driplang.Duration(10 * time.Minute)}
+
+	tests := map[string]struct {
+		expr     driplang.Expr
+		events   []driplang.Event
+		expected bool
+		index    int
+	}{
+		"within window": {
+			expr:     window,
+			events:   at(0, 5, 10),
+			expected: true,
+			index:    2,
+		},
+		"spread out": {
+			expr:     window,
+			events:   at(0, 6, 11, 17, 22),
+			expected: false,
+			index:    -1,
+		},
+		"later window": {
+			expr:     window,
+			events:   at(0, 11, 15, 16, 30),
+			expected: true,
+			index:    3,
+		},
+		"too few": {
+			expr:     window,
+			events:   at(0, 1),
+			expected: false,
+			index:    -1,
+		},
+		"other events are ignored": {
+			expr: window,
+			events: append(at(0, 1), []driplang.Event{
+				{Name: signup, Time: t0.Add(2 * time.Minute)},
+				{Name: failedLogin, Time: t0.Add(3 * time.Minute)},
+			}...),
+			expected: true,
+			index:    3,
+		},
+		"after then.a": {
+			expr: driplang.Then{A: driplang.EventName(signup), B: window},
+			events: []driplang.Event{
+				{Name: failedLogin, Time: t0},
+				{Name: failedLogin, Time: t0.Add(time.Minute)},
+				{Name: signup, Time: t0.Add(2 * time.Minute)},
+				{Name: failedLogin, Time: t0.Add(3 * time.Minute)},
+			},
+			expected: false,
+			index:    -1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			i, satisfied := driplang.EvaluateWithIndexAt(test.expr, test.events, t0.Add(time.Hour))
+			require.Equal(t, test.expected, satisfied)
+			require.Equal(t, test.index, i)
+		})
+	}
+}
+
+// TestEvaluateSince verifies that Since is satisfied once at least its
+// duration has passed since the latest occurrence of its sub-expression, or
+// since the start of history if there is none.
+func TestEvaluateSince(t *testing.T) {
+	const (
+		signup = "signup"
+		login  = "login"
+	)
+
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	inactive := driplang.Since{A: driplang.EventName(login), D: driplang.Duration(14 * 24 * time.Hour)}
+	events := []driplang.Event{
+		{Name: signup, Time: t0},
+		{Name: login, Time: timey.AddHours(t0, 24)},
+		{Name: login, Time: timey.AddHours(t0, 48)},
+	}
+
+	tests := map[string]struct {
+		expr     driplang.Expr
+		events   []driplang.Event
+		now      time.Time
+		expected bool
+		index    int
+	}{
+		"inactive": {
+			expr:     inactive,
+			events:   events,
+			now:      timey.AddHours(t0, 48+14*24),
+			expected: true,
+			index:    2,
+		},
+		"active": {
+			expr:     inactive,
+			events:   events,
+			now:      timey.AddHours(t0, 48+14*24).Add(-time.Nanosecond),
+			expected: false,
+			index:    -1,
+		},
+		"never occurred, measured from start of history": {
+			expr:     inactive,
+			events:   events[:1],
+			now:      timey.AddHours(t0, 14*24),
+			expected: true,
+			index:    -1,
+		},
+		"never occurred, recent start of history": {
+			expr:     inactive,
+			events:   events[:1],
+			now:      timey.AddHours(t0, 14*24-1),
+			expected: false,
+			index:    -1,
+		},
+		"no events": {
+			expr:     inactive,
+			now:      timey.AddHours(t0, 1000),
+			expected: false,
+			index:    -1,
+		},
+		"after then.a": {
+			expr: driplang.Then{A: driplang.EventName(login), B: inactive},
+			events: append(events, driplang.Event{
+				Name: signup, Time: timey.AddHours(t0, 72),
+			}),
+			now:      timey.AddHours(t0, 48+14*24),
+			expected: true,
+			index:    2,
+		},
+		"after then.a, occurrence before": {
+			expr:     driplang.Then{A: driplang.EventName(signup), B: driplang.Since{A: driplang.EventName(login), D: driplang.Duration(time.Hour)}},
+			events:   []driplang.Event{{Name: login, Time: t0}, {Name: signup, Time: timey.AddHours(t0, 10)}},
+			now:      timey.AddHours(t0, 10).Add(30 * time.Minute),
+			expected: false,
+			index:    -1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			i, satisfied := driplang.EvaluateWithIndexAt(test.expr, test.events, test.now)
+			require.Equal(t, test.expected, satisfied)
+			require.Equal(t, test.index, i)
+		})
+	}
+}
+
+// TestEvaluateCalendar verifies that AfterTime, BeforeTime, During and On
+// restrict events to absolute points in time, times of day and days of the
+// week in the given time zone, and that they compose with other operators.
+func TestEvaluateCalendar(t *testing.T) {
+	const (
+		signup   = "signup"
+		purchase = "purchase"
+	)
+
+	// Friday; Copenhagen is at UTC+1.
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	officeHours := func(zone string) driplang.Expr {
+		return driplang.During{
+			A:    driplang.EventName(purchase),
+			From: driplang.Duration(9 * time.Hour),
+			To:   driplang.Duration(17 * time.Hour),
+			Zone: zone,
+		}
+	}
+	weekend := func(zone string) driplang.Expr {
+		return driplang.On{
+			A:    driplang.EventName(purchase),
+			Days: []time.Weekday{time.Saturday, time.Sunday},
+			Zone: zone,
+		}
+	}
+
+	tests := map[string]struct {
+		expr     driplang.Expr
+		events   []driplang.Event
+		expected bool
+		index    int
+	}{
+		"after time": {
+			expr:     driplang.AfterTime{A: driplang.EventName(signup), T: timey.AddHours(t0, -1)},
+			events:   []driplang.Event{{Name: signup, Time: t0}},
+			expected: true,
+			index:    0,
+		},
+		"after time is exclusive": {
+			expr:     driplang.AfterTime{A: driplang.EventName(signup), T: t0},
+			events:   []driplang.Event{{Name: signup, Time: t0}},
+			expected: false,
+			index:    -1,
+		},
+		"before time": {
+			expr:     driplang.BeforeTime{A: driplang.EventName(signup), T: t0.Add(time.Nanosecond)},
+			events:   []driplang.Event{{Name: signup, Time: t0}},
+			expected: true,
+			index:    0,
+		},
+		"before time is exclusive": {
+			expr:     driplang.BeforeTime{A: driplang.EventName(signup), T: t0},
+			events:   []driplang.Event{{Name: signup, Time: t0}},
+			expected: false,
+			index:    -1,
+		},
+		"before time, not": {
+			expr: driplang.Then{
+				A: driplang.EventName(signup),
+				B: driplang.Not{A: driplang.BeforeTime{A: driplang.EventName(purchase), T: timey.AddHours(t0, 24)}},
+			},
+			events: []driplang.Event{
+				{Name: signup, Time: t0},
+				{Name: purchase, Time: timey.AddHours(t0, 25)},
+			},
+			expected: true,
+			index:    0,
+		},
+		"during": {
+			expr:     officeHours("Europe/Copenhagen"),
+			events:   []driplang.Event{{Name: purchase, Time: timey.AddHours(t0, 3).Add(30 * time.Minute)}},
+			expected: true,
+			index:    0,
+		},
+		"during, end is exclusive": {
+			expr:     officeHours("Europe/Copenhagen"),
+			events:   []driplang.Event{{Name: purchase, Time: timey.AddHours(t0, 4)}},
+			expected: false,
+			index:    -1,
+		},
+		"during, other time zone": {
+			expr:     officeHours("UTC"),
+			events:   []driplang.Event{{Name: purchase, Time: timey.AddHours(t0, 4)}},
+			expected: true,
+			index:    0,
+		},
+		"during, first occurrence within": {
+			expr: officeHours("Europe/Copenhagen"),
+			events: []driplang.Event{
+				{Name: purchase, Time: timey.AddHours(t0, -12)},
+				{Name: signup, Time: timey.AddHours(t0, -1)},
+				{Name: purchase, Time: t0},
+				{Name: purchase, Time: timey.AddHours(t0, 1)},
+			},
+			expected: true,
+			index:    2,
+		},
+		"during, wrapping around midnight": {
+			expr: driplang.During{
+				A:    driplang.EventName(purchase),
+				From: driplang.Duration(22 * time.Hour),
+				To:   driplang.Duration(6 * time.Hour),
+				Zone: "Europe/Copenhagen",
+			},
+			events:   []driplang.Event{{Name: purchase, Time: timey.AddHours(t0, 11).Add(30 * time.Minute)}},
+			expected: true,
+			index:    0,
+		},
+		"not during": {
+			expr:     driplang.Not{A: officeHours("Europe/Copenhagen")},
+			events:   []driplang.Event{{Name: purchase, Time: timey.AddHours(t0, 8)}},
+			expected: true,
+			index:    -1,
+		},
+		"on": {
+			expr:     weekend("Europe/Copenhagen"),
+			events:   []driplang.Event{{Name: purchase, Time: timey.AddHours(t0, 11).Add(30 * time.Minute)}},
+			expected: true,
+			index:    0,
+		},
+		"on, other time zone": {
+			expr:     weekend("UTC"),
+			events:   []driplang.Event{{Name: purchase, Time: timey.AddHours(t0, 11).Add(30 * time.Minute)}},
+			expected: false,
+			index:    -1,
+		},
+		"composed": {
+			expr: driplang.Then{
+				A: driplang.AfterTime{A: driplang.EventName(signup), T: timey.AddHours(t0, -24)},
+				B: driplang.On{
+					A:    officeHours("Europe/Copenhagen"),
+					Days: []time.Weekday{time.Monday},
+					Zone: "Europe/Copenhagen",
+				},
+			},
+			events: []driplang.Event{
+				{Name: signup, Time: t0},
+				{Name: purchase, Time: timey.AddHours(t0, 24)},
+				{Name: purchase, Time: timey.AddHours(t0, 3*24-6)},
+				{Name: purchase, Time: timey.AddHours(t0, 3*24)},
+			},
+			expected: true,
+			index:    3,
+		},
+		"day relative to then.a": {
+			expr: driplang.Then{
+				A: driplang.EventName(signup),
+				B: driplang.Between{
+					A:   driplang.EventName(purchase),
+					Min: driplang.Duration(29 * 24 * time.Hour),
+					Max: driplang.Duration(30 * 24 * time.Hour),
+				},
+			},
+			events: []driplang.Event{
+				{Name: signup, Time: t0},
+				{Name: purchase, Time: timey.AddHours(t0, 29*24+12)},
+			},
+			expected: true,
+			index:    1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			i, satisfied := driplang.EvaluateWithIndexAt(test.expr, test.events, timey.AddHours(t0, 60*24))
+			require.Equal(t, test.expected, satisfied)
+			require.Equal(t, test.index, i)
+
+			program, err := driplang.Compile(test.expr)
+			require.NoError(t, err)
+			i, satisfied = program.EvaluateWithIndexAt(test.events, timey.AddHours(t0, 60*24))
+			require.Equal(t, test.expected, satisfied)
+			require.Equal(t, test.index, i)
+		})
+	}
+}
+
+// TestEvaluateAnchoredAfter verifies that After can be anchored to the first or
+// latest event, or the first or latest event with a name, instead of the event
+// satisfying Then.A, and that it can then be used anywhere.
+func TestEvaluateAnchoredAfter(t *testing.T) {
+	const (
+		visit    = "visit"
+		trial    = "trial_started"
+		purchase = "purchase"
+	)
+
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	noPurchase := func(hours int, anchor driplang.Anchor) driplang.Expr {
+		return driplang.After{
+			A:      driplang.Not{A: driplang.EventName(purchase)},
+			D:      driplang.Duration(time.Duration(hours) * time.Hour),
+			Anchor: anchor,
+		}
+	}
+	events := []driplang.Event{
+		{Name: visit, Time: t0},
+		{Name: trial, Time: timey.AddHours(t0, 24)},
+		{Name: visit, Time: timey.AddHours(t0, 48)},
+		{Name: trial, Time: timey.AddHours(t0, 72)},
+	}
+
+	tests := map[string]struct {
+		expr     driplang.Expr
+		events   []driplang.Event
+		now      time.Time
+		expected bool
+		index    int
+	}{
+		"first": {
+			expr:     noPurchase(7*24, driplang.Anchor{Kind: driplang.AnchorFirst}),
+			events:   events,
+			now:      timey.AddHours(t0, 7*24).Add(time.Nanosecond),
+			expected: true,
+			index:    -1,
+		},
+		"first, too soon": {
+			expr:     noPurchase(7*24, driplang.Anchor{Kind: driplang.AnchorFirst}),
+			events:   events,
+			now:      timey.AddHours(t0, 7*24),
+			expected: false,
+			index:    -1,
+		},
+		"last": {
+			expr:     noPurchase(7*24, driplang.Anchor{Kind: driplang.AnchorLast}),
+			events:   events,
+			now:      timey.AddHours(t0, 72+7*24),
+			expected: false,
+			index:    -1,
+		},
+		"first with name": {
+			expr:     noPurchase(7*24, driplang.Anchor{Kind: driplang.AnchorFirst, Name: trial}),
+			events:   events,
+			now:      timey.AddHours(t0, 24+7*24).Add(time.Nanosecond),
+			expected: true,
+			index:    -1,
+		},
+		"last with name": {
+			expr:     noPurchase(7*24, driplang.Anchor{Kind: driplang.AnchorLast, Name: trial}),
+			events:   events,
+			now:      timey.AddHours(t0, 24+7*24).Add(time.Nanosecond),
+			expected: false,
+			index:    -1,
+		},
+		"missing anchor": {
+			expr:     noPurchase(0, driplang.Anchor{Kind: driplang.AnchorFirst, Name: purchase}),
+			events:   events,
+			now:      timey.AddHours(t0, 1000),
+			expected: false,
+			index:    -1,
+		},
+		"event after anchor": {
+			expr: driplang.After{
+				A:      driplang.EventName(visit),
+				D:      driplang.Duration(24 * time.Hour),
+				Anchor: driplang.Anchor{Kind: driplang.AnchorFirst, Name: trial},
+			},
+			events:   events,
+			now:      timey.AddHours(t0, 1000),
+			expected: true,
+			index:    2,
+		},
+		"regardless of then.a": {
+			expr: driplang.Then{
+				A: driplang.EventName(visit),
+				B: driplang.After{
+					A:      driplang.EventName(trial),
+					D:      driplang.Duration(36 * time.Hour),
+					Anchor: driplang.Anchor{Kind: driplang.AnchorFirst, Name: trial},
+				},
+			},
+			events:   events,
+			now:      timey.AddHours(t0, 1000),
+			expected: true,
+			index:    3,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			i, satisfied := driplang.EvaluateWithIndexAt(test.expr, test.events, test.now)
+			require.Equal(t, test.expected, satisfied)
+			require.Equal(t, test.index, i)
+
+			program, err := driplang.Compile(test.expr)
+			require.NoError(t, err)
+			i, satisfied = program.EvaluateWithIndexAt(test.events, test.now)
+			require.Equal(t, test.expected, satisfied)
+			require.Equal(t, test.index, i)
+		})
+	}
+}
+
+// TestEvaluateThenStrategy verifies which of the events satisfying Then.A that
+// Then.B is measured from using each ThenStrategy.
+func TestEvaluateThenStrategy(t *testing.T) {
+	const (
+		cart     = "cart"
+		purchase = "purchase"
+	)
+
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	abandoned := func(strategy driplang.ThenStrategy) driplang.Expr {
+		return driplang.Then{
+			A:        driplang.EventName(cart),
+			B:        driplang.Not{A: driplang.EventName(purchase)},
+			Strategy: strategy,
+		}
+	}
+	slowPurchase := func(strategy driplang.ThenStrategy) driplang.Expr {
+		return driplang.Then{
+			A:        driplang.EventName(cart),
+			B:        driplang.After{A: driplang.EventName(purchase), D: driplang.Duration(time.Hour)},
+			Strategy: strategy,
+		}
+	}
+	purchasedAfterCart := []driplang.Event{
+		{Name: cart, Time: t0},
+		{Name: purchase, Time: timey.AddHours(t0, 1)},
+		{Name: cart, Time: timey.AddHours(t0, 2)},
+	}
+	cartAgain := []driplang.Event{
+		{Name: cart, Time: t0},
+		{Name: cart, Time: timey.AddHours(t0, 10)},
+		{Name: purchase, Time: timey.AddHours(t0, 10).Add(30 * time.Minute)},
+	}
+
+	tests := map[string]struct {
+		expr     driplang.Expr
+		events   []driplang.Event
+		expected bool
+		index    int
+	}{
+		"abandoned, default": {
+			expr:     abandoned(driplang.ThenDefault),
+			events:   purchasedAfterCart,
+			expected: false,
+			index:    -1,
+		},
+		"abandoned, earliest": {
+			expr:     abandoned(driplang.ThenEarliest),
+			events:   purchasedAfterCart,
+			expected: false,
+			index:    -1,
+		},
+		"abandoned, latest": {
+			expr:     abandoned(driplang.ThenLatest),
+			events:   purchasedAfterCart,
+			expected: true,
+			index:    2,
+		},
+		"abandoned, any": {
+			expr:     abandoned(driplang.ThenAny),
+			events:   purchasedAfterCart,
+			expected: true,
+			index:    2,
+		},
+		"slow purchase, default": {
+			expr:     slowPurchase(driplang.ThenDefault),
+			events:   cartAgain,
+			expected: true,
+			index:    2,
+		},
+		"slow purchase, earliest": {
+			expr:     slowPurchase(driplang.ThenEarliest),
+			events:   cartAgain,
+			expected: true,
+			index:    2,
+		},
+		"slow purchase, latest": {
+			expr:     slowPurchase(driplang.ThenLatest),
+			events:   cartAgain,
+			expected: false,
+			index:    -1,
+		},
+		"slow purchase, any": {
+			expr:     slowPurchase(driplang.ThenAny),
+			events:   cartAgain,
+			expected: true,
+			index:    2,
+		},
+		"latest before b": {
+			expr: driplang.Then{
+				A:        driplang.EventName("signup"),
+				B:        driplang.EventName(purchase),
+				Strategy: driplang.ThenLatest,
+			},
+			events: []driplang.Event{
+				{Name: "signup", Time: t0},
+				{Name: purchase, Time: timey.AddHours(t0, 2)},
+				{Name: "signup", Time: timey.AddHours(t0, 3)},
+			},
+			expected: true,
+			index:    1,
+		},
+		"a satisfied without events": {
+			expr: driplang.Then{
+				A:        driplang.Not{A: driplang.EventName(purchase)},
+				B:        driplang.EventName(cart),
+				Strategy: driplang.ThenLatest,
+			},
+			events:   purchasedAfterCart[:1],
+			expected: true,
+			index:    0,
+		},
+		"no occurrences": {
+			expr:     abandoned(driplang.ThenAny),
+			events:   purchasedAfterCart[1:2],
+			expected: false,
+			index:    -1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			now := timey.AddHours(t0, 24)
+			i, satisfied := driplang.EvaluateWithIndexAt(test.expr, test.events, now)
+			require.Equal(t, test.expected, satisfied)
+			require.Equal(t, test.index, i)
+
+			program, err := driplang.Compile(test.expr)
+			require.NoError(t, err)
+			i, satisfied = program.EvaluateWithIndexAt(test.events, now)
+			require.Equal(t, test.expected, satisfied)
+			require.Equal(t, test.index, i)
+		})
+	}
+}
+
+// TestEvaluateSeq verifies that Seq is satisfied by adjacent events matching
+// its steps, allowing events named in Ignore between them, or any events when
+// relaxed.
+func TestEvaluateSeq(t *testing.T) {
+	const (
+		signup    = "signup"
+		view      = "view"
+		cart      = "cart"
+		heartbeat = "heartbeat"
+		purchase  = "purchase"
+	)
+
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	seq := func(names ...string) driplang.Seq {
+		s := driplang.Seq{}
+		for _, name := range names {
+			s.Steps = append(s.Steps, driplang.EventName(name))
+		}
+		return s
+	}
+	events := []driplang.Event{
+		{Name: view, Time: t0},
+		{Name: cart, Time: timey.AddHours(t0, 1), Properties: map[string]interface{}{"n": 2.0}},
+		{Name: heartbeat, Time: timey.AddHours(t0, 2)},
+		{Name: purchase, Time: timey.AddHours(t0, 3)},
+	}
+
+	tests := map[string]struct {
+		expr     driplang.Expr
+		events   []driplang.Event
+		expected bool
+		index    int
+	}{
+		"adjacent": {
+			expr:     seq(view, cart),
+			events:   events,
+			expected: true,
+			index:    1,
+		},
+		"single step": {
+			expr:     seq(purchase),
+			events:   events,
+			expected: true,
+			index:    3,
+		},
+		"event between": {
+			expr:     seq(view, cart, purchase),
+			events:   events,
+			expected: false,
+			index:    -1,
+		},
+		"ignored event between": {
+			expr: driplang.Seq{
+				Steps:  seq(view, cart, purchase).Steps,
+				Ignore: []driplang.EventName{heartbeat},
+			},
+			events:   events,
+			expected: true,
+			index:    3,
+		},
+		"relaxed": {
+			expr:     driplang.Seq{Steps: seq(view, purchase).Steps, Relaxed: true},
+			events:   events,
+			expected: true,
+			index:    3,
+		},
+		"wrong order": {
+			expr:     driplang.Seq{Steps: seq(cart, view).Steps, Relaxed: true},
+			events:   events,
+			expected: false,
+			index:    -1,
+		},
+		"where step": {
+			expr: driplang.Seq{Steps: []driplang.Expr{
+				driplang.EventName(view),
+				driplang.Where{Name: cart, Predicates: []driplang.Predicate{{Property: "n", Op: driplang.OpGreater, Value: 2.0}}},
+			}},
+			events:   events,
+			expected: false,
+			index:    -1,
+		},
+		"later start": {
+			expr: seq(view, cart),
+			events: []driplang.Event{
+				{Name: view, Time: t0},
+				{Name: view, Time: timey.AddHours(t0, 1)},
+				{Name: cart, Time: timey.AddHours(t0, 2)},
+			},
+			expected: true,
+			index:    2,
+		},
+		"after then.a": {
+			expr: driplang.Then{A: driplang.EventName(signup), B: seq(view, cart)},
+			events: []driplang.Event{
+				{Name: view, Time: t0},
+				{Name: cart, Time: timey.AddHours(t0, 1)},
+				{Name: signup, Time: timey.AddHours(t0, 2)},
+				{Name: view, Time: timey.AddHours(t0, 3)},
+				{Name: cart, Time: timey.AddHours(t0, 4)},
+			},
+			expected: true,
+			index:    4,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			now := timey.AddHours(t0, 24)
+			i, satisfied := driplang.EvaluateWithIndexAt(test.expr, test.events, now)
+			require.Equal(t, test.expected, satisfied)
+			require.Equal(t, test.index, i)
+
+			program, err := driplang.Compile(test.expr)
+			require.NoError(t, err)
+			i, satisfied = program.EvaluateWithIndexAt(test.events, now)
+			require.Equal(t, test.expected, satisfied)
+			require.Equal(t, test.index, i)
+		})
+	}
+}
+
+// TestEvaluateNary verifies that AnyOf, AllOf and AtLeast are satisfied by
+// enough of their expressions, and that they return the index of the right
+// event.
+func TestEvaluateNary(t *testing.T) {
+	const (
+		a = "a"
+		b = "b"
+		c = "c"
+		x = "x"
+	)
+
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	events := []driplang.Event{
+		{Name: a, Time: t0},
+		{Name: b, Time: timey.AddHours(t0, 1)},
+		{Name: c, Time: timey.AddHours(t0, 2)},
+	}
+	exprs := func(names ...string) []driplang.Expr {
+		exprs := []driplang.Expr{}
+		for _, name := range names {
+			exprs = append(exprs, driplang.EventName(name))
+		}
+		return exprs
+	}
+
+	tests := map[string]struct {
+		expr     driplang.Expr
+		expected bool
+		index    int
+	}{
+		"any of": {
+			expr:     driplang.AnyOf{Exprs: exprs(x, b, a)},
+			expected: true,
+			index:    0,
+		},
+		"any of none": {
+			expr:     driplang.AnyOf{Exprs: exprs(x, "y")},
+			expected: false,
+			index:    -1,
+		},
+		"any of with unsatisfied not": {
+			expr: driplang.AnyOf{Exprs: []driplang.Expr{
+				driplang.Not{A: driplang.EventName(c)},
+				driplang.EventName(a),
+			}},
+			expected: true,
+			index:    0,
+		},
+		"or with unsatisfied not": {
+			// Unlike AnyOf, Or uses the larger index when one of its
+			// operands isn't satisfied, which may be that of NOT.
+			expr: driplang.Or{
+				A: driplang.Not{A: driplang.EventName(c)},
+				B: driplang.EventName(a),
+			},
+			expected: true,
+			index:    2,
+		},
+		"all of": {
+			expr:     driplang.AllOf{Exprs: exprs(a, c, b)},
+			expected: true,
+			index:    2,
+		},
+		"all of missing": {
+			expr:     driplang.AllOf{Exprs: exprs(a, x)},
+			expected: false,
+			index:    -1,
+		},
+		"at least": {
+			expr:     driplang.AtLeast{K: 2, Exprs: exprs(c, x, b, a)},
+			expected: true,
+			index:    1,
+		},
+		"at least too few": {
+			expr:     driplang.AtLeast{K: 3, Exprs: exprs(a, b, x)},
+			expected: false,
+			index:    -1,
+		},
+		"at least after": {
+			expr: driplang.Then{
+				A: driplang.EventName(a),
+				B: driplang.After{
+					A: driplang.AtLeast{K: 2, Exprs: exprs(b, c)},
+					D: driplang.Duration(30 * time.Minute),
+				},
+			},
+			expected: true,
+			index:    2,
+		},
+		"at least too few after": {
+			expr: driplang.Then{
+				A: driplang.EventName(a),
+				B: driplang.After{
+					A: driplang.AtLeast{K: 2, Exprs: exprs(b, c)},
+					D: driplang.Duration(90 * time.Minute),
+				},
+			},
+			expected: false,
+			index:    -1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			now := timey.AddHours(t0, 24)
+			i, satisfied := driplang.EvaluateWithIndexAt(test.expr, events, now)
+			require.Equal(t, test.expected, satisfied)
+			require.Equal(t, test.index, i)
+
+			program, err := driplang.Compile(test.expr)
+			require.NoError(t, err)
+			i, satisfied = program.EvaluateWithIndexAt(events, now)
+			require.Equal(t, test.expected, satisfied)
+			require.Equal(t, test.index, i)
+		})
+	}
+}
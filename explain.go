@@ -0,0 +1,201 @@
+package driplang
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Explanation describes how an expression was evaluated. Its tree mirrors the
+// tree of the expression, making it possible to see why an expression was or
+// wasn't satisfied.
+type Explanation struct {
+	// Expression is the textual form of the evaluated expression.
+	Expression string `json:"expression"`
+
+	// Operator is the name of the expression's root operator, as used by
+	// Marshal.
+	Operator string `json:"operator"`
+
+	Satisfied bool `json:"satisfied"`
+
+	// TimeAfter reports whether the events satisfying the expression all
+	// happened after MustBeAfter. For expressions satisfied without events,
+	// e.g. by NOT, it reports whether the time of evaluation is after
+	// MustBeAfter.
+	TimeAfter bool `json:"time_after"`
+
+	// MustBeAfter is the point in time the expression was evaluated against,
+	// e.g. the time of the event satisfying Then.A. It's nil for expressions
+	// not bound by one.
+	MustBeAfter *time.Time `json:"must_be_after,omitempty"`
+
+	// Index is the index of the event that satisfied the expression, or -1 if
+	// none did.
+	Index int `json:"index"`
+
+	// Indices are the indices of all events the expression matched, including
+	// those matched by its sub-expressions, in ascending order.
+	Indices []int `json:"indices"`
+
+	// Occurrences are the indices of the occurrences of the expression found
+	// by an operator counting them, such as Count, in ascending order. The
+	// rest of the explanation is that of finding the first of them.
+	Occurrences []int `json:"occurrences,omitempty"`
+
+	Children []*Explanation `json:"children,omitempty"`
+
+	// firstAttempt holds the children of the first attempt at evaluating
+	// Then, which is kept if no attempt succeeds.
+	firstAttempt []*Explanation
+}
+
+// Explain evaluates e like Evaluate, and returns an explanation of the
+// evaluation.
+func Explain(e Expr, events []Event) *Explanation {
+	return ExplainAt(e, events, SystemClock.Now())
+}
+
+// ExplainAt evaluates e like EvaluateAt, and returns an explanation of the
+// evaluation.
+func ExplainAt(e Expr, events []Event, now time.Time) *Explanation {
+	root := &Explanation{}
+	ev := evaluator{events: events, now: now, trace: root}
+	ev.evaluate(e, 0, len(events), minTime)
+	return root.Children[0]
+}
+
+// explain evaluates e and records the evaluation as a child of ev.trace.
+func (ev *evaluator) explain(e Expr, lo, hi int, mustBeAfter time.Time) (int, bool, bool) {
+	node := &Explanation{
+		Expression: e.Expression(),
+		Operator:   operatorName(e),
+		Indices:    []int{},
+	}
+	if mustBeAfter != minTime {
+		node.MustBeAfter = &mustBeAfter
+	}
+
+	parent := ev.trace
+	parent.Children = append(parent.Children, node)
+
+	ev.trace = node
+	i, satisfied, timeAfter := ev.evaluateExpr(e, lo, hi, mustBeAfter)
+	ev.trace = parent
+
+	if !satisfied && node.firstAttempt != nil {
+		node.Children = node.firstAttempt
+	}
+	node.firstAttempt = nil
+
+	node.Satisfied = satisfied
+	node.TimeAfter = timeAfter
+	node.Index = i
+	if satisfied {
+		if i >= 0 {
+			node.Indices = append(node.Indices, i)
+		}
+		for _, child := range node.Children {
+			if child.Satisfied {
+				node.Indices = append(node.Indices, child.Indices...)
+			}
+		}
+		slices.Sort(node.Indices)
+		node.Indices = slices.Compact(node.Indices)
+	}
+
+	return i, satisfied, timeAfter
+}
+
+// retrace discards the explanation of the previous attempt at evaluating the
+// children of the current node, used when evaluating Then.
+func (ev *evaluator) retrace() {
+	if ev.trace == nil || len(ev.trace.Children) == 0 {
+		return
+	}
+
+	if ev.trace.firstAttempt == nil {
+		ev.trace.firstAttempt = ev.trace.Children
+	}
+	ev.trace.Children = nil
+}
+
+// mark returns the number of children of the node currently being explained,
+// for use with mergeOccurrences and mergeAttempts, or -1 if not explaining.
+func (ev *evaluator) mark() int {
+	if ev.trace == nil {
+		return -1
+	}
+	return len(ev.trace.Children)
+}
+
+// mergeOccurrences replaces the children of the current node added since mark,
+// which are attempts at finding the occurrences of the same operand, one after
+// the other, by the first of them. It's annotated with the occurrences found,
+// and the events matched by them, keeping the tree mirroring the expression.
+func (ev *evaluator) mergeOccurrences(mark int) {
+	if mark < 0 || len(ev.trace.Children) <= mark {
+		return
+	}
+
+	attempts := ev.trace.Children[mark:]
+	merged := attempts[0]
+	for _, attempt := range attempts {
+		if attempt.Satisfied && attempt.TimeAfter && attempt.Index >= 0 {
+			merged.Occurrences = append(merged.Occurrences, attempt.Index)
+			merged.Indices = append(merged.Indices, attempt.Indices...)
+		}
+	}
+	slices.Sort(merged.Indices)
+	merged.Indices = slices.Compact(merged.Indices)
+
+	ev.trace.Children = append(ev.trace.Children[:mark], merged)
+}
+
+// mergeAttempts replaces the children of the current node added since mark,
+// which are attempts at evaluating the same operand, by the one that satisfied
+// it, which is the last of them, or by the first if none did, like Then does
+// for the prefixes of the events.
+func (ev *evaluator) mergeAttempts(mark int) {
+	if mark < 0 || len(ev.trace.Children) <= mark {
+		return
+	}
+
+	attempts := ev.trace.Children[mark:]
+	kept := attempts[0]
+	if last := attempts[len(attempts)-1]; last.Satisfied {
+		kept = last
+	}
+	ev.trace.Children = append(ev.trace.Children[:mark], kept)
+}
+
+// String returns the explanation as indented text, one line per node.
+func (x *Explanation) String() string {
+	sb := strings.Builder{}
+	x.write(&sb, 0)
+	return sb.String()
+}
+
+func (x *Explanation) write(sb *strings.Builder, indent int) {
+	status := "not satisfied"
+	if x.Satisfied {
+		status = "satisfied"
+	}
+
+	fmt.Fprintf(sb, "%s%s: %s", strings.Repeat("  ", indent), x.Expression, status)
+	if len(x.Indices) > 0 {
+		fmt.Fprintf(sb, ", events %v", x.Indices)
+	}
+	if len(x.Occurrences) > 0 {
+		fmt.Fprintf(sb, ", occurrences %v", x.Occurrences)
+	}
+	if x.MustBeAfter != nil {
+		fmt.Fprintf(sb, ", must be after %s (time after: %t)", x.MustBeAfter.Format(time.RFC3339Nano), x.TimeAfter)
+	}
+	sb.WriteString("\n")
+
+	for _, child := range x.Children {
+		child.write(sb, indent+1)
+	}
+}
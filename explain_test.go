@@ -0,0 +1,318 @@
+package driplang_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/micvbang/driplang"
+	"github.com/micvbang/go-helpy/timey"
+	"github.com/stretchr/testify/require"
+)
+
+// TestExplain verifies that Explain returns a tree mirroring the expression,
+// recording the outcome of every sub-expression.
+func TestExplain(t *testing.T) {
+	const (
+		signup   = "signup"
+		purchase = "purchase"
+		visit    = "visit"
+	)
+
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	events := []driplang.Event{
+		{Name: visit, Time: start},
+		{Name: signup, Time: timey.AddHours(start, 1)},
+		{Name: visit, Time: timey.AddHours(start, 2)},
+		{Name: purchase, Time: timey.AddHours(start, 30)},
+	}
+
+	expr := driplang.Then{
+		A: driplang.EventName(signup),
+		B: driplang.And{
+			A: driplang.EventName(visit),
+			B: driplang.After{
+				A: driplang.EventName(purchase),
+				D: driplang.Duration(24 * time.Hour),
+			},
+		},
+	}
+
+	got := driplang.ExplainAt(expr, events, timey.AddHours(start, 48))
+
+	signupTime := events[1].Time
+	afterTime := signupTime.Add(24 * time.Hour)
+	expected := &driplang.Explanation{
+		Expression: expr.Expression(),
+		Operator:   "then",
+		Satisfied:  true,
+		TimeAfter:  true,
+		Index:      3,
+		Indices:    []int{1, 2, 3},
+		Children: []*driplang.Explanation{
+			{
+				Expression: `"signup"`,
+				Operator:   "event_name",
+				Satisfied:  true,
+				TimeAfter:  true,
+				Index:      1,
+				Indices:    []int{1},
+			},
+			{
+				Expression:  expr.B.Expression(),
+				Operator:    "and",
+				Satisfied:   true,
+				TimeAfter:   true,
+				MustBeAfter: &signupTime,
+				Index:       3,
+				Indices:     []int{2, 3},
+				Children: []*driplang.Explanation{
+					{
+						Expression:  `"visit"`,
+						Operator:    "event_name",
+						Satisfied:   true,
+						TimeAfter:   true,
+						MustBeAfter: &signupTime,
+						Index:       2,
+						Indices:     []int{2},
+					},
+					{
+						Expression:  `("purchase" AFTER 24h0m0s)`,
+						Operator:    "after",
+						Satisfied:   true,
+						TimeAfter:   true,
+						MustBeAfter: &signupTime,
+						Index:       3,
+						Indices:     []int{3},
+						Children: []*driplang.Explanation{
+							{
+								Expression:  `"purchase"`,
+								Operator:    "event_name",
+								Satisfied:   true,
+								TimeAfter:   true,
+								MustBeAfter: &afterTime,
+								Index:       3,
+								Indices:     []int{3},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	require.Equal(t, expected, got)
+	require.Equal(t, driplang.EvaluateAt(expr, events, timey.AddHours(start, 48)), got.Satisfied)
+}
+
+// TestExplainNotSatisfied verifies that explanations of unsatisfied
+// expressions show which sub-expression failed, and that unsatisfied Then
+// expressions are explained by their first attempt, which considers all
+// events.
+func TestExplainNotSatisfied(t *testing.T) {
+	const (
+		signup   = "signup"
+		purchase = "purchase"
+	)
+
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	events := []driplang.Event{
+		{Name: signup, Time: start},
+		{Name: purchase, Time: timey.AddHours(start, 2)},
+	}
+
+	expr := driplang.Then{
+		A: driplang.EventName(signup),
+		B: driplang.After{
+			A: driplang.Not{A: driplang.EventName(purchase)},
+			D: driplang.Duration(72 * time.Hour),
+		},
+	}
+
+	got := driplang.ExplainAt(expr, events, timey.AddHours(start, 100))
+	require.False(t, got.Satisfied)
+	require.Empty(t, got.Indices)
+	require.Len(t, got.Children, 2)
+	require.True(t, got.Children[0].Satisfied)
+	require.Equal(t, 0, got.Children[0].Index)
+
+	after := got.Children[1]
+	require.False(t, after.Satisfied)
+	require.False(t, after.Children[0].Satisfied)
+	require.Equal(t, 1, after.Children[0].Children[0].Index)
+
+	require.Equal(t, `("signup" THEN ((NOT "purchase") AFTER 72h0m0s)): not satisfied
+  "signup": satisfied, events [0]
+  ((NOT "purchase") AFTER 72h0m0s): not satisfied, must be after 2024-03-01T12:00:00Z (time after: false)
+    (NOT "purchase"): not satisfied, must be after 2024-03-04T12:00:00Z (time after: false)
+      "purchase": satisfied, events [1], must be after 2024-03-04T12:00:00Z (time after: false)
+`, got.String())
+}
+
+// TestExplainJSON verifies that explanations can be rendered as JSON.
+func TestExplainJSON(t *testing.T) {
+	events := []driplang.Event{
+		{Name: "a", Time: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+	}
+	expr := driplang.Or{
+		A: driplang.EventName("a"),
+		B: driplang.EventName("b"),
+	}
+
+	bs, err := json.Marshal(driplang.Explain(expr, events))
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"expression": "(\"a\" OR \"b\")",
+		"operator": "or",
+		"satisfied": true,
+		"time_after": true,
+		"index": 0,
+		"indices": [0],
+		"children": [
+			{"expression": "\"a\"", "operator": "event_name", "satisfied": true, "time_after": true, "index": 0, "indices": [0]},
+			{"expression": "\"b\"", "operator": "event_name", "satisfied": false, "time_after": true, "index": -1, "indices": []}
+		]
+	}`, string(bs))
+}
+
+// TestExplainCount verifies that the attempts at finding the occurrences of
+// the operand of Count are explained by a single child, annotated with the
+// occurrences found.
+func TestExplainCount(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	events := []driplang.Event{
+		{Name: "a", Time: start},
+		{Name: "b", Time: timey.AddHours(start, 1)},
+		{Name: "a", Time: timey.AddHours(start, 2)},
+		{Name: "a", Time: timey.AddHours(start, 3)},
+		{Name: "a", Time: timey.AddHours(start, 4)},
+		{Name: "a", Time: timey.AddHours(start, 5)},
+	}
+
+	expr := driplang.Count{A: driplang.EventName("a"), Op: driplang.OpGreaterOrEqual, N: 10}
+	got := driplang.ExplainAt(expr, events, timey.AddHours(start, 48))
+	require.False(t, got.Satisfied)
+	require.Len(t, got.Children, 1)
+	require.Equal(t, []int{0, 2, 3, 4, 5}, got.Children[0].Occurrences)
+	require.Equal(t, []int{0, 2, 3, 4, 5}, got.Children[0].Indices)
+
+	expr.N = 3
+	got = driplang.ExplainAt(expr, events, timey.AddHours(start, 48))
+	require.True(t, got.Satisfied)
+	require.Equal(t, []int{0, 2, 3}, got.Indices)
+	require.Equal(t, `COUNT("a") >= 3: satisfied, events [0 2 3]
+  "a": satisfied, events [0 2 3], occurrences [0 2 3]
+`, got.String())
+}
+
+// TestExplainWindow verifies that the attempts at finding the occurrences of
+// the operand of Window are explained by a single child, annotated with the
+// occurrences found until the window was satisfied.
+func TestExplainWindow(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	events := []driplang.Event{
+		{Name: "login_failed", Time: start},
+		{Name: "login_failed", Time: timey.AddHours(start, 5)},
+		{Name: "login_failed", Time: timey.AddHours(start, 6)},
+		{Name: "login_failed", Time: timey.AddHours(start, 7)},
+		{Name: "login_failed", Time: timey.AddHours(start, 20)},
+	}
+
+	expr := driplang.Window{A: driplang.EventName("login_failed"), N: 3, D: driplang.Duration(2 * time.Hour)}
+	got := driplang.ExplainAt(expr, events, timey.AddHours(start, 48))
+	require.True(t, got.Satisfied)
+	require.Equal(t, 3, got.Index)
+	require.Len(t, got.Children, 1)
+	require.Equal(t, []int{0, 1, 2, 3}, got.Children[0].Occurrences)
+
+	expr.N = 5
+	got = driplang.ExplainAt(expr, events, timey.AddHours(start, 48))
+	require.False(t, got.Satisfied)
+	require.Len(t, got.Children, 1)
+	require.Equal(t, []int{0, 1, 2, 3, 4}, got.Children[0].Occurrences)
+}
+
+// TestExplainSince verifies that the attempts at finding the latest occurrence
+// of the operand of Since are explained by a single child, annotated with the
+// occurrences found.
+func TestExplainSince(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	events := []driplang.Event{
+		{Name: "login", Time: start},
+		{Name: "login", Time: timey.AddHours(start, 24)},
+		{Name: "visit", Time: timey.AddHours(start, 30)},
+		{Name: "login", Time: timey.AddHours(start, 48)},
+	}
+
+	expr := driplang.Since{A: driplang.EventName("login"), D: driplang.Duration(24 * time.Hour)}
+	got := driplang.ExplainAt(expr, events, timey.AddHours(start, 72))
+	require.True(t, got.Satisfied)
+	require.Equal(t, 3, got.Index)
+	require.Len(t, got.Children, 1)
+	require.Equal(t, []int{0, 1, 3}, got.Children[0].Occurrences)
+	require.Equal(t, `("login" SINCE 24h0m0s): satisfied, events [0 1 3]
+  "login": satisfied, events [0 1 3], occurrences [0 1 3]
+`, got.String())
+}
+
+// TestExplainThenStrategy verifies that Then using a strategy is explained by
+// one child for each of its operands: one annotated with the occurrences of
+// A, and the attempt at B that satisfied it, or the first if none did.
+func TestExplainThenStrategy(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	events := []driplang.Event{
+		{Name: "a", Time: start},
+		{Name: "a", Time: timey.AddHours(start, 1)},
+		{Name: "b", Time: timey.AddHours(start, 2)},
+		{Name: "a", Time: timey.AddHours(start, 3)},
+		{Name: "a", Time: timey.AddHours(start, 4)},
+		{Name: "c", Time: timey.AddHours(start, 5)},
+	}
+	now := timey.AddHours(start, 48)
+
+	expr := driplang.Then{A: driplang.EventName("a"), B: driplang.EventName("c"), Strategy: driplang.ThenAny}
+	got := driplang.ExplainAt(expr, events, now)
+	require.True(t, got.Satisfied)
+	require.Len(t, got.Children, 2)
+	require.Equal(t, []int{0, 1, 3, 4}, got.Children[0].Occurrences)
+	require.True(t, got.Children[1].Satisfied)
+	require.Equal(t, 5, got.Children[1].Index)
+
+	expr.B = driplang.After{A: driplang.EventName("c"), D: driplang.Duration(6 * time.Hour)}
+	got = driplang.ExplainAt(expr, events, now)
+	require.False(t, got.Satisfied)
+	require.Len(t, got.Children, 2)
+	require.Equal(t, []int{0, 1, 3, 4}, got.Children[0].Occurrences)
+	require.False(t, got.Children[1].Satisfied)
+	require.Equal(t, events[0].Time, *got.Children[1].MustBeAfter)
+
+	expr.A = driplang.Not{A: driplang.EventName("d")}
+	got = driplang.ExplainAt(expr, events, now)
+	require.Len(t, got.Children, 2)
+	require.True(t, got.Children[0].Satisfied)
+	require.Empty(t, got.Children[0].Occurrences)
+}
+
+// TestExplainDuring verifies that the attempts at finding an occurrence of the
+// operand of During within its window are explained by a single child,
+// annotated with the occurrences tried.
+func TestExplainDuring(t *testing.T) {
+	start := time.Date(2024, 3, 1, 6, 0, 0, 0, time.UTC)
+	events := []driplang.Event{
+		{Name: "a", Time: start},
+		{Name: "a", Time: timey.AddHours(start, 1)},
+		{Name: "a", Time: timey.AddHours(start, 4)},
+		{Name: "a", Time: timey.AddHours(start, 5)},
+	}
+
+	expr := driplang.During{
+		A:    driplang.EventName("a"),
+		From: driplang.Duration(9 * time.Hour),
+		To:   driplang.Duration(17 * time.Hour),
+		Zone: "UTC",
+	}
+	got := driplang.ExplainAt(expr, events, timey.AddHours(start, 48))
+	require.True(t, got.Satisfied)
+	require.Equal(t, 2, got.Index)
+	require.Len(t, got.Children, 1)
+	require.Equal(t, []int{0, 1, 2}, got.Children[0].Occurrences)
+}
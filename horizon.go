@@ -0,0 +1,227 @@
+package driplang
+
+import "time"
+
+// Horizon returns how far back from the time of evaluation events are needed
+// to evaluate e as they arrive, given whether the older events satisfied it,
+// as Matcher does when it keeps events. For example, the horizon of
+// `"purchase" THEN ANY ("refund" WITHIN 24h)` is 24 hours. It returns false if
+// the horizon is unbounded, e.g. for NOT and COUNT.
+func Horizon(e Expr) (time.Duration, bool) {
+	switch v := e.(type) {
+	case EventName, Where:
+		return 0, true
+
+	case Or:
+		return maxHorizon(Horizon, v.A, v.B)
+
+	case AnyOf:
+		return maxHorizon(Horizon, v.Exprs...)
+
+	case AllOf:
+		if len(v.Exprs) == 1 {
+			return Horizon(v.Exprs[0])
+		}
+
+	case AtLeast:
+		if v.K == 1 {
+			return maxHorizon(Horizon, v.Exprs...)
+		}
+
+	case AfterTime:
+		return Horizon(v.A)
+
+	case BeforeTime:
+		return Horizon(v.A)
+
+	case During:
+		if singleEvent(v.A) {
+			return 0, true
+		}
+
+	case On:
+		if singleEvent(v.A) {
+			return 0, true
+		}
+
+	case Window:
+		if singleEvent(v.A) && v.D >= 0 {
+			return time.Duration(v.D), true
+		}
+
+	case Then:
+		// Every occurrence of A is tried, and each of them is an event of
+		// its own.
+		if v.Strategy == ThenAny && singleEvent(v.A) {
+			return reach(v.B, 0, false)
+		}
+	}
+	return 0, false
+}
+
+// reach returns how long after the time that e is evaluated relative to, e.g.
+// that of the event satisfying Then.A when e is Then.B, the events that can
+// change the result of evaluating e can be, and the passing of time can. If
+// limited, the events are known to be no later than limit after that time,
+// e.g. within WITHIN. It returns false if that's unbounded.
+func reach(e Expr, limit time.Duration, limited bool) (time.Duration, bool) {
+	switch v := e.(type) {
+	case EventName, Where:
+		return limit, limited
+
+	case Within:
+		return reachWindow(v.A, 0, time.Duration(v.D), limit, limited)
+
+	case Between:
+		return reachWindow(v.A, time.Duration(v.Min), time.Duration(v.Max), limit, limited)
+
+	case After:
+		if v.Anchor != (Anchor{}) {
+			break
+		}
+
+		// A is evaluated relative to D later, but its events are still
+		// limited like the After's.
+		r, ok := reach(v.A, limit, limited)
+		return addReach(max(time.Duration(v.D), 0), r, ok)
+
+	case Then:
+		a, aOk := reach(v.A, limit, limited)
+		b, bOk := reach(v.B, limit, limited)
+		return addReach(a, b, aOk && bOk)
+
+	case Since:
+		// The result changes when D has passed since the latest occurrence
+		// of A.
+		r, ok := reach(v.A, limit, limited)
+		return addReach(r, max(time.Duration(v.D), 0), ok)
+
+	case Not:
+		return reach(v.A, limit, limited)
+
+	case And:
+		return maxReach(limit, limited, v.A, v.B)
+
+	case Or:
+		return maxReach(limit, limited, v.A, v.B)
+
+	case AnyOf:
+		return maxReach(limit, limited, v.Exprs...)
+
+	case AllOf:
+		return maxReach(limit, limited, v.Exprs...)
+
+	case AtLeast:
+		return maxReach(limit, limited, v.Exprs...)
+
+	case Count:
+		return reach(v.A, limit, limited)
+
+	case Window:
+		return reach(v.A, limit, limited)
+
+	case AfterTime:
+		return reach(v.A, limit, limited)
+
+	case BeforeTime:
+		return reach(v.A, limit, limited)
+
+	case During:
+		return reach(v.A, limit, limited)
+
+	case On:
+		return reach(v.A, limit, limited)
+	}
+	return 0, false
+}
+
+// reachWindow returns the reach of e within a window from `from` until `to`
+// after the time it's evaluated relative to. Like for After, e is evaluated
+// relative to the start of the window, and the window closes at its end.
+func reachWindow(e Expr, from, to, limit time.Duration, limited bool) (time.Duration, bool) {
+	from, to = max(from, 0), max(to, 0)
+	if !limited || to < limit {
+		limit = to
+	}
+
+	r, ok := reach(e, max(limit-from, 0), true)
+	r, ok = addReach(from, r, ok)
+	if !ok {
+		return 0, false
+	}
+	return max(r, to), true
+}
+
+// maxReach returns the maximum reach of exprs.
+func maxReach(limit time.Duration, limited bool, exprs ...Expr) (time.Duration, bool) {
+	return maxHorizon(func(e Expr) (time.Duration, bool) {
+		return reach(e, limit, limited)
+	}, exprs...)
+}
+
+// addReach returns a+b, if ok and it doesn't overflow.
+func addReach(a, b time.Duration, ok bool) (time.Duration, bool) {
+	if !ok || a+b < a {
+		return 0, false
+	}
+	return a + b, true
+}
+
+// maxHorizon returns the maximum of fn for exprs, or false if fn returns
+// false for any of them.
+func maxHorizon(fn func(Expr) (time.Duration, bool), exprs ...Expr) (time.Duration, bool) {
+	if len(exprs) == 0 {
+		return 0, false
+	}
+
+	var d time.Duration
+	for _, e := range exprs {
+		ed, ok := fn(e)
+		if !ok {
+			return 0, false
+		}
+		d = max(d, ed)
+	}
+	return d, true
+}
+
+// singleEvent reports whether every occurrence of e is a single event that
+// satisfies it on its own, regardless of the other events, when e isn't
+// evaluated relative to a time.
+func singleEvent(e Expr) bool {
+	switch v := e.(type) {
+	case EventName, Where:
+		return true
+	case Or:
+		return singleEvent(v.A) && singleEvent(v.B)
+	case AnyOf:
+		for _, e := range v.Exprs {
+			if !singleEvent(e) {
+				return false
+			}
+		}
+		return len(v.Exprs) > 0
+	case AfterTime:
+		return singleEvent(v.A)
+	case BeforeTime:
+		return singleEvent(v.A)
+	case During:
+		return singleEvent(v.A)
+	case On:
+		return singleEvent(v.A)
+	default:
+		return false
+	}
+}
+
+// RelevantNames returns the names of the events that can change the result of
+// evaluating e, i.e. Names(e), so that other events can be left out, except
+// for the first event, which marks the start of history for SINCE. It returns
+// false if events of any name can change the result, e.g. for a strict SEQ.
+func RelevantNames(e Expr) ([]string, bool) {
+	program, err := Compile(e)
+	if err != nil || program.allEvents {
+		return nil, false
+	}
+	return Names(e), true
+}
@@ -0,0 +1,233 @@
+package driplang_test
+
+import (
+	"encoding/json"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/micvbang/driplang"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHorizon verifies that Horizon returns how long before the time of
+// evaluation the events satisfying expressions can be, and false if that's
+// unbounded.
+func TestHorizon(t *testing.T) {
+	a, b := driplang.EventName("a"), driplang.EventName("b")
+	hours := func(n int) driplang.Duration {
+		return driplang.Duration(time.Duration(n) * time.Hour)
+	}
+
+	tests := map[string]struct {
+		expr    driplang.Expr
+		horizon time.Duration
+		bounded bool
+	}{
+		"event name": {
+			expr:    a,
+			bounded: true,
+		},
+		"after time": {
+			expr:    driplang.AfterTime{A: a, T: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+			bounded: true,
+		},
+		"window": {
+			expr:    driplang.Window{A: a, N: 3, D: hours(2)},
+			horizon: 2 * time.Hour,
+			bounded: true,
+		},
+		"or": {
+			expr:    driplang.Or{A: a, B: driplang.Window{A: b, N: 3, D: hours(2)}},
+			horizon: 2 * time.Hour,
+			bounded: true,
+		},
+		"then any within": {
+			expr:    driplang.Then{A: a, B: driplang.Within{A: b, D: hours(24)}, Strategy: driplang.ThenAny},
+			horizon: 24 * time.Hour,
+			bounded: true,
+		},
+		"then any between": {
+			expr:    driplang.Then{A: a, B: driplang.Between{A: b, Min: hours(1), Max: hours(3)}, Strategy: driplang.ThenAny},
+			horizon: 3 * time.Hour,
+			bounded: true,
+		},
+		"then any after": {
+			expr: driplang.Then{A: a, B: driplang.After{A: b, D: hours(1)}, Strategy: driplang.ThenAny},
+		},
+		"then": {
+			expr: driplang.Then{A: a, B: driplang.Within{A: b, D: hours(24)}},
+		},
+		"within": {
+			expr: driplang.Within{A: a, D: hours(24)},
+		},
+		"not": {
+			expr: driplang.Not{A: a},
+		},
+		"and": {
+			expr: driplang.And{A: a, B: b},
+		},
+		"count": {
+			expr: driplang.Count{A: a, Op: driplang.OpGreaterOrEqual, N: 2},
+		},
+		"since": {
+			expr: driplang.Since{A: a, D: hours(1)},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			horizon, bounded := driplang.Horizon(test.expr)
+			require.Equal(t, test.bounded, bounded)
+			require.Equal(t, test.horizon, horizon)
+		})
+	}
+}
+
+// TestRelevantNames verifies that RelevantNames returns the names of the
+// events that can change results, and false if events of any name can.
+func TestRelevantNames(t *testing.T) {
+	a, b := driplang.EventName("a"), driplang.EventName("b")
+
+	tests := map[string]struct {
+		expr     driplang.Expr
+		names    []string
+		relevant bool
+	}{
+		"then": {
+			expr:     driplang.Then{A: b, B: driplang.Not{A: a}},
+			names:    []string{"b", "a"},
+			relevant: true,
+		},
+		"relaxed seq": {
+			expr:     driplang.Seq{Steps: []driplang.Expr{a, b}, Relaxed: true},
+			names:    []string{"a", "b"},
+			relevant: true,
+		},
+		"since within then": {
+			expr:     driplang.Then{A: b, B: driplang.Since{A: a, D: driplang.Duration(time.Hour)}},
+			names:    []string{"b", "a"},
+			relevant: true,
+		},
+		"after named anchor": {
+			expr:     driplang.After{A: a, D: driplang.Duration(time.Hour), Anchor: driplang.Anchor{Kind: driplang.AnchorLast, Name: b}},
+			names:    []string{"b", "a"},
+			relevant: true,
+		},
+		"since": {
+			expr:     driplang.Since{A: a, D: driplang.Duration(time.Hour)},
+			names:    []string{"a"},
+			relevant: true,
+		},
+		"strict seq": {
+			expr: driplang.Seq{Steps: []driplang.Expr{a, b}},
+		},
+		"strict seq within then": {
+			expr: driplang.Then{A: a, B: driplang.Seq{Steps: []driplang.Expr{a, b}}},
+		},
+		"then within then": {
+			expr: driplang.Then{A: a, B: driplang.Then{A: driplang.Not{A: a}, B: b}},
+		},
+		"after first event within then": {
+			expr: driplang.Then{A: b, B: driplang.After{A: a, D: driplang.Duration(time.Hour), Anchor: driplang.Anchor{Kind: driplang.AnchorFirst}}},
+		},
+		"after latest event": {
+			expr: driplang.After{A: a, D: driplang.Duration(time.Hour), Anchor: driplang.Anchor{Kind: driplang.AnchorLast}},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			names, relevant := driplang.RelevantNames(test.expr)
+			require.Equal(t, test.relevant, relevant)
+			require.Equal(t, test.names, names)
+		})
+	}
+}
+
+// TestRelevantNamesEqualsEvaluate verifies that leaving out events that
+// aren't relevant, except for the first one, doesn't change results, for
+// random expressions and event histories.
+func TestRelevantNamesEqualsEvaluate(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	names := []string{"a", "b", "c"}
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for run := 0; run < 5000; run++ {
+		expr := randomExpr(rng, names, 4)
+		events := randomEvents(rng, append(names, "d"), start, rng.Intn(12))
+		now := start.Add(time.Duration(rng.Intn(48)) * time.Hour)
+
+		relevantNames, ok := driplang.RelevantNames(expr)
+		if !ok {
+			continue
+		}
+
+		var relevant []driplang.Event
+		for i, event := range events {
+			for _, name := range relevantNames {
+				if i == 0 || event.Name == name {
+					relevant = append(relevant, event)
+					break
+				}
+			}
+		}
+		require.Equal(t, driplang.EvaluateAt(expr, events, now), driplang.EvaluateAt(expr, relevant, now), "%s %v", expr.Expression(), events)
+	}
+}
+
+// TestHorizonEqualsEvaluate verifies that a Matcher keeping the events within
+// the horizon before the time of evaluation, and whether the older ones
+// satisfied the expression, gives the same results as evaluating it against
+// every event, for random expressions and event histories.
+func TestHorizonEqualsEvaluate(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	names := []string{"a", "b", "c"}
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	bounded := 0
+	for run := 0; run < 5000; run++ {
+		expr := randomExpr(rng, names, 4)
+		if rng.Intn(2) == 0 {
+			expr = driplang.Then{
+				A:        randomExpr(rng, names, 1),
+				B:        driplang.Within{A: expr, D: driplang.Duration(time.Duration(rng.Intn(6)) * time.Hour)},
+				Strategy: driplang.ThenAny,
+			}
+		}
+
+		horizon, ok := driplang.Horizon(expr)
+		if !ok {
+			continue
+		}
+		bounded++
+
+		m, err := driplang.NewMatcher(expr)
+		require.NoError(t, err)
+
+		events := randomEvents(rng, names, start, rng.Intn(12))
+		for i, event := range events {
+			_, err := m.Observe(event)
+			require.NoError(t, err)
+			require.Equal(t, driplang.EvaluateAt(expr, events[:i+1], event.Time), m.Satisfied(), "%s %v", expr.Expression(), events[:i+1])
+
+			// Events whose names aren't used don't cause a re-evaluation,
+			// and leave the kept events as they are.
+			if !slices.Contains(driplang.Names(expr), event.Name) {
+				continue
+			}
+
+			bs, err := json.Marshal(m)
+			require.NoError(t, err)
+			state := struct {
+				Events []driplang.Event `json:"events"`
+			}{}
+			require.NoError(t, json.Unmarshal(bs, &state))
+			for _, kept := range state.Events {
+				require.False(t, kept.Time.Before(event.Time.Add(-horizon)), "%s %v", expr.Expression(), events[:i+1])
+			}
+		}
+	}
+	require.NotZero(t, bounded)
+}
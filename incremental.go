@@ -0,0 +1,881 @@
+package driplang
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+)
+
+// node evaluates an expression as events arrive, keeping a summary of them
+// instead of the events themselves. Like evaluator.evaluate, a node is
+// evaluated relative to a time its events must not be before, and is given
+// the events of its range, e.g. those following the event satisfying Then.A,
+// one at a time.
+//
+// Nodes are stored by marshalling them to JSON, and restored by unmarshalling
+// into the nodes built for the same expression.
+type node interface {
+	// observe adds the event with index i to the events of the node.
+	observe(i int, event Event)
+
+	// evaluate returns the result of evaluating the node at ev.now, like
+	// evaluator.evaluate does for the events observed. It doesn't change the
+	// node.
+	evaluate(ev *evaluator) (evsIndex int, satisfied, timeAfter bool)
+
+	// final reports whether the result of evaluate is the same at any time
+	// after now, regardless of the events observed. It may return false for
+	// a result that can't change.
+	final(now time.Time) bool
+}
+
+// incremental reports whether e can be evaluated using nodes. That's the
+// case unless e uses Seq, AFTER anchored to the latest event or to the first
+// event with a name, or operators finding the occurrences of an expression,
+// e.g. THEN and COUNT, for one that isn't a predicate; see predicate.
+func incremental(e Expr) bool {
+	switch v := e.(type) {
+	case EventName, Where:
+		return true
+	case Not:
+		return incremental(v.A)
+	case And:
+		return incremental(v.A) && incremental(v.B)
+	case Or:
+		return incremental(v.A) && incremental(v.B)
+	case AnyOf:
+		return allIncremental(v.Exprs)
+	case AllOf:
+		return allIncremental(v.Exprs)
+	case AtLeast:
+		return allIncremental(v.Exprs)
+	case AfterTime:
+		return incremental(v.A)
+	case BeforeTime:
+		return incremental(v.A)
+	case Within:
+		return incremental(v.A)
+	case Between:
+		return incremental(v.A)
+	case After:
+		return (v.Anchor == Anchor{} || v.Anchor == Anchor{Kind: AnchorFirst}) && incremental(v.A)
+	case Count:
+		return isPredicate(v.A)
+	case Window:
+		return isPredicate(v.A)
+	case Since:
+		return isPredicate(v.A)
+	case During:
+		return isPredicate(v.A)
+	case On:
+		return isPredicate(v.A)
+	case Then:
+		return isPredicate(v.A) && incremental(v.B)
+	default:
+		return false
+	}
+}
+
+func allIncremental(exprs []Expr) bool {
+	for _, e := range exprs {
+		if !incremental(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// predicate returns the function reporting whether an event satisfies e on
+// its own, for e being an event name or WHERE, possibly limited to times
+// using AFTER, BEFORE, DURING and ON. The occurrences of e, see
+// evaluator.occurrence, are then the events satisfying it that aren't before
+// the time e is evaluated relative to. strict reports whether e uses DURING
+// or ON, which, unlike event names, aren't satisfied by earlier events when
+// there are no occurrences.
+func predicate(e Expr) (matches func(Event) bool, strict bool) {
+	switch v := e.(type) {
+	case EventName:
+		return func(event Event) bool { return event.Name == string(v) }, false
+
+	case Where:
+		return v.matches, false
+
+	case AfterTime:
+		matches, strict := predicate(v.A)
+		if matches == nil {
+			return nil, false
+		}
+		return func(event Event) bool { return event.Time.After(v.T) && matches(event) }, strict
+
+	case BeforeTime:
+		matches, strict := predicate(v.A)
+		if matches == nil {
+			return nil, false
+		}
+		return func(event Event) bool { return event.Time.Before(v.T) && matches(event) }, strict
+
+	case During:
+		matches, _ := predicate(v.A)
+		if matches == nil {
+			return nil, false
+		}
+		return func(event Event) bool { return v.matches(event.Time) && matches(event) }, true
+
+	case On:
+		matches, _ := predicate(v.A)
+		if matches == nil {
+			return nil, false
+		}
+		return func(event Event) bool { return v.matches(event.Time) && matches(event) }, true
+
+	default:
+		return nil, false
+	}
+}
+
+// isPredicate reports whether e is a predicate; see predicate.
+func isPredicate(e Expr) bool {
+	matches, _ := predicate(e)
+	return matches != nil
+}
+
+// occurs returns the function reporting whether an event is an occurrence of
+// the predicate e evaluated relative to mustBeAfter.
+func occurs(e Expr, mustBeAfter time.Time) func(Event) bool {
+	matches, _ := predicate(e)
+	return func(event Event) bool {
+		return !event.Time.Before(mustBeAfter) && matches(event)
+	}
+}
+
+// history is shared by the nodes evaluating an expression.
+type history struct {
+	// start is the time of the first event, which marks the start of
+	// history for Since; zero if there are no events.
+	start time.Time
+}
+
+// node returns the node evaluating e relative to mustBeAfter, for e that is
+// incremental.
+func (h *history) node(e Expr, mustBeAfter time.Time) node {
+	switch v := e.(type) {
+	case EventName:
+		return newEventNode(func(event Event) bool { return event.Name == string(v) }, mustBeAfter)
+
+	case Where:
+		return newEventNode(v.matches, mustBeAfter)
+
+	case Not:
+		return &notNode{window: isWindow(v.A), A: h.node(v.A, mustBeAfter)}
+
+	case And:
+		return &binaryNode{combine: combineAnd, A: h.node(v.A, mustBeAfter), B: h.node(v.B, mustBeAfter)}
+
+	case Or:
+		return &binaryNode{combine: combineOr, A: h.node(v.A, mustBeAfter), B: h.node(v.B, mustBeAfter)}
+
+	case AnyOf:
+		return &naryNode{combine: evaluateAnyOf, Exprs: h.nodes(v.Exprs, mustBeAfter)}
+
+	case AllOf:
+		return &naryNode{combine: evaluateAllOf, Exprs: h.nodes(v.Exprs, mustBeAfter)}
+
+	case AtLeast:
+		combine := func(n int, operand func(i int) (int, bool, bool)) (int, bool, bool) {
+			return evaluateAtLeast(v.K, n, operand)
+		}
+		return &naryNode{combine: combine, Exprs: h.nodes(v.Exprs, mustBeAfter)}
+
+	case AfterTime:
+		return &rangeNode{keep: func(t time.Time) bool { return t.After(v.T) }, A: h.node(v.A, mustBeAfter)}
+
+	case BeforeTime:
+		return &rangeNode{keep: func(t time.Time) bool { return t.Before(v.T) }, A: h.node(v.A, mustBeAfter)}
+
+	case Within:
+		return h.windowNode(v.A, mustBeAfter, 0, v.D)
+
+	case Between:
+		return h.windowNode(v.A, mustBeAfter, v.Min, v.Max)
+
+	case After:
+		if v.Anchor.Kind == AnchorFirst {
+			return &anchoredNode{history: h, after: v}
+		}
+		if mustBeAfter == minTime {
+			return &unsatisfiedNode{}
+		}
+		return &afterNode{A: h.node(v.A, mustBeAfter.Add(time.Duration(v.D)))}
+
+	case Count:
+		// Once the count is above the limits of OpGreater and
+		// OpGreaterOrEqual, further occurrences can't change the result.
+		limit := math.MaxInt
+		switch v.Op {
+		case OpGreater:
+			limit = v.N + 1
+		case OpGreaterOrEqual:
+			limit = v.N
+		}
+		return &countNode{count: v, limit: limit, occurs: occurs(v.A, mustBeAfter), mustBeAfter: mustBeAfter, Last: -1}
+
+	case Window:
+		return &windowCountNode{window: v, occurs: occurs(v.A, mustBeAfter), mustBeAfter: mustBeAfter, Match: -1}
+
+	case Since:
+		return &sinceNode{history: h, since: v, occurs: occurs(v.A, mustBeAfter), mustBeAfter: mustBeAfter, Latest: -1}
+
+	case During:
+		return &filterNode{matches: v.matches, occurs: occurs(v.A, mustBeAfter), mustBeAfter: mustBeAfter, Match: -1}
+
+	case On:
+		return &filterNode{matches: v.matches, occurs: occurs(v.A, mustBeAfter), mustBeAfter: mustBeAfter, Match: -1}
+
+	case Then:
+		return h.thenNode(v, mustBeAfter)
+
+	default:
+		return &unsatisfiedNode{}
+	}
+}
+
+// nodes returns the nodes evaluating exprs relative to mustBeAfter.
+func (h *history) nodes(exprs []Expr, mustBeAfter time.Time) []node {
+	nodes := make([]node, len(exprs))
+	for i, e := range exprs {
+		nodes[i] = h.node(e, mustBeAfter)
+	}
+	return nodes
+}
+
+// unsatisfiedNode is never satisfied, e.g. for After outside Then.B.
+type unsatisfiedNode struct{}
+
+func (n *unsatisfiedNode) observe(i int, event Event) {}
+
+func (n *unsatisfiedNode) evaluate(ev *evaluator) (int, bool, bool) {
+	return -1, false, false
+}
+
+func (n *unsatisfiedNode) final(now time.Time) bool {
+	return true
+}
+
+// eventNode evaluates EventName and Where by keeping their first occurrence,
+// and the first matching event before that; see evaluator.evaluate.
+type eventNode struct {
+	matches     func(Event) bool
+	mustBeAfter time.Time
+
+	First      int `json:"first"`
+	FirstAfter int `json:"first_after"`
+}
+
+func newEventNode(matches func(Event) bool, mustBeAfter time.Time) *eventNode {
+	return &eventNode{matches: matches, mustBeAfter: mustBeAfter, First: -1, FirstAfter: -1}
+}
+
+func (n *eventNode) observe(i int, event Event) {
+	if n.FirstAfter >= 0 || !n.matches(event) {
+		return
+	}
+
+	if n.First < 0 {
+		n.First = i
+	}
+	if !event.Time.Before(n.mustBeAfter) {
+		n.FirstAfter = i
+	}
+}
+
+func (n *eventNode) evaluate(ev *evaluator) (int, bool, bool) {
+	if n.FirstAfter >= 0 {
+		return n.FirstAfter, true, true
+	}
+	if n.First >= 0 {
+		return n.First, true, false
+	}
+	return -1, false, ev.nowAfter(n.mustBeAfter)
+}
+
+func (n *eventNode) final(now time.Time) bool {
+	return n.FirstAfter >= 0
+}
+
+// notNode evaluates Not.
+type notNode struct {
+	window bool
+
+	A node `json:"a"`
+}
+
+func (n *notNode) observe(i int, event Event) {
+	n.A.observe(i, event)
+}
+
+func (n *notNode) evaluate(ev *evaluator) (int, bool, bool) {
+	ai, a, aAfter := n.A.evaluate(ev)
+	return combineNot(n.window, ai, a, aAfter)
+}
+
+func (n *notNode) final(now time.Time) bool {
+	return n.A.final(now)
+}
+
+// binaryNode evaluates And and Or.
+type binaryNode struct {
+	combine func(ai int, a, aAfter bool, bi int, b, bAfter bool) (int, bool, bool)
+
+	A node `json:"a"`
+	B node `json:"b"`
+}
+
+func (n *binaryNode) observe(i int, event Event) {
+	n.A.observe(i, event)
+	n.B.observe(i, event)
+}
+
+func (n *binaryNode) evaluate(ev *evaluator) (int, bool, bool) {
+	ai, a, aAfter := n.A.evaluate(ev)
+	bi, b, bAfter := n.B.evaluate(ev)
+	return n.combine(ai, a, aAfter, bi, b, bAfter)
+}
+
+func (n *binaryNode) final(now time.Time) bool {
+	return n.A.final(now) && n.B.final(now)
+}
+
+// naryNode evaluates AnyOf, AllOf and AtLeast.
+type naryNode struct {
+	combine func(n int, operand func(i int) (int, bool, bool)) (int, bool, bool)
+
+	Exprs []node `json:"exprs"`
+}
+
+func (n *naryNode) observe(i int, event Event) {
+	for _, e := range n.Exprs {
+		e.observe(i, event)
+	}
+}
+
+func (n *naryNode) evaluate(ev *evaluator) (int, bool, bool) {
+	return n.combine(len(n.Exprs), func(i int) (int, bool, bool) {
+		return n.Exprs[i].evaluate(ev)
+	})
+}
+
+func (n *naryNode) final(now time.Time) bool {
+	for _, e := range n.Exprs {
+		if !e.final(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// rangeNode evaluates AfterTime and BeforeTime by only giving A the events
+// whose times they keep.
+type rangeNode struct {
+	keep func(time.Time) bool
+
+	A node `json:"a"`
+}
+
+func (n *rangeNode) observe(i int, event Event) {
+	if n.keep(event.Time) {
+		n.A.observe(i, event)
+	}
+}
+
+func (n *rangeNode) evaluate(ev *evaluator) (int, bool, bool) {
+	return n.A.evaluate(ev)
+}
+
+func (n *rangeNode) final(now time.Time) bool {
+	return n.A.final(now)
+}
+
+// windowNode evaluates Within and Between; see evaluator.evaluateWindow.
+type windowNode struct {
+	end time.Time
+
+	A node `json:"a"`
+}
+
+func (h *history) windowNode(e Expr, mustBeAfter time.Time, from, to Duration) node {
+	if mustBeAfter == minTime {
+		return &unsatisfiedNode{}
+	}
+
+	return &windowNode{
+		end: mustBeAfter.Add(time.Duration(to)),
+		A:   h.node(e, mustBeAfter.Add(time.Duration(from))),
+	}
+}
+
+func (n *windowNode) observe(i int, event Event) {
+	if !event.Time.After(n.end) {
+		n.A.observe(i, event)
+	}
+}
+
+func (n *windowNode) evaluate(ev *evaluator) (int, bool, bool) {
+	ai, a, aAfter := n.A.evaluate(ev)
+	if a && aAfter {
+		return ai, true, true
+	}
+	return -1, false, ev.nowAfter(n.end)
+}
+
+func (n *windowNode) final(now time.Time) bool {
+	return n.A.final(now) && now.After(n.end)
+}
+
+// afterNode evaluates After within Then.B.
+type afterNode struct {
+	A node `json:"a"`
+}
+
+func (n *afterNode) observe(i int, event Event) {
+	n.A.observe(i, event)
+}
+
+func (n *afterNode) evaluate(ev *evaluator) (int, bool, bool) {
+	ai, a, aAfter := n.A.evaluate(ev)
+	if a {
+		return ai, aAfter, aAfter
+	}
+	return -1, false, false
+}
+
+func (n *afterNode) final(now time.Time) bool {
+	return n.A.final(now)
+}
+
+// anchoredNode evaluates After anchored to the first event of its range, by
+// creating the node for A once that event is observed.
+type anchoredNode struct {
+	history *history
+	after   After
+
+	Anchor time.Time `json:"anchor"`
+	A      node      `json:"a,omitempty"`
+}
+
+func (n *anchoredNode) observe(i int, event Event) {
+	if n.A == nil {
+		n.Anchor = event.Time
+		n.A = n.history.node(n.after.A, event.Time.Add(time.Duration(n.after.D)))
+	}
+	n.A.observe(i, event)
+}
+
+func (n *anchoredNode) evaluate(ev *evaluator) (int, bool, bool) {
+	if n.A == nil {
+		return -1, false, false
+	}
+
+	ai, a, aAfter := n.A.evaluate(ev)
+	if a {
+		return ai, aAfter, aAfter
+	}
+	return -1, false, false
+}
+
+func (n *anchoredNode) final(now time.Time) bool {
+	return n.A != nil && n.A.final(now)
+}
+
+func (n *anchoredNode) UnmarshalJSON(bs []byte) error {
+	state := struct {
+		Anchor time.Time       `json:"anchor"`
+		A      json.RawMessage `json:"a"`
+	}{}
+	err := json.Unmarshal(bs, &state)
+	if err != nil || state.A == nil {
+		return err
+	}
+
+	n.Anchor = state.Anchor
+	n.A = n.history.node(n.after.A, state.Anchor.Add(time.Duration(n.after.D)))
+	return json.Unmarshal(state.A, n.A)
+}
+
+// countNode evaluates Count by counting the occurrences of its predicate;
+// see evaluator.evaluateCount.
+type countNode struct {
+	count       Count
+	limit       int
+	occurs      func(Event) bool
+	mustBeAfter time.Time
+
+	N    int `json:"n"`
+	Last int `json:"last"`
+}
+
+func (n *countNode) observe(i int, event Event) {
+	if n.N < n.limit && n.occurs(event) {
+		n.N, n.Last = n.N+1, i
+	}
+}
+
+func (n *countNode) evaluate(ev *evaluator) (int, bool, bool) {
+	if !n.count.compare(n.N) {
+		return -1, false, n.N > 0 || ev.nowAfter(n.mustBeAfter)
+	}
+	return n.Last, true, n.N > 0 || ev.nowAfter(n.mustBeAfter)
+}
+
+func (n *countNode) final(now time.Time) bool {
+	return n.N >= n.limit && (n.N > 0 || now.After(n.mustBeAfter))
+}
+
+// windowCountNode evaluates Window by keeping the times of the latest N
+// occurrences of its predicate, until they're within D; see
+// evaluator.evaluateWindowCount.
+type windowCountNode struct {
+	window      Window
+	occurs      func(Event) bool
+	mustBeAfter time.Time
+
+	Times []time.Time `json:"times,omitempty"`
+	Found bool        `json:"found,omitempty"`
+	Match int         `json:"match"`
+}
+
+func (n *windowCountNode) observe(i int, event Event) {
+	if n.Match >= 0 || n.window.N <= 0 || !n.occurs(event) {
+		return
+	}
+
+	n.Found = true
+	n.Times = append(n.Times, event.Time)
+	if len(n.Times) > n.window.N {
+		n.Times = append(n.Times[:0], n.Times[1:]...)
+	}
+	if len(n.Times) == n.window.N && event.Time.Sub(n.Times[0]) <= time.Duration(n.window.D) {
+		n.Match, n.Times = i, nil
+	}
+}
+
+func (n *windowCountNode) evaluate(ev *evaluator) (int, bool, bool) {
+	if n.Match >= 0 {
+		return n.Match, true, true
+	}
+	return -1, false, n.Found || ev.nowAfter(n.mustBeAfter)
+}
+
+func (n *windowCountNode) final(now time.Time) bool {
+	return n.Match >= 0
+}
+
+// sinceNode evaluates Since by keeping the latest occurrence of its
+// predicate; see evaluator.evaluateSince.
+type sinceNode struct {
+	history     *history
+	since       Since
+	occurs      func(Event) bool
+	mustBeAfter time.Time
+
+	Latest     int       `json:"latest"`
+	LatestTime time.Time `json:"latest_time"`
+}
+
+func (n *sinceNode) observe(i int, event Event) {
+	if n.occurs(event) {
+		n.Latest, n.LatestTime = i, event.Time
+	}
+}
+
+func (n *sinceNode) evaluate(ev *evaluator) (int, bool, bool) {
+	var since time.Time
+	switch {
+	case n.Latest >= 0:
+		since = n.LatestTime
+	case n.mustBeAfter != minTime:
+		since = n.mustBeAfter
+	case !n.history.start.IsZero():
+		since = n.history.start
+	default:
+		return -1, false, false
+	}
+
+	if !ev.nowAfter(since.Add(time.Duration(n.since.D)).Add(-time.Nanosecond)) {
+		return -1, false, n.Latest >= 0 || ev.nowAfter(n.mustBeAfter)
+	}
+	return n.Latest, true, true
+}
+
+// final returns false, since a later occurrence starts the duration over.
+func (n *sinceNode) final(now time.Time) bool {
+	return false
+}
+
+// filterNode evaluates During and On by keeping the first occurrence of their
+// predicate whose time matches; see evaluator.evaluateFilter.
+type filterNode struct {
+	matches     func(time.Time) bool
+	occurs      func(Event) bool
+	mustBeAfter time.Time
+
+	Found bool `json:"found,omitempty"`
+	Match int  `json:"match"`
+}
+
+func (n *filterNode) observe(i int, event Event) {
+	if n.Match >= 0 || !n.occurs(event) {
+		return
+	}
+
+	n.Found = true
+	if n.matches(event.Time) {
+		n.Match = i
+	}
+}
+
+func (n *filterNode) evaluate(ev *evaluator) (int, bool, bool) {
+	if n.Match >= 0 {
+		return n.Match, true, true
+	}
+	return -1, false, n.Found || ev.nowAfter(n.mustBeAfter)
+}
+
+func (n *filterNode) final(now time.Time) bool {
+	return n.Match >= 0
+}
+
+// thenNode evaluates Then, whose A is a predicate, by keeping a node for B
+// for each occurrence of A that can still be chosen, or for the event
+// satisfying A without being an occurrence if there are none; see
+// evaluator.evaluateThen and evaluator.evaluateThenStrategy.
+//
+// Using ThenAny and ThenLatest, the attempts whose results can no longer
+// change, because they're final or B's reach has passed, see reach, are
+// settled as events arrive.
+type thenNode struct {
+	history *history
+	then    Then
+	occurs  func(Event) bool
+	weak    func(Event) bool
+	reach   time.Duration
+	bounded bool
+
+	// Weak is the attempt for the first event satisfying A before the time
+	// it's evaluated relative to.
+	Weak *thenAttempt `json:"weak,omitempty"`
+
+	// Attempts are those for the occurrences of A.
+	Attempts []*thenAttempt `json:"attempts,omitempty"`
+
+	// Settled is the result of an attempt that can no longer change, and
+	// that is chosen regardless of later occurrences.
+	Settled *thenResult `json:"settled,omitempty"`
+}
+
+// thenAttempt is the node for Then.B following an event satisfying Then.A.
+type thenAttempt struct {
+	AI   int       `json:"ai"`
+	Time time.Time `json:"time"`
+
+	// Next is the index of the following occurrence of A, or -1 if there
+	// is none.
+	Next int  `json:"next"`
+	B    node `json:"b"`
+}
+
+type thenResult struct {
+	Index     int  `json:"index"`
+	TimeAfter bool `json:"time_after"`
+}
+
+func (h *history) thenNode(v Then, mustBeAfter time.Time) *thenNode {
+	matches, strict := predicate(v.A)
+	n := &thenNode{history: h, then: v, occurs: occurs(v.A, mustBeAfter)}
+	n.weak = func(event Event) bool {
+		return !strict && event.Time.Before(mustBeAfter) && matches(event)
+	}
+	n.reach, n.bounded = reach(v.B, 0, false)
+	return n
+}
+
+// attempt returns the attempt for the event at index ai.
+func (n *thenNode) attempt(ai int, t time.Time) *thenAttempt {
+	return &thenAttempt{AI: ai, Time: t, Next: -1, B: n.history.node(n.then.B, t)}
+}
+
+func (n *thenNode) observe(i int, event Event) {
+	if n.Settled != nil {
+		return
+	}
+	n.settle(event.Time)
+
+	if n.Weak != nil {
+		n.Weak.B.observe(i, event)
+	}
+	for _, attempt := range n.Attempts {
+		attempt.B.observe(i, event)
+	}
+
+	switch {
+	case n.occurs(event):
+		if len(n.Attempts) > 0 && (n.then.Strategy == ThenDefault || n.then.Strategy == ThenEarliest) {
+			return
+		}
+
+		if k := len(n.Attempts) - 1; k >= 0 && n.Attempts[k].Next < 0 {
+			n.Attempts[k].Next = i
+		}
+		n.Attempts = append(n.Attempts, n.attempt(i, event.Time))
+
+		// Only the default strategy goes back to the event before the
+		// occurrences.
+		if n.then.Strategy != ThenDefault {
+			n.Weak = nil
+		}
+
+	case n.Weak == nil && len(n.Attempts) == 0 && n.weak(event):
+		n.Weak = n.attempt(i, event.Time)
+	}
+}
+
+// settle leaves out the attempts, from the earliest one, whose results can
+// no longer change at now, until one of them is chosen, or one can't be left
+// out yet.
+func (n *thenNode) settle(now time.Time) {
+	if n.then.Strategy != ThenAny && n.then.Strategy != ThenLatest {
+		return
+	}
+
+	ev := evaluator{now: now}
+	for len(n.Attempts) > 0 {
+		attempt := n.Attempts[0]
+		reached := n.bounded && now.After(attempt.Time.Add(n.reach))
+		if !reached && !attempt.B.final(now) {
+			return
+		}
+
+		bi, b, bAfter := n.evaluateB(&ev, attempt)
+		if b && (n.then.Strategy == ThenAny || n.chosen(attempt, bi)) {
+			n.Settled = &thenResult{Index: bi, TimeAfter: bAfter}
+			n.Weak, n.Attempts = nil, nil
+			return
+		}
+
+		// Using ThenLatest, an attempt satisfied without events is chosen
+		// until there is a following occurrence.
+		if b && attempt.Next < 0 {
+			return
+		}
+		n.Attempts = n.Attempts[1:]
+	}
+}
+
+// chosen reports whether, using ThenLatest, the attempt whose B was satisfied
+// by the event at index bi is chosen also once there are following
+// occurrences of A: the occurrence must be the latest one before that event;
+// see evaluator.evaluateThenStrategy.
+func (n *thenNode) chosen(attempt *thenAttempt, bi int) bool {
+	if attempt.Next < 0 {
+		return bi != attempt.AI
+	}
+	return bi != attempt.AI && bi <= attempt.Next
+}
+
+func (n *thenNode) evaluate(ev *evaluator) (int, bool, bool) {
+	if n.Settled != nil {
+		return n.Settled.Index, true, n.Settled.TimeAfter
+	}
+
+	if len(n.Attempts) == 0 {
+		if n.Weak == nil {
+			return -1, false, false
+		}
+		bi, b, _ := n.evaluateB(ev, n.Weak)
+		return bi, b, false
+	}
+
+	if n.then.Strategy == ThenDefault {
+		if bi, b, bAfter := n.evaluateB(ev, n.Attempts[0]); b {
+			return bi, true, bAfter
+		}
+		if n.Weak == nil {
+			return -1, false, false
+		}
+		bi, b, _ := n.evaluateB(ev, n.Weak)
+		return bi, b, false
+	}
+
+	for _, attempt := range n.Attempts {
+		bi, b, bAfter := n.evaluateB(ev, attempt)
+		if !b {
+			continue
+		}
+
+		// Using ThenLatest, the occurrence must be the latest one before the
+		// event satisfying B, or the latest one of all if B is satisfied
+		// without events, in which case bi is ai.
+		if n.then.Strategy == ThenLatest && attempt.Next >= 0 && !n.chosen(attempt, bi) {
+			continue
+		}
+		return bi, true, bAfter
+	}
+	return -1, false, false
+}
+
+func (n *thenNode) final(now time.Time) bool {
+	return n.Settled != nil
+}
+
+// evaluateB evaluates the attempt's B. The returned index is that of the
+// event satisfying B, or that of the attempt if B is satisfied without
+// events; see evaluator.evaluateThenB.
+func (n *thenNode) evaluateB(ev *evaluator, attempt *thenAttempt) (int, bool, bool) {
+	bi, b, bAfter := attempt.B.evaluate(ev)
+	if !b {
+		return -1, false, false
+	}
+	if bi < 0 {
+		return attempt.AI, true, bAfter
+	}
+	return bi, true, bAfter
+}
+
+func (n *thenNode) UnmarshalJSON(bs []byte) error {
+	type storedAttempt struct {
+		AI   int             `json:"ai"`
+		Time time.Time       `json:"time"`
+		Next int             `json:"next"`
+		B    json.RawMessage `json:"b"`
+	}
+	state := struct {
+		Weak     *storedAttempt  `json:"weak"`
+		Attempts []storedAttempt `json:"attempts"`
+		Settled  *thenResult     `json:"settled"`
+	}{}
+	err := json.Unmarshal(bs, &state)
+	if err != nil {
+		return err
+	}
+
+	restore := func(stored storedAttempt) (*thenAttempt, error) {
+		attempt := n.attempt(stored.AI, stored.Time)
+		attempt.Next = stored.Next
+		return attempt, json.Unmarshal(stored.B, attempt.B)
+	}
+
+	n.Weak, n.Attempts, n.Settled = nil, nil, state.Settled
+	if state.Weak != nil {
+		n.Weak, err = restore(*state.Weak)
+		if err != nil {
+			return err
+		}
+	}
+	for _, stored := range state.Attempts {
+		attempt, err := restore(stored)
+		if err != nil {
+			return err
+		}
+		n.Attempts = append(n.Attempts, attempt)
+	}
+	return nil
+}
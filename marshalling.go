@@ -4,143 +4,843 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Marshal marshals an expression to a byte format that can be unmarshalled
-// (using Unmarshal) to the same expression.
+// (using Unmarshal) to the same expression. If e contains operators unknown to
+// this package, which Unmarshal can't unmarshal, or nil expressions, an error
+// of type Errors is returned, locating each by its JSON path.
 func Marshal(e Expr) ([]byte, error) {
+	if errs := marshalErrors(e, "$", nil); len(errs) > 0 {
+		return nil, errs
+	}
 	return json.Marshal(&e)
 }
 
+// marshalErrors appends an Error to errs for each expression in e, at path,
+// that can't be unmarshalled.
+func marshalErrors(e Expr, path string, errs Errors) Errors {
+	if e == nil {
+		return append(errs, &Error{Code: ErrorCodeMissingField, Path: path, Message: "expression is nil"})
+	}
+
+	if _, ok := operator(e); !ok {
+		return append(errs, &Error{Code: ErrorCodeUnknownOperator, Path: path, Message: fmt.Sprintf("unknown operator %T", e)})
+	}
+
+	for i, child := range children(e) {
+		errs = marshalErrors(child, childPath(e, path, i), errs)
+	}
+	return errs
+}
+
+// childPath returns the JSON path of the i'th child of e, whose path is path.
+func childPath(e Expr, path string, i int) string {
+	key, list := childKey(e, i)
+	if list {
+		return fmt.Sprintf("%s.%s[%d]", path, key, i)
+	}
+	return path + "." + key
+}
+
+// childKey returns the key of the i'th child of e in the marshalled form, and
+// whether the children of e are instead the elements of a list with that key.
+func childKey(e Expr, i int) (string, bool) {
+	switch e.(type) {
+	case Seq:
+		return "steps", true
+	case AnyOf, AllOf, AtLeast:
+		return "exprs", true
+	}
+
+	if i == 1 {
+		return "b", false
+	}
+	return "a", false
+}
+
 func (a And) MarshalJSON() ([]byte, error) {
-	return marshalABOperator("and", a.A, a.B)
+	return marshalOperator(a, "", "")
 }
 
 func (o Or) MarshalJSON() ([]byte, error) {
-	return marshalABOperator("or", o.A, o.B)
+	return marshalOperator(o, "", "")
 }
 
 func (t Then) MarshalJSON() ([]byte, error) {
-	return marshalABOperator("then", t.A, t.B)
-}
+	if t.Strategy == ThenDefault {
+		return marshalOperator(t, "", "")
+	}
 
-func (n Not) MarshalJSON() ([]byte, error) {
-	opa, err := json.Marshal(n.A)
+	strategy, err := json.Marshal(t.Strategy)
 	if err != nil {
 		return nil, err
 	}
 
-	return []byte(fmt.Sprintf(`{"operator": "not", "a": %v}`, string(opa))), nil
+	return marshalOperator(t, "", fmt.Sprintf(`, "strategy": %s`, strategy))
+}
+
+func (n Not) MarshalJSON() ([]byte, error) {
+	return marshalOperator(n, "", "")
 }
 
 func (e EventName) MarshalJSON() ([]byte, error) {
-	return []byte(fmt.Sprintf(`{"operator": "event_name", "a": "%v"}`, string(e))), nil
+	name, err := json.Marshal(string(e))
+	if err != nil {
+		return nil, err
+	}
+
+	return marshalOperator(e, "", fmt.Sprintf(`, "a": %s`, name))
 }
 
-func (a After) MarshalJSON() ([]byte, error) {
-	opa, err := json.Marshal(a.A)
+func (w Where) MarshalJSON() ([]byte, error) {
+	name, err := json.Marshal(string(w.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	predicates := w.Predicates
+	if predicates == nil {
+		predicates = []Predicate{}
+	}
+	preds, err := json.Marshal(predicates)
 	if err != nil {
 		return nil, err
 	}
 
-	return []byte(fmt.Sprintf(`{"operator": "after", "a": %v, "d": "%v"}`, string(opa), a.D)), nil
+	return marshalOperator(w, "", fmt.Sprintf(`, "a": %s, "predicates": %s`, name, preds))
 }
 
-func marshalABOperator(name string, a, b Expr) ([]byte, error) {
-	opa, err := json.Marshal(a)
+func (a After) MarshalJSON() ([]byte, error) {
+	if a.Anchor == (Anchor{}) {
+		return marshalOperator(a, "", fmt.Sprintf(`, "d": "%v"`, a.D))
+	}
+
+	kind, err := json.Marshal(a.Anchor.Kind)
 	if err != nil {
 		return nil, err
 	}
 
-	opb, err := json.Marshal(b)
+	name, err := json.Marshal(string(a.Anchor.Name))
 	if err != nil {
 		return nil, err
 	}
 
-	return []byte(fmt.Sprintf(`{"operator": "%s", "a": %v, "b": %v}`, name, string(opa), string(opb))), nil
+	return marshalOperator(a, "", fmt.Sprintf(`, "d": "%v", "anchor": {"kind": %s, "name": %s}`, a.D, kind, name))
+}
+
+func (w Within) MarshalJSON() ([]byte, error) {
+	return marshalOperator(w, "", fmt.Sprintf(`, "d": "%v"`, w.D))
+}
+
+func (b Between) MarshalJSON() ([]byte, error) {
+	return marshalOperator(b, "", fmt.Sprintf(`, "min": "%v", "max": "%v"`, b.Min, b.Max))
 }
 
-// Unmarshal unmarshals an Expr.
-func Unmarshal(bs []byte) (Expr, error) {
-	m := map[string]interface{}{}
-	err := json.Unmarshal(bs, &m)
+func (c Count) MarshalJSON() ([]byte, error) {
+	op, err := json.Marshal(c.Op)
 	if err != nil {
 		return nil, err
 	}
 
-	return unmarshal(m)
+	return marshalOperator(c, "", fmt.Sprintf(`, "op": %s, "n": %d`, op, c.N))
 }
 
-// ErrInvalidExpression is returned when attempting to unmarshal something that
-// isn't a driplang.Expr.
-var ErrInvalidExpression = errors.New("invalid expression")
+func (s Since) MarshalJSON() ([]byte, error) {
+	return marshalOperator(s, "", fmt.Sprintf(`, "d": "%v"`, s.D))
+}
 
-func unmarshal(m map[string]interface{}) (Expr, error) {
-	name, ok := m["operator"].(string)
-	if !ok {
-		return nil, ErrInvalidExpression
+func (w Window) MarshalJSON() ([]byte, error) {
+	return marshalOperator(w, "", fmt.Sprintf(`, "n": %d, "d": "%v"`, w.N, w.D))
+}
+
+func (a AfterTime) MarshalJSON() ([]byte, error) {
+	return marshalOperator(a, "", fmt.Sprintf(`, "t": %q`, a.T.Format(time.RFC3339Nano)))
+}
+
+func (b BeforeTime) MarshalJSON() ([]byte, error) {
+	return marshalOperator(b, "", fmt.Sprintf(`, "t": %q`, b.T.Format(time.RFC3339Nano)))
+}
+
+func (d During) MarshalJSON() ([]byte, error) {
+	zone, err := json.Marshal(d.Zone)
+	if err != nil {
+		return nil, err
 	}
 
-	switch name {
-	case "event_name":
-		return EventName(m["a"].(string)), nil
+	return marshalOperator(d, "", fmt.Sprintf(`, "from": %q, "to": %q, "zone": %s`, formatTimeOfDay(d.From), formatTimeOfDay(d.To), zone))
+}
 
-	case "not":
-		a, err := unmarshal(m["a"].(map[string]interface{}))
-		return Not{A: a}, err
+func (o On) MarshalJSON() ([]byte, error) {
+	days := make([]string, len(o.Days))
+	for i, day := range o.Days {
+		days[i] = formatWeekday(day)
+	}
+	ds, err := json.Marshal(days)
+	if err != nil {
+		return nil, err
+	}
+
+	zone, err := json.Marshal(o.Zone)
+	if err != nil {
+		return nil, err
+	}
+
+	return marshalOperator(o, "", fmt.Sprintf(`, "days": %s, "zone": %s`, ds, zone))
+}
 
-	case "and":
-		a, err := unmarshal(m["a"].(map[string]interface{}))
+func (s Seq) MarshalJSON() ([]byte, error) {
+	var sb strings.Builder
+	if s.Relaxed {
+		sb.WriteString(`, "relaxed": true`)
+	}
+	if len(s.Ignore) > 0 {
+		names := make([]string, len(s.Ignore))
+		for i, name := range s.Ignore {
+			names[i] = string(name)
+		}
+		ignore, err := json.Marshal(names)
 		if err != nil {
 			return nil, err
 		}
+		fmt.Fprintf(&sb, `, "ignore": %s`, ignore)
+	}
+	return marshalOperator(s, "", sb.String())
+}
+
+func (a AnyOf) MarshalJSON() ([]byte, error) {
+	return marshalOperator(a, "", "")
+}
+
+func (a AllOf) MarshalJSON() ([]byte, error) {
+	return marshalOperator(a, "", "")
+}
+
+func (a AtLeast) MarshalJSON() ([]byte, error) {
+	return marshalOperator(a, fmt.Sprintf(`, "k": %d`, a.K), "")
+}
+
+// marshalOperator marshals e with its children, keyed like in childKey, and
+// the already marshalled fields, if any, that come before and after them.
+func marshalOperator(e Node, before, after string) ([]byte, error) {
+	name, _ := operator(e)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `{"operator": "%s"%s`, name, before)
 
-		b, err := unmarshal(m["b"].(map[string]interface{}))
+	children := e.Children()
+	if key, list := childKey(e, 0); list {
+		if children == nil {
+			children = []Expr{}
+		}
+		cs, err := json.Marshal(children)
 		if err != nil {
 			return nil, err
 		}
+		fmt.Fprintf(&sb, `, "%s": %s`, key, cs)
+	} else {
+		for i, child := range children {
+			c, err := json.Marshal(child)
+			if err != nil {
+				return nil, err
+			}
+			key, _ := childKey(e, i)
+			fmt.Fprintf(&sb, `, "%s": %s`, key, c)
+		}
+	}
 
-		return And{A: a, B: b}, nil
+	sb.WriteString(after)
+	sb.WriteString("}")
+	return []byte(sb.String()), nil
+}
 
-	case "or":
-		a, err := unmarshal(m["a"].(map[string]interface{}))
-		if err != nil {
-			return nil, err
+// operatorName returns the name of the root operator of e, as used in the
+// marshalled form, or its type if it's unknown.
+func operatorName(e Expr) string {
+	if name, ok := operator(e); ok {
+		return name
+	}
+	return fmt.Sprintf("%T", e)
+}
+
+// operator returns the name of the root operator of e, as used in the
+// marshalled form, and whether it's an operator of this package.
+func operator(e Expr) (string, bool) {
+	switch e.(type) {
+	case EventName:
+		return "event_name", true
+	case Where:
+		return "where", true
+	case Not:
+		return "not", true
+	case And:
+		return "and", true
+	case Or:
+		return "or", true
+	case Then:
+		return "then", true
+	case After:
+		return "after", true
+	case Within:
+		return "within", true
+	case Count:
+		return "count", true
+	case Window:
+		return "window", true
+	case Since:
+		return "since", true
+	case Between:
+		return "between", true
+	case AfterTime:
+		return "after_time", true
+	case BeforeTime:
+		return "before_time", true
+	case During:
+		return "during", true
+	case On:
+		return "on", true
+	case Seq:
+		return "seq", true
+	case AnyOf:
+		return "any_of", true
+	case AllOf:
+		return "all_of", true
+	case AtLeast:
+		return "at_least", true
+	default:
+		return "", false
+	}
+}
+
+// Unmarshal unmarshals an Expr. If bs isn't a valid expression, the returned
+// error is of type Errors and describes every problem found, each located by
+// its JSON path.
+//
+// Unmarshal never panics. Expressions nested deeper than DefaultMaxDepth or
+// with more than DefaultMaxNodes nodes are rejected; use WithMaxDepth and
+// WithMaxNodes to change the limits. Use WithValidation to also reject
+// expressions for which Validate reports errors, e.g. when storing rules.
+func Unmarshal(bs []byte, opts ...Option) (Expr, error) {
+	var v interface{}
+	err := json.Unmarshal(bs, &v)
+	if err != nil {
+		e := &Error{Code: ErrorCodeSyntax, Message: err.Error()}
+
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			// Offset is the number of bytes read, including the invalid one.
+			offset := max(0, min(int(syntaxErr.Offset)-1, len(bs)))
+			e.Line, e.Column = lineColumn(string(bs), offset)
 		}
+		return nil, Errors{e}
+	}
 
-		b, err := unmarshal(m["b"].(map[string]interface{}))
-		if err != nil {
-			return nil, err
+	d := decoder{opts: makeOptions(opts)}
+	e := d.unmarshal(v, "$", 1)
+	if len(d.errs) > 0 {
+		return nil, d.errs
+	}
+
+	if errs := d.opts.validationErrors(e); len(errs) > 0 {
+		return nil, errs
+	}
+
+	return e, nil
+}
+
+// decoder turns decoded JSON into an Expr, collecting every problem it finds
+// instead of stopping at the first one.
+type decoder struct {
+	opts  options
+	nodes int
+	errs  Errors
+}
+
+func (d *decoder) errorf(path string, code ErrorCode, format string, args ...interface{}) {
+	d.errs = append(d.errs, &Error{
+		Code:    code,
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (d *decoder) unmarshal(v interface{}, path string, depth int) Expr {
+	if d.opts.depthExceeded(depth) {
+		d.errorf(path, ErrorCodeLimitExceeded, "expression is nested deeper than %d", d.opts.maxDepth)
+		return nil
+	}
+
+	d.nodes++
+	if d.opts.nodesExceeded(d.nodes) {
+		// Only report the first node that exceeds the limit.
+		if d.nodes == d.opts.maxNodes+1 {
+			d.errorf(path, ErrorCodeLimitExceeded, "expression has more than %d nodes", d.opts.maxNodes)
 		}
-		return Or{A: a, B: b}, nil
+		return nil
+	}
 
-	case "then":
-		a, err := unmarshal(m["a"].(map[string]interface{}))
-		if err != nil {
-			return nil, err
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		d.errorf(path, ErrorCodeInvalidValue, "expected object, got %s", jsonType(v))
+		return nil
+	}
+
+	operator, ok := m["operator"]
+	if !ok {
+		d.errorf(path, ErrorCodeMissingField, "missing operator")
+		return nil
+	}
+
+	name, ok := operator.(string)
+	if !ok {
+		d.errorf(path+".operator", ErrorCodeInvalidValue, "expected string, got %s", jsonType(operator))
+		return nil
+	}
+
+	node, ok := operators[name]
+	if !ok {
+		d.errorf(path+".operator", ErrorCodeUnknownOperator, "unknown operator %q", name)
+		return nil
+	}
+
+	// The problems with the operator's own fields are only checked for if
+	// its fields could be unmarshalled; before tells whether its children
+	// could be, too, for operators whose checks concern them.
+	before := len(d.errs)
+
+	// Like in the marshalled form, AT_LEAST's count comes before its
+	// operands.
+	k := 0
+	if _, ok := node.(AtLeast); ok {
+		k = d.int(m, "k", path)
+	}
+
+	// Lists of children can be empty, which is reported by the checks
+	// below, but which WithChildren doesn't accept.
+	e := Expr(node)
+	if children := d.children(node, m, path, depth); len(children) > 0 {
+		e = node.WithChildren(children)
+	}
+	errs := len(d.errs)
+
+	switch e := e.(type) {
+	case EventName:
+		a, _ := d.string(m, "a", path)
+		return EventName(a)
+
+	case Where:
+		a, _ := d.string(m, "a", path)
+		return Where{Name: EventName(a), Predicates: d.predicates(m, "predicates", path)}
+
+	case Then:
+		if _, ok := m["strategy"]; ok {
+			strategy, ok := d.string(m, "strategy", path)
+			e.Strategy = ThenStrategy(strategy)
+			if err := e.Strategy.check(); ok && err != nil {
+				d.errorf(path+".strategy", ErrorCodeInvalidValue, "%s", err)
+			}
 		}
+		return e
 
-		b, err := unmarshal(m["b"].(map[string]interface{}))
-		if err != nil {
-			return nil, err
+	case After:
+		e.D, e.Anchor = d.duration(m, "d", path), d.anchor(m, "anchor", path)
+		return e
+
+	case Count:
+		op, _ := d.string(m, "op", path)
+		e.Op, e.N = PredicateOp(op), d.int(m, "n", path)
+		if err := e.check(); op != "" && err != nil {
+			d.errorf(path, ErrorCodeInvalidValue, "%s", err)
 		}
-		return Then{A: a, B: b}, nil
+		return e
 
-	case "after":
-		a, err := unmarshal(m["a"].(map[string]interface{}))
-		if err != nil {
-			return nil, err
+	case Since:
+		e.D = d.duration(m, "d", path)
+		return e
+
+	case Window:
+		e.N, e.D = d.int(m, "n", path), d.duration(m, "d", path)
+		if err := e.check(); len(d.errs) == errs && err != nil {
+			d.errorf(path, ErrorCodeInvalidValue, "%s", err)
 		}
+		return e
 
-		v, isStr := m["d"].(string)
-		d, err := strconv.ParseInt(v, 10, 64)
-		if !isStr || err != nil {
-			return nil, err
+	case Within:
+		e.D = d.duration(m, "d", path)
+		return e
+
+	case Between:
+		e.Min, e.Max = d.duration(m, "min", path), d.duration(m, "max", path)
+		return e
+
+	case AfterTime:
+		e.T = d.time(m, "t", path)
+		return e
+
+	case BeforeTime:
+		e.T = d.time(m, "t", path)
+		return e
+
+	case During:
+		e.Zone, _ = d.string(m, "zone", path)
+		e.From, e.To = d.timeOfDay(m, "from", path), d.timeOfDay(m, "to", path)
+		if err := e.check(); len(d.errs) == errs && err != nil {
+			d.errorf(path, ErrorCodeInvalidValue, "%s", err)
+		}
+		return e
+
+	case On:
+		e.Zone, _ = d.string(m, "zone", path)
+		e.Days = d.weekdays(m, "days", path)
+		if err := e.check(); len(d.errs) == errs && err != nil {
+			d.errorf(path, ErrorCodeInvalidValue, "%s", err)
+		}
+		return e
+
+	case Seq:
+		if v, ok := m["relaxed"]; ok {
+			e.Relaxed, ok = v.(bool)
+			if !ok {
+				d.errorf(path+".relaxed", ErrorCodeInvalidValue, "expected boolean, got %s", jsonType(v))
+			}
 		}
-		return After{A: a, D: Duration(d)}, nil
+		if _, ok := m["ignore"]; ok {
+			e.Ignore = d.eventNames(m, "ignore", path)
+		}
+
+		if err := e.check(); len(d.errs) == before && err != nil {
+			d.errorf(path, ErrorCodeInvalidValue, "%s", err)
+		}
+		return e
+
+	case AnyOf:
+		if err := e.check(); len(d.errs) == before && err != nil {
+			d.errorf(path, ErrorCodeInvalidValue, "%s", err)
+		}
+		return e
+
+	case AllOf:
+		if err := e.check(); len(d.errs) == before && err != nil {
+			d.errorf(path, ErrorCodeInvalidValue, "%s", err)
+		}
+		return e
+
+	case AtLeast:
+		e.K = k
+		if err := e.check(); len(d.errs) == before && err != nil {
+			d.errorf(path, ErrorCodeInvalidValue, "%s", err)
+		}
+		return e
+
+	default:
+		// Not, And and Or have no fields besides their children.
+		return e
+	}
+}
+
+// operators holds the zero value of every operator of this package by the
+// name used in the marshalled form, for the decoder to fill in.
+var operators = map[string]Node{}
+
+func init() {
+	for _, e := range []Node{EventName(""), Where{}, Not{}, And{}, Or{}, Then{}, After{}, Within{}, Count{}, Window{}, Since{}, Between{}, AfterTime{}, BeforeTime{}, During{}, On{}, Seq{}, AnyOf{}, AllOf{}, AtLeast{}} {
+		name, _ := operator(e)
+		operators[name] = e
+	}
+}
+
+// children unmarshals the sub-expressions of node, the zero value of the
+// operator of the expression at depth, keyed like in childKey.
+func (d *decoder) children(node Node, m map[string]interface{}, path string, depth int) []Expr {
+	if key, list := childKey(node, 0); list {
+		return d.exprs(m, key, path, depth)
+	}
+
+	children := make([]Expr, len(node.Children()))
+	for i := range children {
+		key, _ := childKey(node, i)
+		children[i] = d.expr(m, key, path, depth)
+	}
+	return children
+}
+
+// expr unmarshals the sub-expression m[key] of the expression at depth.
+func (d *decoder) expr(m map[string]interface{}, key string, path string, depth int) Expr {
+	v, ok := m[key]
+	if !ok {
+		d.errorf(path, ErrorCodeMissingField, "missing %q", key)
+		return nil
+	}
+
+	return d.unmarshal(v, path+"."+key, depth+1)
+}
+
+// exprs unmarshals m[key], a list of sub-expressions of the expression at
+// depth.
+func (d *decoder) exprs(m map[string]interface{}, key string, path string, depth int) []Expr {
+	v, ok := m[key]
+	if !ok {
+		d.errorf(path, ErrorCodeMissingField, "missing %q", key)
+		return nil
+	}
+
+	list, ok := v.([]interface{})
+	if !ok {
+		d.errorf(path+"."+key, ErrorCodeInvalidValue, "expected array, got %s", jsonType(v))
+		return nil
+	}
+
+	exprs := make([]Expr, len(list))
+	for i, v := range list {
+		exprs[i] = d.unmarshal(v, fmt.Sprintf("%s.%s[%d]", path, key, i), depth+1)
+	}
+	return exprs
+}
+
+// eventNames unmarshals m[key], a list of event names.
+func (d *decoder) eventNames(m map[string]interface{}, key string, path string) []EventName {
+	v, ok := m[key]
+	if !ok {
+		d.errorf(path, ErrorCodeMissingField, "missing %q", key)
+		return nil
+	}
+
+	list, ok := v.([]interface{})
+	if !ok {
+		d.errorf(path+"."+key, ErrorCodeInvalidValue, "expected array, got %s", jsonType(v))
+		return nil
+	}
+
+	var names []EventName
+	for i, v := range list {
+		s, ok := v.(string)
+		if !ok {
+			d.errorf(fmt.Sprintf("%s.%s[%d]", path, key, i), ErrorCodeInvalidValue, "expected string, got %s", jsonType(v))
+			continue
+		}
+		names = append(names, EventName(s))
+	}
+	return names
+}
+
+func (d *decoder) string(m map[string]interface{}, key string, path string) (string, bool) {
+	v, ok := m[key]
+	if !ok {
+		d.errorf(path, ErrorCodeMissingField, "missing %q", key)
+		return "", false
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		d.errorf(path+"."+key, ErrorCodeInvalidValue, "expected string, got %s", jsonType(v))
+		return "", false
+	}
+
+	return s, true
+}
+
+// duration unmarshals m[key], a string holding an integer number of
+// nanoseconds.
+func (d *decoder) duration(m map[string]interface{}, key string, path string) Duration {
+	s, ok := d.string(m, key, path)
+	if !ok {
+		return 0
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		d.errorf(path+"."+key, ErrorCodeInvalidValue, "invalid duration %q", s)
+		return 0
+	}
+
+	return Duration(v)
+}
+
+// anchor unmarshals m[key], an optional object holding the kind and name of
+// an Anchor. A missing anchor is the zero Anchor.
+func (d *decoder) anchor(m map[string]interface{}, key string, path string) Anchor {
+	v, ok := m[key]
+	if !ok {
+		return Anchor{}
+	}
+
+	am, ok := v.(map[string]interface{})
+	if !ok {
+		d.errorf(path+"."+key, ErrorCodeInvalidValue, "expected object, got %s", jsonType(v))
+		return Anchor{}
+	}
+
+	errs := len(d.errs)
+	kind, _ := d.string(am, "kind", path+"."+key)
+	a := Anchor{Kind: AnchorKind(kind)}
+	if _, ok := am["name"]; ok {
+		name, _ := d.string(am, "name", path+"."+key)
+		a.Name = EventName(name)
+	}
+
+	if err := a.check(); len(d.errs) == errs && err != nil {
+		d.errorf(path+"."+key, ErrorCodeInvalidValue, "%s", err)
+	}
+	return a
+}
+
+// time unmarshals m[key], a string holding an RFC 3339 timestamp.
+func (d *decoder) time(m map[string]interface{}, key string, path string) time.Time {
+	s, ok := d.string(m, key, path)
+	if !ok {
+		return time.Time{}
+	}
+
+	t, err := parseTimestamp(s)
+	if err != nil {
+		d.errorf(path+"."+key, ErrorCodeInvalidValue, "%s", err)
+		return time.Time{}
+	}
+
+	return t
+}
+
+// timeOfDay unmarshals m[key], a string holding a time of day such as
+// "09:30".
+func (d *decoder) timeOfDay(m map[string]interface{}, key string, path string) Duration {
+	s, ok := d.string(m, key, path)
+	if !ok {
+		return 0
+	}
+
+	v, err := parseTimeOfDay(s)
+	if err != nil {
+		d.errorf(path+"."+key, ErrorCodeInvalidValue, "%s", err)
+		return 0
+	}
+
+	return v
+}
+
+// weekdays unmarshals m[key], a list of abbreviated names of days of the
+// week such as "MON".
+func (d *decoder) weekdays(m map[string]interface{}, key string, path string) []time.Weekday {
+	v, ok := m[key]
+	if !ok {
+		d.errorf(path, ErrorCodeMissingField, "missing %q", key)
+		return nil
+	}
+
+	list, ok := v.([]interface{})
+	if !ok {
+		d.errorf(path+"."+key, ErrorCodeInvalidValue, "expected array, got %s", jsonType(v))
+		return nil
+	}
+
+	var days []time.Weekday
+	for i, v := range list {
+		path := fmt.Sprintf("%s.%s[%d]", path, key, i)
+		s, ok := v.(string)
+		if !ok {
+			d.errorf(path, ErrorCodeInvalidValue, "expected string, got %s", jsonType(v))
+			continue
+		}
+
+		day, ok := parseWeekday(s)
+		if !ok {
+			d.errorf(path, ErrorCodeInvalidValue, "invalid day of week %q", s)
+			continue
+		}
+		days = append(days, day)
+	}
+	return days
+}
+
+// int unmarshals m[key], an integer number.
+func (d *decoder) int(m map[string]interface{}, key string, path string) int {
+	v, ok := m[key]
+	if !ok {
+		d.errorf(path, ErrorCodeMissingField, "missing %q", key)
+		return 0
+	}
+
+	f, ok := v.(float64)
+	if !ok {
+		d.errorf(path+"."+key, ErrorCodeInvalidValue, "expected number, got %s", jsonType(v))
+		return 0
+	}
+
+	// Larger numbers can't be represented exactly by JSON numbers.
+	if f != math.Trunc(f) || math.Abs(f) > 1<<53 {
+		d.errorf(path+"."+key, ErrorCodeInvalidValue, "expected integer, got %v", f)
+		return 0
+	}
+
+	return int(f)
+}
+
+// predicates unmarshals m[key], a list of predicates.
+func (d *decoder) predicates(m map[string]interface{}, key string, path string) []Predicate {
+	v, ok := m[key]
+	if !ok {
+		d.errorf(path, ErrorCodeMissingField, "missing %q", key)
+		return nil
+	}
+
+	list, ok := v.([]interface{})
+	if !ok {
+		d.errorf(path+"."+key, ErrorCodeInvalidValue, "expected array, got %s", jsonType(v))
+		return nil
+	}
+
+	var predicates []Predicate
+	for i, v := range list {
+		path := fmt.Sprintf("%s.%s[%d]", path, key, i)
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			d.errorf(path, ErrorCodeInvalidValue, "expected object, got %s", jsonType(v))
+			continue
+		}
+
+		property, ok := d.string(m, "property", path)
+		if !ok {
+			continue
+		}
+		op, ok := d.string(m, "op", path)
+		if !ok {
+			continue
+		}
+		value, ok := m["value"]
+		if !ok {
+			d.errorf(path, ErrorCodeMissingField, "missing %q", "value")
+			continue
+		}
+
+		p := Predicate{Property: property, Op: PredicateOp(op), Value: value}
+		if err := p.check(); err != nil {
+			d.errorf(path, ErrorCodeInvalidValue, "%s", err)
+			continue
+		}
+		predicates = append(predicates, p)
+	}
+
+	return predicates
+}
 
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
 	default:
-		return nil, fmt.Errorf("unhandled Expr %v", m)
+		return fmt.Sprintf("%T", v)
 	}
 }
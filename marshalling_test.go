@@ -2,6 +2,7 @@ package driplang_test
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 	"time"
 
@@ -41,12 +42,135 @@ func TestMarshalEqualUnmarshal(t *testing.T) {
 		"event_name": {
 			expr: driplang.EventName("a"),
 		},
+		"where": {
+			expr: driplang.Where{
+				Name: driplang.EventName("purchase"),
+				Predicates: []driplang.Predicate{
+					{Property: "amount", Op: driplang.OpGreater, Value: 100.5},
+					{Property: "country", Op: driplang.OpIn, Value: []interface{}{"DK", 1.0, true}},
+					{Property: "path", Op: driplang.OpMatches, Value: "^/pricing"},
+				},
+			},
+		},
+		"where without predicates": {
+			expr: driplang.Where{Name: driplang.EventName("purchase")},
+		},
+		"count": {
+			expr: driplang.Count{
+				A:  driplang.EventName("a"),
+				Op: driplang.OpGreaterOrEqual,
+				N:  3,
+			},
+		},
+		"since": {
+			expr: driplang.Since{
+				A: driplang.EventName("a"),
+				D: driplang.Duration(14 * 24 * time.Hour),
+			},
+		},
+		"window": {
+			expr: driplang.Window{
+				A: driplang.EventName("a"),
+				N: 5,
+				D: driplang.Duration(10 * time.Minute),
+			},
+		},
+		"within": {
+			expr: driplang.Within{
+				A: driplang.EventName("a"),
+				D: driplang.Duration(24 * time.Hour),
+			},
+		},
+		"after time": {
+			expr: driplang.AfterTime{
+				A: driplang.EventName("a"),
+				T: time.Date(2024, 3, 1, 12, 30, 0, 500, time.UTC),
+			},
+		},
+		"before time": {
+			expr: driplang.BeforeTime{
+				A: driplang.EventName("a"),
+				T: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		"during": {
+			expr: driplang.During{
+				A:    driplang.EventName("a"),
+				From: driplang.Duration(9 * time.Hour),
+				To:   driplang.Duration(17*time.Hour + 30*time.Second),
+				Zone: "Europe/Copenhagen",
+			},
+		},
+		"on": {
+			expr: driplang.On{
+				A:    driplang.EventName("a"),
+				Days: []time.Weekday{time.Monday, time.Friday},
+				Zone: "Asia/Tokyo",
+			},
+		},
+		"between": {
+			expr: driplang.Between{
+				A:   driplang.EventName("a"),
+				Min: driplang.Duration(time.Hour),
+				Max: driplang.Duration(24 * time.Hour),
+			},
+		},
 		"after": {
 			expr: driplang.After{
 				A: driplang.EventName("a"),
 				D: driplang.Duration(42133742),
 			},
 		},
+		"seq": {
+			expr: driplang.Or{
+				A: driplang.Seq{
+					Steps: []driplang.Expr{
+						driplang.EventName("a"),
+						driplang.Where{Name: "b", Predicates: []driplang.Predicate{{Property: "n", Op: driplang.OpLess, Value: 2.0}}},
+					},
+					Ignore: []driplang.EventName{"c", "d"},
+				},
+				B: driplang.Seq{
+					Steps:   []driplang.Expr{driplang.EventName("a")},
+					Relaxed: true,
+				},
+			},
+		},
+		"n-ary": {
+			expr: driplang.AnyOf{Exprs: []driplang.Expr{
+				driplang.EventName("a"),
+				driplang.AllOf{Exprs: []driplang.Expr{
+					driplang.EventName("b"),
+					driplang.Not{A: driplang.EventName("c")},
+				}},
+				driplang.AtLeast{K: 2, Exprs: []driplang.Expr{
+					driplang.EventName("d"),
+					driplang.EventName("e"),
+					driplang.Then{A: driplang.EventName("f"), B: driplang.EventName("g")},
+				}},
+			}},
+		},
+		"then strategy": {
+			expr: driplang.Then{
+				A:        driplang.EventName("a"),
+				B:        driplang.EventName("b"),
+				Strategy: driplang.ThenLatest,
+			},
+		},
+		"anchored after": {
+			expr: driplang.Or{
+				A: driplang.After{
+					A:      driplang.EventName("a"),
+					D:      driplang.Duration(time.Hour),
+					Anchor: driplang.Anchor{Kind: driplang.AnchorFirst},
+				},
+				B: driplang.After{
+					A:      driplang.EventName("a"),
+					D:      driplang.Duration(time.Hour),
+					Anchor: driplang.Anchor{Kind: driplang.AnchorLast, Name: "b"},
+				},
+			},
+		},
 		"deeply nested": {
 			expr: driplang.Then{
 				A: driplang.And{
@@ -102,6 +226,44 @@ func TestMarshalEqualUnmarshal(t *testing.T) {
 	}
 }
 
+// TestMarshalTimeKeepsInstant verifies that AfterTime and BeforeTime keep the
+// instant and offset of T through a round trip, but not its Location.
+func TestMarshalTimeKeepsInstant(t *testing.T) {
+	copenhagen, err := time.LoadLocation("Europe/Copenhagen")
+	require.NoError(t, err)
+	ts := time.Date(2024, 3, 1, 13, 0, 0, 0, copenhagen)
+
+	bs, err := driplang.Marshal(driplang.BeforeTime{A: driplang.AfterTime{A: driplang.EventName("a"), T: ts}, T: ts.UTC()})
+	require.NoError(t, err)
+
+	gotExpr, err := driplang.Unmarshal(bs)
+	require.NoError(t, err)
+
+	before := gotExpr.(driplang.BeforeTime)
+	require.Equal(t, time.UTC, before.T.Location())
+	require.True(t, ts.Equal(before.T))
+
+	after := before.A.(driplang.AfterTime)
+	_, offset := after.T.Zone()
+	require.Equal(t, 60*60, offset)
+	require.True(t, ts.Equal(after.T))
+
+	require.Equal(t, driplang.Canonical(driplang.BeforeTime{A: driplang.AfterTime{A: driplang.EventName("a"), T: ts}, T: ts}), driplang.Canonical(gotExpr))
+}
+
+// TestMarshalErrors verifies that Marshal refuses expressions that can't be
+// unmarshalled, locating each problem by its JSON path.
+func TestMarshalErrors(t *testing.T) {
+	_, err := driplang.Marshal(driplang.Then{
+		A: driplang.AnyOf{Exprs: []driplang.Expr{driplang.EventName("a"), unknownExpr{}}},
+		B: driplang.Not{},
+	})
+	require.Equal(t, driplang.Errors{
+		{Code: driplang.ErrorCodeUnknownOperator, Path: "$.a.exprs[1]", Message: "unknown operator driplang_test.unknownExpr"},
+		{Code: driplang.ErrorCodeMissingField, Path: "$.b.a", Message: "expression is nil"},
+	}, err)
+}
+
 func TestUnmarshalInvalidExpression(t *testing.T) {
 	tests := map[string]struct {
 		bs  []byte
@@ -120,11 +282,311 @@ func TestUnmarshalInvalidExpression(t *testing.T) {
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
 			_, err := driplang.Unmarshal(test.bs)
-			require.Equal(t, test.err, err)
+			require.ErrorIs(t, err, test.err)
 		})
 	}
 }
 
+// TestUnmarshalErrors verifies that Unmarshal reports every problem in the
+// input, each located by its JSON path.
+func TestUnmarshalErrors(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		expected driplang.Errors
+	}{
+		"invalid json": {
+			input: "{\n\"operator\": }",
+			expected: driplang.Errors{
+				{Code: driplang.ErrorCodeSyntax, Line: 2, Column: 13, Message: "invalid character '}' looking for beginning of value"},
+			},
+		},
+		"not an object": {
+			input: `[1, 2]`,
+			expected: driplang.Errors{
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$", Message: "expected object, got array"},
+			},
+		},
+		"unknown operator": {
+			input: `{"operator": "xor", "a": {"operator": "event_name", "a": "a"}}`,
+			expected: driplang.Errors{
+				{Code: driplang.ErrorCodeUnknownOperator, Path: "$.operator", Message: `unknown operator "xor"`},
+			},
+		},
+		"nested problems": {
+			input: `{"operator": "then",
+				"a": {"operator": "not", "a": {"operator": "event_name", "a": 42}},
+				"b": {"operator": "and",
+					"a": {"operator": "after", "a": {"operator": "event_name", "a": "b"}, "d": "1h"},
+					"b": {"operator": "or", "a": {"operator": "event_name"}}
+				}
+			}`,
+			expected: driplang.Errors{
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.a.a.a", Message: "expected string, got number"},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.b.a.d", Message: `invalid duration "1h"`},
+				{Code: driplang.ErrorCodeMissingField, Path: "$.b.b.a", Message: `missing "a"`},
+				{Code: driplang.ErrorCodeMissingField, Path: "$.b.b", Message: `missing "b"`},
+			},
+		},
+		"invalid predicates": {
+			input: `{"operator": "where", "a": "purchase", "predicates": [
+				{"property": "amount", "op": ">", "value": "100"},
+				{"property": "amount", "op": "~", "value": 1},
+				{"property": "path", "op": "MATCHES", "value": "("},
+				{"op": "=", "value": 1},
+				{"property": "country", "op": "IN", "value": ["DK", ["SE"]]},
+				7
+			]}`,
+			expected: driplang.Errors{
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.predicates[0]", Message: "> expects a number, got string"},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.predicates[1]", Message: `unknown predicate operator "~"`},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.predicates[2]", Message: `invalid regular expression "("`},
+				{Code: driplang.ErrorCodeMissingField, Path: "$.predicates[3]", Message: `missing "property"`},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.predicates[4]", Message: "IN expects a list of strings, numbers and booleans, got list"},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.predicates[5]", Message: "expected object, got number"},
+			},
+		},
+		"invalid count": {
+			input: `{"operator": "or",
+				"a": {"operator": "count", "a": {"operator": "event_name", "a": "a"}, "op": "IN", "n": 1},
+				"b": {"operator": "count", "a": {"operator": "event_name", "a": "a"}, "op": "=", "n": 1.5}
+			}`,
+			expected: driplang.Errors{
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.a", Message: `invalid count operator "IN"`},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.b.n", Message: "expected integer, got 1.5"},
+			},
+		},
+		"invalid window": {
+			input: `{"operator": "or",
+				"a": {"operator": "window", "a": {"operator": "event_name", "a": "a"}, "n": 0, "d": "1"},
+				"b": {"operator": "window", "a": {"operator": "event_name", "a": "a"}, "n": "1", "d": "-1"}
+			}`,
+			expected: driplang.Errors{
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.a", Message: "window count 0 is less than 1"},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.b.n", Message: "expected number, got string"},
+			},
+		},
+		"invalid calendar": {
+			input: `{"operator": "or",
+				"a": {"operator": "during", "a": {"operator": "event_name", "a": "a"}, "from": "9", "to": "17:00", "zone": "UTC"},
+				"b": {"operator": "or",
+					"a": {"operator": "on", "a": {"operator": "event_name", "a": "a"}, "days": ["MON", "FUNDAY"], "zone": "UTC"},
+					"b": {"operator": "and",
+						"a": {"operator": "on", "a": {"operator": "event_name", "a": "a"}, "days": ["MON"], "zone": "Mars/Olympus"},
+						"b": {"operator": "after_time", "a": {"operator": "event_name", "a": "a"}, "t": "2024-03-01"}
+					}
+				}
+			}`,
+			expected: driplang.Errors{
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.a.from", Message: `invalid time of day "9"`},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.b.a.days[1]", Message: `invalid day of week "FUNDAY"`},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.b.b.a", Message: `unknown time zone "Mars/Olympus"`},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.b.b.b.t", Message: `invalid timestamp "2024-03-01"`},
+			},
+		},
+		"invalid seq": {
+			input: `{"operator": "or",
+				"a": {"operator": "seq", "steps": [{"operator": "not", "a": {"operator": "event_name", "a": "a"}}]},
+				"b": {"operator": "or",
+					"a": {"operator": "seq", "steps": [], "relaxed": "yes"},
+					"b": {"operator": "seq", "steps": [{"operator": "event_name", "a": "a"}], "ignore": ["b", 1]}
+				}
+			}`,
+			expected: driplang.Errors{
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.a", Message: "SEQ step 0 is not, not an event name"},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.b.a.relaxed", Message: "expected boolean, got string"},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.b.b.ignore[1]", Message: "expected string, got number"},
+			},
+		},
+		"invalid n-ary": {
+			input: `{"operator": "or",
+				"a": {"operator": "any_of", "exprs": []},
+				"b": {"operator": "all_of",
+					"exprs": [
+						{"operator": "at_least", "k": 3, "exprs": [{"operator": "event_name", "a": "a"}]},
+						{"operator": "at_least", "k": "1", "exprs": {}}
+					]
+				}
+			}`,
+			expected: driplang.Errors{
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.a", Message: "ANY_OF has no expressions"},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.b.exprs[0]", Message: "AT_LEAST count 3 is greater than the number of expressions, 1"},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.b.exprs[1].k", Message: "expected number, got string"},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.b.exprs[1].exprs", Message: "expected array, got object"},
+			},
+		},
+		"invalid then strategy": {
+			input: `{"operator": "or",
+				"a": {"operator": "then", "a": {"operator": "event_name", "a": "a"}, "b": {"operator": "event_name", "a": "b"}, "strategy": "FIRST"},
+				"b": {"operator": "then", "a": {"operator": "event_name", "a": "a"}, "b": {"operator": "event_name", "a": "b"}, "strategy": 1}
+			}`,
+			expected: driplang.Errors{
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.a.strategy", Message: `invalid THEN strategy "FIRST"`},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.b.strategy", Message: "expected string, got number"},
+			},
+		},
+		"invalid anchor": {
+			input: `{"operator": "or",
+				"a": {"operator": "after", "a": {"operator": "event_name", "a": "a"}, "d": "1", "anchor": {"kind": "NOW"}},
+				"b": {"operator": "or",
+					"a": {"operator": "after", "a": {"operator": "event_name", "a": "a"}, "d": "1", "anchor": {"kind": "", "name": "b"}},
+					"b": {"operator": "after", "a": {"operator": "event_name", "a": "a"}, "d": "1", "anchor": {"name": 1}}
+				}
+			}`,
+			expected: driplang.Errors{
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.a.anchor", Message: `invalid anchor "NOW"`},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.b.a.anchor", Message: `anchor name "b" given without FIRST or LAST`},
+				{Code: driplang.ErrorCodeMissingField, Path: "$.b.b.anchor", Message: `missing "kind"`},
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.b.b.anchor.name", Message: "expected string, got number"},
+			},
+		},
+		"invalid operator type": {
+			input: `{"operator": "not", "a": {"operator": 1}}`,
+			expected: driplang.Errors{
+				{Code: driplang.ErrorCodeInvalidValue, Path: "$.a.operator", Message: "expected string, got number"},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := driplang.Unmarshal([]byte(test.input))
+			require.Equal(t, test.expected, err)
+			require.ErrorIs(t, err, driplang.ErrInvalidExpression)
+		})
+	}
+}
+
+// TestUnmarshalLimits verifies that Unmarshal rejects expressions exceeding
+// the configured depth and node limits.
+func TestUnmarshalLimits(t *testing.T) {
+	expr := driplang.Then{
+		A: driplang.EventName("a"),
+		B: driplang.Not{
+			A: driplang.And{
+				A: driplang.EventName("b"),
+				B: driplang.EventName("c"),
+			},
+		},
+	}
+	bs, err := driplang.Marshal(expr)
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		opts     []driplang.Option
+		expected error
+	}{
+		"within limits": {
+			opts: []driplang.Option{driplang.WithMaxDepth(4), driplang.WithMaxNodes(6)},
+		},
+		"limits disabled": {
+			opts: []driplang.Option{driplang.WithMaxDepth(0), driplang.WithMaxNodes(0)},
+		},
+		"too deep": {
+			opts: []driplang.Option{driplang.WithMaxDepth(3)},
+			expected: driplang.Errors{
+				{Code: driplang.ErrorCodeLimitExceeded, Path: "$.b.a.a", Message: "expression is nested deeper than 3"},
+				{Code: driplang.ErrorCodeLimitExceeded, Path: "$.b.a.b", Message: "expression is nested deeper than 3"},
+			},
+		},
+		"too many nodes": {
+			opts: []driplang.Option{driplang.WithMaxNodes(5)},
+			expected: driplang.Errors{
+				{Code: driplang.ErrorCodeLimitExceeded, Path: "$.b.a.b", Message: "expression has more than 5 nodes"},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := driplang.Unmarshal(bs, test.opts...)
+			if test.expected != nil {
+				require.Equal(t, test.expected, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, expr, got)
+		})
+	}
+}
+
+// TestUnmarshalDefaultDepthLimit verifies that very deeply nested input is
+// rejected by default instead of exhausting the stack.
+func TestUnmarshalDefaultDepthLimit(t *testing.T) {
+	const depth = 5000
+	bs := strings.Repeat(`{"operator": "not", "a": `, depth) + `{"operator": "event_name", "a": "a"}` + strings.Repeat("}", depth)
+
+	_, err := driplang.Unmarshal([]byte(bs))
+	require.ErrorIs(t, err, driplang.ErrInvalidExpression)
+
+	var errs driplang.Errors
+	require.ErrorAs(t, err, &errs)
+	require.Equal(t, driplang.ErrorCodeLimitExceeded, errs[0].Code)
+}
+
+// FuzzUnmarshal verifies that Unmarshal never panics, that it enforces its
+// limits, and that everything it accepts survives a round trip through
+// Marshal.
+func FuzzUnmarshal(f *testing.F) {
+	seeds := []driplang.Expr{
+		driplang.EventName("a"),
+		driplang.Then{
+			A: driplang.And{A: driplang.EventName("a"), B: driplang.Not{A: driplang.EventName("b")}},
+			B: driplang.Or{
+				A: driplang.After{A: driplang.EventName("c"), D: driplang.Duration(time.Hour)},
+				B: driplang.EventName("d \" \\ \u00e6"),
+			},
+		},
+	}
+	for _, seed := range seeds {
+		bs, err := driplang.Marshal(seed)
+		require.NoError(f, err)
+		f.Add(bs)
+	}
+	f.Add([]byte(`{"operator": "after", "a": {"operator": "event_name", "a": "a"}, "d": 1}`))
+	f.Add([]byte(`{"operator": "and", "a": [], "b": null}`))
+
+	const maxDepth, maxNodes = 10, 20
+	f.Fuzz(func(t *testing.T, bs []byte) {
+		expr, err := driplang.Unmarshal(bs, driplang.WithMaxDepth(maxDepth), driplang.WithMaxNodes(maxNodes))
+		if err != nil {
+			require.ErrorIs(t, err, driplang.ErrInvalidExpression)
+			return
+		}
+
+		require.LessOrEqual(t, exprDepth(expr), maxDepth)
+		require.LessOrEqual(t, exprNodes(expr), maxNodes)
+
+		marshalled, err := driplang.Marshal(expr)
+		require.NoError(t, err)
+
+		got, err := driplang.Unmarshal(marshalled, driplang.WithMaxDepth(maxDepth), driplang.WithMaxNodes(maxNodes))
+		require.NoError(t, err)
+		require.Equal(t, expr, got)
+	})
+}
+
+// exprDepth returns the nesting depth of e, counting e itself as depth 1.
+func exprDepth(e driplang.Expr) int {
+	d := 0
+	if n, ok := e.(driplang.Node); ok {
+		for _, child := range n.Children() {
+			d = max(d, exprDepth(child))
+		}
+	}
+	return 1 + d
+}
+
+// exprNodes returns the number of operators and event names in e.
+func exprNodes(e driplang.Expr) int {
+	n := 0
+	driplang.Walk(e, func(driplang.Expr) bool {
+		n++
+		return true
+	})
+	return n
+}
+
 func jsonMarshal(t *testing.T, v interface{}) []byte {
 	mv, err := json.Marshal(v)
 
@@ -0,0 +1,357 @@
+package driplang
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrEventOutOfOrder is returned by Matcher.Observe when given an event older
+// than the time it has been advanced to.
+var ErrEventOutOfOrder = errors.New("event out of order")
+
+// Transition describes the result of a Matcher before and after observing an
+// event or advancing time.
+type Transition struct {
+	From bool
+	To   bool
+	At   time.Time
+}
+
+// Changed reports whether the result changed.
+func (t Transition) Changed() bool {
+	return t.From != t.To
+}
+
+// Matcher evaluates an expression as events arrive one at a time, e.g. for a
+// single user, and reports when the result changes. The time of evaluation is
+// driven by the observed events and by calls to Advance.
+//
+// For most expressions, Matcher keeps a summary of the events per operator,
+// e.g. counts and the first occurrences of event names, and updates it as each
+// event is observed. Expressions using Seq, AFTER anchored to the latest or a
+// named event, or THEN, COUNT, WINDOW, SINCE, DURING or ON of more than an
+// event name or WHERE, are re-evaluated against the events that can change the
+// result instead; see Horizon.
+//
+// A Matcher can be stored between events using json.Marshal and restored
+// using json.Unmarshal.
+type Matcher struct {
+	program   *Program
+	names     map[string]bool
+	span      time.Duration
+	bounded   bool
+	events    []Event
+	now       time.Time
+	satisfied bool
+	next      time.Time
+	hasNext   bool
+
+	// root evaluates the expression incrementally, and is nil if it can't
+	// be; see incremental. observed is the number of events it has been
+	// given.
+	root     node
+	history  history
+	observed int
+
+	// final reports whether the expression was satisfied by events older
+	// than the span, which have been left out, making it satisfied from
+	// then on.
+	final bool
+}
+
+// NewMatcher returns a Matcher for e that hasn't observed any events. It
+// returns an error if e can't be compiled; see Compile.
+func NewMatcher(e Expr) (*Matcher, error) {
+	m := &Matcher{}
+	err := m.init(e)
+	if err != nil {
+		return nil, err
+	}
+
+	m.update()
+	return m, nil
+}
+
+func (m *Matcher) init(e Expr) error {
+	program, err := Compile(e)
+	if err != nil {
+		return err
+	}
+
+	m.program = program
+	if incremental(e) {
+		m.root = m.history.node(e, minTime)
+		return nil
+	}
+
+	m.span, m.bounded = Horizon(e)
+	m.names = make(map[string]bool)
+	for _, name := range Names(e) {
+		m.names[name] = true
+	}
+	return nil
+}
+
+// Satisfied returns the result of the latest evaluation.
+func (m *Matcher) Satisfied() bool {
+	return m.satisfied
+}
+
+// Next returns the time at which Advance must be called for the result to
+// change, if no new events are observed before then. If the result can't
+// change with the passing of time alone, false is returned.
+func (m *Matcher) Next() (time.Time, bool) {
+	return m.next, m.hasNext
+}
+
+// Observe adds event to the events seen by m and advances the time of
+// evaluation to the time of event. Events must be observed in the order they
+// happened, and can't be older than the time of evaluation;
+// ErrEventOutOfOrder is returned otherwise.
+func (m *Matcher) Observe(event Event) (Transition, error) {
+	if event.Time.Before(m.now) {
+		return Transition{}, fmt.Errorf("%w: %s is before %s", ErrEventOutOfOrder, event.Time, m.now)
+	}
+
+	if m.root != nil {
+		m.observe(event)
+		m.now = event.Time
+		return m.update(), nil
+	}
+
+	// Only events used by the expression are kept, except for the first one,
+	// which marks the start of history for Since, and unless events of any
+	// name can change the result.
+	if !m.names[event.Name] && len(m.events) > 0 && !m.program.allEvents {
+		return m.Advance(event.Time), nil
+	}
+
+	m.events = append(m.events, event)
+	m.now = event.Time
+	return m.update(), nil
+}
+
+// Advance advances the time of evaluation to now. Times before the current
+// time of evaluation are ignored.
+func (m *Matcher) Advance(now time.Time) Transition {
+	if !now.After(m.now) {
+		return Transition{From: m.satisfied, To: m.satisfied, At: m.now}
+	}
+
+	m.now = now
+	if !m.hasNext || now.Before(m.next) {
+		return Transition{From: m.satisfied, To: m.satisfied, At: m.now}
+	}
+	return m.update()
+}
+
+// observe gives event to the nodes of m.
+func (m *Matcher) observe(event Event) {
+	if m.observed == 0 {
+		m.history.start = event.Time
+	}
+	m.root.observe(m.observed, event)
+	m.observed++
+}
+
+// update re-evaluates the expression at m.now.
+func (m *Matcher) update() Transition {
+	t := Transition{From: m.satisfied, At: m.now}
+	if m.root != nil {
+		ev := evaluator{now: m.now}
+		_, satisfied, _ := m.root.evaluate(&ev)
+		m.satisfied = m.final || satisfied
+	} else {
+		m.forget()
+		m.satisfied = m.final || m.program.EvaluateAt(m.events, m.now)
+	}
+	m.next, m.hasNext = m.nextChange()
+	t.To = m.satisfied
+	return t
+}
+
+// forget leaves out the events older than the span before m.now, if the
+// expression has one, first recording whether they satisfied it. Their result
+// is final, and the newer events are enough to evaluate the expression for
+// the rest; see Horizon.
+func (m *Matcher) forget() {
+	if !m.bounded {
+		return
+	}
+	if m.final {
+		m.events = nil
+		return
+	}
+
+	cutoff := m.now.Add(-m.span)
+	n := sort.Search(len(m.events), func(i int) bool {
+		return !m.events[i].Time.Before(cutoff)
+	})
+	if n == 0 {
+		return
+	}
+
+	m.final = EvaluateAt(startingBefore(m.program.Expr(), cutoff), m.events, m.now)
+	m.events = append([]Event{}, m.events[n:]...)
+}
+
+// nextChange returns the time at which the result can change, if no new
+// events are observed before then.
+func (m *Matcher) nextChange() (time.Time, bool) {
+	if m.final {
+		return time.Time{}, false
+	}
+	if m.root == nil {
+		return m.program.NextChange(m.events, m.now)
+	}
+
+	ev := evaluator{}
+	return ev.nextChangeOf(m.now, func(ev *evaluator) bool {
+		_, satisfied, _ := m.root.evaluate(ev)
+		return satisfied
+	})
+}
+
+// startingBefore returns an expression satisfied by the sets of events that
+// satisfy e and start before t, for e with a bounded span. Satisfying e
+// without THEN can't be undone by later events, so only the occurrences of
+// Then.A are restricted.
+func startingBefore(e Expr, t time.Time) Expr {
+	switch v := e.(type) {
+	case Or:
+		return Or{A: startingBefore(v.A, t), B: startingBefore(v.B, t)}
+	case AnyOf:
+		return AnyOf{Exprs: startingBeforeAll(v.Exprs, t)}
+	case AllOf:
+		return AllOf{Exprs: startingBeforeAll(v.Exprs, t)}
+	case AtLeast:
+		return AtLeast{K: v.K, Exprs: startingBeforeAll(v.Exprs, t)}
+	case AfterTime:
+		return AfterTime{A: startingBefore(v.A, t), T: v.T}
+	case BeforeTime:
+		return BeforeTime{A: startingBefore(v.A, t), T: v.T}
+	case Then:
+		return Then{A: BeforeTime{A: v.A, T: t}, B: v.B, Strategy: v.Strategy}
+	default:
+		return e
+	}
+}
+
+// startingBeforeAll returns startingBefore of each of exprs.
+func startingBeforeAll(exprs []Expr, t time.Time) []Expr {
+	restricted := make([]Expr, len(exprs))
+	for i, e := range exprs {
+		restricted[i] = startingBefore(e, t)
+	}
+	return restricted
+}
+
+type matcherState struct {
+	Expr      json.RawMessage `json:"expr"`
+	Events    []matcherEvent  `json:"events,omitempty"`
+	Nodes     *nodesState     `json:"nodes,omitempty"`
+	Now       time.Time       `json:"now"`
+	Satisfied bool            `json:"satisfied"`
+	Final     bool            `json:"final,omitempty"`
+}
+
+// nodesState is the stored form of the nodes of a Matcher.
+type nodesState struct {
+	Root     json.RawMessage `json:"root"`
+	Start    time.Time       `json:"start"`
+	Observed int             `json:"observed"`
+}
+
+func (m *Matcher) MarshalJSON() ([]byte, error) {
+	expr, err := Marshal(m.program.Expr())
+	if err != nil {
+		return nil, err
+	}
+
+	state := matcherState{
+		Expr:      expr,
+		Events:    matcherEvents(m.events),
+		Now:       m.now,
+		Satisfied: m.satisfied,
+		Final:     m.final,
+	}
+	if m.root != nil {
+		root, err := json.Marshal(m.root)
+		if err != nil {
+			return nil, err
+		}
+		state.Nodes = &nodesState{Root: root, Start: m.history.start, Observed: m.observed}
+	}
+	return json.Marshal(state)
+}
+
+func (m *Matcher) UnmarshalJSON(bs []byte) error {
+	state := matcherState{}
+	err := json.Unmarshal(bs, &state)
+	if err != nil {
+		return err
+	}
+
+	expr, err := Unmarshal(state.Expr)
+	if err != nil {
+		return err
+	}
+
+	*m = Matcher{
+		events:    restoredEvents(state.Events),
+		now:       state.Now,
+		satisfied: state.Satisfied,
+		final:     state.Final,
+	}
+	err = m.init(expr)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case m.root != nil && state.Nodes != nil:
+		m.history.start, m.observed = state.Nodes.Start, state.Nodes.Observed
+		err = json.Unmarshal(state.Nodes.Root, m.root)
+		if err != nil {
+			return err
+		}
+
+	case m.root != nil:
+		// Stored as events, e.g. before the expression could be evaluated
+		// incrementally.
+		for _, event := range m.events {
+			m.observe(event)
+		}
+		m.events = nil
+	}
+
+	m.next, m.hasNext = m.nextChange()
+	return nil
+}
+
+// matcherEvent is the stored form of an Event, keeping the encoding of Event
+// itself unchanged.
+type matcherEvent struct {
+	Name       string                 `json:"name"`
+	Time       time.Time              `json:"time"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+func matcherEvents(events []Event) []matcherEvent {
+	stored := make([]matcherEvent, len(events))
+	for i, event := range events {
+		stored[i] = matcherEvent(event)
+	}
+	return stored
+}
+
+func restoredEvents(stored []matcherEvent) []Event {
+	events := make([]Event, len(stored))
+	for i, event := range stored {
+		events[i] = Event(event)
+	}
+	return events
+}
@@ -0,0 +1,598 @@
+package driplang_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/micvbang/driplang"
+	"github.com/micvbang/go-helpy/timey"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMatcherTransitions verifies that Matcher reports transitions caused by
+// both observed events and the passing of time.
+func TestMatcherTransitions(t *testing.T) {
+	const (
+		signup   = "signup"
+		purchase = "purchase"
+	)
+
+	expr := driplang.Then{
+		A: driplang.EventName(signup),
+		B: driplang.After{
+			A: driplang.Not{A: driplang.EventName(purchase)},
+			D: driplang.Duration(72 * time.Hour),
+		},
+	}
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	m, err := driplang.NewMatcher(expr)
+	require.NoError(t, err)
+	require.False(t, m.Satisfied())
+
+	transition, err := m.Observe(driplang.Event{Name: signup, Time: start})
+	require.NoError(t, err)
+	require.False(t, transition.Changed())
+
+	next, ok := m.Next()
+	require.True(t, ok)
+	require.Equal(t, timey.AddHours(start, 72).Add(time.Nanosecond), next)
+
+	// Irrelevant events don't change the result.
+	transition, err = m.Observe(driplang.Event{Name: "visit", Time: timey.AddHours(start, 1)})
+	require.NoError(t, err)
+	require.False(t, transition.Changed())
+
+	transition = m.Advance(timey.AddHours(start, 71))
+	require.False(t, transition.Changed())
+
+	transition = m.Advance(next)
+	require.Equal(t, driplang.Transition{From: false, To: true, At: next}, transition)
+	require.True(t, m.Satisfied())
+
+	_, ok = m.Next()
+	require.False(t, ok)
+
+	_, err = m.Observe(driplang.Event{Name: signup, Time: start})
+	require.ErrorIs(t, err, driplang.ErrEventOutOfOrder)
+}
+
+// TestMatcherNotSatisfiedWithoutEvents verifies that a new Matcher reports
+// the result of evaluating its expression without events.
+func TestMatcherNotSatisfiedWithoutEvents(t *testing.T) {
+	m, err := driplang.NewMatcher(driplang.Not{A: driplang.EventName("a")})
+	require.NoError(t, err)
+	require.True(t, m.Satisfied())
+
+	transition, err := m.Observe(driplang.Event{Name: "a", Time: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)})
+	require.NoError(t, err)
+	require.Equal(t, driplang.Transition{From: true, To: false, At: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}, transition)
+}
+
+// TestMatcherEqualsEvaluate verifies that, after every observed event and
+// advancement of time, Matcher reports the same result as evaluating the
+// expression against the full history, and that this holds when the
+// Matcher is marshalled and unmarshalled along the way.
+func TestMatcherEqualsEvaluate(t *testing.T) {
+	const (
+		a = "a"
+		b = "b"
+		c = "c"
+	)
+
+	expr := driplang.Or{
+		A: driplang.Then{
+			A: driplang.EventName(a),
+			B: driplang.After{
+				A: driplang.Not{A: driplang.EventName(b)},
+				D: driplang.Duration(5 * time.Hour),
+			},
+		},
+		B: driplang.Then{
+			A: driplang.EventName(b),
+			B: driplang.And{
+				A: driplang.EventName(a),
+				B: driplang.After{
+					A: driplang.EventName(a),
+					D: driplang.Duration(2 * time.Hour),
+				},
+			},
+		},
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	names := []string{a, b, c}
+
+	for run := 0; run < 50; run++ {
+		m, err := driplang.NewMatcher(expr)
+		require.NoError(t, err)
+		history := []driplang.Event{}
+		now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+		for step := 0; step < 20; step++ {
+			now = now.Add(time.Duration(rng.Intn(4*60)) * time.Minute)
+
+			if rng.Intn(3) == 0 {
+				m.Advance(now)
+			} else {
+				event := driplang.Event{Name: names[rng.Intn(len(names))], Time: now}
+				history = append(history, event)
+
+				_, err := m.Observe(event)
+				require.NoError(t, err)
+			}
+			require.Equal(t, driplang.EvaluateAt(expr, history, now), m.Satisfied(), "history: %v", history)
+
+			if rng.Intn(4) == 0 {
+				bs, err := json.Marshal(m)
+				require.NoError(t, err)
+
+				m = &driplang.Matcher{}
+				require.NoError(t, json.Unmarshal(bs, m))
+			}
+		}
+	}
+}
+
+// TestMatcherEqualsEvaluateRandom verifies that Matcher reports the same
+// results as evaluating random expressions against the full history, when the
+// history has events whose names aren't used by the expressions, and when
+// events older than their span are left out.
+func TestMatcherEqualsEvaluateRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	names := []string{"a", "b", "c"}
+
+	for run := 0; run < 2000; run++ {
+		expr := randomExpr(rng, names, 4)
+		switch rng.Intn(3) {
+		case 0:
+			// Evaluated from the event following A, which can have any name.
+			expr = driplang.Then{A: randomExpr(rng, names, 1), B: expr}
+		case 1:
+			// Bounded by a span, leaving out older events.
+			expr = driplang.Then{
+				A:        randomExpr(rng, names, 1),
+				B:        driplang.Within{A: expr, D: driplang.Duration(time.Duration(rng.Intn(6)) * time.Hour)},
+				Strategy: driplang.ThenAny,
+			}
+		}
+
+		m, err := driplang.NewMatcher(expr)
+		require.NoError(t, err)
+
+		history := []driplang.Event{}
+		now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		for step := 0; step < 10; step++ {
+			now = now.Add(time.Duration(rng.Intn(3*60)) * time.Minute)
+
+			if rng.Intn(4) == 0 {
+				m.Advance(now)
+			} else {
+				event := randomEvents(rng, []string{"a", "b", "c", "x", "y"}, now, 1)[0]
+				event.Time = now
+				history = append(history, event)
+
+				_, err := m.Observe(event)
+				require.NoError(t, err)
+			}
+			require.Equal(t, driplang.EvaluateAt(expr, history, now), m.Satisfied(), "%s %v", expr.Expression(), history)
+
+			if rng.Intn(4) == 0 {
+				bs, err := json.Marshal(m)
+				require.NoError(t, err)
+
+				m = &driplang.Matcher{}
+				require.NoError(t, json.Unmarshal(bs, m))
+			}
+		}
+	}
+}
+
+// TestMatcherIncrementalEqualsEvaluate verifies that Matcher reports the same
+// results and next changes as evaluating random expressions against the full
+// history, for the expressions whose summaries of the events it keeps, also
+// when it's marshalled and unmarshalled along the way.
+func TestMatcherIncrementalEqualsEvaluate(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	names := []string{"a", "b", "c"}
+	strategies := []driplang.ThenStrategy{driplang.ThenDefault, driplang.ThenEarliest, driplang.ThenLatest, driplang.ThenAny}
+
+	incremental := 0
+	for run := 0; run < 5000; run++ {
+		expr := randomExpr(rng, names, 4)
+		if rng.Intn(2) == 0 {
+			expr = driplang.Then{
+				A:        randomPredicate(rng, names),
+				B:        expr,
+				Strategy: strategies[rng.Intn(len(strategies))],
+			}
+		}
+
+		m, err := driplang.NewMatcher(expr)
+		require.NoError(t, err)
+		if !matcherNodes(t, m) {
+			continue
+		}
+		incremental++
+
+		history := []driplang.Event{}
+		now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		for step := 0; step < 12; step++ {
+			now = now.Add(time.Duration(rng.Intn(3*60)) * time.Minute)
+
+			if rng.Intn(4) == 0 {
+				m.Advance(now)
+			} else {
+				event := randomEvents(rng, []string{"a", "b", "c", "x"}, now, 1)[0]
+				event.Time = now
+				history = append(history, event)
+
+				_, err := m.Observe(event)
+				require.NoError(t, err)
+			}
+			require.Equal(t, driplang.EvaluateAt(expr, history, now), m.Satisfied(), "%s %v", expr.Expression(), history)
+
+			next, ok := m.Next()
+			expectedNext, expectedOk := driplang.NextChange(expr, history, now)
+			require.Equal(t, expectedOk, ok, "%s %v", expr.Expression(), history)
+			require.Equal(t, expectedNext, next, "%s %v", expr.Expression(), history)
+
+			if rng.Intn(3) == 0 {
+				bs, err := json.Marshal(m)
+				require.NoError(t, err)
+
+				m = &driplang.Matcher{}
+				require.NoError(t, json.Unmarshal(bs, m))
+			}
+		}
+	}
+	require.Greater(t, incremental, 2000)
+}
+
+// TestMatcherRestoresEvents verifies that a Matcher stored with its events is
+// restored when the expression is evaluated incrementally.
+func TestMatcherRestoresEvents(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	stored := `{
+		"expr": {"operator": "count", "a": {"operator": "event_name", "a": "a"}, "op": ">=", "n": 2},
+		"events": [
+			{"name": "a", "time": "2024-03-01T12:00:00Z"},
+			{"name": "a", "time": "2024-03-01T13:00:00Z"}
+		],
+		"now": "2024-03-01T13:00:00Z",
+		"satisfied": true
+	}`
+
+	m := &driplang.Matcher{}
+	require.NoError(t, json.Unmarshal([]byte(stored), m))
+	require.True(t, matcherNodes(t, m))
+
+	_, err := m.Observe(driplang.Event{Name: "b", Time: timey.AddHours(t0, 2)})
+	require.NoError(t, err)
+	require.True(t, m.Satisfied())
+}
+
+// TestMatcherSpan verifies that Matcher only keeps the events within the span
+// of time of expressions that have one, while still reporting results of the
+// events it left out, when it keeps events rather than summaries of them.
+func TestMatcherSpan(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	expr := driplang.Then{
+		A:        driplang.Or{A: driplang.EventName("a"), B: driplang.EventName("c")},
+		B:        driplang.Within{A: driplang.EventName("b"), D: driplang.Duration(time.Hour)},
+		Strategy: driplang.ThenAny,
+	}
+
+	tests := map[string]struct {
+		names     []string
+		satisfied bool
+	}{
+		"not satisfied": {
+			names: []string{"a", "a", "a"},
+		},
+		"satisfied by left out events": {
+			names:     []string{"a", "b", "a"},
+			satisfied: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			m, err := driplang.NewMatcher(expr)
+			require.NoError(t, err)
+			require.False(t, matcherNodes(t, m))
+
+			for i := 0; i < 100; i++ {
+				_, err = m.Observe(driplang.Event{Name: test.names[i%len(test.names)], Time: t0.Add(time.Duration(i) * 40 * time.Minute)})
+				require.NoError(t, err)
+			}
+			require.Equal(t, test.satisfied, m.Satisfied())
+
+			bs, err := json.Marshal(m)
+			require.NoError(t, err)
+
+			state := struct {
+				Events []driplang.Event `json:"events"`
+			}{}
+			require.NoError(t, json.Unmarshal(bs, &state))
+			require.LessOrEqual(t, len(state.Events), 2)
+
+			m = &driplang.Matcher{}
+			require.NoError(t, json.Unmarshal(bs, m))
+			m.Advance(t0.Add(1000 * time.Hour))
+			require.Equal(t, test.satisfied, m.Satisfied())
+		})
+	}
+}
+
+// TestMatcherSummary verifies that the stored state of a Matcher keeping
+// summaries of the events doesn't grow with the number of events observed.
+func TestMatcherSummary(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]driplang.Expr{
+		"then any within": driplang.Then{
+			A:        driplang.EventName("a"),
+			B:        driplang.Within{A: driplang.EventName("b"), D: driplang.Duration(time.Hour)},
+			Strategy: driplang.ThenAny,
+		},
+		"then latest": driplang.Then{
+			A:        driplang.EventName("a"),
+			B:        driplang.After{A: driplang.Not{A: driplang.EventName("b")}, D: driplang.Duration(time.Hour)},
+			Strategy: driplang.ThenLatest,
+		},
+		"count":  driplang.Count{A: driplang.EventName("a"), Op: driplang.OpGreaterOrEqual, N: 1000},
+		"since":  driplang.Since{A: driplang.EventName("b"), D: driplang.Duration(time.Hour)},
+		"window": driplang.Window{A: driplang.EventName("a"), N: 3, D: driplang.Duration(time.Hour)},
+	}
+
+	for name, expr := range tests {
+		t.Run(name, func(t *testing.T) {
+			m, err := driplang.NewMatcher(expr)
+			require.NoError(t, err)
+			require.True(t, matcherNodes(t, m))
+
+			sizes := []int{}
+			for i := 0; i < 10000; i++ {
+				_, err = m.Observe(driplang.Event{Name: []string{"a", "a", "b"}[i%3], Time: t0.Add(time.Duration(i) * 40 * time.Minute)})
+				require.NoError(t, err)
+
+				if i == 99 || i == 9999 {
+					bs, err := json.Marshal(m)
+					require.NoError(t, err)
+					sizes = append(sizes, len(bs))
+				}
+			}
+
+			// Only the digits of the indices grow.
+			require.InDelta(t, sizes[0], sizes[1], 16)
+		})
+	}
+}
+
+// TestMatcherSince verifies that Matcher keeps track of the start of history
+// for Since, even when the first event isn't used by the expression.
+func TestMatcherSince(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	expr := driplang.Since{A: driplang.EventName("login"), D: driplang.Duration(24 * time.Hour)}
+
+	m, err := driplang.NewMatcher(expr)
+	require.NoError(t, err)
+
+	_, err = m.Observe(driplang.Event{Name: "signup", Time: t0})
+	require.NoError(t, err)
+	require.False(t, m.Satisfied())
+
+	next, ok := m.Next()
+	require.True(t, ok)
+	require.Equal(t, timey.AddHours(t0, 24), next)
+
+	transition := m.Advance(next)
+	require.True(t, transition.Changed())
+	require.True(t, m.Satisfied())
+}
+
+// TestMatcherAnchoredAfter verifies that Matcher keeps events of any name when
+// they can change the result, here by being the latest event.
+func TestMatcherAnchoredAfter(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	expr := driplang.After{
+		A:      driplang.Not{A: driplang.EventName("purchase")},
+		D:      driplang.Duration(24 * time.Hour),
+		Anchor: driplang.Anchor{Kind: driplang.AnchorLast},
+	}
+
+	m, err := driplang.NewMatcher(expr)
+	require.NoError(t, err)
+
+	_, err = m.Observe(driplang.Event{Name: "visit", Time: t0})
+	require.NoError(t, err)
+	_, err = m.Observe(driplang.Event{Name: "visit", Time: timey.AddHours(t0, 12)})
+	require.NoError(t, err)
+
+	next, ok := m.Next()
+	require.True(t, ok)
+	require.Equal(t, timey.AddHours(t0, 36).Add(time.Nanosecond), next)
+
+	transition := m.Advance(next)
+	require.True(t, transition.Changed())
+	require.True(t, m.Satisfied())
+}
+
+// TestMatcherAnchoredFirst verifies that Matcher keeps events of any name when
+// an After is anchored to the first of them in a range that doesn't start at
+// the first event.
+func TestMatcherAnchoredFirst(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	first := driplang.Anchor{Kind: driplang.AnchorFirst}
+
+	tests := map[string]struct {
+		expr   driplang.Expr
+		events []driplang.Event
+		now    time.Time
+	}{
+		"within then": {
+			expr: driplang.Then{
+				A: driplang.EventName("a"),
+				B: driplang.After{A: driplang.EventName("b"), D: driplang.Duration(time.Hour), Anchor: first},
+			},
+			events: []driplang.Event{
+				{Name: "a", Time: t0},
+				{Name: "x", Time: t0.Add(time.Minute)},
+				{Name: "b", Time: timey.AddHours(t0, 2)},
+			},
+			now: timey.AddHours(t0, 3),
+		},
+		"within after time": {
+			expr: driplang.AtLeast{K: 1, Exprs: []driplang.Expr{
+				driplang.AfterTime{
+					A: driplang.After{A: driplang.EventName("b"), D: driplang.Duration(2 * time.Hour), Anchor: first},
+					T: t0.Add(30 * time.Minute),
+				},
+			}},
+			events: []driplang.Event{
+				{Name: "a", Time: t0},
+				{Name: "x", Time: timey.AddHours(t0, 1)},
+				{Name: "b", Time: t0.Add(210 * time.Minute)},
+			},
+			now: timey.AddHours(t0, 4),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			m, err := driplang.NewMatcher(test.expr)
+			require.NoError(t, err)
+
+			for _, event := range test.events {
+				_, err = m.Observe(event)
+				require.NoError(t, err)
+			}
+			m.Advance(test.now)
+
+			require.True(t, driplang.EvaluateAt(test.expr, test.events, test.now))
+			require.True(t, m.Satisfied())
+		})
+	}
+}
+
+// TestMatcherThenAfterTime verifies that Matcher keeps events of any name when
+// a Then using the default strategy is evaluated for prefixes of the events
+// starting at one of them, here the first event after a time.
+func TestMatcherThenAfterTime(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	expr, err := driplang.Parse(`(("c" SINCE 5h) THEN ("b" SINCE 3h)) AFTER "2024-03-01T18:00:00Z"`)
+	require.NoError(t, err)
+
+	events := []driplang.Event{
+		{Name: "c", Time: t0},
+		{Name: "b", Time: timey.AddHours(t0, 2)},
+		{Name: "a", Time: timey.AddHours(t0, 8)},
+	}
+	now := timey.AddHours(t0, 37)
+
+	m, err := driplang.NewMatcher(expr)
+	require.NoError(t, err)
+	for _, event := range events {
+		_, err = m.Observe(event)
+		require.NoError(t, err)
+	}
+	m.Advance(now)
+
+	require.True(t, driplang.EvaluateAt(expr, events, now))
+	require.True(t, m.Satisfied())
+}
+
+// TestMatcherStrictSeq verifies that Matcher keeps events of any name when
+// they can break a strict Seq.
+func TestMatcherStrictSeq(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	expr := driplang.Seq{Steps: []driplang.Expr{driplang.EventName("cart"), driplang.EventName("purchase")}}
+
+	m, err := driplang.NewMatcher(expr)
+	require.NoError(t, err)
+
+	for i, name := range []string{"cart", "visit", "purchase"} {
+		_, err = m.Observe(driplang.Event{Name: name, Time: timey.AddHours(t0, i)})
+		require.NoError(t, err)
+	}
+	require.False(t, m.Satisfied())
+}
+
+// matcherNodes reports whether m stores summaries of the events, rather than
+// the events.
+func matcherNodes(t *testing.T, m *driplang.Matcher) bool {
+	bs, err := json.Marshal(m)
+	require.NoError(t, err)
+
+	state := struct {
+		Nodes json.RawMessage `json:"nodes"`
+	}{}
+	require.NoError(t, json.Unmarshal(bs, &state))
+	return state.Nodes != nil
+}
+
+// randomPredicate returns a random event name or WHERE, possibly limited to
+// times, using the given event names.
+func randomPredicate(rng *rand.Rand, names []string) driplang.Expr {
+	e := randomExpr(rng, names, 1)
+	switch rng.Intn(4) {
+	case 0:
+		return driplang.AfterTime{A: e, T: time.Date(2024, 3, 1, 12+rng.Intn(12), 0, 0, 0, time.UTC)}
+	case 1:
+		from := rng.Intn(24)
+		return driplang.During{
+			A:    e,
+			From: driplang.Duration(time.Duration(from) * time.Hour),
+			To:   driplang.Duration(time.Duration((from+1+rng.Intn(12))%24) * time.Hour),
+			Zone: "UTC",
+		}
+	default:
+		return e
+	}
+}
+
+// BenchmarkMatcherObserve measures observing an event after a history of n
+// events. Keeping summaries of the events, the time it takes doesn't grow
+// with n.
+func BenchmarkMatcherObserve(b *testing.B) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	names := []string{"signup", "purchase", "page_view"}
+
+	exprs := map[string]driplang.Expr{
+		"then": driplang.Then{
+			A: driplang.EventName("signup"),
+			B: driplang.After{A: driplang.Not{A: driplang.EventName("purchase")}, D: driplang.Duration(time.Hour)},
+		},
+		"then any within": driplang.Then{
+			A:        driplang.EventName("signup"),
+			B:        driplang.Within{A: driplang.EventName("purchase"), D: driplang.Duration(time.Hour)},
+			Strategy: driplang.ThenAny,
+		},
+		"count": driplang.Count{A: driplang.EventName("purchase"), Op: driplang.OpGreaterOrEqual, N: 100_000},
+	}
+
+	for name, expr := range exprs {
+		for _, n := range []int{100, 10_000} {
+			b.Run(fmt.Sprintf("%s/%d", name, n), func(b *testing.B) {
+				m, err := driplang.NewMatcher(expr)
+				require.NoError(b, err)
+
+				for i := 0; i < n; i++ {
+					_, err := m.Observe(driplang.Event{Name: names[i%len(names)], Time: start.Add(time.Duration(i) * time.Minute)})
+					require.NoError(b, err)
+				}
+
+				event := driplang.Event{Name: "page_view", Time: start.Add(time.Duration(n) * time.Minute)}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_, err = m.Observe(event)
+				}
+				require.NoError(b, err)
+			})
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package driplang
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AnyOf is satisfied if any of Exprs is satisfied, like a chain of Ors, e.g.
+// `ANY_OF("a", "b", "c")`. The returned index is the lowest one of the
+// satisfied expressions. Unlike Or, which returns the larger index when only
+// one of its operands is satisfied, that is never the index of an expression
+// that isn't satisfied, such as NOT "a" when "a" is; see Flatten.
+type AnyOf struct {
+	Exprs []Expr `json:"exprs"`
+}
+
+func (a AnyOf) Expression() string {
+	return fmt.Sprintf("ANY_OF(%s)", expressions(a.Exprs))
+}
+
+// check returns an error if a has no expressions.
+func (a AnyOf) check() error {
+	return checkOperands("ANY_OF", a.Exprs)
+}
+
+// AllOf is satisfied if all of Exprs are satisfied, like a chain of Ands,
+// e.g. `ALL_OF("a", "b", "c")`. The returned index is the highest one of the
+// satisfied expressions.
+type AllOf struct {
+	Exprs []Expr `json:"exprs"`
+}
+
+func (a AllOf) Expression() string {
+	return fmt.Sprintf("ALL_OF(%s)", expressions(a.Exprs))
+}
+
+// check returns an error if a has no expressions.
+func (a AllOf) check() error {
+	return checkOperands("ALL_OF", a.Exprs)
+}
+
+// AtLeast is satisfied if at least K of Exprs are satisfied, e.g.
+// `AT_LEAST(2, "a", "b", "c")`. The returned index is that of the event by
+// which K of them were satisfied.
+//
+// Within After, AtLeast is only satisfied if K of Exprs are satisfied by
+// events after its anchor.
+type AtLeast struct {
+	K     int    `json:"k"`
+	Exprs []Expr `json:"exprs"`
+}
+
+func (a AtLeast) Expression() string {
+	return fmt.Sprintf("AT_LEAST(%d, %s)", a.K, expressions(a.Exprs))
+}
+
+// check returns an error if a has no expressions, or if it can never be
+// satisfied because of its K.
+func (a AtLeast) check() error {
+	if err := checkOperands("AT_LEAST", a.Exprs); err != nil {
+		return err
+	}
+
+	if a.K < 1 {
+		return fmt.Errorf("AT_LEAST count %d is less than 1", a.K)
+	}
+
+	if a.K > len(a.Exprs) {
+		return fmt.Errorf("AT_LEAST count %d is greater than the number of expressions, %d", a.K, len(a.Exprs))
+	}
+	return nil
+}
+
+// checkOperands returns an error if the operator op has no operands.
+func checkOperands(op string, exprs []Expr) error {
+	if len(exprs) == 0 {
+		return fmt.Errorf("%s has no expressions", op)
+	}
+	return nil
+}
+
+// expressions returns the textual form of exprs, separated by commas.
+func expressions(exprs []Expr) string {
+	ss := make([]string, len(exprs))
+	for i, e := range exprs {
+		ss[i] = e.Expression()
+	}
+	return strings.Join(ss, ", ")
+}
+
+// Flatten returns e with every chain of directly nested Ands and AllOfs
+// replaced by a single AllOf, and every chain of directly nested Ors and
+// AnyOfs replaced by a single AnyOf, e.g. `(("a" OR "b") OR "c")` by
+// `ANY_OF("a", "b", "c")`. The result is evaluated like e.
+//
+// An Or with an operand that can return the index of an event without being
+// satisfied, such as NOT, returns that index when the other operand is
+// satisfied, which an AnyOf doesn't. Such Ors are kept, and end chains.
+func Flatten(e Expr) Expr {
+	return Rewrite(e, func(e Expr) Expr {
+		switch e.(type) {
+		case And, AllOf:
+			return AllOf{Exprs: flattenOperands(e, nil, allOperands)}
+		case Or, AnyOf:
+			if _, ok := anyOperands(e); !ok {
+				return e
+			}
+			return AnyOf{Exprs: flattenOperands(e, nil, anyOperands)}
+		default:
+			return e
+		}
+	})
+}
+
+// flattenOperands appends the operands of e to exprs. Operands that chained
+// returns operands for are replaced by their own operands.
+func flattenOperands(e Expr, exprs []Expr, chained func(Expr) ([]Expr, bool)) []Expr {
+	operands, ok := chained(e)
+	if !ok {
+		return append(exprs, e)
+	}
+
+	for _, operand := range operands {
+		exprs = flattenOperands(operand, exprs, chained)
+	}
+	return exprs
+}
+
+// allOperands returns the operands of e if it's an And or an AllOf.
+func allOperands(e Expr) ([]Expr, bool) {
+	switch v := e.(type) {
+	case And:
+		return []Expr{v.A, v.B}, true
+	case AllOf:
+		return v.Exprs, true
+	default:
+		return nil, false
+	}
+}
+
+// anyOperands returns the operands of e if it's an AnyOf, or an Or that is
+// evaluated like an AnyOf of its operands; see Flatten.
+func anyOperands(e Expr) ([]Expr, bool) {
+	switch v := e.(type) {
+	case Or:
+		if indexUnsatisfied(v.A) || indexUnsatisfied(v.B) {
+			return nil, false
+		}
+		return []Expr{v.A, v.B}, true
+	case AnyOf:
+		return v.Exprs, true
+	default:
+		return nil, false
+	}
+}
+
+// indexUnsatisfied reports whether e can return the index of an event when it
+// isn't satisfied, e.g. NOT, which returns that of the event satisfying its
+// operand.
+func indexUnsatisfied(e Expr) bool {
+	switch v := e.(type) {
+	case EventName, Where, And, AnyOf, AllOf, AtLeast, Then, Within, Between, Count, Window, Since, During, On, Seq:
+		return false
+	case Or:
+		return indexUnsatisfied(v.A) || indexUnsatisfied(v.B)
+	case AfterTime:
+		return indexUnsatisfied(v.A)
+	case BeforeTime:
+		return indexUnsatisfied(v.A)
+	default:
+		// NOT, AFTER, and operators of other packages.
+		return true
+	}
+}
@@ -0,0 +1,99 @@
+package driplang_test
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/micvbang/driplang"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFlatten verifies that Flatten replaces chains of Ands and Ors, including
+// those within other operators, by AllOfs and AnyOfs, and that Ors with an
+// operand returning an index when it isn't satisfied, such as NOT, are kept.
+func TestFlatten(t *testing.T) {
+	a, b, c, d := driplang.EventName("a"), driplang.EventName("b"), driplang.EventName("c"), driplang.EventName("d")
+
+	tests := map[string]struct {
+		expr     driplang.Expr
+		expected driplang.Expr
+	}{
+		"event name": {
+			expr:     a,
+			expected: a,
+		},
+		"left nested or": {
+			expr:     driplang.Or{A: driplang.Or{A: a, B: b}, B: c},
+			expected: driplang.AnyOf{Exprs: []driplang.Expr{a, b, c}},
+		},
+		"right nested and": {
+			expr:     driplang.And{A: a, B: driplang.AllOf{Exprs: []driplang.Expr{b, driplang.And{A: c, B: d}}}},
+			expected: driplang.AllOf{Exprs: []driplang.Expr{a, b, c, d}},
+		},
+		"mixed": {
+			expr: driplang.Or{
+				A: driplang.And{A: a, B: driplang.And{A: b, B: c}},
+				B: driplang.Or{A: d, B: driplang.Not{A: driplang.Or{A: a, B: b}}},
+			},
+			expected: driplang.Or{
+				A: driplang.AllOf{Exprs: []driplang.Expr{a, b, c}},
+				B: driplang.Or{A: d, B: driplang.Not{A: driplang.AnyOf{Exprs: []driplang.Expr{a, b}}}},
+			},
+		},
+		"or of not": {
+			expr: driplang.Or{
+				A: driplang.Or{A: a, B: b},
+				B: driplang.AnyOf{Exprs: []driplang.Expr{c, driplang.Or{A: driplang.Not{A: d}, B: a}}},
+			},
+			expected: driplang.AnyOf{Exprs: []driplang.Expr{
+				a,
+				b,
+				c,
+				driplang.Or{A: driplang.Not{A: d}, B: a},
+			}},
+		},
+		"within other operators": {
+			expr: driplang.Then{
+				A: driplang.AtLeast{K: 1, Exprs: []driplang.Expr{driplang.Or{A: a, B: b}}},
+				B: driplang.After{A: driplang.And{A: c, B: d}, D: driplang.Duration(time.Hour)},
+			},
+			expected: driplang.Then{
+				A: driplang.AtLeast{K: 1, Exprs: []driplang.Expr{driplang.AnyOf{Exprs: []driplang.Expr{a, b}}}},
+				B: driplang.After{A: driplang.AllOf{Exprs: []driplang.Expr{c, d}}, D: driplang.Duration(time.Hour)},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, test.expected, driplang.Flatten(test.expr))
+		})
+	}
+}
+
+// TestFlattenEqualsEvaluate verifies that flattened expressions are evaluated
+// like the expressions they were flattened from, for random expressions and
+// event histories.
+func TestFlattenEqualsEvaluate(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	names := []string{"a", "b", "c"}
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for run := 0; run < 2000; run++ {
+		expr := randomExpr(rng, names, 4)
+		flattened := driplang.Flatten(expr)
+		events := randomEvents(rng, names, start, rng.Intn(12))
+		now := start.Add(time.Duration(rng.Intn(48)) * time.Hour)
+
+		expectedIndex, expected := driplang.EvaluateWithIndexAt(expr, events, now)
+		gotIndex, got := driplang.EvaluateWithIndexAt(flattened, events, now)
+		require.Equal(t, expected, got, "%s %v", expr.Expression(), events)
+		require.Equal(t, expectedIndex, gotIndex, "%s %v", expr.Expression(), events)
+
+		expectedNext, expectedChanges := driplang.NextChange(expr, events, now)
+		gotNext, gotChanges := driplang.NextChange(flattened, events, now)
+		require.Equal(t, expectedChanges, gotChanges)
+		require.Equal(t, expectedNext, gotNext)
+	}
+}
@@ -0,0 +1,45 @@
+package driplang
+
+import "time"
+
+// NextChange returns the earliest time after now at which the result of
+// evaluating e against events changes, assuming that no new events arrive.
+// The returned time is the first instant at which EvaluateAt returns a
+// different result than it does at now. If the result never changes with the
+// passing of time alone, false is returned.
+//
+// This makes it possible to schedule a re-evaluation exactly when it's
+// needed, e.g. for `"signup" THEN (NOT "purchase" AFTER 72h)`, instead of
+// polling.
+func NextChange(e Expr, events []Event, now time.Time) (time.Time, bool) {
+	return evaluator{events: events}.nextChange(e, now)
+}
+
+// nextChange implements NextChange using a copy of ev.
+func (ev evaluator) nextChange(e Expr, now time.Time) (time.Time, bool) {
+	return ev.nextChangeOf(now, func(ev *evaluator) bool {
+		_, satisfied, _ := ev.evaluate(e, 0, len(ev.events), minTime)
+		return satisfied
+	})
+}
+
+// nextChangeOf is like nextChange, for the result of evaluate.
+func (ev evaluator) nextChangeOf(now time.Time, evaluate func(ev *evaluator) bool) (time.Time, bool) {
+	ev.now = now
+	initial := evaluate(&ev)
+
+	// The result can only change once a point in time compared to the time of
+	// evaluation has passed. Such points in time can depend on the result of
+	// other comparisons, so they're found one at a time, by evaluating just
+	// after the earliest one.
+	for ev.hasDeadline {
+		at := ev.deadline.Add(time.Nanosecond)
+
+		ev.now, ev.hasDeadline = at, false
+		if evaluate(&ev) != initial {
+			return at, true
+		}
+	}
+
+	return time.Time{}, false
+}
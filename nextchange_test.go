@@ -0,0 +1,136 @@
+package driplang_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micvbang/driplang"
+	"github.com/micvbang/go-helpy/timey"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNextChange verifies that NextChange returns the earliest time at which
+// the result of an evaluation changes without new events arriving, and that
+// the result actually changes at that time.
+func TestNextChange(t *testing.T) {
+	const (
+		signup   = "signup"
+		purchase = "purchase"
+		visit    = "visit"
+	)
+
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	notPurchaseAfter := func(d time.Duration) driplang.Expr {
+		return driplang.After{
+			A: driplang.Not{A: driplang.EventName(purchase)},
+			D: driplang.Duration(d),
+		}
+	}
+
+	tests := map[string]struct {
+		expr     driplang.Expr
+		events   []driplang.Event
+		now      time.Time
+		expected time.Time
+		changes  bool
+	}{
+		"becomes true": {
+			expr: driplang.Then{
+				A: driplang.EventName(signup),
+				B: notPurchaseAfter(72 * time.Hour),
+			},
+			events:   []driplang.Event{{Name: signup, Time: start}},
+			now:      timey.AddHours(start, 1),
+			expected: timey.AddHours(start, 72).Add(time.Nanosecond),
+			changes:  true,
+		},
+		"already changed": {
+			expr: driplang.Then{
+				A: driplang.EventName(signup),
+				B: notPurchaseAfter(72 * time.Hour),
+			},
+			events: []driplang.Event{{Name: signup, Time: start}},
+			now:    timey.AddHours(start, 73),
+		},
+		"event prevents change": {
+			expr: driplang.Then{
+				A: driplang.EventName(signup),
+				B: notPurchaseAfter(72 * time.Hour),
+			},
+			events: []driplang.Event{
+				{Name: signup, Time: start},
+				{Name: purchase, Time: timey.AddHours(start, 2)},
+			},
+			now: timey.AddHours(start, 3),
+		},
+		"window closes": {
+			expr: driplang.Then{
+				A: driplang.EventName(signup),
+				B: driplang.Not{A: driplang.Within{A: driplang.EventName(purchase), D: driplang.Duration(72 * time.Hour)}},
+			},
+			events:   []driplang.Event{{Name: signup, Time: start}},
+			now:      timey.AddHours(start, 1),
+			expected: timey.AddHours(start, 72).Add(time.Nanosecond),
+			changes:  true,
+		},
+		"inactivity": {
+			expr: driplang.Since{A: driplang.EventName(visit), D: driplang.Duration(14 * 24 * time.Hour)},
+			events: []driplang.Event{
+				{Name: signup, Time: start},
+				{Name: visit, Time: timey.AddHours(start, 1)},
+			},
+			now:      timey.AddHours(start, 2),
+			expected: timey.AddHours(start, 14*24+1),
+			changes:  true,
+		},
+		"not time dependent": {
+			expr: driplang.And{
+				A: driplang.EventName(signup),
+				B: driplang.EventName(visit),
+			},
+			events: []driplang.Event{{Name: signup, Time: start}},
+			now:    start,
+		},
+		"first deadline doesn't change the result": {
+			expr: driplang.Then{
+				A: driplang.EventName(signup),
+				B: driplang.And{
+					A: notPurchaseAfter(24 * time.Hour),
+					B: driplang.After{
+						A: driplang.Not{A: driplang.EventName(visit)},
+						D: driplang.Duration(48 * time.Hour),
+					},
+				},
+			},
+			events:   []driplang.Event{{Name: signup, Time: start}},
+			now:      start,
+			expected: timey.AddHours(start, 48).Add(time.Nanosecond),
+			changes:  true,
+		},
+		"becomes false": {
+			expr: driplang.Then{
+				A: driplang.EventName(signup),
+				B: driplang.Not{A: notPurchaseAfter(24 * time.Hour)},
+			},
+			events:   []driplang.Event{{Name: signup, Time: start}},
+			now:      start,
+			expected: timey.AddHours(start, 24).Add(time.Nanosecond),
+			changes:  true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, changes := driplang.NextChange(test.expr, test.events, test.now)
+			require.Equal(t, test.changes, changes)
+			if !changes {
+				return
+			}
+			require.Equal(t, test.expected, got)
+
+			before := driplang.EvaluateAt(test.expr, test.events, test.now)
+			require.Equal(t, before, driplang.EvaluateAt(test.expr, test.events, got.Add(-time.Nanosecond)))
+			require.NotEqual(t, before, driplang.EvaluateAt(test.expr, test.events, got))
+		})
+	}
+}
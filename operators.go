@@ -2,16 +2,55 @@ package driplang
 
 import (
 	"fmt"
+	"reflect"
+	"strconv"
 	"time"
 
 	"github.com/micvbang/go-helpy/stringy"
 )
 
 /*
-expr 		::= expr AND expr | expr OR expr | NOT expr | expr THEN expr | expr AFTER duration
+expr 		::= expr AND expr | expr OR expr | NOT expr | expr THEN [ EARLIEST | LATEST | ANY ] expr | expr AFTER duration [ FROM anchor ] | expr WITHIN duration | expr BETWEEN duration AND duration | expr SINCE duration | expr AFTER timestamp | expr BEFORE timestamp | expr DURING time_of_day TO time_of_day IN zone | expr ON "[" weekday { "," weekday } "]" IN zone | any_of | all_of | at_least | count | window | seq | event_name | where | "(" expr ")"
 event_name 	::= [string]
 duration    ::= [int]
-
+where		::= event_name "[" predicate { "," predicate } "]"
+predicate	::= property ( "=" | "!=" | "<" | "<=" | ">" | ">=" | PREFIX | MATCHES ) value | property IN "[" value { "," value } "]"
+property	::= [string]
+value		::= [string] | [number] | [bool]
+count		::= COUNT "(" expr ")" ( "=" | "!=" | "<" | "<=" | ">" | ">=" ) [int]
+window		::= WINDOW "(" expr "," [int] "," duration ")"
+any_of		::= ANY_OF "(" expr { "," expr } ")"
+all_of		::= ALL_OF "(" expr { "," expr } ")"
+at_least	::= AT_LEAST "(" [int] "," expr { "," expr } ")"
+seq		::= SEQ "(" step { "," step } ")" [ RELAXED ] [ IGNORE "[" event_name { "," event_name } "]" ]
+step		::= event_name | where
+anchor		::= ( FIRST | LAST ) [ event_name ]
+timestamp	::= [string]
+time_of_day	::= [string]
+zone		::= [string]
+weekday		::= SUN | MON | TUE | WED | THU | FRI | SAT
+
+Parentheses are optional; operators bind, from loosest to tightest: OR, AND,
+THEN, the postfix AFTER, WITHIN, BETWEEN, SINCE, BEFORE, DURING and ON, and the
+prefix NOT. `"a" THEN NOT "b" AFTER 3d` is therefore parsed as
+`("a" THEN ((NOT "b") AFTER 72h0m0s))`. Binary operators are left associative.
+
+Keywords are case insensitive. WITHIN, BETWEEN, SINCE, BEFORE, DURING and ON
+are only keywords where an operator is expected, and COUNT, WINDOW, SEQ,
+ANY_OF, ALL_OF and AT_LEAST only when followed by a parenthesis; otherwise they
+may be used as bare event names.
+
+Event names, and the name of an anchor, are double quoted strings using Go
+escape sequences, e.g. "signup", or bare identifiers, e.g. signup. Durations
+accept the units of time.ParseDuration as well as d (days) and w (weeks), e.g.
+72h, 3d or 1w2d12h. Timestamps are RFC 3339, times of day are e.g. "09:00", and
+zones are IANA time zone names, which must always be given.
+
+EARLIEST, LATEST and ANY choose which of the events satisfying THEN's left hand
+side the right hand side is measured from; see ThenStrategy. AFTER is anchored
+to that event, or, using FROM, to the first or latest event, optionally with a
+name; see Anchor. SEQ matches adjacent events, unless followed by RELAXED, or
+by IGNORE to allow only the given events between them.
 */
 
 type Duration time.Duration
@@ -23,7 +62,7 @@ type Expr interface {
 type EventName string
 
 func (e EventName) Expression() string {
-	return fmt.Sprintf("\"%v\"", e)
+	return strconv.Quote(string(e))
 }
 
 type And struct {
@@ -52,111 +91,302 @@ func (n Not) Expression() string {
 	return fmt.Sprintf("(NOT %s)", n.A.Expression())
 }
 
+// Then is satisfied if B is satisfied by events following the event
+// satisfying A. Strategy decides which of the events satisfying A that is.
+//
+// Using ThenEarliest, ThenLatest and ThenAny, the occurrences of A (see
+// Count) are tried. If A has none, but is satisfied anyway, e.g. by NOT, B may
+// be satisfied by any of the events.
 type Then struct {
-	A Expr `json:"a"`
-	B Expr `json:"b"`
+	A        Expr         `json:"a"`
+	B        Expr         `json:"b"`
+	Strategy ThenStrategy `json:"strategy"`
 }
 
 func (t Then) Expression() string {
-	return fmt.Sprintf("(%s THEN %s)", t.A.Expression(), t.B.Expression())
+	if t.Strategy == ThenDefault {
+		return fmt.Sprintf("(%s THEN %s)", t.A.Expression(), t.B.Expression())
+	}
+	return fmt.Sprintf("(%s THEN %s %s)", t.A.Expression(), t.Strategy, t.B.Expression())
 }
 
+// ThenStrategy decides which of the events satisfying Then.A that Then.B, and
+// e.g. After within it, is measured from.
+type ThenStrategy string
+
+const (
+	// ThenDefault evaluates A against every prefix of the events, starting
+	// with all of them, and is satisfied if B is satisfied after the event
+	// satisfying A for one of them. For an event name, that is its first
+	// occurrence.
+	ThenDefault ThenStrategy = ""
+
+	// ThenEarliest is satisfied if B is satisfied after the first occurrence
+	// of A.
+	ThenEarliest ThenStrategy = "EARLIEST"
+
+	// ThenLatest is satisfied if B is satisfied by events after the latest
+	// occurrence of A before them. If B is satisfied without events, it's
+	// the latest occurrence of all, e.g. the latest "cart" in `"cart" THEN
+	// LATEST NOT "purchase"`.
+	ThenLatest ThenStrategy = "LATEST"
+
+	// ThenAny is satisfied if B is satisfied after any occurrence of A,
+	// trying them from the first one.
+	ThenAny ThenStrategy = "ANY"
+)
+
+// check returns an error if s is unknown.
+func (s ThenStrategy) check() error {
+	switch s {
+	case ThenDefault, ThenEarliest, ThenLatest, ThenAny:
+		return nil
+	default:
+		return fmt.Errorf("invalid THEN strategy %q", s)
+	}
+}
+
+// After is satisfied if A is satisfied by events at least D after the time of
+// its anchor. By default, the anchor is the event satisfying Then.A, and After
+// can only be satisfied within Then.B; see Anchor for anchoring it to other
+// events, e.g. `"purchase" AFTER 7d FROM FIRST`.
 type After struct {
-	A Expr     `json:"a"`
-	D Duration `json:"t"`
+	A      Expr     `json:"a"`
+	D      Duration `json:"t"`
+	Anchor Anchor   `json:"anchor"`
 }
 
 func (a After) Expression() string {
-	return fmt.Sprintf("(%s AFTER %s)", a.A.Expression(), time.Duration(a.D))
+	if a.Anchor.Kind == AnchorThen {
+		return fmt.Sprintf("(%s AFTER %s)", a.A.Expression(), time.Duration(a.D))
+	}
+	return fmt.Sprintf("(%s AFTER %s FROM %s)", a.A.Expression(), time.Duration(a.D), a.Anchor)
 }
 
-// ContainsOperator returns true if the operator `op` is part of the expression
-// `e` (or any of its subexpressions).
-func ContainsOperator(e Expr, op Expr) bool {
-	switch v := e.(type) {
-	case EventName:
-		return IsOperator(v, op)
+// AnchorKind is the kind of event an After is anchored to.
+type AnchorKind string
 
-	case Or:
-		return IsOperator(v, op) || ContainsOperator(v.A, op) || ContainsOperator(v.B, op)
+const (
+	// AnchorThen anchors After to the event satisfying Then.A.
+	AnchorThen AnchorKind = ""
 
-	case And:
-		return IsOperator(v, op) || ContainsOperator(v.A, op) || ContainsOperator(v.B, op)
+	// AnchorFirst anchors After to the first event, or the first event with
+	// the anchor's name.
+	AnchorFirst AnchorKind = "FIRST"
 
-	case Then:
-		return IsOperator(v, op) || ContainsOperator(v.A, op) || ContainsOperator(v.B, op)
+	// AnchorLast anchors After to the latest event, or the latest event with
+	// the anchor's name.
+	AnchorLast AnchorKind = "LAST"
+)
 
-	case After:
-		return IsOperator(v, op) || ContainsOperator(v.A, op)
+// Anchor is the event that After measures its duration from. The zero Anchor
+// is the event satisfying Then.A. Anchors other than that make After usable
+// anywhere, e.g. at the top level of an expression, and don't depend on what
+// happened in between, e.g. `"purchase" AFTER 30d FROM LAST "trial_started"`.
+//
+// Like the events of other operators, anchors are found among the events the
+// After is evaluated against, e.g. those following the event satisfying
+// Then.A when used within Then.B.
+type Anchor struct {
+	Kind AnchorKind `json:"kind"`
+	Name EventName  `json:"name,omitempty"`
+}
 
-	case Not:
-		return IsOperator(v, op) || ContainsOperator(v.A, op)
+func (a Anchor) String() string {
+	if a.Name == "" {
+		return string(a.Kind)
+	}
+	return fmt.Sprintf("%s %s", a.Kind, a.Name.Expression())
+}
 
+// check returns an error if a's kind is unknown, or if it has a name without
+// being anchored to the first or latest event.
+func (a Anchor) check() error {
+	switch a.Kind {
+	case AnchorThen:
+		if a.Name != "" {
+			return fmt.Errorf("anchor name %s given without FIRST or LAST", a.Name.Expression())
+		}
+	case AnchorFirst, AnchorLast:
 	default:
-		return false
+		return fmt.Errorf("invalid anchor %q", a.Kind)
 	}
+	return nil
 }
 
-// IsOperator returns true if the root expression of `e` is the same type as
-// `op`.
-func IsOperator(e Expr, op Expr) bool {
-	switch op.(type) {
-	case EventName:
-		_, ok := e.(EventName)
-		return ok
+// Within is like After, but gives an upper bound instead: it's satisfied if A
+// is satisfied by events no later than D after the time of the event
+// satisfying Then.A. Like After, it can only be satisfied within Then.B.
+//
+// NOT Within is satisfied once the window has closed without A being
+// satisfied, e.g. `"signup" THEN NOT ("purchase" WITHIN 72h)`. This only
+// applies when NOT applies to the window directly: NOT of an AND, OR, ANY_OF
+// or ALL_OF of windows is satisfied as soon as they aren't, even while the
+// windows are open. To wait for several windows, negate each of them, e.g.
+// `NOT ("a" WITHIN 1h) AND NOT ("b" WITHIN 2h)`; Validate warns about this.
+type Within struct {
+	A Expr     `json:"a"`
+	D Duration `json:"d"`
+}
 
-	case Or:
-		_, ok := e.(Or)
-		return ok
+func (w Within) Expression() string {
+	return fmt.Sprintf("(%s WITHIN %s)", w.A.Expression(), time.Duration(w.D))
+}
 
-	case And:
-		_, ok := e.(And)
-		return ok
+// Between is like Within, but the window starts Min after the time of the
+// event satisfying Then.A and ends Max after it, both inclusive.
+type Between struct {
+	A   Expr     `json:"a"`
+	Min Duration `json:"min"`
+	Max Duration `json:"max"`
+}
 
-	case Then:
-		_, ok := e.(Then)
-		return ok
+func (b Between) Expression() string {
+	return fmt.Sprintf("(%s BETWEEN %s AND %s)", b.A.Expression(), time.Duration(b.Min), time.Duration(b.Max))
+}
 
-	case After:
-		_, ok := e.(After)
-		return ok
+// Count is satisfied if the number of occurrences of A compares to N as given
+// by Op, which is one of OpEqual, OpNotEqual, OpLess, OpLessOrEqual, OpGreater
+// and OpGreaterOrEqual. E.g. Count{A: EventName("page_view"), Op:
+// OpGreaterOrEqual, N: 3} is satisfied by three or more page views.
+//
+// The occurrences of A are found by repeatedly evaluating A against the
+// events following the previous occurrence, only counting those satisfied by
+// events not before the time of the event satisfying Then.A, if any.
+// Satisfying A without events, e.g. using NOT, isn't an occurrence. Since,
+// Window, During, On and the strategies of Then find occurrences the same way.
+type Count struct {
+	A  Expr        `json:"a"`
+	Op PredicateOp `json:"op"`
+	N  int         `json:"n"`
+}
 
-	case Not:
-		_, ok := e.(Not)
-		return ok
+func (c Count) Expression() string {
+	return fmt.Sprintf("COUNT(%s) %s %d", c.A.Expression(), c.Op, c.N)
+}
 
+// check returns an error if c's operator isn't a comparison, or if N is
+// negative.
+func (c Count) check() error {
+	switch c.Op {
+	case OpEqual, OpNotEqual, OpLess, OpLessOrEqual, OpGreater, OpGreaterOrEqual:
+	default:
+		return fmt.Errorf("invalid count operator %q", c.Op)
+	}
+
+	if c.N < 0 {
+		return fmt.Errorf("count %d is negative", c.N)
+	}
+	return nil
+}
+
+// compare returns the result of comparing n to c.N using c.Op.
+func (c Count) compare(n int) bool {
+	switch c.Op {
+	case OpEqual:
+		return n == c.N
+	case OpNotEqual:
+		return n != c.N
+	case OpLess:
+		return n < c.N
+	case OpLessOrEqual:
+		return n <= c.N
+	case OpGreater:
+		return n > c.N
+	case OpGreaterOrEqual:
+		return n >= c.N
 	default:
 		return false
 	}
 }
 
-// Names returns a list of all the unique names contained within Expr.
-func Names(e Expr) []string {
-	return stringy.Unique(getNames(e))
+// Since is satisfied if the latest occurrence of A (see Count) was at least D
+// before the time of evaluation, e.g. `"login" SINCE 14d` for users that have
+// been inactive for 14 days.
+//
+// If A hasn't occurred, the time of the event satisfying Then.A is used
+// instead, or, outside of Then.B, the time of the first event. Since is never
+// satisfied without any events.
+type Since struct {
+	A Expr     `json:"a"`
+	D Duration `json:"d"`
 }
 
-func getNames(e Expr) []string {
-	switch v := e.(type) {
+func (s Since) Expression() string {
+	return fmt.Sprintf("(%s SINCE %s)", s.A.Expression(), time.Duration(s.D))
+}
 
-	case EventName:
-		return []string{string(v)}
+// Window is satisfied if any window of time of length D contains at least N
+// occurrences of A (see Count), e.g. 5 failed logins within 10 minutes. The
+// windows are inclusive, i.e. the first and last occurrence may be exactly D
+// apart.
+type Window struct {
+	A Expr     `json:"a"`
+	N int      `json:"n"`
+	D Duration `json:"d"`
+}
 
-	case Not:
-		return Names(v.A)
+func (w Window) Expression() string {
+	return fmt.Sprintf("WINDOW(%s, %d, %s)", w.A.Expression(), w.N, time.Duration(w.D))
+}
 
-	case Or:
-		return append(Names(v.A), Names(v.B)...)
+// check returns an error if w can never be satisfied because of its N or D.
+func (w Window) check() error {
+	if w.N < 1 {
+		return fmt.Errorf("window count %d is less than 1", w.N)
+	}
 
-	case And:
-		return append(Names(v.A), Names(v.B)...)
+	if w.D < 0 {
+		return fmt.Errorf("window duration %s is negative", time.Duration(w.D))
+	}
+	return nil
+}
 
-	case Then:
-		return append(Names(v.A), Names(v.B)...)
+// ContainsOperator returns true if the operator `op` is part of the expression
+// `e` (or any of its subexpressions).
+func ContainsOperator(e Expr, op Expr) bool {
+	found := false
+	Walk(e, func(e Expr) bool {
+		found = found || IsOperator(e, op)
+		return !found
+	})
+	return found
+}
+
+// IsOperator returns true if the root expression of `e` is the same type as
+// `op`.
+func IsOperator(e Expr, op Expr) bool {
+	return op != nil && reflect.TypeOf(e) == reflect.TypeOf(op)
+}
 
-	case After:
-		return Names(v.A)
+// Names returns a list of all the unique names contained within Expr.
+func Names(e Expr) []string {
+	names := []string{}
+	Walk(e, func(e Expr) bool {
+		switch v := e.(type) {
+		case EventName:
+			names = append(names, string(v))
+		case Where:
+			names = append(names, string(v.Name))
+		case After:
+			if v.Anchor.Name != "" {
+				names = append(names, string(v.Anchor.Name))
+			}
+		case Seq:
+			for _, name := range v.Ignore {
+				names = append(names, string(name))
+			}
+		}
+		return true
+	})
+	return stringy.Unique(names)
+}
 
-	default:
-		return []string{}
+// depth returns the nesting depth of e, counting e itself as depth 1.
+func depth(e Expr) int {
+	d := 0
+	for _, child := range children(e) {
+		d = max(d, depth(child))
 	}
+	return 1 + d
 }
@@ -17,6 +17,7 @@ func TestNames(t *testing.T) {
 		name2 = "2"
 		name3 = "3"
 		name4 = "4"
+		name5 = "5"
 	)
 	expr := driplang.Then{
 		A: driplang.EventName(name1),
@@ -42,6 +43,31 @@ func TestNames(t *testing.T) {
 	require.True(t, names.Contains(name3))
 	require.True(t, names.Contains(name4))
 	require.False(t, names.Contains("not in set"))
+
+	where := driplang.Or{
+		A: driplang.Where{Name: name4, Predicates: []driplang.Predicate{{Property: "p", Op: driplang.OpEqual, Value: "v"}}},
+		B: driplang.Not{A: driplang.EventName(name3)},
+	}
+	require.ElementsMatch(t, []string{name4, name3}, driplang.Names(where))
+
+	anchored := driplang.After{
+		A:      driplang.EventName(name2),
+		D:      driplang.Duration(0),
+		Anchor: driplang.Anchor{Kind: driplang.AnchorLast, Name: name5},
+	}
+	require.ElementsMatch(t, []string{name2, name5}, driplang.Names(anchored))
+
+	seq := driplang.Seq{
+		Steps:  []driplang.Expr{driplang.EventName(name1), driplang.Where{Name: name2}, driplang.EventName(name1)},
+		Ignore: []driplang.EventName{name3},
+	}
+	require.ElementsMatch(t, []string{name1, name2, name3}, driplang.Names(seq))
+
+	atLeast := driplang.AtLeast{K: 1, Exprs: []driplang.Expr{
+		driplang.AnyOf{Exprs: []driplang.Expr{driplang.EventName(name1), driplang.EventName(name2)}},
+		driplang.AllOf{Exprs: []driplang.Expr{driplang.EventName(name1), driplang.Not{A: driplang.EventName(name3)}}},
+	}}
+	require.ElementsMatch(t, []string{name1, name2, name3}, driplang.Names(atLeast))
 }
 
 func TestIsOperatorSimple(t *testing.T) {
@@ -176,6 +202,44 @@ func TestContainsOperator(t *testing.T) {
 			},
 			op: driplang.EventName("op"),
 		},
+		"count": {
+			expected: true,
+			expr: driplang.Or{
+				A: driplang.EventName("a"),
+				B: driplang.Count{A: driplang.EventName("b"), Op: driplang.OpEqual, N: 1},
+			},
+			op: driplang.Count{},
+		},
+		"since": {
+			expected: true,
+			expr: driplang.Then{
+				A: driplang.EventName("a"),
+				B: driplang.Since{A: driplang.EventName("b")},
+			},
+			op: driplang.Since{},
+		},
+		"window": {
+			expected: true,
+			expr: driplang.Not{
+				A: driplang.Window{A: driplang.EventName("b"), N: 1},
+			},
+			op: driplang.Window{},
+		},
+		"within": {
+			expected: true,
+			expr: driplang.Then{
+				A: driplang.EventName("a"),
+				B: driplang.Between{A: driplang.Within{A: driplang.EventName("b")}},
+			},
+			op: driplang.Within{},
+		},
+		"where": {
+			expected: true,
+			expr: driplang.Not{
+				A: driplang.Where{Name: "a"},
+			},
+			op: driplang.Where{},
+		},
 		"or": {
 			expected: true,
 			expr: driplang.Then{
@@ -229,6 +293,43 @@ func TestContainsOperator(t *testing.T) {
 			},
 			op: driplang.Not{},
 		},
+		"seq": {
+			expected: true,
+			expr: driplang.Not{
+				A: driplang.Seq{Steps: []driplang.Expr{
+					driplang.EventName("a"),
+					driplang.Where{Name: "b"},
+				}},
+			},
+			op: driplang.Where{},
+		},
+		"calendar": {
+			expected: true,
+			expr: driplang.On{
+				A: driplang.During{
+					A: driplang.AfterTime{
+						A: driplang.EventName("a"),
+						T: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+					},
+					From: driplang.Duration(9 * time.Hour),
+					To:   driplang.Duration(17 * time.Hour),
+					Zone: "UTC",
+				},
+				Days: []time.Weekday{time.Monday},
+				Zone: "UTC",
+			},
+			op: driplang.AfterTime{},
+		},
+		"n-ary": {
+			expected: true,
+			expr: driplang.AnyOf{Exprs: []driplang.Expr{
+				driplang.EventName("a"),
+				driplang.AtLeast{K: 1, Exprs: []driplang.Expr{
+					driplang.AllOf{Exprs: []driplang.Expr{driplang.Not{A: driplang.EventName("b")}}},
+				}},
+			}},
+			op: driplang.Not{},
+		},
 	}
 
 	for name, test := range tests {
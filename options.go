@@ -0,0 +1,79 @@
+package driplang
+
+const (
+	// DefaultMaxDepth is the default maximum nesting depth of expressions
+	// accepted by Parse and Unmarshal.
+	DefaultMaxDepth = 256
+
+	// DefaultMaxNodes is the default maximum number of operators and event
+	// names in expressions accepted by Parse and Unmarshal.
+	DefaultMaxNodes = 10_000
+)
+
+// Option configures Parse and Unmarshal.
+type Option func(*options)
+
+type options struct {
+	maxDepth int
+	maxNodes int
+	validate bool
+}
+
+func makeOptions(opts []Option) options {
+	o := options{
+		maxDepth: DefaultMaxDepth,
+		maxNodes: DefaultMaxNodes,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithMaxDepth sets the maximum nesting depth of an expression, counting the
+// root as depth 1. A value <= 0 disables the limit.
+func WithMaxDepth(depth int) Option {
+	return func(o *options) {
+		o.maxDepth = depth
+	}
+}
+
+// WithMaxNodes sets the maximum number of operators and event names in an
+// expression. A value <= 0 disables the limit.
+func WithMaxNodes(nodes int) Option {
+	return func(o *options) {
+		o.maxNodes = nodes
+	}
+}
+
+// WithValidation makes Parse and Unmarshal run Validate on the expression,
+// and reject it if any errors are found. Warnings are ignored.
+func WithValidation() Option {
+	return func(o *options) {
+		o.validate = true
+	}
+}
+
+func (o options) depthExceeded(depth int) bool {
+	return o.maxDepth > 0 && depth > o.maxDepth
+}
+
+func (o options) nodesExceeded(nodes int) bool {
+	return o.maxNodes > 0 && nodes > o.maxNodes
+}
+
+// validationErrors returns the errors found by Validate in e, if validation is
+// enabled.
+func (o options) validationErrors(e Expr) Errors {
+	if !o.validate {
+		return nil
+	}
+
+	var errs Errors
+	for _, d := range Validate(e) {
+		if d.Severity == SeverityError {
+			errs = append(errs, &Error{Code: d.Code, Path: d.Path, Message: d.Message})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,1090 @@
+package driplang
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Parse parses the textual form of an expression, as returned by
+// Expr.Expression(), into an Expr, e.g. `"signup" THEN NOT "purchase" AFTER 3d`.
+// The grammar, and the precedence of its operators, is described next to the
+// operators. For every Expr e built from the operators of this package,
+// Parse(e.Expression()) returns an Expr equal to e.
+//
+// If s isn't a valid expression, the returned error is of type Errors and
+// describes every problem found, each located by line and column. The same
+// limits as for Unmarshal apply; see WithMaxDepth and WithMaxNodes. Use
+// WithValidation to also reject expressions that can't work as intended.
+func Parse(s string, opts ...Option) (Expr, error) {
+	p := &parser{src: s, opts: makeOptions(opts)}
+	p.lex()
+
+	e := p.parseOr()
+	for tok := p.peek(); tok.kind != tokenEOF; tok = p.peek() {
+		p.errorf(tok, "unexpected %s", tok)
+		p.next()
+
+		// Keep going in order to report problems in the rest of the input.
+		if p.peek().kind != tokenEOF {
+			p.parseOr()
+		}
+	}
+
+	if len(p.errs) == 0 && p.opts.depthExceeded(depth(e)) {
+		p.errorf(token{}, "expression is nested deeper than %d", p.opts.maxDepth)
+		p.errs[0].Code = ErrorCodeLimitExceeded
+	}
+
+	if len(p.errs) > 0 {
+		sortByPosition(p.errs)
+		return nil, p.errs
+	}
+
+	if errs := p.opts.validationErrors(e); len(errs) > 0 {
+		p.locate(e, errs)
+		sortByPosition(errs)
+		return nil, errs
+	}
+
+	return e, nil
+}
+
+// locate locates errs, found by Validate in e, by the line and column of the
+// nodes they were found at instead of by JSON path. Nodes are created after
+// their children, in order, so walking e the same way visits them in the
+// order their positions were recorded.
+func (p *parser) locate(e Expr, errs Errors) {
+	positions := make(map[string]int, len(p.positions))
+	var walk func(e Expr, path string)
+	walk = func(e Expr, path string) {
+		for i, child := range children(e) {
+			walk(child, childPath(e, path, i))
+		}
+		if n := len(positions); n < len(p.positions) {
+			positions[path] = p.positions[n]
+		}
+	}
+	walk(e, "$")
+
+	for _, err := range errs {
+		// Problems with a part of a node, e.g. a predicate of a Where, are
+		// located at the node.
+		path := err.Path
+		pos, ok := positions[path]
+		for !ok {
+			i := strings.LastIndexAny(path, ".[")
+			if i < 0 {
+				break
+			}
+			path = path[:i]
+			pos, ok = positions[path]
+		}
+
+		if ok {
+			err.Line, err.Column = lineColumn(p.src, pos)
+			err.Path = ""
+		}
+	}
+}
+
+// sortByPosition sorts errs by line and column.
+func sortByPosition(errs Errors) {
+	sort.SliceStable(errs, func(i, j int) bool {
+		a, b := errs[i], errs[j]
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenLParen
+	tokenRParen
+	tokenLBracket
+	tokenRBracket
+	tokenComma
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of input"
+	case tokenString:
+		return fmt.Sprintf("string %s", t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// keywords are the identifiers that can't be used as bare event names.
+var keywords = []string{"AND", "OR", "NOT", "THEN", "AFTER"}
+
+func isKeyword(s string) bool {
+	for _, kw := range keywords {
+		if strings.EqualFold(s, kw) {
+			return true
+		}
+	}
+	return false
+}
+
+// postfixKeywords are the identifiers that are only keywords where an
+// operator is expected.
+var postfixKeywords = []string{"WITHIN", "BETWEEN", "SINCE", "BEFORE", "DURING", "ON"}
+
+func isPostfixKeyword(s string) bool {
+	for _, kw := range postfixKeywords {
+		if strings.EqualFold(s, kw) {
+			return true
+		}
+	}
+	return false
+}
+
+type parser struct {
+	src    string
+	opts   options
+	tokens []token
+	pos    int
+	errs   Errors
+
+	// nesting is the current recursion depth of parseUnary; it's tracked in
+	// order to stop early on input that exceeds the limits.
+	nesting int
+	stopped bool
+
+	// positions holds the position in src of every node created so far, in
+	// the order they were created. Their number is tracked like nesting.
+	positions []int
+}
+
+// lex splits the source into tokens. Characters that can't start a token are
+// reported and skipped.
+func (p *parser) lex() {
+	s := p.src
+	for pos := 0; pos < len(s); {
+		r, size := utf8.DecodeRuneInString(s[pos:])
+		switch {
+		case unicode.IsSpace(r):
+			pos += size
+
+		case r == '(':
+			p.tokens = append(p.tokens, token{kind: tokenLParen, text: "(", pos: pos})
+			pos += size
+
+		case r == ')':
+			p.tokens = append(p.tokens, token{kind: tokenRParen, text: ")", pos: pos})
+			pos += size
+
+		case r == '[':
+			p.tokens = append(p.tokens, token{kind: tokenLBracket, text: "[", pos: pos})
+			pos += size
+
+		case r == ']':
+			p.tokens = append(p.tokens, token{kind: tokenRBracket, text: "]", pos: pos})
+			pos += size
+
+		case r == ',':
+			p.tokens = append(p.tokens, token{kind: tokenComma, text: ",", pos: pos})
+			pos += size
+
+		case r == '=' || r == '<' || r == '>' || r == '!' && strings.HasPrefix(s[pos+1:], "="):
+			end := pos + size
+			if end < len(s) && s[end] == '=' && r != '=' {
+				end++
+			}
+			p.tokens = append(p.tokens, token{kind: tokenOperator, text: s[pos:end], pos: pos})
+			pos = end
+
+		case r == '"':
+			end := pos + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				p.errorf(token{pos: pos}, "unterminated string")
+				end = len(s) - 1
+			}
+			p.tokens = append(p.tokens, token{kind: tokenString, text: s[pos : end+1], pos: pos})
+			pos = end + 1
+
+		case isDigit(r) || (r == '-' || r == '.') && pos+1 < len(s) && isDigit(rune(s[pos+1])):
+			end := pos + size
+			for end < len(s) {
+				r, size := utf8.DecodeRuneInString(s[end:])
+				if !isIdentRune(r) && r != '.' {
+					break
+				}
+				end += size
+			}
+			p.tokens = append(p.tokens, token{kind: tokenNumber, text: s[pos:end], pos: pos})
+			pos = end
+
+		case isIdentStart(r):
+			end := pos + size
+			for end < len(s) {
+				r, size := utf8.DecodeRuneInString(s[end:])
+				if !isIdentRune(r) && r != '.' && r != '-' && r != ':' {
+					break
+				}
+				end += size
+			}
+			p.tokens = append(p.tokens, token{kind: tokenIdent, text: s[pos:end], pos: pos})
+			pos = end
+
+		default:
+			p.errorf(token{pos: pos}, "unexpected character %q", r)
+			pos += size
+		}
+	}
+
+	p.tokens = append(p.tokens, token{kind: tokenEOF, pos: len(s)})
+}
+
+func isDigit(r rune) bool {
+	return '0' <= r && r <= '9'
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isIdentRune(r rune) bool {
+	return isIdentStart(r) || unicode.IsDigit(r)
+}
+
+// lineColumn returns the 1-based line and column of the byte offset pos in s.
+func lineColumn(s string, pos int) (line, column int) {
+	line = 1 + strings.Count(s[:pos], "\n")
+	lineStart := strings.LastIndexByte(s[:pos], '\n') + 1
+	return line, 1 + utf8.RuneCountInString(s[lineStart:pos])
+}
+
+// errorf records a syntax error at the position of tok. Only the first error
+// at any position is kept, since the ones that follow are usually caused by
+// it.
+func (p *parser) errorf(tok token, format string, args ...interface{}) {
+	if p.stopped {
+		return
+	}
+
+	line, column := lineColumn(p.src, tok.pos)
+	if n := len(p.errs); n > 0 && p.errs[n-1].Line == line && p.errs[n-1].Column == column {
+		return
+	}
+
+	p.errs = append(p.errs, &Error{
+		Code:    ErrorCodeSyntax,
+		Line:    line,
+		Column:  column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// acceptKeyword consumes the next token if it is the keyword kw.
+func (p *parser) acceptKeyword(kw string) bool {
+	if p.peekKeyword(kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// peekKeyword reports whether the next token is the keyword kw.
+func (p *parser) peekKeyword(kw string) bool {
+	tok := p.peek()
+	return tok.kind == tokenIdent && strings.EqualFold(tok.text, kw)
+}
+
+// limitExceeded reports a limit violation at the current token and skips the
+// rest of the input, since there's no point in continuing. Errors caused by
+// the skipping are not reported.
+func (p *parser) limitExceeded(format string, args ...interface{}) {
+	p.errorf(p.peek(), format, args...)
+	p.errs[len(p.errs)-1].Code = ErrorCodeLimitExceeded
+	p.pos = len(p.tokens) - 1
+	p.stopped = true
+}
+
+// node records the position of a newly created node, that of the token at,
+// and returns it.
+func (p *parser) node(at token, e Expr) Expr {
+	p.positions = append(p.positions, at.pos)
+	if p.opts.nodesExceeded(len(p.positions)) {
+		p.limitExceeded("expression has more than %d nodes", p.opts.maxNodes)
+	}
+	return e
+}
+
+func (p *parser) parseOr() Expr {
+	a := p.parseAnd()
+	for op := p.peek(); p.acceptKeyword("OR"); op = p.peek() {
+		a = p.node(op, Or{A: a, B: p.parseAnd()})
+	}
+	return a
+}
+
+func (p *parser) parseAnd() Expr {
+	a := p.parseThen()
+	for op := p.peek(); p.acceptKeyword("AND"); op = p.peek() {
+		a = p.node(op, And{A: a, B: p.parseThen()})
+	}
+	return a
+}
+
+func (p *parser) parseThen() Expr {
+	a := p.parsePostfix()
+	for op := p.peek(); p.acceptKeyword("THEN"); op = p.peek() {
+		strategy := p.parseThenStrategy()
+		a = p.node(op, Then{A: a, B: p.parsePostfix(), Strategy: strategy})
+	}
+	return a
+}
+
+// parseThenStrategy parses the optional strategy following THEN. EARLIEST,
+// LATEST and ANY are only keywords when followed by the start of an
+// expression, and may otherwise be used as bare event names.
+func (p *parser) parseThenStrategy() ThenStrategy {
+	tok := p.peek()
+	if tok.kind != tokenIdent || !startsOperand(p.tokens[p.pos+1]) {
+		return ThenDefault
+	}
+
+	for _, strategy := range []ThenStrategy{ThenEarliest, ThenLatest, ThenAny} {
+		if strings.EqualFold(tok.text, string(strategy)) {
+			p.next()
+			return strategy
+		}
+	}
+	return ThenDefault
+}
+
+// startsOperand reports whether tok can start the operand of an operator.
+func startsOperand(tok token) bool {
+	switch tok.kind {
+	case tokenString, tokenLParen:
+		return true
+	case tokenIdent:
+		return strings.EqualFold(tok.text, "NOT") || !isKeyword(tok.text) && !isPostfixKeyword(tok.text)
+	default:
+		return false
+	}
+}
+
+func (p *parser) parsePostfix() Expr {
+	a := p.parseUnary()
+	for {
+		op := p.peek()
+		switch {
+		case p.acceptKeyword("AFTER"):
+			if p.peek().kind == tokenString {
+				a = p.node(op, AfterTime{A: a, T: p.parseTimestamp()})
+				break
+			}
+			after := After{A: a, D: p.parseDuration()}
+			if p.acceptKeyword("FROM") {
+				after.Anchor = p.parseAnchor()
+			}
+			a = p.node(op, after)
+
+		case p.acceptKeyword("BEFORE"):
+			a = p.node(op, BeforeTime{A: a, T: p.parseTimestamp()})
+
+		case p.peekKeyword("DURING"):
+			a = p.parseDuring(a)
+
+		case p.peekKeyword("ON"):
+			a = p.parseOn(a)
+
+		case p.acceptKeyword("WITHIN"):
+			a = p.node(op, Within{A: a, D: p.parseDuration()})
+
+		case p.acceptKeyword("SINCE"):
+			a = p.node(op, Since{A: a, D: p.parseDuration()})
+
+		case p.acceptKeyword("BETWEEN"):
+			from := p.parseDuration()
+			if !p.acceptKeyword("AND") {
+				p.errorf(p.peek(), "expected AND, got %s", p.peek())
+			}
+			a = p.node(op, Between{A: a, Min: from, Max: p.parseDuration()})
+
+		default:
+			return a
+		}
+	}
+}
+
+func (p *parser) parseUnary() Expr {
+	p.nesting++
+	defer func() { p.nesting-- }()
+	if p.opts.depthExceeded(p.nesting) {
+		p.limitExceeded("expression is nested deeper than %d", p.opts.maxDepth)
+		return EventName("")
+	}
+
+	if op := p.peek(); p.acceptKeyword("NOT") {
+		return p.node(op, Not{A: p.parseUnary()})
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() Expr {
+	tok := p.peek()
+	switch tok.kind {
+	case tokenLParen:
+		p.next()
+		e := p.parseOr()
+		p.expect(tokenRParen, ")")
+		return e
+
+	case tokenString:
+		p.next()
+		return p.parseEventName(tok, EventName(p.unquote(tok)))
+
+	case tokenIdent:
+		if strings.EqualFold(tok.text, "COUNT") && p.tokens[p.pos+1].kind == tokenLParen {
+			return p.parseCount()
+		}
+		if strings.EqualFold(tok.text, "WINDOW") && p.tokens[p.pos+1].kind == tokenLParen {
+			return p.parseWindow()
+		}
+		if strings.EqualFold(tok.text, "SEQ") && p.tokens[p.pos+1].kind == tokenLParen {
+			return p.parseSeq()
+		}
+		if strings.EqualFold(tok.text, "ANY_OF") && p.tokens[p.pos+1].kind == tokenLParen {
+			return p.parseAnyOf()
+		}
+		if strings.EqualFold(tok.text, "ALL_OF") && p.tokens[p.pos+1].kind == tokenLParen {
+			return p.parseAllOf()
+		}
+		if strings.EqualFold(tok.text, "AT_LEAST") && p.tokens[p.pos+1].kind == tokenLParen {
+			return p.parseAtLeast()
+		}
+
+		if isKeyword(tok.text) {
+			// Leave the keyword for the caller; it's most likely an operator
+			// with a missing operand.
+			p.errorf(tok, "expected expression, got keyword %s", strings.ToUpper(tok.text))
+			return EventName("")
+		}
+		p.next()
+		return p.parseEventName(tok, EventName(tok.text))
+
+	case tokenNumber:
+		p.next()
+		p.errorf(tok, "expected expression, got %s", tok)
+		return EventName("")
+
+	default:
+		p.errorf(tok, "expected expression, got %s", tok)
+		return EventName("")
+	}
+}
+
+// parseCount parses `COUNT(expr) op n`.
+func (p *parser) parseCount() Expr {
+	start := p.next()
+	p.next()
+
+	c := Count{A: p.parseOr()}
+	p.expect(tokenRParen, ")")
+
+	opTok := p.peek()
+	if opTok.kind != tokenOperator {
+		p.errorf(opTok, "expected comparison operator, got %s", opTok)
+
+		// Skip what is most likely a misspelled operator and the count.
+		if opTok.kind == tokenIdent && !isKeyword(opTok.text) {
+			p.next()
+		}
+		if p.peek().kind == tokenNumber {
+			p.next()
+		}
+		return c
+	}
+	p.next()
+	c.Op = PredicateOp(opTok.text)
+
+	if !p.parseInt(&c.N) {
+		return p.node(start, c)
+	}
+
+	if err := c.check(); err != nil {
+		p.errorf(opTok, "%s", err)
+	}
+	return p.node(start, c)
+}
+
+// parseWindow parses `WINDOW(expr, n, duration)`.
+func (p *parser) parseWindow() Expr {
+	start := p.next()
+	p.next()
+
+	errs := len(p.errs)
+	w := Window{A: p.parseOr()}
+	if !p.expect(tokenComma, ",") || !p.parseInt(&w.N) || !p.expect(tokenComma, ",") {
+		p.skipParenthesized()
+		return p.node(start, w)
+	}
+	w.D = p.parseDuration()
+	p.expect(tokenRParen, ")")
+
+	if err := w.check(); len(p.errs) == errs && err != nil {
+		p.errorf(start, "%s", err)
+	}
+	return p.node(start, w)
+}
+
+// parseAnchor parses `FIRST` or `LAST`, optionally followed by a double
+// quoted event name.
+func (p *parser) parseAnchor() Anchor {
+	var anchor Anchor
+	switch {
+	case p.acceptKeyword("FIRST"):
+		anchor.Kind = AnchorFirst
+	case p.acceptKeyword("LAST"):
+		anchor.Kind = AnchorLast
+	default:
+		tok := p.peek()
+		p.errorf(tok, "expected FIRST or LAST, got %s", tok)
+
+		// Skip what is most likely a misspelled anchor.
+		if tok.kind == tokenIdent && !isKeyword(tok.text) {
+			p.next()
+		}
+		return anchor
+	}
+
+	if tok := p.peek(); tok.kind == tokenString {
+		p.next()
+		anchor.Name = EventName(p.unquote(tok))
+	}
+	return anchor
+}
+
+// parseDuring parses `DURING "from" TO "to" IN "zone"` following a.
+func (p *parser) parseDuring(a Expr) Expr {
+	start := p.next()
+
+	errs := len(p.errs)
+	d := During{A: a, From: p.parseTimeOfDay()}
+	if !p.acceptKeyword("TO") {
+		p.errorf(p.peek(), "expected TO, got %s", p.peek())
+	}
+	d.To = p.parseTimeOfDay()
+	d.Zone = p.parseZone()
+
+	if err := d.check(); len(p.errs) == errs && err != nil {
+		p.errorf(start, "%s", err)
+	}
+	return p.node(start, d)
+}
+
+// parseOn parses `ON [day, ...] IN "zone"` following a.
+func (p *parser) parseOn(a Expr) Expr {
+	start := p.next()
+
+	errs := len(p.errs)
+	o := On{A: a}
+	if p.expect(tokenLBracket, "[") {
+		p.parseList(func() bool {
+			tok := p.peek()
+			day, ok := parseWeekday(tok.text)
+			if tok.kind != tokenIdent || !ok {
+				p.errorf(tok, "expected day of week, got %s", tok)
+				return false
+			}
+			p.next()
+			o.Days = append(o.Days, day)
+			return true
+		})
+	}
+	o.Zone = p.parseZone()
+
+	if err := o.check(); len(p.errs) == errs && err != nil {
+		p.errorf(start, "%s", err)
+	}
+	return p.node(start, o)
+}
+
+// parseTimestamp parses a double quoted RFC 3339 timestamp.
+func (p *parser) parseTimestamp() time.Time {
+	tok := p.peek()
+	if tok.kind != tokenString {
+		p.errorf(tok, "expected timestamp, got %s", tok)
+		return time.Time{}
+	}
+	p.next()
+
+	t, err := parseTimestamp(p.unquote(tok))
+	if err != nil {
+		p.errorf(tok, "%s", err)
+	}
+	return t
+}
+
+// parseTimeOfDay parses a double quoted time of day such as "09:30".
+func (p *parser) parseTimeOfDay() Duration {
+	tok := p.peek()
+	if tok.kind != tokenString {
+		p.errorf(tok, "expected time of day, got %s", tok)
+		return 0
+	}
+	p.next()
+
+	d, err := parseTimeOfDay(p.unquote(tok))
+	if err != nil {
+		p.errorf(tok, "%s", err)
+	}
+	return d
+}
+
+// parseZone parses `IN "zone"`.
+func (p *parser) parseZone() string {
+	if !p.acceptKeyword("IN") {
+		p.errorf(p.peek(), "expected IN, got %s", p.peek())
+		return ""
+	}
+
+	tok := p.peek()
+	if tok.kind != tokenString {
+		p.errorf(tok, "expected time zone, got %s", tok)
+		return ""
+	}
+	p.next()
+	return p.unquote(tok)
+}
+
+// parseSeq parses `SEQ(step, ...)`, optionally followed by RELAXED and
+// `IGNORE [name, ...]`.
+func (p *parser) parseSeq() Expr {
+	start := p.next()
+	p.next()
+
+	errs := len(p.errs)
+	s := Seq{}
+	for {
+		tok := p.peek()
+		step := p.parseOr()
+		switch step.(type) {
+		case EventName, Where:
+		default:
+			p.errorf(tok, "expected event name, got %s", step.Expression())
+		}
+		s.Steps = append(s.Steps, step)
+
+		if p.peek().kind != tokenComma {
+			break
+		}
+		p.next()
+	}
+	if !p.expect(tokenRParen, ")") {
+		p.skipParenthesized()
+	}
+
+	s.Relaxed = p.acceptKeyword("RELAXED")
+	if p.acceptKeyword("IGNORE") && p.expect(tokenLBracket, "[") {
+		p.parseList(func() bool {
+			tok := p.peek()
+			if tok.kind == tokenString {
+				s.Ignore = append(s.Ignore, EventName(p.unquote(tok)))
+			} else if tok.kind == tokenIdent && !isKeyword(tok.text) {
+				s.Ignore = append(s.Ignore, EventName(tok.text))
+			} else {
+				p.errorf(tok, "expected event name, got %s", tok)
+				return false
+			}
+			p.next()
+			return true
+		})
+	}
+
+	if err := s.check(); len(p.errs) == errs && err != nil {
+		p.errorf(start, "%s", err)
+	}
+	return p.node(start, s)
+}
+
+// parseAnyOf parses `ANY_OF(expr, ...)`.
+func (p *parser) parseAnyOf() Expr {
+	start := p.next()
+	p.next()
+
+	errs := len(p.errs)
+	a := AnyOf{Exprs: p.parseExprs()}
+	if err := a.check(); len(p.errs) == errs && err != nil {
+		p.errorf(start, "%s", err)
+	}
+	return p.node(start, a)
+}
+
+// parseAllOf parses `ALL_OF(expr, ...)`.
+func (p *parser) parseAllOf() Expr {
+	start := p.next()
+	p.next()
+
+	errs := len(p.errs)
+	a := AllOf{Exprs: p.parseExprs()}
+	if err := a.check(); len(p.errs) == errs && err != nil {
+		p.errorf(start, "%s", err)
+	}
+	return p.node(start, a)
+}
+
+// parseAtLeast parses `AT_LEAST(k, expr, ...)`.
+func (p *parser) parseAtLeast() Expr {
+	start := p.next()
+	p.next()
+
+	errs := len(p.errs)
+	a := AtLeast{}
+	if !p.parseInt(&a.K) || !p.expect(tokenComma, ",") {
+		p.skipParenthesized()
+		return p.node(start, a)
+	}
+	a.Exprs = p.parseExprs()
+
+	if err := a.check(); len(p.errs) == errs && err != nil {
+		p.errorf(start, "%s", err)
+	}
+	return p.node(start, a)
+}
+
+// parseExprs parses a list of expressions separated by commas, and the
+// closing parenthesis following it.
+func (p *parser) parseExprs() []Expr {
+	var exprs []Expr
+	for {
+		exprs = append(exprs, p.parseOr())
+		if p.peek().kind != tokenComma {
+			break
+		}
+		p.next()
+	}
+
+	if !p.expect(tokenRParen, ")") {
+		p.skipParenthesized()
+	}
+	return exprs
+}
+
+// parseInt parses an integer into n, reporting whether it succeeded.
+func (p *parser) parseInt(n *int) bool {
+	tok := p.peek()
+	if tok.kind != tokenNumber {
+		p.errorf(tok, "expected count, got %s", tok)
+		return false
+	}
+	p.next()
+
+	v, err := strconv.Atoi(tok.text)
+	if err != nil {
+		p.errorf(tok, "invalid count %q", tok.text)
+		return false
+	}
+	*n = v
+	return true
+}
+
+// skipParenthesized skips the rest of a parenthesized list after a problem,
+// including the closing parenthesis.
+func (p *parser) skipParenthesized() {
+	depth := 0
+	for tok := p.next(); tok.kind != tokenEOF; tok = p.next() {
+		switch tok.kind {
+		case tokenLParen:
+			depth++
+		case tokenRParen:
+			if depth == 0 {
+				return
+			}
+			depth--
+		}
+	}
+}
+
+// expect consumes the next token if it is of the given kind, and reports an
+// error otherwise.
+func (p *parser) expect(kind tokenKind, text string) bool {
+	tok := p.peek()
+	if tok.kind != kind {
+		p.errorf(tok, "expected %q, got %s", text, tok)
+		return false
+	}
+	p.next()
+	return true
+}
+
+func (p *parser) unquote(tok token) string {
+	s, err := strconv.Unquote(tok.text)
+	if err != nil {
+		p.errorf(tok, "invalid string %s", tok.text)
+	}
+	return s
+}
+
+// parseEventName parses what follows the event name name, given by the token
+// tok, which is either nothing or the predicates of a Where.
+func (p *parser) parseEventName(tok token, name EventName) Expr {
+	if p.peek().kind != tokenLBracket {
+		return p.node(tok, name)
+	}
+	p.next()
+
+	var predicates []Predicate
+	p.parseList(func() bool {
+		predicates = append(predicates, p.parsePredicate())
+		return true
+	})
+
+	return p.node(tok, Where{Name: name, Predicates: predicates})
+}
+
+// parseList parses the elements of a list following its "[", and the "]"
+// closing it, using parseElement, which returns false if an element is
+// broken. The rest of the list is then skipped, since what follows a broken
+// element can't be made sense of.
+func (p *parser) parseList(parseElement func() bool) {
+	for p.peek().kind != tokenRBracket {
+		if !parseElement() || p.peek().kind != tokenComma {
+			break
+		}
+		p.next()
+	}
+
+	if closing := p.peek(); closing.kind != tokenRBracket {
+		p.errorf(closing, "expected \"]\", got %s", closing)
+		for tok := p.peek(); tok.kind != tokenRBracket && tok.kind != tokenEOF; tok = p.peek() {
+			p.next()
+		}
+	}
+	p.next()
+}
+
+func (p *parser) parsePredicate() Predicate {
+	var pred Predicate
+
+	tok := p.peek()
+	switch tok.kind {
+	case tokenString:
+		pred.Property = p.unquote(tok)
+	case tokenIdent:
+		pred.Property = tok.text
+	default:
+		p.errorf(tok, "expected property, got %s", tok)
+		return pred
+	}
+	p.next()
+
+	opTok := p.peek()
+	switch {
+	case opTok.kind == tokenOperator:
+		pred.Op = PredicateOp(opTok.text)
+	case opTok.kind == tokenIdent && slices.ContainsFunc([]PredicateOp{OpIn, OpPrefix, OpMatches}, func(op PredicateOp) bool {
+		return strings.EqualFold(opTok.text, string(op))
+	}):
+		pred.Op = PredicateOp(strings.ToUpper(opTok.text))
+	default:
+		p.errorf(opTok, "expected predicate operator, got %s", opTok)
+		return pred
+	}
+	p.next()
+
+	pred.Value = p.parseValue()
+	if err := pred.check(); err != nil {
+		p.errorf(opTok, "%s", err)
+	}
+	return pred
+}
+
+// parseValue parses the value of a predicate: a string, a number, a boolean
+// or a list of those.
+func (p *parser) parseValue() interface{} {
+	if p.peek().kind != tokenLBracket {
+		return p.parseScalar()
+	}
+
+	p.next()
+	values := []interface{}{}
+	for p.peek().kind != tokenRBracket {
+		if tok := p.peek(); tok.kind == tokenLBracket {
+			// No predicate accepts nested lists, so they're skipped
+			// rather than parsed, which would nest without bound.
+			p.errorf(tok, "lists can't be nested")
+			p.skipList()
+		} else {
+			values = append(values, p.parseScalar())
+		}
+
+		if p.peek().kind != tokenComma {
+			break
+		}
+		p.next()
+	}
+
+	p.expect(tokenRBracket, "]")
+	return values
+}
+
+// skipList skips the list starting at the current token, including the lists
+// nested in it.
+func (p *parser) skipList() {
+	for depth := 0; p.peek().kind != tokenEOF; {
+		switch p.next().kind {
+		case tokenLBracket:
+			depth++
+		case tokenRBracket:
+			depth--
+		}
+		if depth == 0 {
+			return
+		}
+	}
+}
+
+// parseScalar parses a string, a number or a boolean.
+func (p *parser) parseScalar() interface{} {
+	tok := p.peek()
+	switch {
+	case tok.kind == tokenString:
+		p.next()
+		return p.unquote(tok)
+
+	case tok.kind == tokenNumber:
+		p.next()
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			p.errorf(tok, "invalid number %q", tok.text)
+		}
+		return n
+
+	case tok.kind == tokenIdent && (strings.EqualFold(tok.text, "true") || strings.EqualFold(tok.text, "false")):
+		p.next()
+		return strings.EqualFold(tok.text, "true")
+
+	default:
+		p.errorf(tok, "expected value, got %s", tok)
+		return nil
+	}
+}
+
+func (p *parser) parseDuration() Duration {
+	tok := p.peek()
+	if tok.kind != tokenNumber {
+		p.errorf(tok, "expected duration, got %s", tok)
+		return 0
+	}
+	p.next()
+
+	d, err := parseDuration(tok.text)
+	if err != nil {
+		p.errorf(tok, "%s", err)
+	}
+	return Duration(d)
+}
+
+// parseDuration parses a duration such as "1w2d3h4m5.5s". It accepts
+// everything time.ParseDuration does, as well as the units d (24 hours) and
+// w (7 days).
+func parseDuration(s string) (time.Duration, error) {
+	orig := s
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	// Segments using d and w are summed here; everything else is left for
+	// time.ParseDuration, which is exact for the strings it produces itself.
+	var days float64
+	sawDays := false
+	rest := ""
+	for s != "" {
+		i := 0
+		for i < len(s) && (isDigit(rune(s[i])) || s[i] == '.') {
+			i++
+		}
+		j := i
+		for j < len(s) && !isDigit(rune(s[j])) && s[j] != '.' {
+			j++
+		}
+
+		unit := 24 * time.Hour
+		switch s[i:j] {
+		case "d":
+		case "w":
+			unit *= 7
+		default:
+			rest += s[:j]
+			s = s[j:]
+			continue
+		}
+
+		n, err := strconv.ParseFloat(s[:i], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", orig)
+		}
+		days += n * float64(unit)
+		sawDays = true
+		s = s[j:]
+	}
+
+	if !sawDays {
+		d, err := time.ParseDuration(orig)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", orig)
+		}
+		return d, nil
+	}
+
+	d := time.Duration(0)
+	if rest != "" {
+		var err error
+		d, err = time.ParseDuration(rest)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", orig)
+		}
+	}
+
+	if days >= float64(math.MaxInt64-d) {
+		return 0, fmt.Errorf("invalid duration %q: overflow", orig)
+	}
+	d += time.Duration(days)
+
+	if neg {
+		d = -d
+	}
+	return d, nil
+}
@@ -0,0 +1,641 @@
+package driplang_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/micvbang/driplang"
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseExpressionRoundTrip verifies that parsing the output of
+// Expression() returns the original expression.
+func TestParseExpressionRoundTrip(t *testing.T) {
+	tests := map[string]struct {
+		expr driplang.Expr
+	}{
+		"event_name": {
+			expr: driplang.EventName("a"),
+		},
+		"event_name with escapes": {
+			expr: driplang.EventName("quote \" backslash \\ newline \n"),
+		},
+		"event_name keyword": {
+			expr: driplang.EventName("AND"),
+		},
+		"event_name empty": {
+			expr: driplang.EventName(""),
+		},
+		"and": {
+			expr: driplang.And{
+				A: driplang.EventName("a"),
+				B: driplang.EventName("b"),
+			},
+		},
+		"or": {
+			expr: driplang.Or{
+				A: driplang.EventName("a"),
+				B: driplang.EventName("b"),
+			},
+		},
+		"then": {
+			expr: driplang.Then{
+				A: driplang.EventName("a"),
+				B: driplang.EventName("b"),
+			},
+		},
+		"not": {
+			expr: driplang.Not{
+				A: driplang.EventName("a"),
+			},
+		},
+		"after": {
+			expr: driplang.After{
+				A: driplang.EventName("a"),
+				D: driplang.Duration(42133742),
+			},
+		},
+		"where": {
+			expr: driplang.Where{
+				Name: driplang.EventName("purchase"),
+				Predicates: []driplang.Predicate{
+					{Property: "amount", Op: driplang.OpGreaterOrEqual, Value: -100.25},
+					{Property: "plan", Op: driplang.OpNotEqual, Value: "free"},
+					{Property: "trial", Op: driplang.OpEqual, Value: false},
+					{Property: "country", Op: driplang.OpIn, Value: []interface{}{"DK", 45.0, true}},
+					{Property: "path \"quoted\"", Op: driplang.OpPrefix, Value: "/pricing"},
+					{Property: "email", Op: driplang.OpMatches, Value: `@example\.com$`},
+				},
+			},
+		},
+		"where without predicates": {
+			expr: driplang.Where{Name: driplang.EventName("purchase")},
+		},
+		"count": {
+			expr: driplang.Then{
+				A: driplang.Count{
+					A:  driplang.Then{A: driplang.EventName("a"), B: driplang.EventName("b")},
+					Op: driplang.OpNotEqual,
+					N:  2,
+				},
+				B: driplang.Count{A: driplang.EventName("c"), Op: driplang.OpLess, N: 0},
+			},
+		},
+		"since": {
+			expr: driplang.Since{
+				A: driplang.Or{A: driplang.EventName("a"), B: driplang.EventName("b")},
+				D: driplang.Duration(14 * 24 * time.Hour),
+			},
+		},
+		"window": {
+			expr: driplang.Window{
+				A: driplang.Or{A: driplang.EventName("a"), B: driplang.EventName("b")},
+				N: 5,
+				D: driplang.Duration(10 * time.Minute),
+			},
+		},
+		"within": {
+			expr: driplang.Then{
+				A: driplang.EventName("a"),
+				B: driplang.Not{
+					A: driplang.Within{
+						A: driplang.EventName("b"),
+						D: driplang.Duration(72 * time.Hour),
+					},
+				},
+			},
+		},
+		"between": {
+			expr: driplang.Between{
+				A:   driplang.EventName("a"),
+				Min: driplang.Duration(time.Hour),
+				Max: driplang.Duration(90 * time.Minute),
+			},
+		},
+		"seq": {
+			expr: driplang.Then{
+				A: driplang.Seq{
+					Steps: []driplang.Expr{
+						driplang.EventName("view"),
+						driplang.Where{Name: "cart", Predicates: []driplang.Predicate{{Property: "n", Op: driplang.OpGreater, Value: 1.0}}},
+						driplang.EventName("purchase"),
+					},
+					Ignore: []driplang.EventName{"heartbeat", "ping \"x\""},
+				},
+				B: driplang.Seq{
+					Steps:   []driplang.Expr{driplang.EventName("a"), driplang.EventName("b")},
+					Relaxed: true,
+					Ignore:  []driplang.EventName{"c"},
+				},
+			},
+		},
+		"n-ary": {
+			expr: driplang.Then{
+				A: driplang.AnyOf{Exprs: []driplang.Expr{
+					driplang.EventName("a"),
+					driplang.Or{A: driplang.EventName("b"), B: driplang.EventName("c")},
+				}},
+				B: driplang.AtLeast{K: 2, Exprs: []driplang.Expr{
+					driplang.AllOf{Exprs: []driplang.Expr{driplang.EventName("d")}},
+					driplang.Not{A: driplang.EventName("e")},
+					driplang.After{A: driplang.EventName("f"), D: driplang.Duration(time.Hour)},
+				}},
+			},
+		},
+		"then strategies": {
+			expr: driplang.Then{
+				A: driplang.Then{
+					A:        driplang.EventName("a"),
+					B:        driplang.EventName("b"),
+					Strategy: driplang.ThenEarliest,
+				},
+				B: driplang.Then{
+					A:        driplang.EventName("c"),
+					B:        driplang.Not{A: driplang.EventName("d")},
+					Strategy: driplang.ThenAny,
+				},
+				Strategy: driplang.ThenLatest,
+			},
+		},
+		"anchored after": {
+			expr: driplang.And{
+				A: driplang.After{
+					A:      driplang.EventName("a"),
+					D:      driplang.Duration(7 * 24 * time.Hour),
+					Anchor: driplang.Anchor{Kind: driplang.AnchorFirst},
+				},
+				B: driplang.After{
+					A:      driplang.EventName("b"),
+					D:      driplang.Duration(30 * 24 * time.Hour),
+					Anchor: driplang.Anchor{Kind: driplang.AnchorLast, Name: "trial \"started\""},
+				},
+			},
+		},
+		"after time": {
+			expr: driplang.AfterTime{
+				A: driplang.EventName("a"),
+				T: time.Date(2024, 3, 1, 12, 30, 0, 500, time.UTC),
+			},
+		},
+		"before time": {
+			expr: driplang.BeforeTime{
+				A: driplang.Then{A: driplang.EventName("a"), B: driplang.EventName("b")},
+				T: time.Date(2024, 3, 1, 0, 0, 0, 0, time.FixedZone("", -5*60*60)),
+			},
+		},
+		"during": {
+			expr: driplang.During{
+				A:    driplang.EventName("a"),
+				From: driplang.Duration(22 * time.Hour),
+				To:   driplang.Duration(6*time.Hour + 30*time.Minute + 15*time.Second),
+				Zone: "Europe/Copenhagen",
+			},
+		},
+		"on": {
+			expr: driplang.On{
+				A:    driplang.Or{A: driplang.EventName("a"), B: driplang.EventName("b")},
+				Days: []time.Weekday{time.Saturday, time.Sunday},
+				Zone: "America/New_York",
+			},
+		},
+		"where large number": {
+			expr: driplang.Where{
+				Name: driplang.EventName("a"),
+				Predicates: []driplang.Predicate{
+					{Property: "n", Op: driplang.OpLess, Value: 1e300},
+				},
+			},
+		},
+		"after negative": {
+			expr: driplang.After{
+				A: driplang.EventName("a"),
+				D: driplang.Duration(-time.Hour),
+			},
+		},
+		"after zero": {
+			expr: driplang.After{
+				A: driplang.EventName("a"),
+				D: driplang.Duration(0),
+			},
+		},
+		"right nested": {
+			expr: driplang.Then{
+				A: driplang.EventName("a"),
+				B: driplang.Then{
+					A: driplang.EventName("b"),
+					B: driplang.Or{
+						A: driplang.EventName("c"),
+						B: driplang.And{
+							A: driplang.EventName("d"),
+							B: driplang.EventName("e"),
+						},
+					},
+				},
+			},
+		},
+		"deeply nested": {
+			expr: driplang.Then{
+				A: driplang.And{
+					A: driplang.After{
+						A: driplang.Not{
+							A: driplang.EventName("1"),
+						},
+						D: driplang.Duration(10 * time.Hour),
+					},
+					B: driplang.Or{
+						A: driplang.EventName("2"),
+						B: driplang.Not{
+							A: driplang.After{
+								A: driplang.EventName("3"),
+								D: driplang.Duration(1 * time.Millisecond),
+							},
+						},
+					},
+				},
+				B: driplang.Not{
+					A: driplang.Not{
+						A: driplang.EventName("4"),
+					},
+				},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := driplang.Parse(test.expr.Expression())
+			require.NoError(t, err)
+			require.Equal(t, test.expr, got)
+		})
+	}
+}
+
+// TestParsePrecedence verifies that operators bind according to their
+// precedence when parentheses are left out.
+func TestParsePrecedence(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		expected string
+	}{
+		"and binds tighter than or": {
+			input:    `"a" OR "b" AND "c"`,
+			expected: `("a" OR ("b" AND "c"))`,
+		},
+		"then binds tighter than and": {
+			input:    `"a" AND "b" THEN "c"`,
+			expected: `("a" AND ("b" THEN "c"))`,
+		},
+		"after binds tighter than then": {
+			input:    `"a" THEN "b" AFTER 2h`,
+			expected: `("a" THEN ("b" AFTER 2h0m0s))`,
+		},
+		"not binds tighter than after": {
+			input:    `"signup" THEN NOT "purchase" AFTER 72h`,
+			expected: `("signup" THEN ((NOT "purchase") AFTER 72h0m0s))`,
+		},
+		"left associative": {
+			input:    `"a" THEN "b" THEN "c"`,
+			expected: `(("a" THEN "b") THEN "c")`,
+		},
+		"parentheses override precedence": {
+			input:    `("a" OR "b") AND "c"`,
+			expected: `(("a" OR "b") AND "c")`,
+		},
+		"chained after": {
+			input:    `"a" AFTER 1h AFTER 2h`,
+			expected: `(("a" AFTER 1h0m0s) AFTER 2h0m0s)`,
+		},
+		"keywords are case insensitive": {
+			input:    `"a" then not "b" after 1h`,
+			expected: `("a" THEN ((NOT "b") AFTER 1h0m0s))`,
+		},
+		"bare identifiers": {
+			input:    "signup THEN page_view.pricing",
+			expected: `("signup" THEN "page_view.pricing")`,
+		},
+		"where": {
+			input:    `purchase[amount>100, country in ["DK","SE"], path prefix "/pricing"] THEN refund`,
+			expected: `("purchase"["amount" > 100, "country" IN ["DK", "SE"], "path" PREFIX "/pricing"] THEN "refund")`,
+		},
+		"count": {
+			input:    `signup THEN count(page_view) >= 3 AFTER 1d AND NOT count(purchase)=1`,
+			expected: `(("signup" THEN (COUNT("page_view") >= 3 AFTER 24h0m0s)) AND (NOT COUNT("purchase") = 1))`,
+		},
+		"window": {
+			input:    `signup THEN window(session, 3, 1w)`,
+			expected: `("signup" THEN WINDOW("session", 3, 168h0m0s))`,
+		},
+		"since": {
+			input:    `login SINCE 2w OR since SINCE 1h`,
+			expected: `(("login" SINCE 336h0m0s) OR ("since" SINCE 1h0m0s))`,
+		},
+		"window as event name": {
+			input:    `window AND "b"`,
+			expected: `("window" AND "b")`,
+		},
+		"count as event name": {
+			input:    `count THEN "b"`,
+			expected: `("count" THEN "b")`,
+		},
+		"within": {
+			input:    `"a" THEN NOT "b" WITHIN 3d`,
+			expected: `("a" THEN ((NOT "b") WITHIN 72h0m0s))`,
+		},
+		"between binds tighter than and": {
+			input:    `"a" THEN "b" BETWEEN 1h AND 2h AND "c"`,
+			expected: `(("a" THEN ("b" BETWEEN 1h0m0s AND 2h0m0s)) AND "c")`,
+		},
+		"contextual keywords as event names": {
+			input:    `within THEN between WITHIN 1h`,
+			expected: `("within" THEN ("between" WITHIN 1h0m0s))`,
+		},
+		"seq": {
+			input:    `seq(view, cart[n > 1]) relaxed THEN SEQ("a") ignore [heartbeat, "ping"] AFTER 1h OR seq`,
+			expected: `((SEQ("view", "cart"["n" > 1]) RELAXED THEN (SEQ("a") IGNORE ["heartbeat", "ping"] AFTER 1h0m0s)) OR "seq")`,
+		},
+		"n-ary": {
+			input:    `any_of(a, b AND c) THEN at_least(2, a, b THEN c, all_of(d)) OR any_of`,
+			expected: `((ANY_OF("a", ("b" AND "c")) THEN AT_LEAST(2, "a", ("b" THEN "c"), ALL_OF("d"))) OR "any_of")`,
+		},
+		"then strategies": {
+			input:    `cart THEN latest NOT purchase OR a THEN Any ("b") OR a THEN earliest b AFTER 1h`,
+			expected: `((("cart" THEN LATEST (NOT "purchase")) OR ("a" THEN ANY "b")) OR ("a" THEN EARLIEST ("b" AFTER 1h0m0s)))`,
+		},
+		"then strategies as event names": {
+			input:    `a THEN latest AND a THEN any WITHIN 1h OR a THEN earliest`,
+			expected: `((("a" THEN "latest") AND ("a" THEN ("any" WITHIN 1h0m0s))) OR ("a" THEN "earliest"))`,
+		},
+		"anchored after": {
+			input:    `purchase AFTER 7d from first AND NOT purchase AFTER 30d FROM LAST "trial" THEN first`,
+			expected: `(("purchase" AFTER 168h0m0s FROM FIRST) AND (((NOT "purchase") AFTER 720h0m0s FROM LAST "trial") THEN "first"))`,
+		},
+		"calendar": {
+			input:    `purchase during "9:00" to "17:00" in "UTC" THEN refund ON [sat, Sun] IN "Europe/Copenhagen" AFTER "2024-03-01T00:00:00Z"`,
+			expected: `(("purchase" DURING "09:00" TO "17:00" IN "UTC") THEN (("refund" ON [SAT, SUN] IN "Europe/Copenhagen") AFTER "2024-03-01T00:00:00Z"))`,
+		},
+		"calendar keywords as event names": {
+			input:    `before THEN on BEFORE "2024-03-01T00:00:00+01:00" AND during AFTER "2024-03-01T00:00:00-00:00"`,
+			expected: `(("before" THEN ("on" BEFORE "2024-03-01T00:00:00+01:00")) AND ("during" AFTER "2024-03-01T00:00:00Z"))`,
+		},
+		"multiple lines": {
+			input:    "signup\n\tTHEN purchase",
+			expected: `("signup" THEN "purchase")`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := driplang.Parse(test.input)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, got.Expression())
+		})
+	}
+}
+
+// TestParseDurations verifies that duration literals accept the units of
+// time.ParseDuration as well as days and weeks.
+func TestParseDurations(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		expected time.Duration
+	}{
+		"go":          {input: "2h30m", expected: 2*time.Hour + 30*time.Minute},
+		"fraction":    {input: "1.5h", expected: 90 * time.Minute},
+		"micro":       {input: "5µs", expected: 5 * time.Microsecond},
+		"zero":        {input: "0", expected: 0},
+		"days":        {input: "3d", expected: 72 * time.Hour},
+		"zero days":   {input: "0d", expected: 0},
+		"weeks":       {input: "2w", expected: 14 * 24 * time.Hour},
+		"mixed":       {input: "1w2d12h30m", expected: 9*24*time.Hour + 12*time.Hour + 30*time.Minute},
+		"half day":    {input: "0.5d", expected: 12 * time.Hour},
+		"negative":    {input: "-1d2h", expected: -26 * time.Hour},
+		"nanoseconds": {input: "42.133742ms", expected: 42133742},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := driplang.Parse(`"a" AFTER ` + test.input)
+			require.NoError(t, err)
+			require.Equal(t, driplang.After{A: driplang.EventName("a"), D: driplang.Duration(test.expected)}, got)
+		})
+	}
+}
+
+// TestParseInvalid verifies that Parse returns an error, including the
+// position of the problem, for invalid input.
+func TestParseInvalid(t *testing.T) {
+	tests := map[string]struct {
+		input string
+		err   string
+	}{
+		"empty": {
+			input: "",
+			err:   "1:1: expected expression, got end of input",
+		},
+		"unterminated string": {
+			input: `"a" AND "b`,
+			err:   `1:9: unterminated string`,
+		},
+		"missing right operand": {
+			input: `"a" AND`,
+			err:   "1:8: expected expression, got end of input",
+		},
+		"missing closing parenthesis": {
+			input: `("a" AND "b"`,
+			err:   `1:13: expected ")", got end of input`,
+		},
+		"trailing tokens": {
+			input: `"a" "b"`,
+			err:   `1:5: unexpected string "b"`,
+		},
+		"keyword as event name": {
+			input: `"a" AND then`,
+			err:   "1:9: expected expression, got keyword THEN; 1:13: expected expression, got end of input",
+		},
+		"missing duration": {
+			input: `"a" THEN "b" AFTER`,
+			err:   `1:19: expected duration, got end of input`,
+		},
+		"invalid timestamp": {
+			input: `"a" THEN "b" AFTER "c"`,
+			err:   `1:20: invalid timestamp "c"`,
+		},
+		"invalid duration unit": {
+			input: `"a" THEN "b" AFTER 3y`,
+			err:   `1:20: invalid duration "3y"`,
+		},
+		"invalid predicate value": {
+			input: `"a"[amount > "b", path MATCHES "(", x = [1]]`,
+			err:   `1:12: > expects a number, got string; 1:24: invalid regular expression "("; 1:39: = expects a string, number or boolean, got list`,
+		},
+		"nested list": {
+			input: `"a"[c IN ["DK", ` + strings.Repeat("[", 100_000) + strings.Repeat("]", 100_000) + `, "SE"]] THEN "b"`,
+			err:   `1:17: lists can't be nested`,
+		},
+		"invalid predicate operator": {
+			input: `"a"[amount ~ 1]`,
+			err:   `1:12: unexpected character '~'; 1:14: expected predicate operator, got "1"`,
+		},
+		"missing closing bracket": {
+			input: `"a"[amount > 1 THEN "b"`,
+			err:   `1:16: expected "]", got "THEN"`,
+		},
+		"between missing and": {
+			input: `"a" THEN "b" BETWEEN 1h 2h`,
+			err:   `1:25: expected AND, got "2h"`,
+		},
+		"invalid count": {
+			input: `COUNT("a") IN 2 OR COUNT("b") > -1 OR COUNT("c") = 1.5`,
+			err:   `1:12: expected comparison operator, got "IN"; 1:31: count -1 is negative; 1:52: invalid count "1.5"`,
+		},
+		"invalid window": {
+			input: `WINDOW("a", 0, 1h) OR WINDOW("b" 1, 1h) OR WINDOW("c", 1, 1h`,
+			err:   `1:1: window count 0 is less than 1; 1:34: expected ",", got "1"; 1:61: expected ")", got end of input`,
+		},
+		"invalid seq": {
+			input: `SEQ("a" THEN "b", NOT c) OR SEQ(a) IGNORE [AND] OR SEQ(a b)`,
+			err:   `1:5: expected event name, got ("a" THEN "b"); 1:19: expected event name, got (NOT "c"); 1:44: expected event name, got "AND"; 1:58: expected ")", got "b"`,
+		},
+		"invalid n-ary": {
+			input: `ANY_OF() OR ALL_OF(a, ) OR AT_LEAST(0, a) OR AT_LEAST(a, b) OR ALL_OF(a b)`,
+			err:   `1:8: expected expression, got ")"; 1:23: expected expression, got ")"; 1:28: AT_LEAST count 0 is less than 1; 1:55: expected count, got "a"; 1:73: expected ")", got "b"`,
+		},
+		"invalid anchor": {
+			input: `"a" AFTER 1d FROM NOW OR "b" AFTER 1d FROM`,
+			err:   `1:19: expected FIRST or LAST, got "NOW"; 1:43: expected FIRST or LAST, got end of input`,
+		},
+		"invalid calendar": {
+			input: `"a" DURING "9" TO "10:00" IN "UTC" OR "b" ON [MON, FUNDAY] IN "UTC" OR "c" ON [] IN "Mars/Olympus" OR "d" DURING "10:00" "11:00" IN "UTC"`,
+			err:   `1:12: invalid time of day "9"; 1:52: expected day of week, got "FUNDAY"; 1:76: no days given; 1:122: expected TO, got string "11:00"`,
+		},
+		"unknown time zone": {
+			input: `"a" DURING "10:00" TO "10:00" IN "UTC" OR "b" ON [MON] IN "Mars/Olympus"`,
+			err:   `1:5: time of day window from 10:00 to 10:00 is empty; 1:47: unknown time zone "Mars/Olympus"`,
+		},
+		"local time zone": {
+			input: `"a" DURING "09:00" TO "17:00" IN "Local" OR "b" ON [MON] IN "Local"`,
+			err:   `1:5: time zone "Local" depends on the system; give it explicitly, e.g. "Europe/Copenhagen"; 1:49: time zone "Local" depends on the system; give it explicitly, e.g. "Europe/Copenhagen"`,
+		},
+		"unexpected character": {
+			input: "\"a\"\nAND #",
+			err:   `2:5: unexpected character '#'; 2:6: expected expression, got end of input`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := driplang.Parse(test.input)
+			require.EqualError(t, err, test.err)
+		})
+	}
+}
+
+// TestParseMultipleErrors verifies that Parse keeps going after a problem and
+// reports every problem it finds, each located by line and column.
+func TestParseMultipleErrors(t *testing.T) {
+	_, err := driplang.Parse("\"a\" AND AND \"b\"\nTHEN \"c\" AFTER 3y\nOR #")
+
+	var errs driplang.Errors
+	require.ErrorAs(t, err, &errs)
+	require.Equal(t, driplang.Errors{
+		{Code: driplang.ErrorCodeSyntax, Line: 1, Column: 9, Message: "expected expression, got keyword AND"},
+		{Code: driplang.ErrorCodeSyntax, Line: 2, Column: 16, Message: `invalid duration "3y"`},
+		{Code: driplang.ErrorCodeSyntax, Line: 3, Column: 4, Message: "unexpected character '#'"},
+		{Code: driplang.ErrorCodeSyntax, Line: 3, Column: 5, Message: "expected expression, got end of input"},
+	}, errs)
+	require.ErrorIs(t, err, driplang.ErrInvalidExpression)
+}
+
+// TestParseValidationErrors verifies that Parse locates the problems found
+// using WithValidation by line and column, like syntax errors.
+func TestParseValidationErrors(t *testing.T) {
+	_, err := driplang.Parse("\"a\" AFTER 1h\nOR \"b\" THEN (\"c\" AND NOT \"c\")", driplang.WithValidation())
+
+	var errs driplang.Errors
+	require.ErrorAs(t, err, &errs)
+	require.Equal(t, driplang.Errors{
+		{Code: driplang.ErrorCodeMisplacedAfter, Line: 1, Column: 5, Message: "AFTER can only be satisfied on the right hand side of THEN"},
+		{Code: driplang.ErrorCodeContradiction, Line: 2, Column: 18, Message: `"c" can't be satisfied together with its negation at $.b.b.b`},
+	}, errs)
+}
+
+// TestParseLimits verifies that Parse rejects expressions exceeding the
+// configured depth and node limits, and that deeply nested input is rejected
+// by default instead of exhausting the stack.
+func TestParseLimits(t *testing.T) {
+	tests := map[string]struct {
+		input string
+		opts  []driplang.Option
+		err   string
+	}{
+		"within limits": {
+			input: `"a" THEN NOT ("b" AND "c")`,
+			opts:  []driplang.Option{driplang.WithMaxDepth(4), driplang.WithMaxNodes(6)},
+		},
+		"too deep": {
+			input: `"a" THEN NOT ("b" AND "c")`,
+			opts:  []driplang.Option{driplang.WithMaxDepth(3)},
+			err:   "1:1: expression is nested deeper than 3",
+		},
+		"too many nodes": {
+			input: `"a" THEN NOT ("b" AND "c")`,
+			opts:  []driplang.Option{driplang.WithMaxNodes(5)},
+			err:   "1:27: expression has more than 5 nodes",
+		},
+		"deeply nested parentheses": {
+			input: strings.Repeat("(", 100_000) + `"a"` + strings.Repeat(")", 100_000),
+			err:   "1:257: expression is nested deeper than 256",
+		},
+		"deeply nested not": {
+			input: strings.Repeat("NOT ", 100_000) + `"a"`,
+			err:   "1:1025: expression is nested deeper than 256",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := driplang.Parse(test.input, test.opts...)
+			if test.err == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.EqualError(t, err, test.err)
+
+			var errs driplang.Errors
+			require.ErrorAs(t, err, &errs)
+			require.Equal(t, driplang.ErrorCodeLimitExceeded, errs[0].Code)
+		})
+	}
+}
+
+// FuzzParse verifies that Parse never panics, that it enforces its limits, and
+// that everything it accepts survives a round trip through Expression().
+func FuzzParse(f *testing.F) {
+	f.Add(`"a" THEN NOT "b" AFTER 3d`)
+	f.Add(`signup AND ("x\"y" OR z) THEN w AFTER -1w2d3h4m5.5s`)
+	f.Add(`("a" AND`)
+	f.Add(`purchase[amount >= 1.5, c IN ["DK", 1, true], p PREFIX "/", e MATCHES "x+"]`)
+	f.Add(`SEQ(a, b[n > 1]) RELAXED IGNORE [c, "d"] THEN seq`)
+	f.Add(`ANY_OF(a, ALL_OF(b, c), AT_LEAST(2, d, e, f)) OR all_of`)
+	f.Add(`cart THEN latest NOT purchase OR a THEN any`)
+	f.Add(`a AFTER 1d FROM last "b" OR c AFTER 2h FROM FIRST`)
+	f.Add(`a DURING "22:00" TO "6:30:15" IN "Europe/Copenhagen" ON [sat, SUN] IN "UTC" BEFORE "2024-03-01T00:00:00+01:00"`)
+
+	const maxDepth, maxNodes = 10, 20
+	f.Fuzz(func(t *testing.T, s string) {
+		expr, err := driplang.Parse(s, driplang.WithMaxDepth(maxDepth), driplang.WithMaxNodes(maxNodes))
+		if err != nil {
+			require.ErrorIs(t, err, driplang.ErrInvalidExpression)
+			return
+		}
+
+		require.LessOrEqual(t, exprDepth(expr), maxDepth)
+		require.LessOrEqual(t, exprNodes(expr), maxNodes)
+
+		got, err := driplang.Parse(expr.Expression(), driplang.WithMaxDepth(maxDepth), driplang.WithMaxNodes(maxNodes))
+		require.NoError(t, err)
+		require.Equal(t, expr, got)
+	})
+}
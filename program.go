@@ -0,0 +1,620 @@
+package driplang
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Program is an expression compiled for fast repeated evaluation. It gives
+// the same results as evaluating the expression it was compiled from, e.g.
+// using Evaluate, but looks up events by name using per-name indexes of the
+// events instead of scanning them.
+//
+// A Program is safe for concurrent use.
+type Program struct {
+	expr     Expr
+	compiled Expr
+	names    map[string]int
+
+	// allEvents reports whether events of any name can change the result,
+	// e.g. because of an After anchored to the latest event.
+	allEvents bool
+}
+
+// eventRef is an EventName whose name has been resolved to an ID by Compile.
+type eventRef struct {
+	name EventName
+	id   int
+}
+
+func (r eventRef) Expression() string {
+	return r.name.Expression()
+}
+
+// whereRef is a Where whose name has been resolved to an ID by Compile, with
+// the regular expressions of its MATCHES predicates compiled.
+type whereRef struct {
+	Where
+	id int
+
+	// regexps holds the regular expression of each predicate using
+	// OpMatches, and nil for the others.
+	regexps []*regexp.Regexp
+}
+
+// matches reports whether event satisfies r, like Where.matches.
+func (r whereRef) matches(event Event) bool {
+	if event.Name != string(r.Name) {
+		return false
+	}
+
+	for i, p := range r.Predicates {
+		if re := r.regexps[i]; re != nil {
+			s, ok := event.Properties[p.Property].(string)
+			if !ok || !re.MatchString(s) {
+				return false
+			}
+		} else if !p.matches(event.Properties) {
+			return false
+		}
+	}
+	return true
+}
+
+// afterRef is an After anchored to the first or latest event with a name,
+// whose name has been resolved to an ID by Compile.
+type afterRef struct {
+	After
+	id int
+}
+
+// thenRef is a Then with the IDs of the event names used by A, which makes it
+// possible to only consider the prefixes of events that change A's result.
+type thenRef struct {
+	Then
+	ids []int
+}
+
+// Compile compiles e into a Program. If e contains operators unknown to this
+// package, invalid predicates, counts or windows, an error of type Errors is
+// returned, locating each by its JSON path.
+func Compile(e Expr) (*Program, error) {
+	c := compiler{names: make(map[string]int)}
+	compiled := c.compile(e, "$")
+	if len(c.errs) > 0 {
+		return nil, c.errs
+	}
+
+	return &Program{
+		expr:      e,
+		compiled:  compiled,
+		names:     c.names,
+		allEvents: refIDs(compiled, []int{}, false) == nil,
+	}, nil
+}
+
+type compiler struct {
+	names map[string]int
+	errs  Errors
+}
+
+// id returns the ID of name, assigning it a new one if it hasn't been seen.
+func (c *compiler) id(name EventName) int {
+	id, ok := c.names[string(name)]
+	if !ok {
+		id = len(c.names)
+		c.names[string(name)] = id
+	}
+	return id
+}
+
+func (c *compiler) compile(e Expr, path string) Expr {
+	switch v := e.(type) {
+	case EventName:
+		return eventRef{name: v, id: c.id(v)}
+
+	case Where:
+		regexps := make([]*regexp.Regexp, len(v.Predicates))
+		for i, p := range v.Predicates {
+			if err := p.check(); err != nil {
+				c.errs = append(c.errs, &Error{
+					Code:    ErrorCodeInvalidValue,
+					Path:    fmt.Sprintf("%s.predicates[%d]", path, i),
+					Message: err.Error(),
+				})
+				continue
+			}
+
+			if p.Op == OpMatches {
+				regexps[i] = regexp.MustCompile(p.Value.(string))
+			}
+		}
+		return whereRef{Where: v, id: c.id(v.Name), regexps: regexps}
+
+	case Not:
+		return Not{A: c.compile(v.A, path+".a")}
+
+	case And:
+		return And{A: c.compile(v.A, path+".a"), B: c.compile(v.B, path+".b")}
+
+	case Or:
+		return Or{A: c.compile(v.A, path+".a"), B: c.compile(v.B, path+".b")}
+
+	case Then:
+		if err := v.Strategy.check(); err != nil {
+			c.errs = append(c.errs, &Error{Code: ErrorCodeInvalidValue, Path: path, Message: err.Error()})
+		}
+
+		a := c.compile(v.A, path+".a")
+		return thenRef{
+			Then: Then{A: a, B: c.compile(v.B, path+".b"), Strategy: v.Strategy},
+			ids:  refIDs(a, []int{}, false),
+		}
+
+	case After:
+		if err := v.Anchor.check(); err != nil {
+			c.errs = append(c.errs, &Error{Code: ErrorCodeInvalidValue, Path: path, Message: err.Error()})
+		}
+
+		a := After{A: c.compile(v.A, path+".a"), D: v.D, Anchor: v.Anchor}
+		if v.Anchor.Name != "" {
+			return afterRef{After: a, id: c.id(v.Anchor.Name)}
+		}
+		return a
+
+	case Within:
+		return Within{A: c.compile(v.A, path+".a"), D: v.D}
+
+	case Count:
+		if err := v.check(); err != nil {
+			c.errs = append(c.errs, &Error{Code: ErrorCodeInvalidValue, Path: path, Message: err.Error()})
+		}
+		return Count{A: c.compile(v.A, path+".a"), Op: v.Op, N: v.N}
+
+	case Since:
+		return Since{A: c.compile(v.A, path+".a"), D: v.D}
+
+	case Window:
+		if err := v.check(); err != nil {
+			c.errs = append(c.errs, &Error{Code: ErrorCodeInvalidValue, Path: path, Message: err.Error()})
+		}
+		return Window{A: c.compile(v.A, path+".a"), N: v.N, D: v.D}
+
+	case Between:
+		return Between{A: c.compile(v.A, path+".a"), Min: v.Min, Max: v.Max}
+
+	case AfterTime:
+		return AfterTime{A: c.compile(v.A, path+".a"), T: v.T}
+
+	case BeforeTime:
+		return BeforeTime{A: c.compile(v.A, path+".a"), T: v.T}
+
+	case During:
+		if err := v.check(); err != nil {
+			c.errs = append(c.errs, &Error{Code: ErrorCodeInvalidValue, Path: path, Message: err.Error()})
+		}
+		return During{A: c.compile(v.A, path+".a"), From: v.From, To: v.To, Zone: v.Zone}
+
+	case Seq:
+		if err := v.check(); err != nil {
+			c.errs = append(c.errs, &Error{Code: ErrorCodeInvalidValue, Path: path, Message: err.Error()})
+		}
+
+		steps := make([]Expr, len(v.Steps))
+		for i, step := range v.Steps {
+			steps[i] = c.compile(step, fmt.Sprintf("%s.steps[%d]", path, i))
+		}
+		return Seq{Steps: steps, Relaxed: v.Relaxed, Ignore: v.Ignore}
+
+	case On:
+		if err := v.check(); err != nil {
+			c.errs = append(c.errs, &Error{Code: ErrorCodeInvalidValue, Path: path, Message: err.Error()})
+		}
+		return On{A: c.compile(v.A, path+".a"), Days: v.Days, Zone: v.Zone}
+
+	case AnyOf:
+		if err := v.check(); err != nil {
+			c.errs = append(c.errs, &Error{Code: ErrorCodeInvalidValue, Path: path, Message: err.Error()})
+		}
+		return AnyOf{Exprs: c.compileExprs(v.Exprs, path)}
+
+	case AllOf:
+		if err := v.check(); err != nil {
+			c.errs = append(c.errs, &Error{Code: ErrorCodeInvalidValue, Path: path, Message: err.Error()})
+		}
+		return AllOf{Exprs: c.compileExprs(v.Exprs, path)}
+
+	case AtLeast:
+		if err := v.check(); err != nil {
+			c.errs = append(c.errs, &Error{Code: ErrorCodeInvalidValue, Path: path, Message: err.Error()})
+		}
+		return AtLeast{K: v.K, Exprs: c.compileExprs(v.Exprs, path)}
+
+	default:
+		c.errs = append(c.errs, &Error{
+			Code:    ErrorCodeUnknownOperator,
+			Path:    path,
+			Message: fmt.Sprintf("unknown operator %T", e),
+		})
+		return nil
+	}
+}
+
+// compileExprs compiles exprs, the operands of the n-ary operator at path.
+func (c *compiler) compileExprs(exprs []Expr, path string) []Expr {
+	compiled := make([]Expr, len(exprs))
+	for i, e := range exprs {
+		compiled[i] = c.compile(e, fmt.Sprintf("%s.exprs[%d]", path, i))
+	}
+	return compiled
+}
+
+// refIDs appends the IDs of the event names in the compiled expression e to
+// ids, skipping duplicates. It returns nil if events of any name can change
+// e's result.
+//
+// offset reports whether e can be evaluated from another event than the first
+// one, e.g. the one following an occurrence of Then.A, which can have any
+// name. Matcher keeps the first event, so only then do an After anchored to
+// the first event, whatever its name, and the prefixes of the events that a
+// Then using the default strategy evaluates A for depend on events of any
+// name.
+func refIDs(e Expr, ids []int, offset bool) []int {
+	if ids == nil {
+		return nil
+	}
+
+	switch v := e.(type) {
+	case eventRef:
+		for _, id := range ids {
+			if id == v.id {
+				return ids
+			}
+		}
+		return append(ids, v.id)
+	case whereRef:
+		return refIDs(eventRef{name: v.Name, id: v.id}, ids, offset)
+	case Not:
+		return refIDs(v.A, ids, offset)
+	case And:
+		return refIDs(v.B, refIDs(v.A, ids, offset), offset)
+	case Or:
+		return refIDs(v.B, refIDs(v.A, ids, offset), offset)
+	case thenRef:
+		if v.Strategy == ThenDefault && offset {
+			// The prefixes of the events start at an event of any name.
+			return nil
+		}
+
+		// Using the default strategy, A is evaluated for prefixes of the
+		// events; otherwise its occurrences are found one after the other.
+		aOffset := offset || v.Strategy != ThenDefault
+		return refIDs(v.B, refIDs(v.A, ids, aOffset), true)
+	case After:
+		if v.Anchor.Kind == AnchorLast {
+			// The anchor is the latest event of any name; anchors with a
+			// name are compiled to afterRef.
+			return nil
+		}
+		if v.Anchor.Kind == AnchorFirst && offset {
+			return nil
+		}
+		return refIDs(v.A, ids, offset)
+	case afterRef:
+		return refIDs(v.A, refIDs(eventRef{name: v.Anchor.Name, id: v.id}, ids, offset), offset)
+	case Within:
+		return refIDs(v.A, ids, offset)
+	case Count:
+		return refIDs(v.A, ids, true)
+	case Window:
+		return refIDs(v.A, ids, true)
+	case Since:
+		return refIDs(v.A, ids, true)
+	case Between:
+		return refIDs(v.A, ids, offset)
+	case AfterTime:
+		// The events not after T are left out.
+		return refIDs(v.A, ids, true)
+	case BeforeTime:
+		return refIDs(v.A, ids, offset)
+	case During:
+		return refIDs(v.A, ids, true)
+	case On:
+		return refIDs(v.A, ids, true)
+	case Seq:
+		if !v.Relaxed {
+			// Any event between two steps breaks the sequence.
+			return nil
+		}
+		for _, step := range v.Steps {
+			ids = refIDs(step, ids, true)
+		}
+		return ids
+	case AnyOf:
+		for _, e := range v.Exprs {
+			ids = refIDs(e, ids, offset)
+		}
+		return ids
+	case AllOf:
+		for _, e := range v.Exprs {
+			ids = refIDs(e, ids, offset)
+		}
+		return ids
+	case AtLeast:
+		for _, e := range v.Exprs {
+			ids = refIDs(e, ids, offset)
+		}
+		return ids
+	default:
+		return ids
+	}
+}
+
+// Expr returns the expression p was compiled from.
+func (p *Program) Expr() Expr {
+	return p.expr
+}
+
+// Evaluate is like the package level Evaluate.
+func (p *Program) Evaluate(events []Event) bool {
+	return p.EvaluateAt(events, SystemClock.Now())
+}
+
+// EvaluateWithIndex is like the package level EvaluateWithIndex.
+func (p *Program) EvaluateWithIndex(events []Event) (int, bool) {
+	return p.EvaluateWithIndexAt(events, SystemClock.Now())
+}
+
+// EvaluateAt is like the package level EvaluateAt.
+func (p *Program) EvaluateAt(events []Event, now time.Time) bool {
+	_, satisfied := p.EvaluateWithIndexAt(events, now)
+	return satisfied
+}
+
+// EvaluateWithIndexAt is like the package level EvaluateWithIndexAt.
+func (p *Program) EvaluateWithIndexAt(events []Event, now time.Time) (int, bool) {
+	return p.Index(events).EvaluateWithIndexAt(now)
+}
+
+// NextChange is like the package level NextChange.
+func (p *Program) NextChange(events []Event, now time.Time) (time.Time, bool) {
+	return p.Index(events).NextChange(now)
+}
+
+// Indexed is a history of events indexed by name for evaluating a Program.
+// Evaluating it repeatedly, e.g. at different times, or using both
+// EvaluateAt and NextChange, only indexes the events once. The events must
+// not be changed while it's in use.
+//
+// An Indexed is safe for concurrent use.
+type Indexed struct {
+	program *Program
+	events  []Event
+
+	// index holds, for each name ID, the indices of the events with that name
+	// in ascending order.
+	index [][]int
+}
+
+// Index indexes events for evaluating p against them.
+func (p *Program) Index(events []Event) *Indexed {
+	// Each name is looked up once per run of events with that name, and the
+	// indices of all names share a single allocation.
+	ids := make([]int, len(events))
+	counts := make([]int, len(p.names))
+	total, id, name := 0, -1, ""
+	for i, event := range events {
+		if i == 0 || event.Name != name {
+			var ok bool
+			if id, ok = p.names[event.Name]; !ok {
+				id = -1
+			}
+			name = event.Name
+		}
+
+		ids[i] = id
+		if id >= 0 {
+			counts[id]++
+			total++
+		}
+	}
+
+	all := make([]int, total)
+	index := make([][]int, len(counts))
+	offset := 0
+	for id, n := range counts {
+		index[id] = all[offset : offset : offset+n]
+		offset += n
+	}
+	for i, id := range ids {
+		if id >= 0 {
+			index[id] = append(index[id], i)
+		}
+	}
+
+	return &Indexed{program: p, events: events, index: index}
+}
+
+// EvaluateAt is like Program.EvaluateAt, using x's events.
+func (x *Indexed) EvaluateAt(now time.Time) bool {
+	_, satisfied := x.EvaluateWithIndexAt(now)
+	return satisfied
+}
+
+// EvaluateWithIndexAt is like Program.EvaluateWithIndexAt, using x's events.
+func (x *Indexed) EvaluateWithIndexAt(now time.Time) (int, bool) {
+	ev := x.evaluator()
+	ev.now = now
+	i, satisfied, _ := ev.evaluate(x.program.compiled, 0, len(x.events), minTime)
+	return i, satisfied
+}
+
+// NextChange is like Program.NextChange, using x's events.
+func (x *Indexed) NextChange(now time.Time) (time.Time, bool) {
+	return x.evaluator().nextChange(x.program.compiled, now)
+}
+
+// evaluator returns an evaluator for x's events.
+func (x *Indexed) evaluator() evaluator {
+	return evaluator{events: x.events, index: x.index, cursors: make([]cursor, len(x.index))}
+}
+
+// cursor holds positions in the index of a name ID found by earlier lookups,
+// where the next lookups start searching. Then looks up events in prefixes
+// that differ by one event at a time, so a lookup rarely moves a cursor more
+// than a step.
+type cursor struct {
+	lo, hi, prev int
+}
+
+// seek returns the position of the first index in occurrences not before i.
+// It searches outwards from the position *hint, in steps that double in size,
+// and moves the hint to the result. This takes time logarithmic in the
+// distance moved rather than in len(occurrences).
+func seek(occurrences []int, i int, hint *int) int {
+	// The result is in (lo, hi].
+	lo, hi := -1, len(occurrences)
+	if j := min(*hint, hi); j == hi || occurrences[j] >= i {
+		hi = j
+		for step := 1; hi-step >= 0; step *= 2 {
+			if occurrences[hi-step] < i {
+				lo = hi - step
+				break
+			}
+			hi -= step
+		}
+	} else {
+		lo = j
+		for step := 1; lo+step < hi; step *= 2 {
+			if occurrences[lo+step] >= i {
+				hi = lo + step
+				break
+			}
+			lo += step
+		}
+	}
+
+	for lo+1 < hi {
+		m := int(uint(lo+hi) >> 1)
+		if occurrences[m] >= i {
+			hi = m
+		} else {
+			lo = m
+		}
+	}
+
+	*hint = hi
+	return hi
+}
+
+// occurrences returns the indices of the events in ev.events[lo:hi] with the
+// name ID id, and the position in them of the first event not before
+// mustBeAfter.
+func (ev *evaluator) occurrences(id int, lo, hi int, mustBeAfter time.Time) ([]int, int) {
+	occurrences, c := ev.index[id], &ev.cursors[id]
+	occurrences = occurrences[seek(occurrences, lo, &c.lo):seek(occurrences, hi, &c.hi)]
+
+	// Events are sorted by time, so the first event that is not before
+	// mustBeAfter can be found using binary search, too. Usually, it's the
+	// first one.
+	if len(occurrences) > 0 && !ev.events[occurrences[0]].Time.Before(mustBeAfter) {
+		return occurrences, 0
+	}
+	j := sort.Search(len(occurrences), func(j int) bool {
+		return ev.events[occurrences[j]].Time.Sub(mustBeAfter) >= 0
+	})
+	return occurrences, j
+}
+
+// evaluateEventRef evaluates r like an EventName, only considering the
+// indexed events with r's name.
+func (ev *evaluator) evaluateEventRef(r eventRef, lo, hi int, mustBeAfter time.Time) (int, bool, bool) {
+	// Usually, the first occurrence isn't before mustBeAfter, and the end of
+	// the occurrences needn't be found.
+	index := ev.index[r.id]
+	if first := seek(index, lo, &ev.cursors[r.id].lo); first < len(index) && index[first] < hi && !ev.events[index[first]].Time.Before(mustBeAfter) {
+		return index[first], true, true
+	}
+
+	occurrences, j := ev.occurrences(r.id, lo, hi, mustBeAfter)
+	if len(occurrences) == 0 {
+		return -1, false, ev.nowAfter(mustBeAfter)
+	}
+
+	if j < len(occurrences) {
+		return occurrences[j], true, true
+	}
+
+	return occurrences[0], true, false
+}
+
+// evaluateWhereRef evaluates r like a Where, only considering the indexed
+// events with r's name.
+func (ev *evaluator) evaluateWhereRef(r whereRef, lo, hi int, mustBeAfter time.Time) (int, bool, bool) {
+	occurrences, j := ev.occurrences(r.id, lo, hi, mustBeAfter)
+	for _, i := range occurrences[j:] {
+		if r.matches(ev.events[i]) {
+			return i, true, true
+		}
+	}
+
+	for _, i := range occurrences[:j] {
+		if r.matches(ev.events[i]) {
+			return i, true, false
+		}
+	}
+
+	return -1, false, ev.nowAfter(mustBeAfter)
+}
+
+// evaluateAfterRef evaluates r like an After, finding its anchor among the
+// indexed events with the anchor's name.
+func (ev *evaluator) evaluateAfterRef(r afterRef, lo, hi int) (int, bool, bool) {
+	occurrences, _ := ev.occurrences(r.id, lo, hi, minTime)
+	anchor := -1
+	if len(occurrences) > 0 && r.Anchor.Kind == AnchorFirst {
+		anchor = occurrences[0]
+	}
+	if len(occurrences) > 0 && r.Anchor.Kind == AnchorLast {
+		anchor = occurrences[len(occurrences)-1]
+	}
+
+	return ev.evaluateAnchoredAfter(r.After, anchor, lo, hi)
+}
+
+// keepsOccurrence reports whether e, a compiled expression, is satisfied by
+// the same event in every prefix of the events that includes it, as is the
+// case for an event name: the first occurrence not before the time it must be
+// after, or the first occurrence if there is none.
+func keepsOccurrence(e Expr) bool {
+	switch e.(type) {
+	case eventRef, whereRef:
+		return true
+	default:
+		return false
+	}
+}
+
+// prevPrefix returns the length of the next prefix of the events to consider
+// when evaluating Then, given that the prefix ending before i was just
+// considered. If ids is nil every prefix is considered; otherwise the next
+// prefix is the one ending just before the latest event before i with one of
+// the name IDs in ids, as the events in between can't change the result of
+// Then.A.
+func (ev *evaluator) prevPrefix(ids []int, i int) int {
+	if ids == nil {
+		return i - 1
+	}
+
+	prev := -1
+	for _, id := range ids {
+		occurrences := ev.index[id]
+		j := seek(occurrences, i, &ev.cursors[id].prev) - 1
+		if j >= 0 && occurrences[j] > prev {
+			prev = occurrences[j]
+		}
+	}
+	return prev
+}
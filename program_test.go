@@ -0,0 +1,331 @@
+package driplang_test
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/micvbang/driplang"
+	"github.com/stretchr/testify/require"
+)
+
+// TestProgramEqualsEvaluate verifies that evaluating a compiled Program gives
+// the same results as evaluating the expression it was compiled from, for
+// random expressions and event histories.
+func TestProgramEqualsEvaluate(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	names := []string{"a", "b", "c"}
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for run := 0; run < 2000; run++ {
+		expr := randomExpr(rng, names, 4)
+		events := randomEvents(rng, names, start, rng.Intn(12))
+		now := start.Add(time.Duration(rng.Intn(48)) * time.Hour)
+
+		program, err := driplang.Compile(expr)
+		require.NoError(t, err)
+
+		expectedIndex, expected := driplang.EvaluateWithIndexAt(expr, events, now)
+		gotIndex, got := program.EvaluateWithIndexAt(events, now)
+		require.Equal(t, expected, got, "%s %v", expr.Expression(), events)
+		require.Equal(t, expectedIndex, gotIndex, "%s %v", expr.Expression(), events)
+
+		expectedNext, expectedChanges := driplang.NextChange(expr, events, now)
+		gotNext, gotChanges := program.NextChange(events, now)
+		require.Equal(t, expectedChanges, gotChanges)
+		require.Equal(t, expectedNext, gotNext)
+	}
+}
+
+// TestIndexedEqualsEvaluate verifies that evaluating events indexed once by
+// a Program gives the same results as evaluating the expression, at
+// different times and for longer histories than TestProgramEqualsEvaluate.
+func TestIndexedEqualsEvaluate(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	names := []string{"a", "b", "c"}
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for run := 0; run < 500; run++ {
+		expr := randomExpr(rng, names, 4)
+		events := randomEvents(rng, names, start, rng.Intn(60))
+
+		program, err := driplang.Compile(expr)
+		require.NoError(t, err)
+		indexed := program.Index(events)
+
+		for k := 0; k < 3; k++ {
+			now := start.Add(time.Duration(rng.Intn(48)) * time.Hour)
+
+			expectedIndex, expected := driplang.EvaluateWithIndexAt(expr, events, now)
+			gotIndex, got := indexed.EvaluateWithIndexAt(now)
+			require.Equal(t, expected, got, "%s %v", expr.Expression(), events)
+			require.Equal(t, expectedIndex, gotIndex, "%s %v", expr.Expression(), events)
+
+			expectedNext, expectedChanges := driplang.NextChange(expr, events, now)
+			gotNext, gotChanges := indexed.NextChange(now)
+			require.Equal(t, expectedChanges, gotChanges)
+			require.Equal(t, expectedNext, gotNext)
+		}
+	}
+}
+
+type unknownExpr struct{}
+
+func (unknownExpr) Expression() string {
+	return "unknown"
+}
+
+// TestCompileUnknownOperator verifies that Compile returns an error locating
+// operators it doesn't know.
+func TestCompileUnknownOperator(t *testing.T) {
+	_, err := driplang.Compile(driplang.Then{
+		A: driplang.EventName("a"),
+		B: driplang.Not{A: unknownExpr{}},
+	})
+	require.Equal(t, driplang.Errors{
+		{Code: driplang.ErrorCodeUnknownOperator, Path: "$.b.a", Message: "unknown operator driplang_test.unknownExpr"},
+	}, err)
+}
+
+// TestCompileInvalidPredicate verifies that Compile returns an error locating
+// invalid predicates.
+func TestCompileInvalidPredicate(t *testing.T) {
+	_, err := driplang.Compile(driplang.Not{
+		A: driplang.Where{
+			Name:       "a",
+			Predicates: []driplang.Predicate{{Property: "p", Op: "~", Value: 1.0}},
+		},
+	})
+	require.Equal(t, driplang.Errors{
+		{Code: driplang.ErrorCodeInvalidValue, Path: "$.a.predicates[0]", Message: `unknown predicate operator "~"`},
+	}, err)
+}
+
+// BenchmarkThen compares evaluating a Then expression using Evaluate and a
+// compiled Program, for histories where most events aren't used by the
+// expression. Evaluate considers every prefix of the events, scanning each of
+// them, which is quadratic in the number of events. Program only considers the
+// prefixes ending at events used by Then.A, and finds them using its indexes.
+func BenchmarkThen(b *testing.B) {
+	expr := driplang.Then{
+		A: driplang.EventName("signup"),
+		B: driplang.After{
+			A: driplang.EventName("purchase"),
+			D: driplang.Duration(time.Hour),
+		},
+	}
+	program, err := driplang.Compile(expr)
+	require.NoError(b, err)
+
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := start.Add(time.Hour)
+
+	for _, n := range []int{100, 1_000, 10_000} {
+		events := make([]driplang.Event, n)
+		for i := range events {
+			events[i] = driplang.Event{Name: "page_view", Time: start.Add(time.Duration(i) * time.Second)}
+		}
+		events[n-1].Name = "signup"
+
+		b.Run(fmt.Sprintf("evaluate/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				driplang.EvaluateAt(expr, events, now)
+			}
+		})
+
+		b.Run(fmt.Sprintf("program/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				program.EvaluateAt(events, now)
+			}
+		})
+	}
+}
+
+// BenchmarkThenWorstCase is like BenchmarkThen, but every event satisfies
+// Then.A, so Program can't skip the prefixes of the events by name. With the
+// default strategy, Evaluate finds A at the start of every prefix, which takes
+// time linear in the number of events, while Program only tries the prefixes
+// that change A's result. With ThenAny, B is evaluated after every occurrence
+// of A; Evaluate scans the remaining events each time, which is quadratic,
+// while Program looks them up using its indexes. The indexed cases evaluate
+// an Indexed built once, leaving out the time it takes to index the events.
+func BenchmarkThenWorstCase(b *testing.B) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := start.Add(time.Hour)
+
+	for _, strategy := range []driplang.ThenStrategy{driplang.ThenDefault, driplang.ThenAny} {
+		expr := driplang.Then{
+			A: driplang.EventName("signup"),
+			B: driplang.After{
+				A: driplang.EventName("purchase"),
+				D: driplang.Duration(time.Hour),
+			},
+			Strategy: strategy,
+		}
+		program, err := driplang.Compile(expr)
+		require.NoError(b, err)
+
+		name := "default"
+		if strategy != driplang.ThenDefault {
+			name = strings.ToLower(string(strategy))
+		}
+
+		for _, n := range []int{100, 1_000, 10_000} {
+			events := make([]driplang.Event, n)
+			for i := range events {
+				events[i] = driplang.Event{Name: "signup", Time: start.Add(time.Duration(i) * time.Second)}
+			}
+
+			b.Run(fmt.Sprintf("%s/evaluate/%d", name, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					driplang.EvaluateAt(expr, events, now)
+				}
+			})
+
+			b.Run(fmt.Sprintf("%s/program/%d", name, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					program.EvaluateAt(events, now)
+				}
+			})
+
+			indexed := program.Index(events)
+			b.Run(fmt.Sprintf("%s/indexed/%d", name, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					indexed.EvaluateAt(now)
+				}
+			})
+		}
+	}
+}
+
+// randomExpr returns a random expression of at most the given depth, using
+// the given event names.
+func randomExpr(rng *rand.Rand, names []string, depth int) driplang.Expr {
+	if depth <= 1 || rng.Intn(4) == 0 {
+		name := driplang.EventName(names[rng.Intn(len(names))])
+		if rng.Intn(3) > 0 {
+			return name
+		}
+
+		return driplang.Where{
+			Name: name,
+			Predicates: []driplang.Predicate{
+				{Property: "n", Op: driplang.OpGreaterOrEqual, Value: float64(rng.Intn(3))},
+			},
+		}
+	}
+
+	switch rng.Intn(14) {
+	case 0:
+		return driplang.Not{A: randomExpr(rng, names, depth-1)}
+	case 1:
+		return driplang.And{A: randomExpr(rng, names, depth-1), B: randomExpr(rng, names, depth-1)}
+	case 2:
+		return driplang.Or{A: randomExpr(rng, names, depth-1), B: randomExpr(rng, names, depth-1)}
+	case 3:
+		strategies := []driplang.ThenStrategy{driplang.ThenDefault, driplang.ThenDefault, driplang.ThenEarliest, driplang.ThenLatest, driplang.ThenAny}
+		return driplang.Then{
+			A:        randomExpr(rng, names, depth-1),
+			B:        randomExpr(rng, names, depth-1),
+			Strategy: strategies[rng.Intn(len(strategies))],
+		}
+	case 4:
+		return driplang.Within{
+			A: randomExpr(rng, names, depth-1),
+			D: driplang.Duration(time.Duration(rng.Intn(6)) * time.Hour),
+		}
+	case 6:
+		ops := []driplang.PredicateOp{driplang.OpEqual, driplang.OpLess, driplang.OpGreaterOrEqual}
+		return driplang.Count{
+			A:  randomExpr(rng, names, depth-1),
+			Op: ops[rng.Intn(len(ops))],
+			N:  rng.Intn(4),
+		}
+	case 8:
+		return driplang.Since{
+			A: randomExpr(rng, names, depth-1),
+			D: driplang.Duration(time.Duration(rng.Intn(6)) * time.Hour),
+		}
+	case 7:
+		return driplang.Window{
+			A: randomExpr(rng, names, depth-1),
+			N: 1 + rng.Intn(3),
+			D: driplang.Duration(time.Duration(rng.Intn(6)) * time.Hour),
+		}
+	case 5:
+		from := rng.Intn(6)
+		return driplang.Between{
+			A:   randomExpr(rng, names, depth-1),
+			Min: driplang.Duration(time.Duration(from) * time.Hour),
+			Max: driplang.Duration(time.Duration(from+rng.Intn(6)) * time.Hour),
+		}
+	case 9:
+		t := time.Date(2024, 3, 1, 12+rng.Intn(12), 0, 0, 0, time.UTC)
+		if rng.Intn(2) == 0 {
+			return driplang.AfterTime{A: randomExpr(rng, names, depth-1), T: t}
+		}
+		return driplang.BeforeTime{A: randomExpr(rng, names, depth-1), T: t}
+	case 10:
+		from := rng.Intn(24)
+		return driplang.During{
+			A:    randomExpr(rng, names, depth-1),
+			From: driplang.Duration(time.Duration(from) * time.Hour),
+			To:   driplang.Duration(time.Duration((from+1+rng.Intn(12))%24) * time.Hour),
+			Zone: "Europe/Copenhagen",
+		}
+	case 11:
+		seq := driplang.Seq{Relaxed: rng.Intn(2) == 0}
+		for n := 1 + rng.Intn(3); n > 0; n-- {
+			seq.Steps = append(seq.Steps, driplang.EventName(names[rng.Intn(len(names))]))
+		}
+		if rng.Intn(2) == 0 {
+			seq.Ignore = []driplang.EventName{driplang.EventName(names[rng.Intn(len(names))])}
+		}
+		return seq
+	case 12:
+		exprs := make([]driplang.Expr, 1+rng.Intn(3))
+		for i := range exprs {
+			exprs[i] = randomExpr(rng, names, depth-1)
+		}
+		switch rng.Intn(3) {
+		case 0:
+			return driplang.AnyOf{Exprs: exprs}
+		case 1:
+			return driplang.AllOf{Exprs: exprs}
+		default:
+			return driplang.AtLeast{K: 1 + rng.Intn(len(exprs)), Exprs: exprs}
+		}
+	default:
+		anchors := []driplang.Anchor{
+			{},
+			{},
+			{Kind: driplang.AnchorFirst},
+			{Kind: driplang.AnchorLast},
+			{Kind: driplang.AnchorFirst, Name: driplang.EventName(names[rng.Intn(len(names))])},
+			{Kind: driplang.AnchorLast, Name: driplang.EventName(names[rng.Intn(len(names))])},
+		}
+		return driplang.After{
+			A:      randomExpr(rng, names, depth-1),
+			D:      driplang.Duration(time.Duration(rng.Intn(6)) * time.Hour),
+			Anchor: anchors[rng.Intn(len(anchors))],
+		}
+	}
+}
+
+// randomEvents returns n events sorted by time, starting at start, using the
+// given event names. Each event has a random number property "n".
+func randomEvents(rng *rand.Rand, names []string, start time.Time, n int) []driplang.Event {
+	events := make([]driplang.Event, n)
+	t := start
+	for i := range events {
+		t = t.Add(time.Duration(rng.Intn(3)) * time.Hour)
+		events[i] = driplang.Event{
+			Name:       names[rng.Intn(len(names))],
+			Time:       t,
+			Properties: map[string]interface{}{"n": float64(rng.Intn(3))},
+		}
+	}
+	return events
+}
@@ -0,0 +1,487 @@
+package driplang
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"regexp"
+	"sort"
+	"time"
+)
+
+const (
+	// searchTries is the number of random timelines tried by Satisfiable and
+	// Tautology, after trying those with fewer than two events and those built
+	// for COUNT and WINDOW.
+	searchTries = 10_000
+
+	// searchMaxEvents bounds the number of events of the random timelines
+	// tried, besides those of the occurrences built for COUNT and WINDOW.
+	searchMaxEvents = 24
+
+	// searchMaxOccurrences bounds the number of events of the timelines built
+	// with the occurrences needed by COUNT and WINDOW.
+	searchMaxOccurrences = 1_000
+)
+
+// Satisfiable reports whether any events satisfy e at the time given by
+// ev.Clock, and returns such events as a witness, e.g. to use as a test case
+// for e. The witness has no events that can be removed without it no longer
+// satisfying e.
+//
+// The events are searched for: Satisfiable evaluates e for timelines built
+// from the event names, property values, durations and times that e refers
+// to, first all of those with fewer than two events, then timelines with the
+// occurrences needed by each COUNT and WINDOW of e, built from witnesses for
+// their operands, and then random longer ones, some of them including those
+// occurrences.
+//
+// A false result is therefore a heuristic, not a proof that e can't be
+// satisfied: it only means that none of the timelines tried satisfy e. For
+// rules of the size that people write it's rarely wrong, but it can be, e.g.
+// for a COUNT needing more than 1000 occurrences.
+func (ev Evaluator) Satisfiable(e Expr) (bool, []Event) {
+	witness, found := search(e, ev.now(), true)
+	return found, witness
+}
+
+// Tautology reports whether e is satisfied by all events at the time given by
+// ev.Clock. If not, it returns events that don't satisfy e as a
+// counterexample. Like for Satisfiable, the counterexample is searched for.
+func (ev Evaluator) Tautology(e Expr) (bool, []Event) {
+	counterexample, found := search(e, ev.now(), false)
+	return !found, counterexample
+}
+
+// Satisfiable reports whether any events satisfy e at the current time, and
+// returns such events as a witness; see Evaluator.Satisfiable.
+func Satisfiable(e Expr) (bool, []Event) {
+	return Evaluator{}.Satisfiable(e)
+}
+
+// Tautology reports whether e is satisfied by all events at the current time,
+// and returns events that don't satisfy it if not; see Evaluator.Tautology.
+func Tautology(e Expr) (bool, []Event) {
+	return Evaluator{}.Tautology(e)
+}
+
+// search returns events for which evaluating e at now gives satisfied, if it
+// finds any.
+func search(e Expr, now time.Time, satisfied bool) ([]Event, bool) {
+	evaluate := func(events []Event) bool {
+		return EvaluateAt(e, events, now)
+	}
+	if program, err := Compile(e); err == nil {
+		evaluate = func(events []Event) bool {
+			return program.EvaluateAt(events, now)
+		}
+	}
+
+	kinds := eventKinds(e)
+	times := candidateTimes(e, now)
+	found := func(events []Event) ([]Event, bool) {
+		return shrink(events, func(events []Event) bool {
+			return evaluate(events) == satisfied
+		}), true
+	}
+
+	if evaluate(nil) == satisfied {
+		return []Event{}, true
+	}
+
+	for _, kind := range kinds {
+		for _, t := range times {
+			event := kind
+			event.Time = t
+			if events := []Event{event}; evaluate(events) == satisfied {
+				return found(events)
+			}
+		}
+	}
+
+	occurrences := occurrenceTimelines(e, now)
+	for _, events := range occurrences {
+		if evaluate(events) == satisfied {
+			return found(events)
+		}
+	}
+
+	// The timelines depend only on e and now, making the results
+	// reproducible.
+	rng := rand.New(rand.NewSource(1))
+	maxEvents := searchEvents(e)
+	for try := 0; try < searchTries; try++ {
+		events := randomTimeline(rng, kinds, times, 2+rng.Intn(maxEvents-1))
+		if len(occurrences) > 0 && rng.Intn(2) == 0 {
+			events = mergeTimelines(events, occurrences[rng.Intn(len(occurrences))])
+		}
+		if evaluate(events) == satisfied {
+			return found(events)
+		}
+	}
+	return nil, false
+}
+
+// shrink returns events without the events that can be removed while keeping
+// keep true. Removing an event can make others removable, e.g. the event that
+// an earlier one had to precede, so it repeats until no more can be removed.
+func shrink(events []Event, keep func([]Event) bool) []Event {
+	for removed := true; removed; {
+		removed = false
+		for i := 0; i < len(events); {
+			shrunk := append(append([]Event{}, events[:i]...), events[i+1:]...)
+			if keep(shrunk) {
+				events = shrunk
+				removed = true
+				continue
+			}
+			i++
+		}
+	}
+	return events
+}
+
+// randomTimeline returns n events of random kinds, at random times, sorted by
+// time. Half of the timelines use only a random range of times, making events
+// close in time more likely.
+func randomTimeline(rng *rand.Rand, kinds []Event, times []time.Time, n int) []Event {
+	if rng.Intn(2) == 0 {
+		from := rng.Intn(len(times))
+		times = times[from : from+1+rng.Intn(len(times)-from)]
+	}
+
+	events := make([]Event, n)
+	for i := range events {
+		events[i] = kinds[rng.Intn(len(kinds))]
+		events[i].Time = times[rng.Intn(len(times))]
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return events
+}
+
+// occurrenceTimelines returns timelines with the occurrences needed to satisfy,
+// or not satisfy, each COUNT and WINDOW of e: one less, as many as and one
+// more than the N of a COUNT, and the N of a WINDOW. They're built from a
+// witness for the operand, repeated one after the other, as random timelines
+// rarely have enough of them.
+func occurrenceTimelines(e Expr, now time.Time) [][]Event {
+	var timelines [][]Event
+	Walk(e, func(e Expr) bool {
+		var a Expr
+		var counts []int
+		switch v := e.(type) {
+		case Count:
+			a, counts = v.A, []int{v.N - 1, v.N, v.N + 1}
+		case Window:
+			a, counts = v.A, []int{v.N}
+		default:
+			return true
+		}
+
+		witness, ok := search(a, now, true)
+		if !ok || len(witness) == 0 {
+			return true
+		}
+		for _, n := range counts {
+			if n < 1 || n > searchMaxOccurrences/len(witness) {
+				continue
+			}
+			if events, ok := repeatTimeline(witness, n); ok {
+				timelines = append(timelines, events)
+			}
+		}
+		return true
+	})
+	return timelines
+}
+
+// repeatTimeline returns n copies of events, each starting when the previous
+// one ends, and the last at the times of events. It returns false if the
+// times would overflow.
+func repeatTimeline(events []Event, n int) ([]Event, bool) {
+	span := events[len(events)-1].Time.Sub(events[0].Time)
+	if span > 0 && time.Duration(n) > math.MaxInt64/span {
+		return nil, false
+	}
+
+	repeated := make([]Event, 0, n*len(events))
+	for i := 0; i < n; i++ {
+		shift := -time.Duration(n-1-i) * span
+		for _, event := range events {
+			event.Time = event.Time.Add(shift)
+			repeated = append(repeated, event)
+		}
+	}
+	return repeated, true
+}
+
+// mergeTimelines returns the events of a and b, sorted by time. Events at the
+// same time keep their order, with those of a first.
+func mergeTimelines(a, b []Event) []Event {
+	merged := append(append(make([]Event, 0, len(a)+len(b)), a...), b...)
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Time.Before(merged[j].Time)
+	})
+	return merged
+}
+
+// searchEvents returns the maximum number of events of the random timelines
+// tried for e, which is enough for every event name, anchor, COUNT and WINDOW
+// of e to be satisfied twice by events of their own, up to searchMaxEvents.
+func searchEvents(e Expr) int {
+	n := 0
+	Walk(e, func(e Expr) bool {
+		switch v := e.(type) {
+		case EventName, Where:
+			n++
+		case After:
+			if v.Anchor != (Anchor{}) {
+				n++
+			}
+		case Count:
+			n += v.N + 1
+		case Window:
+			n += v.N
+		}
+		return true
+	})
+
+	n *= 2
+	if n < 2 {
+		return 2
+	}
+	if n > searchMaxEvents {
+		return searchMaxEvents
+	}
+	return n
+}
+
+// eventKinds returns the events, without times, that timelines for e are
+// built from: an event for every name of e, an event for every Where of e
+// that satisfies it, and events that satisfy all but one of its predicates,
+// and an event whose name isn't used by e.
+func eventKinds(e Expr) []Event {
+	names := Names(e)
+
+	var kinds []Event
+	for _, name := range names {
+		kinds = append(kinds, Event{Name: name})
+	}
+
+	Walk(e, func(e Expr) bool {
+		w, ok := e.(Where)
+		if !ok {
+			return true
+		}
+
+		properties, ok := satisfyingProperties(w.Predicates)
+		if !ok {
+			return true
+		}
+		kinds = append(kinds, Event{Name: string(w.Name), Properties: properties})
+
+		for _, p := range w.Predicates {
+			for _, v := range candidateValues(p.Value) {
+				if p.matches(map[string]interface{}{p.Property: v}) {
+					continue
+				}
+
+				violating := make(map[string]interface{}, len(properties))
+				for property, value := range properties {
+					violating[property] = value
+				}
+				violating[p.Property] = v
+				kinds = append(kinds, Event{Name: string(w.Name), Properties: violating})
+				break
+			}
+		}
+		return true
+	})
+
+	other := "other"
+	for contains(names, other) {
+		other += "_"
+	}
+	kinds = append(kinds, Event{Name: other})
+
+	var unique []Event
+	for _, kind := range kinds {
+		duplicate := false
+		for _, u := range unique {
+			if reflect.DeepEqual(kind, u) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			unique = append(unique, kind)
+		}
+	}
+	return unique
+}
+
+// satisfyingProperties returns properties that satisfy all of predicates, if
+// it can find any among the candidate values of the predicates.
+func satisfyingProperties(predicates []Predicate) (map[string]interface{}, bool) {
+	properties := map[string]interface{}{}
+	for _, p := range predicates {
+		if _, ok := properties[p.Property]; ok {
+			continue
+		}
+
+		var candidates []interface{}
+		for _, q := range predicates {
+			if q.Property == p.Property {
+				candidates = append(candidates, candidateValues(q.Value)...)
+			}
+		}
+
+		found := false
+		for _, v := range candidates {
+			matches := true
+			for _, q := range predicates {
+				if q.Property == p.Property && !q.matches(map[string]interface{}{q.Property: v}) {
+					matches = false
+					break
+				}
+			}
+			if matches {
+				properties[p.Property] = v
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return properties, true
+}
+
+// candidateValues returns property values that are likely to satisfy, or not
+// satisfy, predicates comparing to value: value itself and values just
+// different from it.
+func candidateValues(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case bool:
+		return []interface{}{v, !v}
+
+	case string:
+		values := []interface{}{v, v + "_", ""}
+		if re, err := regexp.Compile(v); err == nil {
+			prefix, _ := re.LiteralPrefix()
+			values = append(values, prefix, regexp.QuoteMeta(prefix))
+		}
+		return values
+
+	case []interface{}:
+		var values []interface{}
+		for _, element := range v {
+			values = append(values, candidateValues(element)...)
+		}
+		return values
+
+	default:
+		n, ok := toNumber(v)
+		if !ok {
+			return nil
+		}
+		return []interface{}{n, n - 1, n + 1}
+	}
+}
+
+// candidateTimes returns the times, not after now, that timelines for e are
+// built from, in ascending order. They're the times at which the durations
+// of e, and sums of two of them, end before now, times just before and after
+// those, and times around the times and times of day of e.
+func candidateTimes(e Expr, now time.Time) []time.Time {
+	var durations []time.Duration
+	var times []time.Time
+	Walk(e, func(e Expr) bool {
+		switch v := e.(type) {
+		case After:
+			durations = append(durations, time.Duration(v.D))
+		case Within:
+			durations = append(durations, time.Duration(v.D))
+		case Between:
+			durations = append(durations, time.Duration(v.Min), time.Duration(v.Max))
+		case Since:
+			durations = append(durations, time.Duration(v.D))
+		case Window:
+			durations = append(durations, time.Duration(v.D))
+		case AfterTime:
+			times = append(times, v.T)
+		case BeforeTime:
+			times = append(times, v.T)
+		case During:
+			times = append(times, timesOfDay(now, v.Zone, v.From, v.To)...)
+		case On:
+			for day := 1; day < 7; day++ {
+				durations = append(durations, time.Duration(day)*24*time.Hour)
+			}
+		}
+		return true
+	})
+
+	offsets := []time.Duration{0}
+	for i, a := range durations {
+		for _, b := range append([]time.Duration{0}, durations[i:]...) {
+			if d := a + b; d > 0 && d-a == b {
+				offsets = append(offsets, d)
+			}
+		}
+	}
+	for _, t := range times {
+		if !t.After(now) {
+			offsets = append(offsets, now.Sub(t))
+		}
+	}
+
+	candidates := []time.Time{}
+	seen := map[time.Time]bool{}
+	for _, offset := range offsets {
+		for _, d := range []time.Duration{offset - time.Second, offset, offset + time.Second} {
+			t := now.Add(-d)
+			if d < 0 || t.IsZero() || seen[t] {
+				continue
+			}
+			seen[t] = true
+			candidates = append(candidates, t)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Before(candidates[j])
+	})
+	return candidates
+}
+
+// timesOfDay returns the times at the times of day from and to in zone, on
+// the day of now and the day before it.
+func timesOfDay(now time.Time, zone string, from, to Duration) []time.Time {
+	loc, err := loadLocation(zone)
+	if err != nil {
+		return nil
+	}
+
+	var times []time.Time
+	local := now.In(loc)
+	for day := 0; day < 2; day++ {
+		midnight := time.Date(local.Year(), local.Month(), local.Day()-day, 0, 0, 0, 0, loc)
+		times = append(times, midnight.Add(time.Duration(from)), midnight.Add(time.Duration(to)))
+	}
+	return times
+}
+
+// contains reports whether ss contains s.
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+package driplang_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micvbang/driplang"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSatisfiable verifies that Satisfiable finds minimal witnesses for
+// satisfiable expressions, and none for expressions that can't be satisfied.
+func TestSatisfiable(t *testing.T) {
+	a, b := driplang.EventName("a"), driplang.EventName("b")
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	evaluator := driplang.Evaluator{Clock: driplang.ClockFunc(func() time.Time { return now })}
+
+	tests := map[string]struct {
+		expr        driplang.Expr
+		satisfiable bool
+		events      int
+	}{
+		"event name": {
+			expr:        a,
+			satisfiable: true,
+			events:      1,
+		},
+		"not": {
+			expr:        driplang.Not{A: a},
+			satisfiable: true,
+			events:      0,
+		},
+		"contradiction": {
+			expr:        driplang.And{A: a, B: driplang.Not{A: a}},
+			satisfiable: false,
+		},
+		"then after": {
+			expr:        driplang.Then{A: a, B: driplang.After{A: b, D: driplang.Duration(3 * time.Hour)}},
+			satisfiable: true,
+			events:      2,
+		},
+		"then in both orders": {
+			expr:        driplang.And{A: driplang.Then{A: a, B: b}, B: driplang.Then{A: b, B: a}},
+			satisfiable: true,
+			events:      3,
+		},
+		"count": {
+			expr:        driplang.Count{A: a, Op: driplang.OpEqual, N: 4},
+			satisfiable: true,
+			events:      4,
+		},
+		"window": {
+			expr:        driplang.Window{A: a, N: 3, D: driplang.Duration(10 * time.Minute)},
+			satisfiable: true,
+			events:      3,
+		},
+		"count above the random timelines": {
+			expr:        driplang.Count{A: a, Op: driplang.OpGreaterOrEqual, N: 30},
+			satisfiable: true,
+			events:      30,
+		},
+		"count of sequences": {
+			expr:        driplang.Count{A: driplang.Then{A: a, B: driplang.After{A: b, D: driplang.Duration(time.Hour)}}, Op: driplang.OpGreater, N: 25},
+			satisfiable: true,
+			events:      52,
+		},
+		"window above the random timelines": {
+			expr:        driplang.Window{A: a, N: 20, D: driplang.Duration(time.Hour)},
+			satisfiable: true,
+			events:      20,
+		},
+		"window and count": {
+			expr: driplang.And{
+				A: driplang.Window{A: a, N: 40, D: driplang.Duration(time.Hour)},
+				B: driplang.Count{A: b, Op: driplang.OpEqual, N: 1},
+			},
+			satisfiable: true,
+			events:      41,
+		},
+		"conflicting predicates": {
+			expr: driplang.And{
+				A: driplang.Where{Name: a, Predicates: []driplang.Predicate{{Property: "n", Op: driplang.OpGreater, Value: 2.0}}},
+				B: driplang.Not{A: a},
+			},
+			satisfiable: false,
+		},
+		"predicates of different events": {
+			expr: driplang.AllOf{Exprs: []driplang.Expr{
+				driplang.Where{Name: a, Predicates: []driplang.Predicate{{Property: "plan", Op: driplang.OpPrefix, Value: "pro"}}},
+				driplang.Where{Name: a, Predicates: []driplang.Predicate{{Property: "n", Op: driplang.OpLess, Value: 1.0}}},
+				driplang.Not{A: driplang.Where{Name: a, Predicates: []driplang.Predicate{{Property: "plan", Op: driplang.OpEqual, Value: "pro"}}}},
+			}},
+			satisfiable: true,
+			events:      2,
+		},
+		"after time": {
+			expr:        driplang.AfterTime{A: a, T: now.Add(-time.Hour)},
+			satisfiable: true,
+			events:      1,
+		},
+		"after the future": {
+			expr:        driplang.AfterTime{A: a, T: now.Add(time.Hour)},
+			satisfiable: false,
+		},
+		"during": {
+			expr:        driplang.During{A: a, From: driplang.Duration(3 * time.Hour), To: driplang.Duration(4 * time.Hour), Zone: "Europe/Copenhagen"},
+			satisfiable: true,
+			events:      1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			satisfiable, witness := evaluator.Satisfiable(test.expr)
+			require.Equal(t, test.satisfiable, satisfiable)
+			if !test.satisfiable {
+				require.Nil(t, witness)
+				return
+			}
+
+			require.Len(t, witness, test.events)
+			require.NoError(t, driplang.ValidateEvents(witness))
+			require.True(t, evaluator.Evaluate(test.expr, witness))
+
+			for i := range witness {
+				shrunk := append(append([]driplang.Event{}, witness[:i]...), witness[i+1:]...)
+				require.False(t, evaluator.Evaluate(test.expr, shrunk), "event %d can be removed", i)
+			}
+		})
+	}
+}
+
+// TestTautology verifies that Tautology finds counterexamples for expressions
+// that aren't always satisfied, and none for those that are.
+func TestTautology(t *testing.T) {
+	a, b := driplang.EventName("a"), driplang.EventName("b")
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	evaluator := driplang.Evaluator{Clock: driplang.ClockFunc(func() time.Time { return now })}
+
+	tests := map[string]struct {
+		expr      driplang.Expr
+		tautology bool
+	}{
+		"event name": {
+			expr:      a,
+			tautology: false,
+		},
+		"excluded middle": {
+			expr:      driplang.Or{A: a, B: driplang.Not{A: a}},
+			tautology: true,
+		},
+		"count at least zero": {
+			expr:      driplang.Count{A: a, Op: driplang.OpGreaterOrEqual, N: 0},
+			tautology: true,
+		},
+		"not count above the random timelines": {
+			expr:      driplang.Not{A: driplang.Count{A: a, Op: driplang.OpGreaterOrEqual, N: 30}},
+			tautology: false,
+		},
+		"count below the random timelines": {
+			expr:      driplang.Count{A: a, Op: driplang.OpLess, N: 30},
+			tautology: false,
+		},
+		"not window above the random timelines": {
+			expr:      driplang.Not{A: driplang.Window{A: a, N: 20, D: driplang.Duration(time.Hour)}},
+			tautology: false,
+		},
+		"then or not": {
+			expr:      driplang.Or{A: driplang.Then{A: a, B: b}, B: driplang.Not{A: b}},
+			tautology: false,
+		},
+		"predicate or its negation": {
+			expr: driplang.Or{
+				A: driplang.Not{A: a},
+				B: driplang.AnyOf{Exprs: []driplang.Expr{
+					driplang.Where{Name: a, Predicates: []driplang.Predicate{{Property: "n", Op: driplang.OpLess, Value: 2.0}}},
+					driplang.Where{Name: a, Predicates: []driplang.Predicate{{Property: "n", Op: driplang.OpGreaterOrEqual, Value: 2.0}}},
+				}},
+			},
+			tautology: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			tautology, counterexample := evaluator.Tautology(test.expr)
+			require.Equal(t, test.tautology, tautology)
+			if test.tautology {
+				require.Nil(t, counterexample)
+				return
+			}
+
+			require.NoError(t, driplang.ValidateEvents(counterexample))
+			require.False(t, evaluator.Evaluate(test.expr, counterexample))
+		})
+	}
+}
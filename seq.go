@@ -0,0 +1,115 @@
+package driplang
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Seq is satisfied by a sequence of events, one for each of Steps, in order,
+// e.g. `SEQ("view", "cart", "purchase")`. Each step is an EventName or a
+// Where, and is matched by the first event following the previous step that
+// satisfies it.
+//
+// By default, Seq is strict: the events of two consecutive steps must be
+// adjacent, with nothing but events named in Ignore between them. If Relaxed
+// is true, any events may be between them, and Ignore has no effect.
+//
+// Seq is evaluated like an EventName whose event is that of the first step,
+// except that the returned index is that of the event of the last step.
+type Seq struct {
+	Steps   []Expr      `json:"steps"`
+	Relaxed bool        `json:"relaxed"`
+	Ignore  []EventName `json:"ignore"`
+}
+
+func (s Seq) Expression() string {
+	steps := make([]string, len(s.Steps))
+	for i, step := range s.Steps {
+		steps[i] = step.Expression()
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "SEQ(%s)", strings.Join(steps, ", "))
+	if s.Relaxed {
+		sb.WriteString(" RELAXED")
+	}
+	if len(s.Ignore) > 0 {
+		names := make([]string, len(s.Ignore))
+		for i, name := range s.Ignore {
+			names[i] = name.Expression()
+		}
+		fmt.Fprintf(&sb, " IGNORE [%s]", strings.Join(names, ", "))
+	}
+	return sb.String()
+}
+
+// check returns an error if s has no steps, or if one of them isn't an
+// EventName or a Where.
+func (s Seq) check() error {
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("SEQ has no steps")
+	}
+
+	for i, step := range s.Steps {
+		switch step.(type) {
+		case EventName, Where:
+		default:
+			return fmt.Errorf("SEQ step %d is %s, not an event name", i, operatorName(step))
+		}
+	}
+	return nil
+}
+
+// ignores reports whether event may be between the events of two consecutive
+// steps.
+func (s Seq) ignores(event Event) bool {
+	if s.Relaxed {
+		return true
+	}
+
+	for _, name := range s.Ignore {
+		if event.Name == string(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesStep reports whether event satisfies step, which is an EventName or
+// a Where, or their compiled counterparts.
+func matchesStep(step Expr, event Event) bool {
+	switch v := step.(type) {
+	case EventName:
+		return event.Name == string(v)
+	case eventRef:
+		return event.Name == string(v.name)
+	case Where:
+		return v.matches(event)
+	case whereRef:
+		return v.matches(event)
+	default:
+		return false
+	}
+}
+
+// matchSeq returns the index of the event of the last step of s when the event
+// at index i is that of the first step, or -1 if s isn't satisfied by
+// ev.events[i:hi] that way.
+func (ev *evaluator) matchSeq(s Seq, i, hi int) int {
+	if len(s.Steps) == 0 || !matchesStep(s.Steps[0], ev.events[i]) {
+		return -1
+	}
+
+	for _, step := range s.Steps[1:] {
+		i++
+		for ; i < hi && !matchesStep(step, ev.events[i]); i++ {
+			if !s.ignores(ev.events[i]) {
+				return -1
+			}
+		}
+		if i == hi {
+			return -1
+		}
+	}
+	return i
+}
@@ -0,0 +1,371 @@
+package driplang
+
+import "reflect"
+
+// Simplify returns an expression for which Evaluate gives the same result as
+// for e, for any events and time of evaluation, with redundant parts removed:
+// double negations, duplicate operands of AND, OR, ALL_OF and ANY_OF, directly
+// nested AFTERs, and AT_LEAST that is equivalent to ALL_OF or ANY_OF.
+//
+// Parts are only removed where the surrounding operators can't tell the
+// difference. E.g. `NOT NOT "a"` is kept as the left hand side of THEN, where,
+// unlike "a", it's satisfied without an event, letting THEN's right hand side
+// be satisfied by any of the events. The index returned by EvaluateWithIndex
+// may change.
+func Simplify(e Expr) Expr {
+	return rewriter{simplify: true}.rewrite(e, observed{})
+}
+
+// ToNNF returns e in negation normal form, with NOT pushed down towards the
+// event names where Evaluate gives the same result, for any events and time
+// of evaluation: double negations are removed, NOT is distributed over AND,
+// OR, ALL_OF and ANY_OF using De Morgan's laws, moved within AFTER and BEFORE
+// timestamps, and absorbed by COUNT by negating its comparison.
+//
+// NOT is kept where it would change the result, e.g. above THEN and WITHIN,
+// and above AND and OR within AFTER, which depends on when their operands
+// weren't satisfied. Like for Simplify, the index returned by
+// EvaluateWithIndex may change.
+func ToNNF(e Expr) Expr {
+	return rewriter{}.rewrite(e, observed{})
+}
+
+// observed describes what the context of an expression observes of the
+// result of evaluating it, and therefore what rewriting it must preserve,
+// besides whether it's satisfied.
+type observed struct {
+	// index is set if the index of the event satisfying the expression is
+	// observed.
+	index bool
+
+	// unsatIndex is set if the index returned when the expression isn't
+	// satisfied is observed, e.g. by NOT within OR; see indexUnsatisfied.
+	unsatIndex bool
+
+	// afterSat and afterUnsat are set if timeAfter is observed when the
+	// expression is satisfied, and when it isn't.
+	afterSat, afterUnsat bool
+
+	// window is set if it's observed whether the expression is a window,
+	// which changes how NOT treats it; see isWindow.
+	window bool
+}
+
+// child returns what the i'th child of e observes of the result of evaluating
+// it, when e's context observes o.
+func (o observed) child(e Expr, i int, child Expr) observed {
+	switch v := e.(type) {
+	case Not:
+		// NOT inverts whether its child is satisfied, and the absence of
+		// events in a window depends on whether it has closed.
+		return observed{index: o.unsatIndex, afterSat: o.afterUnsat, afterUnsat: o.afterSat || isWindow(child), window: true}
+	case And, AllOf:
+		return observed{index: o.index, afterSat: o.afterSat}
+	case Or:
+		// The timeAfter of all children is used, even if they aren't
+		// satisfied, and so is the index of a child that isn't satisfied
+		// when the other one is.
+		return observed{index: o.index, unsatIndex: o.index || o.unsatIndex, afterSat: o.afterSat, afterUnsat: o.afterSat || o.afterUnsat}
+	case AnyOf:
+		return observed{index: o.index, afterSat: o.afterSat, afterUnsat: o.afterSat || o.afterUnsat}
+	case AtLeast:
+		return observed{index: o.index, afterSat: o.afterSat || o.afterUnsat, afterUnsat: o.afterUnsat}
+	case Then:
+		switch {
+		case i == 1:
+			return observed{index: o.index, afterSat: o.afterSat}
+		case v.Strategy != ThenDefault:
+			// The occurrences of A are those of Count.
+			return observed{index: true, afterSat: true}
+		default:
+			return observed{index: true, afterSat: o.afterSat}
+		}
+	case After:
+		// A satisfied child whose events aren't after the bound gives the
+		// index of an After that isn't satisfied.
+		return observed{index: o.index || o.unsatIndex, afterSat: true}
+	case Within, Between:
+		return observed{index: o.index, afterSat: true}
+	case Count, Window, Since, During, On:
+		return observed{index: true, afterSat: true}
+	case AfterTime, BeforeTime:
+		return observed{index: o.index, unsatIndex: o.unsatIndex, afterSat: o.afterSat, afterUnsat: o.afterUnsat}
+	default:
+		return observed{index: true, unsatIndex: true, afterSat: true, afterUnsat: true, window: true}
+	}
+}
+
+// rewriter implements Simplify and ToNNF, rewriting expressions top-down so
+// that what the context of each expression observes is known.
+type rewriter struct {
+	simplify bool
+}
+
+// rewrite rewrites e, whose context observes o.
+func (r rewriter) rewrite(e Expr, o observed) Expr {
+	if not, ok := e.(Not); ok && !r.simplify {
+		if pushed, ok := pushNot(not, o); ok {
+			return r.rewrite(pushed, o)
+		}
+	}
+
+	if _, ok := operator(e); !ok {
+		// Operators of other packages may observe anything of their children.
+		return e
+	}
+	if _, ok := e.(Seq); ok {
+		// The steps are event names.
+		return e
+	}
+
+	cs := children(e)
+	if len(cs) > 0 {
+		rewritten := make([]Expr, len(cs))
+		for i, child := range cs {
+			rewritten[i] = r.rewrite(child, o.child(e, i, child))
+		}
+		e = e.(Node).WithChildren(rewritten)
+	}
+
+	if !r.simplify {
+		return e
+	}
+
+	for {
+		simplified, ok := simplify(e, o)
+		if !ok || o.window && isWindow(simplified) != isWindow(e) {
+			return e
+		}
+		e = simplified
+	}
+}
+
+// pushNot returns the result of moving n closer to the event names, if that
+// doesn't change what n's context, which observes o, observes.
+func pushNot(n Not, o observed) (Expr, bool) {
+	switch a := n.A.(type) {
+	case Not:
+		// NOT NOT is satisfied without an event, and isn't satisfied with
+		// one.
+		if !o.index && !o.unsatIndex && !isWindow(a.A) {
+			return a.A, true
+		}
+
+	case And:
+		// Unlike NOT, OR of NOTs returns the index of an event when one of
+		// them is satisfied.
+		if !o.index && deMorgan(o, []Expr{a.A, a.B}) {
+			return Or{A: Not{A: a.A}, B: Not{A: a.B}}, true
+		}
+
+	case Or:
+		// Unlike NOT, AND doesn't return an index when it isn't satisfied.
+		if !o.unsatIndex && deMorgan(o, []Expr{a.A, a.B}) {
+			return And{A: Not{A: a.A}, B: Not{A: a.B}}, true
+		}
+
+	case AllOf:
+		if len(a.Exprs) > 0 && !o.unsatIndex && deMorgan(o, a.Exprs) {
+			return AnyOf{Exprs: negate(a.Exprs)}, true
+		}
+
+	case AnyOf:
+		if len(a.Exprs) > 0 && !o.unsatIndex && deMorgan(o, a.Exprs) {
+			return AllOf{Exprs: negate(a.Exprs)}, true
+		}
+
+	case AfterTime:
+		if !isWindow(a.A) {
+			return AfterTime{A: Not{A: a.A}, T: a.T}, true
+		}
+
+	case BeforeTime:
+		if !isWindow(a.A) {
+			return BeforeTime{A: Not{A: a.A}, T: a.T}, true
+		}
+
+	case Count:
+		// NOT is satisfied without an event, COUNT by the last occurrence
+		// counted, and the other way around when they aren't.
+		if c, ok := negateCount(a); ok && !o.index && !o.unsatIndex {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// deMorgan reports whether NOT of the conjunction or disjunction of exprs can
+// be replaced by the disjunction or conjunction of their negations, when the
+// context of the NOT observes o. The two differ in their timeAfter, and NOT
+// treats windows differently than their conjunctions and disjunctions.
+func deMorgan(o observed, exprs []Expr) bool {
+	if o.afterSat || o.afterUnsat {
+		return false
+	}
+
+	for _, e := range exprs {
+		if isWindow(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// negate returns the negations of exprs.
+func negate(exprs []Expr) []Expr {
+	negated := make([]Expr, len(exprs))
+	for i, e := range exprs {
+		negated[i] = Not{A: e}
+	}
+	return negated
+}
+
+// negateCount returns the Count that is satisfied when c isn't, if there is
+// one that's also not satisfied when c is, and has the same timeAfter.
+func negateCount(c Count) (Count, bool) {
+	if c.check() != nil {
+		return c, false
+	}
+
+	negated := map[PredicateOp]PredicateOp{
+		OpEqual:          OpNotEqual,
+		OpNotEqual:       OpEqual,
+		OpLess:           OpGreaterOrEqual,
+		OpGreaterOrEqual: OpLess,
+		OpLessOrEqual:    OpGreater,
+		OpGreater:        OpLessOrEqual,
+	}
+
+	// COUNT(a) >= 0 doesn't look for occurrences of a, and its timeAfter
+	// therefore differs from that of COUNT(a) < 0.
+	if c.N == 0 && (c.Op == OpLess || c.Op == OpGreaterOrEqual) {
+		return c, false
+	}
+
+	return Count{A: c.A, Op: negated[c.Op], N: c.N}, true
+}
+
+// simplify returns the result of removing a redundant part of e, if there is
+// one that e's context, which observes o, can't tell the difference of.
+func simplify(e Expr, o observed) (Expr, bool) {
+	switch v := e.(type) {
+	case Not:
+		// NOT NOT is satisfied without an event.
+		if inner, ok := v.A.(Not); ok && !o.index && !o.unsatIndex && !isWindow(inner.A) {
+			return inner.A, true
+		}
+
+	case And, AllOf:
+		operands := flattenOperands(e, nil, allOperands)
+		unique := uniqueExprs(operands)
+
+		// Unlike its operand, a conjunction that isn't satisfied is never
+		// after, and has no index.
+		if len(unique) == 1 && !o.afterUnsat && (!o.unsatIndex || !indexUnsatisfied(unique[0])) {
+			return unique[0], true
+		}
+		if len(unique) < len(operands) {
+			return chain(e, unique)
+		}
+
+	case Or, AnyOf:
+		if or, ok := e.(Or); ok {
+			if _, ok := anyOperands(e); !ok {
+				// The Or can't be chained, but is evaluated like its
+				// operand if they're the same.
+				if reflect.DeepEqual(or.A, or.B) {
+					return or.A, true
+				}
+				break
+			}
+		}
+
+		operands := flattenOperands(e, nil, anyOperands)
+		unique := uniqueExprs(operands)
+
+		// Like a conjunction, a disjunction that isn't satisfied has no
+		// index.
+		if len(unique) == 1 && (!o.unsatIndex || !indexUnsatisfied(unique[0])) {
+			return unique[0], true
+		}
+		if len(unique) < len(operands) {
+			return chain(e, unique)
+		}
+
+	case AtLeast:
+		switch {
+		case v.check() != nil:
+		case v.K == len(v.Exprs) && !o.afterUnsat:
+			return AllOf{Exprs: v.Exprs}, true
+		case v.K == 1 && !o.afterSat:
+			return AnyOf{Exprs: v.Exprs}, true
+		}
+
+	case After:
+		// An After anchored to the event satisfying Then.A measures its
+		// duration from the time the outer After requires.
+		// The outer After has no index when the inner one isn't satisfied.
+		inner, ok := v.A.(After)
+		if !ok || inner.Anchor != (Anchor{}) || o.unsatIndex {
+			break
+		}
+
+		d := v.D + inner.D
+		if (v.D > 0 && inner.D > 0 && d < 0) || (v.D < 0 && inner.D < 0 && d >= 0) {
+			break
+		}
+		return After{A: inner.A, D: d, Anchor: v.Anchor}, true
+	}
+	return e, false
+}
+
+// uniqueExprs returns exprs without duplicates, keeping the first of each.
+func uniqueExprs(exprs []Expr) []Expr {
+	var unique []Expr
+	for _, e := range exprs {
+		duplicate := false
+		for _, u := range unique {
+			if reflect.DeepEqual(e, u) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			unique = append(unique, e)
+		}
+	}
+	return unique
+}
+
+// chain returns the conjunction or disjunction of exprs using the same kind
+// of operator as e, if it can have that number of operands. Disjunctions of
+// expressions that can't be chained using Or are AnyOfs; see Flatten.
+func chain(e Expr, exprs []Expr) (Expr, bool) {
+	switch e.(type) {
+	case AllOf:
+		return AllOf{Exprs: exprs}, true
+	case AnyOf:
+		return AnyOf{Exprs: exprs}, true
+	case Or:
+		for _, operand := range exprs {
+			if indexUnsatisfied(operand) {
+				return AnyOf{Exprs: exprs}, true
+			}
+		}
+	}
+
+	if len(exprs) < 2 {
+		return e, false
+	}
+
+	_, and := e.(And)
+	c := exprs[0]
+	for _, operand := range exprs[1:] {
+		if and {
+			c = And{A: c, B: operand}
+		} else {
+			c = Or{A: c, B: operand}
+		}
+	}
+	return c, true
+}
@@ -0,0 +1,257 @@
+package driplang_test
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/micvbang/driplang"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSimplify verifies that Simplify removes redundant parts of expressions,
+// and keeps those that the surrounding operators can tell the difference of.
+func TestSimplify(t *testing.T) {
+	a, b, c := driplang.EventName("a"), driplang.EventName("b"), driplang.EventName("c")
+	hour := driplang.Duration(time.Hour)
+
+	tests := map[string]struct {
+		expr     driplang.Expr
+		expected driplang.Expr
+	}{
+		"event name": {
+			expr:     a,
+			expected: a,
+		},
+		"double negation": {
+			expr:     driplang.Not{A: driplang.Not{A: a}},
+			expected: a,
+		},
+		"double negation of window": {
+			expr:     driplang.Not{A: driplang.Not{A: driplang.Within{A: a, D: hour}}},
+			expected: driplang.Not{A: driplang.Not{A: driplang.Within{A: a, D: hour}}},
+		},
+		"double negation as left hand side of then": {
+			expr:     driplang.Then{A: driplang.Not{A: driplang.Not{A: a}}, B: b},
+			expected: driplang.Then{A: driplang.Not{A: driplang.Not{A: a}}, B: b},
+		},
+		"double negation as right hand side of then": {
+			expr:     driplang.Then{A: a, B: driplang.Not{A: driplang.Not{A: b}}},
+			expected: driplang.Then{A: a, B: b},
+		},
+		"duplicate and": {
+			expr:     driplang.And{A: a, B: a},
+			expected: a,
+		},
+		"duplicate and within not": {
+			expr:     driplang.Not{A: driplang.And{A: a, B: a}},
+			expected: driplang.Not{A: a},
+		},
+		"duplicate and within or within window": {
+			expr:     driplang.Within{A: driplang.Or{A: driplang.And{A: a, B: a}, B: b}, D: hour},
+			expected: driplang.Within{A: driplang.Or{A: driplang.And{A: a, B: a}, B: b}, D: hour},
+		},
+		"duplicate in and chain": {
+			expr:     driplang.And{A: driplang.And{A: a, B: b}, B: driplang.AllOf{Exprs: []driplang.Expr{c, a}}},
+			expected: driplang.And{A: driplang.And{A: a, B: b}, B: c},
+		},
+		"duplicate in all of": {
+			expr:     driplang.AllOf{Exprs: []driplang.Expr{a, b, a}},
+			expected: driplang.AllOf{Exprs: []driplang.Expr{a, b}},
+		},
+		"duplicate or": {
+			expr:     driplang.Or{A: a, B: a},
+			expected: a,
+		},
+		"duplicate in or chain": {
+			expr:     driplang.Or{A: driplang.Or{A: a, B: b}, B: a},
+			expected: driplang.Or{A: a, B: b},
+		},
+		"duplicate after simplifying": {
+			expr:     driplang.AnyOf{Exprs: []driplang.Expr{driplang.Not{A: driplang.Not{A: a}}, b, a}},
+			expected: driplang.AnyOf{Exprs: []driplang.Expr{a, b}},
+		},
+		"nested after": {
+			expr: driplang.Then{
+				A: a,
+				B: driplang.After{A: driplang.After{A: b, D: hour}, D: 2 * hour},
+			},
+			expected: driplang.Then{
+				A: a,
+				B: driplang.After{A: b, D: 3 * hour},
+			},
+		},
+		"nested after anchored to first": {
+			expr: driplang.After{
+				A:      driplang.After{A: b, D: hour},
+				D:      2 * hour,
+				Anchor: driplang.Anchor{Kind: driplang.AnchorFirst},
+			},
+			expected: driplang.After{
+				A:      b,
+				D:      3 * hour,
+				Anchor: driplang.Anchor{Kind: driplang.AnchorFirst},
+			},
+		},
+		"nested after within anchored after": {
+			expr: driplang.Then{
+				A: a,
+				B: driplang.After{A: driplang.After{A: b, D: hour, Anchor: driplang.Anchor{Kind: driplang.AnchorFirst}}, D: 2 * hour},
+			},
+			expected: driplang.Then{
+				A: a,
+				B: driplang.After{A: driplang.After{A: b, D: hour, Anchor: driplang.Anchor{Kind: driplang.AnchorFirst}}, D: 2 * hour},
+			},
+		},
+		"at least all": {
+			expr:     driplang.AtLeast{K: 2, Exprs: []driplang.Expr{a, b}},
+			expected: driplang.AllOf{Exprs: []driplang.Expr{a, b}},
+		},
+		"at least one": {
+			expr:     driplang.AtLeast{K: 1, Exprs: []driplang.Expr{a, b}},
+			expected: driplang.AnyOf{Exprs: []driplang.Expr{a, b}},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, test.expected, driplang.Simplify(test.expr))
+		})
+	}
+}
+
+// TestToNNF verifies that ToNNF pushes NOT towards the event names, and keeps
+// it where that would change the result.
+func TestToNNF(t *testing.T) {
+	a, b, c := driplang.EventName("a"), driplang.EventName("b"), driplang.EventName("c")
+	hour := driplang.Duration(time.Hour)
+	ts := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		expr     driplang.Expr
+		expected driplang.Expr
+	}{
+		"negated event name": {
+			expr:     driplang.Not{A: a},
+			expected: driplang.Not{A: a},
+		},
+		"and": {
+			expr:     driplang.Not{A: driplang.And{A: a, B: b}},
+			expected: driplang.Or{A: driplang.Not{A: a}, B: driplang.Not{A: b}},
+		},
+		"or with double negation": {
+			expr:     driplang.Not{A: driplang.Or{A: a, B: driplang.Not{A: b}}},
+			expected: driplang.And{A: driplang.Not{A: a}, B: b},
+		},
+		"all of": {
+			expr:     driplang.Not{A: driplang.AllOf{Exprs: []driplang.Expr{a, driplang.AnyOf{Exprs: []driplang.Expr{b, c}}}}},
+			expected: driplang.AnyOf{Exprs: []driplang.Expr{driplang.Not{A: a}, driplang.AllOf{Exprs: []driplang.Expr{driplang.Not{A: b}, driplang.Not{A: c}}}}},
+		},
+		"after time": {
+			expr:     driplang.Not{A: driplang.AfterTime{A: driplang.Or{A: a, B: b}, T: ts}},
+			expected: driplang.AfterTime{A: driplang.And{A: driplang.Not{A: a}, B: driplang.Not{A: b}}, T: ts},
+		},
+		"count": {
+			expr:     driplang.Not{A: driplang.Count{A: a, Op: driplang.OpGreaterOrEqual, N: 2}},
+			expected: driplang.Count{A: a, Op: driplang.OpLess, N: 2},
+		},
+		"count at least zero": {
+			expr:     driplang.Not{A: driplang.Count{A: a, Op: driplang.OpGreaterOrEqual, N: 0}},
+			expected: driplang.Not{A: driplang.Count{A: a, Op: driplang.OpGreaterOrEqual, N: 0}},
+		},
+		"count as left hand side of then": {
+			expr:     driplang.Then{A: driplang.Not{A: driplang.Count{A: a, Op: driplang.OpEqual, N: 1}}, B: b},
+			expected: driplang.Then{A: driplang.Not{A: driplang.Count{A: a, Op: driplang.OpEqual, N: 1}}, B: b},
+		},
+		"then": {
+			expr:     driplang.Not{A: driplang.Then{A: a, B: b}},
+			expected: driplang.Not{A: driplang.Then{A: a, B: b}},
+		},
+		"and with window": {
+			expr:     driplang.Not{A: driplang.And{A: driplang.Within{A: a, D: hour}, B: b}},
+			expected: driplang.Not{A: driplang.And{A: driplang.Within{A: a, D: hour}, B: b}},
+		},
+		"and within after": {
+			expr:     driplang.Then{A: a, B: driplang.After{A: driplang.Not{A: driplang.And{A: b, B: c}}, D: hour}},
+			expected: driplang.Then{A: a, B: driplang.After{A: driplang.Not{A: driplang.And{A: b, B: c}}, D: hour}},
+		},
+		"within other operators": {
+			expr:     driplang.Then{A: driplang.Not{A: driplang.Or{A: a, B: b}}, B: driplang.Not{A: driplang.Not{A: c}}},
+			expected: driplang.Then{A: driplang.And{A: driplang.Not{A: a}, B: driplang.Not{A: b}}, B: c},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, test.expected, driplang.ToNNF(test.expr))
+		})
+	}
+}
+
+// TestSimplifyEqualsEvaluate verifies that simplified expressions, and
+// expressions converted to negation normal form, are evaluated like the
+// expressions they were rewritten from, for random expressions and event
+// histories.
+func TestSimplifyEqualsEvaluate(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	names := []string{"a", "b", "c"}
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for run := 0; run < 5000; run++ {
+		expr := redundantExpr(rng, randomExpr(rng, names, 4))
+		events := randomEvents(rng, names, start, rng.Intn(12))
+		now := start.Add(time.Duration(rng.Intn(48)) * time.Hour)
+
+		expected := driplang.EvaluateAt(expr, events, now)
+		for _, rewritten := range []driplang.Expr{
+			driplang.Simplify(expr),
+			driplang.ToNNF(expr),
+			driplang.Simplify(driplang.ToNNF(expr)),
+		} {
+			got := driplang.EvaluateAt(rewritten, events, now)
+			require.Equal(t, expected, got, "%s\n%s\n%v", expr.Expression(), rewritten.Expression(), events)
+		}
+	}
+}
+
+// redundantExpr returns e with redundant parts added at random, of the kinds
+// that Simplify and ToNNF remove.
+func redundantExpr(rng *rand.Rand, e driplang.Expr) driplang.Expr {
+	if _, ok := e.(driplang.Seq); ok {
+		// The steps must be event names.
+		return e
+	}
+
+	if n, ok := e.(driplang.Node); ok && len(n.Children()) > 0 {
+		children := n.Children()
+		redundant := make([]driplang.Expr, len(children))
+		for i, child := range children {
+			redundant[i] = redundantExpr(rng, child)
+		}
+		e = n.WithChildren(redundant)
+	}
+
+	d := driplang.Duration(time.Duration(rng.Intn(3)) * time.Hour)
+	switch rng.Intn(12) {
+	case 0:
+		return driplang.Not{A: driplang.Not{A: e}}
+	case 1:
+		return driplang.Not{A: e}
+	case 2:
+		return driplang.And{A: e, B: e}
+	case 3:
+		return driplang.Or{A: e, B: e}
+	case 4:
+		return driplang.AllOf{Exprs: []driplang.Expr{e, e}}
+	case 5:
+		return driplang.AnyOf{Exprs: []driplang.Expr{e}}
+	case 6:
+		return driplang.AtLeast{K: 1 + rng.Intn(2), Exprs: []driplang.Expr{e, e}}
+	case 7:
+		return driplang.After{A: driplang.After{A: e, D: d}, D: d}
+	case 8:
+		return driplang.Not{A: driplang.And{A: e, B: driplang.Not{A: e}}}
+	default:
+		return e
+	}
+}
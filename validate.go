@@ -0,0 +1,314 @@
+package driplang
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Severity tells how serious the problem described by a Diagnostic is.
+type Severity string
+
+const (
+	// SeverityError is used for problems that make an expression, or part of
+	// it, impossible to satisfy.
+	SeverityError Severity = "error"
+
+	// SeverityWarning is used for constructs that are allowed, but are
+	// unlikely to do what was intended.
+	SeverityWarning Severity = "warning"
+)
+
+// Diagnostic describes a problem found by Validate, located by the JSON path
+// of the offending expression in the marshalled form, e.g. "$.b.a".
+type Diagnostic struct {
+	Severity Severity  `json:"severity"`
+	Code     ErrorCode `json:"code"`
+	Path     string    `json:"path"`
+	Message  string    `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s: %s", d.Path, d.Severity, d.Message)
+}
+
+// Validate inspects e for rules that are well-formed but broken, such as
+// After outside the right hand side of Then, which can never be satisfied.
+// It returns a Diagnostic for each problem found, in the order they appear in
+// e, or nil if none were found.
+//
+// Use WithValidation to have Parse and Unmarshal reject expressions for which
+// Validate reports errors.
+func Validate(e Expr) []Diagnostic {
+	v := validator{}
+	v.validate(e, nil, "$", false)
+	return v.diagnostics
+}
+
+type validator struct {
+	diagnostics []Diagnostic
+}
+
+func (v *validator) report(severity Severity, code ErrorCode, path string, format string, args ...interface{}) {
+	v.diagnostics = append(v.diagnostics, Diagnostic{
+		Severity: severity,
+		Code:     code,
+		Path:     path,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// validate validates e at path, and then its children. parent is the
+// expression e is a child of, if any. hasBound tells whether e is evaluated
+// with the time of an earlier event to compare against, i.e. whether it's
+// part of the right hand side of Then, or of an After anchored to other
+// events.
+func (v *validator) validate(e Expr, parent Expr, path string, hasBound bool) {
+	v.validateOperator(e, parent, path, hasBound)
+
+	for i, child := range children(e) {
+		v.validate(child, e, childPath(e, path, i), hasBound || bounds(e, i))
+	}
+}
+
+// validateOperator validates the root operator of e at path, but not its
+// children; see validate.
+func (v *validator) validateOperator(e Expr, parent Expr, path string, hasBound bool) {
+	switch e := e.(type) {
+	case EventName:
+		if e == "" {
+			v.report(SeverityError, ErrorCodeInvalidValue, path, "event name is empty")
+		}
+
+	case Where:
+		if e.Name == "" {
+			v.report(SeverityError, ErrorCodeInvalidValue, path+".a", "event name is empty")
+		}
+
+		for i, p := range e.Predicates {
+			if err := p.check(); err != nil {
+				v.report(SeverityError, ErrorCodeInvalidValue, fmt.Sprintf("%s.predicates[%d]", path, i), "%s", err)
+			}
+		}
+
+	case Not:
+		if !isWindow(e.A) && hasWindowOperand(e.A) {
+			v.report(SeverityWarning, ErrorCodeInvalidValue, path, "NOT doesn't wait for windows within AND, OR, ANY_OF or ALL_OF to close; apply NOT to each window instead")
+		}
+
+	case And, AllOf:
+		if all, ok := e.(AllOf); ok && all.check() != nil {
+			v.report(SeverityError, ErrorCodeInvalidValue, path, "%s", all.check())
+			break
+		}
+
+		// Directly nested Ands and AllOfs are checked together, to find
+		// contradictions between all of their operands, so only the
+		// outermost of them is.
+		if !isAnd(parent) {
+			v.contradictions(andOperands(e, path, nil), path)
+		}
+
+	case Or:
+		// Only its operands can be invalid.
+
+	case AnyOf:
+		if err := e.check(); err != nil {
+			v.report(SeverityError, ErrorCodeInvalidValue, path, "%s", err)
+		}
+
+	case AtLeast:
+		if err := e.check(); err != nil {
+			v.report(SeverityError, ErrorCodeInvalidValue, path, "%s", err)
+		}
+
+	case Then:
+		if err := e.Strategy.check(); err != nil {
+			v.report(SeverityError, ErrorCodeInvalidValue, path, "%s", err)
+		}
+
+	case After:
+		if err := e.Anchor.check(); err != nil {
+			v.report(SeverityError, ErrorCodeInvalidValue, path, "%s", err)
+		}
+
+		if !hasBound && e.Anchor.Kind == AnchorThen {
+			v.report(SeverityError, ErrorCodeMisplacedAfter, path, "AFTER can only be satisfied on the right hand side of THEN")
+		}
+
+		switch {
+		case e.D == 0:
+			v.report(SeverityWarning, ErrorCodeInvalidValue, path, "AFTER duration is zero")
+		case e.D < 0:
+			v.report(SeverityWarning, ErrorCodeInvalidValue, path, "AFTER duration %s is negative", time.Duration(e.D))
+		}
+
+	case Count:
+		if err := e.check(); err != nil {
+			v.report(SeverityError, ErrorCodeInvalidValue, path, "%s", err)
+		}
+
+	case Since:
+		switch {
+		case e.D == 0:
+			v.report(SeverityWarning, ErrorCodeInvalidValue, path, "SINCE duration is zero")
+		case e.D < 0:
+			v.report(SeverityWarning, ErrorCodeInvalidValue, path, "SINCE duration %s is negative", time.Duration(e.D))
+		}
+
+	case Window:
+		if err := e.check(); err != nil {
+			v.report(SeverityError, ErrorCodeInvalidValue, path, "%s", err)
+		}
+
+	case AfterTime:
+		if e.T.IsZero() {
+			v.report(SeverityWarning, ErrorCodeInvalidValue, path, "AFTER timestamp is zero")
+		}
+
+	case BeforeTime:
+		if e.T.IsZero() {
+			v.report(SeverityWarning, ErrorCodeInvalidValue, path, "BEFORE timestamp is zero, so no events are before it")
+		}
+
+	case Seq:
+		if err := e.check(); err != nil {
+			v.report(SeverityError, ErrorCodeInvalidValue, path, "%s", err)
+		}
+
+		if e.Relaxed && len(e.Ignore) > 0 {
+			v.report(SeverityWarning, ErrorCodeInvalidValue, path, "IGNORE has no effect on a RELAXED SEQ")
+		}
+
+	case During:
+		if err := e.check(); err != nil {
+			v.report(SeverityError, ErrorCodeInvalidValue, path, "%s", err)
+		}
+
+	case On:
+		if err := e.check(); err != nil {
+			v.report(SeverityError, ErrorCodeInvalidValue, path, "%s", err)
+		}
+
+	case Within:
+		if !hasBound {
+			v.report(SeverityError, ErrorCodeMisplacedAfter, path, "WITHIN can only be satisfied on the right hand side of THEN")
+		}
+
+		if e.D < 0 {
+			v.report(SeverityError, ErrorCodeInvalidValue, path, "WITHIN duration %s is negative, so the window is empty", time.Duration(e.D))
+		}
+
+	case Between:
+		if !hasBound {
+			v.report(SeverityError, ErrorCodeMisplacedAfter, path, "BETWEEN can only be satisfied on the right hand side of THEN")
+		}
+
+		if e.Min > e.Max {
+			v.report(SeverityError, ErrorCodeInvalidValue, path, "BETWEEN minimum %s is greater than maximum %s, so the window is empty", time.Duration(e.Min), time.Duration(e.Max))
+		}
+
+	default:
+		v.report(SeverityError, ErrorCodeUnknownOperator, path, "unknown operator %T", e)
+	}
+}
+
+// bounds reports whether the i'th child of e is evaluated with the time of an
+// earlier event to compare against, even if e isn't: Then.B, and A of an After
+// anchored to other events, which is evaluated relative to the anchor.
+func bounds(e Expr, i int) bool {
+	switch e := e.(type) {
+	case Then:
+		return i == 1
+	case After:
+		return e.Anchor.Kind != AnchorThen
+	default:
+		return false
+	}
+}
+
+// isAnd reports whether e is an And or an AllOf.
+func isAnd(e Expr) bool {
+	switch e.(type) {
+	case And, AllOf:
+		return true
+	default:
+		return false
+	}
+}
+
+type operand struct {
+	expr Expr
+	path string
+}
+
+// andOperands appends the operands of e, including those of directly nested
+// Ands and AllOfs, to operands.
+func andOperands(e Expr, path string, operands []operand) []operand {
+	switch v := e.(type) {
+	case And:
+		operands = andOperands(v.A, path+".a", operands)
+		return andOperands(v.B, path+".b", operands)
+
+	case AllOf:
+		if len(v.Exprs) == 0 {
+			// Reported by the validation of the operand itself.
+			return append(operands, operand{expr: e, path: path})
+		}
+
+		for i, e := range v.Exprs {
+			operands = andOperands(e, fmt.Sprintf("%s.exprs[%d]", path, i), operands)
+		}
+		return operands
+
+	default:
+		return append(operands, operand{expr: e, path: path})
+	}
+}
+
+// contradictions reports if operands, the operands of the And at path,
+// contain both an expression and its negation, which can never be satisfied
+// together.
+func (v *validator) contradictions(operands []operand, path string) {
+	for _, o := range operands {
+		not, ok := o.expr.(Not)
+		if !ok {
+			continue
+		}
+
+		for _, other := range operands {
+			if reflect.DeepEqual(other.expr, not.A) {
+				v.report(SeverityError, ErrorCodeContradiction, path, "%s can't be satisfied together with its negation at %s", other.expr.Expression(), o.path)
+				return
+			}
+		}
+	}
+}
+
+// hasWindowOperand reports whether e is a window, or an AND, OR, ANY_OF or
+// ALL_OF with a window among its operands.
+func hasWindowOperand(e Expr) bool {
+	switch e := e.(type) {
+	case Within, Between:
+		return true
+	case And:
+		return hasWindowOperand(e.A) || hasWindowOperand(e.B)
+	case Or:
+		return hasWindowOperand(e.A) || hasWindowOperand(e.B)
+	case AnyOf:
+		return anyHasWindowOperand(e.Exprs)
+	case AllOf:
+		return anyHasWindowOperand(e.Exprs)
+	default:
+		return false
+	}
+}
+
+func anyHasWindowOperand(exprs []Expr) bool {
+	for _, e := range exprs {
+		if hasWindowOperand(e) {
+			return true
+		}
+	}
+	return false
+}
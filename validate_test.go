@@ -0,0 +1,324 @@
+package driplang_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micvbang/driplang"
+	"github.com/stretchr/testify/require"
+)
+
+// TestValidate verifies that Validate reports rules that are well-formed but
+// broken, located by their JSON path.
+func TestValidate(t *testing.T) {
+	tests := map[string]struct {
+		expr     driplang.Expr
+		expected []driplang.Diagnostic
+	}{
+		"valid": {
+			expr: driplang.Then{
+				A: driplang.EventName("signup"),
+				B: driplang.After{
+					A: driplang.Not{A: driplang.EventName("purchase")},
+					D: driplang.Duration(72 * time.Hour),
+				},
+			},
+		},
+		"after in nested then.a": {
+			expr: driplang.Then{
+				A: driplang.EventName("a"),
+				B: driplang.Then{
+					A: driplang.After{A: driplang.EventName("b"), D: driplang.Duration(time.Hour)},
+					B: driplang.EventName("c"),
+				},
+			},
+		},
+		"top level after": {
+			expr: driplang.After{A: driplang.EventName("a"), D: driplang.Duration(time.Hour)},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeMisplacedAfter, Path: "$", Message: "AFTER can only be satisfied on the right hand side of THEN"},
+			},
+		},
+		"seq": {
+			expr: driplang.Or{
+				A: driplang.Seq{
+					Steps:   []driplang.Expr{driplang.EventName("a")},
+					Relaxed: true,
+					Ignore:  []driplang.EventName{"b"},
+				},
+				B: driplang.Seq{Steps: []driplang.Expr{driplang.EventName("a"), driplang.Not{A: driplang.EventName("b")}}},
+			},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityWarning, Code: driplang.ErrorCodeInvalidValue, Path: "$.a", Message: "IGNORE has no effect on a RELAXED SEQ"},
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeInvalidValue, Path: "$.b", Message: "SEQ step 1 is not, not an event name"},
+			},
+		},
+		"not of nested windows": {
+			expr: driplang.Then{
+				A: driplang.EventName("a"),
+				B: driplang.And{
+					A: driplang.Not{A: driplang.Within{A: driplang.EventName("b"), D: driplang.Duration(time.Hour)}},
+					B: driplang.Not{A: driplang.Or{
+						A: driplang.EventName("c"),
+						B: driplang.Between{A: driplang.EventName("d"), Min: driplang.Duration(time.Hour), Max: driplang.Duration(2 * time.Hour)},
+					}},
+				},
+			},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityWarning, Code: driplang.ErrorCodeInvalidValue, Path: "$.b.b", Message: "NOT doesn't wait for windows within AND, OR, ANY_OF or ALL_OF to close; apply NOT to each window instead"},
+			},
+		},
+		"invalid then strategy": {
+			expr: driplang.Then{A: driplang.EventName("a"), B: driplang.EventName("b"), Strategy: "FIRST"},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeInvalidValue, Path: "$", Message: `invalid THEN strategy "FIRST"`},
+			},
+		},
+		"anchored after": {
+			expr: driplang.Or{
+				A: driplang.After{A: driplang.EventName("a"), D: driplang.Duration(time.Hour), Anchor: driplang.Anchor{Kind: driplang.AnchorFirst}},
+				B: driplang.After{A: driplang.EventName("a"), D: driplang.Duration(time.Hour), Anchor: driplang.Anchor{Kind: "NOW"}},
+			},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeInvalidValue, Path: "$.b", Message: `invalid anchor "NOW"`},
+			},
+		},
+		"bounds within anchored after": {
+			expr: driplang.AnyOf{Exprs: []driplang.Expr{
+				driplang.After{
+					A:      driplang.Within{A: driplang.EventName("b"), D: driplang.Duration(time.Hour)},
+					D:      driplang.Duration(24 * time.Hour),
+					Anchor: driplang.Anchor{Kind: driplang.AnchorFirst},
+				},
+				driplang.After{
+					A:      driplang.Between{A: driplang.EventName("b"), Min: driplang.Duration(time.Hour), Max: driplang.Duration(2 * time.Hour)},
+					D:      driplang.Duration(24 * time.Hour),
+					Anchor: driplang.Anchor{Kind: driplang.AnchorLast, Name: "a"},
+				},
+				driplang.After{
+					A:      driplang.After{A: driplang.EventName("b"), D: driplang.Duration(time.Hour)},
+					D:      driplang.Duration(24 * time.Hour),
+					Anchor: driplang.Anchor{Kind: driplang.AnchorFirst},
+				},
+			}},
+		},
+		"after in then.a": {
+			expr: driplang.Then{
+				A: driplang.Or{
+					A: driplang.EventName("a"),
+					B: driplang.After{A: driplang.EventName("b"), D: driplang.Duration(time.Hour)},
+				},
+				B: driplang.EventName("c"),
+			},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeMisplacedAfter, Path: "$.a.b", Message: "AFTER can only be satisfied on the right hand side of THEN"},
+			},
+		},
+		"zero and negative durations": {
+			expr: driplang.Then{
+				A: driplang.EventName("a"),
+				B: driplang.Or{
+					A: driplang.After{A: driplang.EventName("b"), D: 0},
+					B: driplang.After{A: driplang.EventName("c"), D: driplang.Duration(-time.Hour)},
+				},
+			},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityWarning, Code: driplang.ErrorCodeInvalidValue, Path: "$.b.a", Message: "AFTER duration is zero"},
+				{Severity: driplang.SeverityWarning, Code: driplang.ErrorCodeInvalidValue, Path: "$.b.b", Message: "AFTER duration -1h0m0s is negative"},
+			},
+		},
+		"windows": {
+			expr: driplang.And{
+				A: driplang.Within{A: driplang.EventName("a"), D: driplang.Duration(-time.Hour)},
+				B: driplang.Then{
+					A: driplang.EventName("a"),
+					B: driplang.Between{A: driplang.EventName("b"), Min: driplang.Duration(2 * time.Hour), Max: driplang.Duration(time.Hour)},
+				},
+			},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeMisplacedAfter, Path: "$.a", Message: "WITHIN can only be satisfied on the right hand side of THEN"},
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeInvalidValue, Path: "$.a", Message: "WITHIN duration -1h0m0s is negative, so the window is empty"},
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeInvalidValue, Path: "$.b.b", Message: "BETWEEN minimum 2h0m0s is greater than maximum 1h0m0s, so the window is empty"},
+			},
+		},
+		"invalid count": {
+			expr: driplang.Count{A: driplang.EventName("a"), Op: driplang.OpGreater, N: -1},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeInvalidValue, Path: "$", Message: "count -1 is negative"},
+			},
+		},
+		"since": {
+			expr: driplang.Since{A: driplang.EventName("a")},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityWarning, Code: driplang.ErrorCodeInvalidValue, Path: "$", Message: "SINCE duration is zero"},
+			},
+		},
+		"invalid window": {
+			expr: driplang.Window{A: driplang.EventName("a"), N: 2, D: driplang.Duration(-time.Minute)},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeInvalidValue, Path: "$", Message: "window duration -1m0s is negative"},
+			},
+		},
+		"calendar": {
+			expr: driplang.And{
+				A: driplang.Or{
+					A: driplang.BeforeTime{A: driplang.EventName("a")},
+					B: driplang.During{A: driplang.EventName("a"), From: driplang.Duration(25 * time.Hour), To: 0, Zone: "UTC"},
+				},
+				B: driplang.Or{
+					A: driplang.On{A: driplang.EventName("a"), Days: []time.Weekday{time.Monday}},
+					B: driplang.On{A: driplang.EventName("a"), Days: []time.Weekday{time.Monday}, Zone: "Local/Nowhere"},
+				},
+			},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityWarning, Code: driplang.ErrorCodeInvalidValue, Path: "$.a.a", Message: "BEFORE timestamp is zero, so no events are before it"},
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeInvalidValue, Path: "$.a.b", Message: "invalid time of day 25h0m0s"},
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeInvalidValue, Path: "$.b.a", Message: "missing time zone"},
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeInvalidValue, Path: "$.b.b", Message: `unknown time zone "Local/Nowhere"`},
+			},
+		},
+		"empty event name": {
+			expr: driplang.Or{A: driplang.EventName("a"), B: driplang.EventName("")},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeInvalidValue, Path: "$.b", Message: "event name is empty"},
+			},
+		},
+		"contradiction": {
+			expr: driplang.And{
+				A: driplang.EventName("a"),
+				B: driplang.Not{A: driplang.EventName("a")},
+			},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeContradiction, Path: "$", Message: `"a" can't be satisfied together with its negation at $.b`},
+			},
+		},
+		"contradiction in nested and": {
+			expr: driplang.Then{
+				A: driplang.EventName("signup"),
+				B: driplang.And{
+					A: driplang.Not{A: driplang.Or{A: driplang.EventName("a"), B: driplang.EventName("b")}},
+					B: driplang.And{
+						A: driplang.EventName("c"),
+						B: driplang.Or{A: driplang.EventName("a"), B: driplang.EventName("b")},
+					},
+				},
+			},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeContradiction, Path: "$.b", Message: `("a" OR "b") can't be satisfied together with its negation at $.b.a`},
+			},
+		},
+		"contradiction in all of": {
+			expr: driplang.AllOf{Exprs: []driplang.Expr{
+				driplang.EventName("a"),
+				driplang.And{A: driplang.EventName("b"), B: driplang.Not{A: driplang.EventName("a")}},
+			}},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeContradiction, Path: "$", Message: `"a" can't be satisfied together with its negation at $.exprs[1].b`},
+			},
+		},
+		"invalid n-ary": {
+			expr: driplang.And{
+				A: driplang.AllOf{},
+				B: driplang.AnyOf{Exprs: []driplang.Expr{
+					driplang.AtLeast{K: 0, Exprs: []driplang.Expr{driplang.EventName("a")}},
+					driplang.After{A: driplang.EventName("b"), D: driplang.Duration(time.Hour)},
+				}},
+			},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeInvalidValue, Path: "$.a", Message: "ALL_OF has no expressions"},
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeInvalidValue, Path: "$.b.exprs[0]", Message: "AT_LEAST count 0 is less than 1"},
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeMisplacedAfter, Path: "$.b.exprs[1]", Message: "AFTER can only be satisfied on the right hand side of THEN"},
+			},
+		},
+		"invalid where": {
+			expr: driplang.Where{
+				Predicates: []driplang.Predicate{
+					{Property: "amount", Op: driplang.OpGreater, Value: 1.0},
+					{Property: "path", Op: driplang.OpPrefix, Value: 1.0},
+				},
+			},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeInvalidValue, Path: "$.a", Message: "event name is empty"},
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeInvalidValue, Path: "$.predicates[1]", Message: "PREFIX expects a string, got number"},
+			},
+		},
+		"no contradiction": {
+			expr: driplang.And{
+				A: driplang.EventName("a"),
+				B: driplang.Not{A: driplang.EventName("b")},
+			},
+		},
+		"unknown operator": {
+			expr: driplang.Not{A: unknownExpr{}},
+			expected: []driplang.Diagnostic{
+				{Severity: driplang.SeverityError, Code: driplang.ErrorCodeUnknownOperator, Path: "$.a", Message: "unknown operator driplang_test.unknownExpr"},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, test.expected, driplang.Validate(test.expr))
+		})
+	}
+}
+
+// TestWithValidation verifies that Parse and Unmarshal reject expressions for
+// which Validate reports errors when using WithValidation, but not warnings.
+func TestWithValidation(t *testing.T) {
+	tests := map[string]struct {
+		expr     driplang.Expr
+		err      string
+		parseErr string
+	}{
+		"valid": {
+			expr: driplang.Then{A: driplang.EventName("a"), B: driplang.EventName("b")},
+		},
+		"warning": {
+			expr: driplang.Then{
+				A: driplang.EventName("a"),
+				B: driplang.After{A: driplang.EventName("b"), D: 0},
+			},
+		},
+		"within in anchored after": {
+			expr: driplang.After{
+				A:      driplang.Within{A: driplang.EventName("b"), D: driplang.Duration(time.Hour)},
+				D:      driplang.Duration(24 * time.Hour),
+				Anchor: driplang.Anchor{Kind: driplang.AnchorFirst},
+			},
+		},
+		"errors": {
+			expr: driplang.Or{
+				A: driplang.After{A: driplang.EventName("a"), D: driplang.Duration(time.Hour)},
+				B: driplang.And{A: driplang.EventName("b"), B: driplang.Not{A: driplang.EventName("b")}},
+			},
+			err:      `$.a: AFTER can only be satisfied on the right hand side of THEN; $.b: "b" can't be satisfied together with its negation at $.b.b`,
+			parseErr: `1:7: AFTER can only be satisfied on the right hand side of THEN; 1:29: "b" can't be satisfied together with its negation at $.b.b`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			bs, err := driplang.Marshal(test.expr)
+			require.NoError(t, err)
+
+			// Without validation, the expression is accepted.
+			_, err = driplang.Unmarshal(bs)
+			require.NoError(t, err)
+
+			unmarshalled, unmarshalErr := driplang.Unmarshal(bs, driplang.WithValidation())
+			parsed, parseErr := driplang.Parse(test.expr.Expression(), driplang.WithValidation())
+			if test.err == "" {
+				require.NoError(t, unmarshalErr)
+				require.NoError(t, parseErr)
+				require.Equal(t, test.expr, unmarshalled)
+				require.Equal(t, test.expr, parsed)
+				return
+			}
+
+			require.EqualError(t, unmarshalErr, test.err)
+			require.EqualError(t, parseErr, test.parseErr)
+			require.ErrorIs(t, unmarshalErr, driplang.ErrInvalidExpression)
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package driplang
+
+import "fmt"
+
+// Node is an Expr whose sub-expressions can be inspected and replaced, which
+// is what Walk, Rewrite and Validate use to traverse expressions, and Marshal
+// and Unmarshal use for the operators of this package. Every operator of this
+// package implements Node; operators of other packages can implement it to be
+// traversed as well.
+type Node interface {
+	Expr
+
+	// Children returns the direct sub-expressions of the node, e.g. A and B of
+	// And, or nil if it has none. Changing the returned list doesn't change
+	// the node.
+	Children() []Expr
+
+	// WithChildren returns a copy of the node with its direct
+	// sub-expressions replaced by children, which are given in the order
+	// returned by Children. It panics if the node can't have that number of
+	// children.
+	WithChildren(children []Expr) Expr
+}
+
+// Walk traverses e in depth-first order: it calls fn(e), and if fn returns
+// true, walks each of the children of e.
+func Walk(e Expr, fn func(Expr) bool) {
+	if e == nil || !fn(e) {
+		return
+	}
+
+	for _, child := range children(e) {
+		Walk(child, fn)
+	}
+}
+
+// Rewrite transforms e bottom-up: the children of every expression are
+// rewritten first, after which the expression, with its rewritten children,
+// is replaced by the result of calling fn on it.
+func Rewrite(e Expr, fn func(Expr) Expr) Expr {
+	n, ok := e.(Node)
+	if !ok {
+		return fn(e)
+	}
+
+	cs := n.Children()
+	if len(cs) == 0 {
+		return fn(e)
+	}
+
+	rewritten := make([]Expr, len(cs))
+	for i, child := range cs {
+		rewritten[i] = Rewrite(child, fn)
+	}
+	return fn(n.WithChildren(rewritten))
+}
+
+// children returns the direct sub-expressions of e, or nil if it has none or
+// doesn't implement Node.
+func children(e Expr) []Expr {
+	if n, ok := e.(Node); ok {
+		return n.Children()
+	}
+	return nil
+}
+
+// checkChildren panics unless children holds n sub-expressions for e.
+func checkChildren(e Expr, children []Expr, n int) {
+	if len(children) != n {
+		panic(fmt.Sprintf("driplang: %s takes %d children, got %d", operatorName(e), n, len(children)))
+	}
+}
+
+// checkListChildren panics unless children holds at least n sub-expressions
+// for e, whose children are a list, and returns a copy of them.
+func checkListChildren(e Expr, children []Expr, n int) []Expr {
+	if len(children) < n {
+		panic(fmt.Sprintf("driplang: %s takes at least %d children, got %d", operatorName(e), n, len(children)))
+	}
+	return copyChildren(children)
+}
+
+// copyChildren returns a copy of children, so that the list of children of an
+// expression can't be changed through it.
+func copyChildren(children []Expr) []Expr {
+	if children == nil {
+		return nil
+	}
+	return append([]Expr{}, children...)
+}
+
+func (e EventName) Children() []Expr {
+	return nil
+}
+
+func (e EventName) WithChildren(children []Expr) Expr {
+	checkChildren(e, children, 0)
+	return e
+}
+
+func (w Where) Children() []Expr {
+	return nil
+}
+
+func (w Where) WithChildren(children []Expr) Expr {
+	checkChildren(w, children, 0)
+	return w
+}
+
+func (n Not) Children() []Expr {
+	return []Expr{n.A}
+}
+
+func (n Not) WithChildren(children []Expr) Expr {
+	checkChildren(n, children, 1)
+	n.A = children[0]
+	return n
+}
+
+func (a And) Children() []Expr {
+	return []Expr{a.A, a.B}
+}
+
+func (a And) WithChildren(children []Expr) Expr {
+	checkChildren(a, children, 2)
+	a.A, a.B = children[0], children[1]
+	return a
+}
+
+func (o Or) Children() []Expr {
+	return []Expr{o.A, o.B}
+}
+
+func (o Or) WithChildren(children []Expr) Expr {
+	checkChildren(o, children, 2)
+	o.A, o.B = children[0], children[1]
+	return o
+}
+
+func (t Then) Children() []Expr {
+	return []Expr{t.A, t.B}
+}
+
+func (t Then) WithChildren(children []Expr) Expr {
+	checkChildren(t, children, 2)
+	t.A, t.B = children[0], children[1]
+	return t
+}
+
+func (a After) Children() []Expr {
+	return []Expr{a.A}
+}
+
+func (a After) WithChildren(children []Expr) Expr {
+	checkChildren(a, children, 1)
+	a.A = children[0]
+	return a
+}
+
+func (w Within) Children() []Expr {
+	return []Expr{w.A}
+}
+
+func (w Within) WithChildren(children []Expr) Expr {
+	checkChildren(w, children, 1)
+	w.A = children[0]
+	return w
+}
+
+func (b Between) Children() []Expr {
+	return []Expr{b.A}
+}
+
+func (b Between) WithChildren(children []Expr) Expr {
+	checkChildren(b, children, 1)
+	b.A = children[0]
+	return b
+}
+
+func (c Count) Children() []Expr {
+	return []Expr{c.A}
+}
+
+func (c Count) WithChildren(children []Expr) Expr {
+	checkChildren(c, children, 1)
+	c.A = children[0]
+	return c
+}
+
+func (s Since) Children() []Expr {
+	return []Expr{s.A}
+}
+
+func (s Since) WithChildren(children []Expr) Expr {
+	checkChildren(s, children, 1)
+	s.A = children[0]
+	return s
+}
+
+func (w Window) Children() []Expr {
+	return []Expr{w.A}
+}
+
+func (w Window) WithChildren(children []Expr) Expr {
+	checkChildren(w, children, 1)
+	w.A = children[0]
+	return w
+}
+
+func (a AfterTime) Children() []Expr {
+	return []Expr{a.A}
+}
+
+func (a AfterTime) WithChildren(children []Expr) Expr {
+	checkChildren(a, children, 1)
+	a.A = children[0]
+	return a
+}
+
+func (b BeforeTime) Children() []Expr {
+	return []Expr{b.A}
+}
+
+func (b BeforeTime) WithChildren(children []Expr) Expr {
+	checkChildren(b, children, 1)
+	b.A = children[0]
+	return b
+}
+
+func (d During) Children() []Expr {
+	return []Expr{d.A}
+}
+
+func (d During) WithChildren(children []Expr) Expr {
+	checkChildren(d, children, 1)
+	d.A = children[0]
+	return d
+}
+
+func (o On) Children() []Expr {
+	return []Expr{o.A}
+}
+
+func (o On) WithChildren(children []Expr) Expr {
+	checkChildren(o, children, 1)
+	o.A = children[0]
+	return o
+}
+
+func (s Seq) Children() []Expr {
+	return copyChildren(s.Steps)
+}
+
+func (s Seq) WithChildren(children []Expr) Expr {
+	s.Steps = checkListChildren(s, children, 1)
+	return s
+}
+
+func (a AnyOf) Children() []Expr {
+	return copyChildren(a.Exprs)
+}
+
+func (a AnyOf) WithChildren(children []Expr) Expr {
+	a.Exprs = checkListChildren(a, children, 1)
+	return a
+}
+
+func (a AllOf) Children() []Expr {
+	return copyChildren(a.Exprs)
+}
+
+func (a AllOf) WithChildren(children []Expr) Expr {
+	a.Exprs = checkListChildren(a, children, 1)
+	return a
+}
+
+func (a AtLeast) Children() []Expr {
+	return copyChildren(a.Exprs)
+}
+
+func (a AtLeast) WithChildren(children []Expr) Expr {
+	a.Exprs = checkListChildren(a, children, max(a.K, 1))
+	return a
+}
@@ -0,0 +1,113 @@
+package driplang_test
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/micvbang/driplang"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWalk verifies that Walk visits expressions in depth-first order, and
+// skips the children of expressions for which fn returns false.
+func TestWalk(t *testing.T) {
+	expr := driplang.Then{
+		A: driplang.Not{A: driplang.EventName("a")},
+		B: driplang.AnyOf{Exprs: []driplang.Expr{
+			driplang.EventName("b"),
+			driplang.After{A: driplang.EventName("c"), D: driplang.Duration(time.Hour)},
+		}},
+	}
+
+	visited := []string{}
+	driplang.Walk(expr, func(e driplang.Expr) bool {
+		visited = append(visited, e.Expression())
+		_, isNot := e.(driplang.Not)
+		return !isNot
+	})
+
+	require.Equal(t, []string{
+		expr.Expression(),
+		`(NOT "a")`,
+		`ANY_OF("b", ("c" AFTER 1h0m0s))`,
+		`"b"`,
+		`("c" AFTER 1h0m0s)`,
+		`"c"`,
+	}, visited)
+}
+
+// TestRewrite verifies that Rewrite transforms expressions bottom-up, keeping
+// the fields of the expressions that aren't children.
+func TestRewrite(t *testing.T) {
+	expr := driplang.Then{
+		A:        driplang.EventName("a"),
+		B:        driplang.Not{A: driplang.Not{A: driplang.Where{Name: "b"}}},
+		Strategy: driplang.ThenLatest,
+	}
+
+	got := driplang.Rewrite(expr, func(e driplang.Expr) driplang.Expr {
+		switch v := e.(type) {
+		case driplang.EventName:
+			return driplang.EventName("x" + v)
+		case driplang.Not:
+			// Children are rewritten first, so double negations found here
+			// consist of rewritten expressions.
+			if inner, ok := v.A.(driplang.Not); ok {
+				return inner.A
+			}
+		}
+		return e
+	})
+
+	require.Equal(t, driplang.Then{
+		A:        driplang.EventName("xa"),
+		B:        driplang.Where{Name: "b"},
+		Strategy: driplang.ThenLatest,
+	}, got)
+}
+
+// TestWithChildren verifies that replacing the children of any expression by
+// its own children gives the same expression, and that WithChildren panics
+// when given the wrong number of children.
+func TestWithChildren(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	names := []string{"a", "b", "c"}
+
+	for run := 0; run < 500; run++ {
+		driplang.Walk(randomExpr(rng, names, 4), func(e driplang.Expr) bool {
+			n, ok := e.(driplang.Node)
+			require.True(t, ok, "%T", e)
+			require.Equal(t, e, n.WithChildren(n.Children()))
+			return true
+		})
+	}
+
+	require.PanicsWithValue(t, "driplang: and takes 2 children, got 1", func() {
+		driplang.And{}.WithChildren([]driplang.Expr{driplang.EventName("a")})
+	})
+	require.PanicsWithValue(t, "driplang: event_name takes 0 children, got 1", func() {
+		driplang.EventName("a").WithChildren([]driplang.Expr{driplang.EventName("b")})
+	})
+	require.PanicsWithValue(t, "driplang: any_of takes at least 1 children, got 0", func() {
+		driplang.AnyOf{}.WithChildren(nil)
+	})
+	require.PanicsWithValue(t, "driplang: at_least takes at least 2 children, got 1", func() {
+		driplang.AtLeast{K: 2}.WithChildren([]driplang.Expr{driplang.EventName("a")})
+	})
+}
+
+// TestChildrenCopied verifies that the lists of children of expressions can't
+// be changed through Children, nor through the list given to WithChildren.
+func TestChildrenCopied(t *testing.T) {
+	a, b := driplang.EventName("a"), driplang.EventName("b")
+
+	anyOf := driplang.AnyOf{Exprs: []driplang.Expr{a, b}}
+	anyOf.Children()[0] = b
+	require.Equal(t, driplang.AnyOf{Exprs: []driplang.Expr{a, b}}, anyOf)
+
+	children := []driplang.Expr{a, b}
+	seq := driplang.Seq{}.WithChildren(children)
+	children[0] = b
+	require.Equal(t, driplang.Seq{Steps: []driplang.Expr{a, b}}, seq)
+}
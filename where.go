@@ -0,0 +1,357 @@
+package driplang
+
+import (
+	"container/list"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Where is satisfied by an event with the given name whose properties satisfy
+// all of the predicates; see Event.Properties. Apart from that, it's
+// evaluated exactly like an EventName.
+type Where struct {
+	Name       EventName   `json:"a"`
+	Predicates []Predicate `json:"predicates"`
+}
+
+func (w Where) Expression() string {
+	preds := make([]string, len(w.Predicates))
+	for i, p := range w.Predicates {
+		preds[i] = p.Expression()
+	}
+	return fmt.Sprintf("%s[%s]", w.Name.Expression(), strings.Join(preds, ", "))
+}
+
+// matches reports whether event satisfies w.
+func (w Where) matches(event Event) bool {
+	if event.Name != string(w.Name) {
+		return false
+	}
+
+	for _, p := range w.Predicates {
+		if !p.matches(event.Properties) {
+			return false
+		}
+	}
+	return true
+}
+
+// PredicateOp is the comparison made by a Predicate.
+type PredicateOp string
+
+const (
+	// OpEqual and OpNotEqual compare strings, numbers and booleans. Values of
+	// different types are never equal.
+	OpEqual    PredicateOp = "="
+	OpNotEqual PredicateOp = "!="
+
+	// OpLess, OpLessOrEqual, OpGreater and OpGreaterOrEqual compare numbers.
+	OpLess           PredicateOp = "<"
+	OpLessOrEqual    PredicateOp = "<="
+	OpGreater        PredicateOp = ">"
+	OpGreaterOrEqual PredicateOp = ">="
+
+	// OpIn is satisfied by properties equal to any value of a list.
+	OpIn PredicateOp = "IN"
+
+	// OpPrefix is satisfied by string properties starting with a string.
+	OpPrefix PredicateOp = "PREFIX"
+
+	// OpMatches is satisfied by string properties matching a regular
+	// expression, using the syntax of the regexp package. The regular
+	// expression isn't anchored, i.e. it may match any part of the property.
+	OpMatches PredicateOp = "MATCHES"
+)
+
+var predicateOps = []PredicateOp{
+	OpEqual, OpNotEqual, OpLess, OpLessOrEqual, OpGreater, OpGreaterOrEqual, OpIn, OpPrefix, OpMatches,
+}
+
+// Predicate is a condition on a property of an event.
+//
+// Value is a string, a float64 or a bool; for OpIn it's a []interface{} of
+// those. This matches the values produced by encoding/json. A property that
+// an event doesn't have never satisfies a predicate, whatever the operator.
+type Predicate struct {
+	Property string      `json:"property"`
+	Op       PredicateOp `json:"op"`
+	Value    interface{} `json:"value"`
+}
+
+func (p Predicate) Expression() string {
+	return fmt.Sprintf("%s %s %s", strconv.Quote(p.Property), p.Op, formatValue(p.Value))
+}
+
+// formatValue returns the textual form of a predicate value.
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case []interface{}:
+		values := make([]string, len(v))
+		for i, value := range v {
+			values[i] = formatValue(value)
+		}
+		return "[" + strings.Join(values, ", ") + "]"
+	default:
+		if n, ok := toNumber(v); ok {
+			return strconv.FormatFloat(n, 'f', -1, 64)
+		}
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// matches reports whether properties satisfy p.
+func (p Predicate) matches(properties map[string]interface{}) bool {
+	property, ok := properties[p.Property]
+	if !ok {
+		return false
+	}
+
+	switch p.Op {
+	case OpEqual:
+		return valuesEqual(property, p.Value)
+
+	case OpNotEqual:
+		return !valuesEqual(property, p.Value)
+
+	case OpLess, OpLessOrEqual, OpGreater, OpGreaterOrEqual:
+		a, aOk := toNumber(property)
+		b, bOk := toNumber(p.Value)
+		if !aOk || !bOk {
+			return false
+		}
+
+		switch p.Op {
+		case OpLess:
+			return a < b
+		case OpLessOrEqual:
+			return a <= b
+		case OpGreater:
+			return a > b
+		default:
+			return a >= b
+		}
+
+	case OpIn:
+		values, _ := p.Value.([]interface{})
+		for _, v := range values {
+			if valuesEqual(property, v) {
+				return true
+			}
+		}
+		return false
+
+	case OpPrefix:
+		s, sOk := property.(string)
+		prefix, prefixOk := p.Value.(string)
+		return sOk && prefixOk && strings.HasPrefix(s, prefix)
+
+	case OpMatches:
+		s, sOk := property.(string)
+		pattern, patternOk := p.Value.(string)
+		if !sOk || !patternOk {
+			return false
+		}
+
+		re, err := compileRegexp(pattern)
+		return err == nil && re.MatchString(s)
+
+	default:
+		return false
+	}
+}
+
+// check returns an error if p's operator is unknown, or if its value isn't
+// valid for the operator.
+func (p Predicate) check() error {
+	switch p.Op {
+	case OpEqual, OpNotEqual:
+		if !isScalar(p.Value) {
+			return fmt.Errorf("%s expects a string, number or boolean, got %s", p.Op, valueType(p.Value))
+		}
+
+	case OpLess, OpLessOrEqual, OpGreater, OpGreaterOrEqual:
+		if _, ok := toNumber(p.Value); !ok {
+			return fmt.Errorf("%s expects a number, got %s", p.Op, valueType(p.Value))
+		}
+
+	case OpIn:
+		values, ok := p.Value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s expects a list, got %s", p.Op, valueType(p.Value))
+		}
+		for _, v := range values {
+			if !isScalar(v) {
+				return fmt.Errorf("%s expects a list of strings, numbers and booleans, got %s", p.Op, valueType(v))
+			}
+		}
+
+	case OpPrefix:
+		if _, ok := p.Value.(string); !ok {
+			return fmt.Errorf("%s expects a string, got %s", p.Op, valueType(p.Value))
+		}
+
+	case OpMatches:
+		pattern, ok := p.Value.(string)
+		if !ok {
+			return fmt.Errorf("%s expects a string, got %s", p.Op, valueType(p.Value))
+		}
+		if _, err := compileRegexp(pattern); err != nil {
+			return fmt.Errorf("invalid regular expression %q", pattern)
+		}
+
+	default:
+		return fmt.Errorf("unknown predicate operator %q", p.Op)
+	}
+
+	return nil
+}
+
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case string, bool:
+		return true
+	default:
+		_, ok := toNumber(v)
+		return ok
+	}
+}
+
+func valueType(v interface{}) string {
+	if _, ok := toNumber(v); ok {
+		return "number"
+	}
+
+	switch v.(type) {
+	case []interface{}:
+		return "list"
+	case bool:
+		return "boolean"
+	default:
+		return jsonType(v)
+	}
+}
+
+func valuesEqual(a, b interface{}) bool {
+	if an, ok := toNumber(a); ok {
+		bn, ok := toNumber(b)
+		return ok && an == bn
+	}
+
+	switch a := a.(type) {
+	case string:
+		b, ok := b.(string)
+		return ok && a == b
+	case bool:
+		b, ok := b.(bool)
+		return ok && a == b
+	default:
+		return false
+	}
+}
+
+// toNumber converts numeric values of any Go type to float64.
+func toNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
+
+// regexps caches compiled regular expressions by pattern, since predicates
+// are evaluated many times. It's bounded, since the patterns come from
+// expressions, which needn't be trusted; a Program compiles its own once.
+var regexps = newRegexpCache(256)
+
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexps.get(pattern); ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	regexps.put(pattern, re)
+	return re, nil
+}
+
+// regexpCache holds the most recently used compiled regular expressions, up
+// to a limit.
+type regexpCache struct {
+	mu      sync.Mutex
+	limit   int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type regexpEntry struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+func newRegexpCache(limit int) *regexpCache {
+	return &regexpCache{limit: limit, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *regexpCache) get(pattern string) (*regexp.Regexp, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[pattern]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(regexpEntry).re, true
+}
+
+// put adds re to the cache, evicting the least recently used regular
+// expression if the cache is full.
+func (c *regexpCache) put(pattern string, re *regexp.Regexp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[pattern]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[pattern] = c.order.PushFront(regexpEntry{pattern: pattern, re: re})
+	if c.order.Len() > c.limit {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(regexpEntry).pattern)
+	}
+}
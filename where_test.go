@@ -0,0 +1,205 @@
+package driplang_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/micvbang/driplang"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWherePredicates verifies that Where is only satisfied by events with
+// the given name whose properties satisfy all predicates.
+func TestWherePredicates(t *testing.T) {
+	properties := map[string]interface{}{
+		"amount":  150.0,
+		"count":   3,
+		"country": "DK",
+		"path":    "/pricing/enterprise",
+		"trial":   true,
+	}
+
+	tests := map[string]struct {
+		expected   bool
+		predicates []driplang.Predicate
+	}{
+		"no predicates": {
+			expected: true,
+		},
+		"equal string": {
+			expected:   true,
+			predicates: []driplang.Predicate{{Property: "country", Op: driplang.OpEqual, Value: "DK"}},
+		},
+		"equal number of other type": {
+			expected:   true,
+			predicates: []driplang.Predicate{{Property: "count", Op: driplang.OpEqual, Value: 3.0}},
+		},
+		"equal bool": {
+			expected:   true,
+			predicates: []driplang.Predicate{{Property: "trial", Op: driplang.OpEqual, Value: true}},
+		},
+		"equal different types": {
+			expected:   false,
+			predicates: []driplang.Predicate{{Property: "country", Op: driplang.OpEqual, Value: 1.0}},
+		},
+		"not equal": {
+			expected:   true,
+			predicates: []driplang.Predicate{{Property: "country", Op: driplang.OpNotEqual, Value: "SE"}},
+		},
+		"not equal equal": {
+			expected:   false,
+			predicates: []driplang.Predicate{{Property: "country", Op: driplang.OpNotEqual, Value: "DK"}},
+		},
+		"greater": {
+			expected:   true,
+			predicates: []driplang.Predicate{{Property: "amount", Op: driplang.OpGreater, Value: 100.0}},
+		},
+		"greater equal": {
+			expected:   false,
+			predicates: []driplang.Predicate{{Property: "amount", Op: driplang.OpGreater, Value: 150.0}},
+		},
+		"greater or equal": {
+			expected:   true,
+			predicates: []driplang.Predicate{{Property: "amount", Op: driplang.OpGreaterOrEqual, Value: 150.0}},
+		},
+		"less": {
+			expected:   false,
+			predicates: []driplang.Predicate{{Property: "amount", Op: driplang.OpLess, Value: 150.0}},
+		},
+		"less or equal": {
+			expected:   true,
+			predicates: []driplang.Predicate{{Property: "count", Op: driplang.OpLessOrEqual, Value: 3.0}},
+		},
+		"compare string": {
+			expected:   false,
+			predicates: []driplang.Predicate{{Property: "country", Op: driplang.OpGreater, Value: 1.0}},
+		},
+		"in": {
+			expected:   true,
+			predicates: []driplang.Predicate{{Property: "country", Op: driplang.OpIn, Value: []interface{}{"SE", "DK"}}},
+		},
+		"not in": {
+			expected:   false,
+			predicates: []driplang.Predicate{{Property: "country", Op: driplang.OpIn, Value: []interface{}{"SE", "NO"}}},
+		},
+		"prefix": {
+			expected:   true,
+			predicates: []driplang.Predicate{{Property: "path", Op: driplang.OpPrefix, Value: "/pricing"}},
+		},
+		"not prefix": {
+			expected:   false,
+			predicates: []driplang.Predicate{{Property: "path", Op: driplang.OpPrefix, Value: "/about"}},
+		},
+		"matches": {
+			expected:   true,
+			predicates: []driplang.Predicate{{Property: "path", Op: driplang.OpMatches, Value: "^/pricing/(team|enterprise)$"}},
+		},
+		"doesn't match": {
+			expected:   false,
+			predicates: []driplang.Predicate{{Property: "path", Op: driplang.OpMatches, Value: "^/pricing$"}},
+		},
+		"missing property": {
+			expected:   false,
+			predicates: []driplang.Predicate{{Property: "plan", Op: driplang.OpNotEqual, Value: "free"}},
+		},
+		"all predicates must be satisfied": {
+			expected: false,
+			predicates: []driplang.Predicate{
+				{Property: "country", Op: driplang.OpEqual, Value: "DK"},
+				{Property: "amount", Op: driplang.OpLess, Value: 100.0},
+			},
+		},
+	}
+
+	events := []driplang.Event{
+		{Name: "page_view", Properties: properties},
+		{Name: "purchase", Properties: properties},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			expr := driplang.Where{Name: "purchase", Predicates: test.predicates}
+
+			i, satisfied := driplang.EvaluateWithIndex(expr, events)
+			require.Equal(t, test.expected, satisfied)
+			if satisfied {
+				require.Equal(t, 1, i)
+			}
+
+			program, err := driplang.Compile(expr)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, program.Evaluate(events))
+		})
+	}
+}
+
+// TestWhereThen verifies that Where can be combined with other operators, and
+// that it's only satisfied by the events matching its predicates.
+func TestWhereThen(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	expr := driplang.Then{
+		A: driplang.EventName("signup"),
+		B: driplang.After{
+			A: driplang.Where{
+				Name: "purchase",
+				Predicates: []driplang.Predicate{
+					{Property: "amount", Op: driplang.OpGreater, Value: 100.0},
+				},
+			},
+			D: driplang.Duration(time.Hour),
+		},
+	}
+
+	events := []driplang.Event{
+		{Name: "signup", Time: t0},
+		{Name: "purchase", Time: t0.Add(30 * time.Minute), Properties: map[string]interface{}{"amount": 500.0}},
+		{Name: "purchase", Time: t0.Add(2 * time.Hour), Properties: map[string]interface{}{"amount": 50.0}},
+		{Name: "purchase", Time: t0.Add(3 * time.Hour), Properties: map[string]interface{}{"amount": 200.0}},
+	}
+
+	now := t0.Add(4 * time.Hour)
+	i, satisfied := driplang.EvaluateWithIndexAt(expr, events, now)
+	require.True(t, satisfied)
+	require.Equal(t, 3, i)
+
+	i, satisfied = driplang.EvaluateWithIndexAt(expr, events[:3], now)
+	require.False(t, satisfied)
+	require.Equal(t, -1, i)
+}
+
+// TestWhereManyPatterns verifies that MATCHES predicates give the right
+// results when more regular expressions are used than are cached.
+func TestWhereManyPatterns(t *testing.T) {
+	events := []driplang.Event{
+		{Name: "purchase", Properties: map[string]interface{}{"path": "/pricing/500"}},
+	}
+
+	for n := 0; n < 1000; n++ {
+		expr := driplang.Where{
+			Name:       "purchase",
+			Predicates: []driplang.Predicate{{Property: "path", Op: driplang.OpMatches, Value: fmt.Sprintf("^/pricing/%d$", n)}},
+		}
+
+		require.Equal(t, n == 500, driplang.Evaluate(expr, events))
+
+		program, err := driplang.Compile(expr)
+		require.NoError(t, err)
+		require.Equal(t, n == 500, program.Evaluate(events))
+	}
+}
+
+// TestEventEncoding verifies that events are encoded using the names of their
+// fields, leaving out properties if there are none.
+func TestEventEncoding(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	bs, err := json.Marshal(driplang.Event{Name: "a", Time: t0})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Name": "a", "Time": "2024-03-01T12:00:00Z"}`, string(bs))
+
+	bs, err = json.Marshal(driplang.Event{Name: "a", Time: t0, Properties: map[string]interface{}{"n": 1.0}})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Name": "a", "Time": "2024-03-01T12:00:00Z", "Properties": {"n": 1}}`, string(bs))
+}